@@ -4,14 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
-	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/sbxb/loyalty/config"
 	"github.com/sbxb/loyalty/internal/logger"
 	"github.com/sbxb/loyalty/models"
 	"github.com/sbxb/loyalty/services/accrual"
 	"github.com/sbxb/loyalty/services/auth"
+	"github.com/sbxb/loyalty/services/expiry"
+	"github.com/sbxb/loyalty/services/hold"
 	"github.com/sbxb/loyalty/services/order"
+	"github.com/sbxb/loyalty/services/transfer"
 	"github.com/sbxb/loyalty/storage"
 )
 
@@ -21,16 +24,22 @@ type URLHandler struct {
 	config  config.Config
 	auth    *auth.AuthService
 	ord     *order.OrderService
-	accrual *accrual.SimpleAccrualService
+	accrual *accrual.AccrualService
+	expiry  *expiry.ExpiryService
+	holds   *hold.HoldService
+	trans   *transfer.TransferService
 }
 
-func NewURLHandler(st storage.Storage, cfg config.Config) URLHandler {
+func NewURLHandler(st storage.Storage, cfg config.Config, as *accrual.AccrualService, auths *auth.AuthService) URLHandler {
 	return URLHandler{
 		store:   st,
 		config:  cfg,
-		auth:    auth.NewAuthService(st),
+		auth:    auths,
 		ord:     order.NewOrderService(st),
-		accrual: accrual.NewSimpleAccrualService(st, cfg.AccrualAddress),
+		accrual: as,
+		expiry:  expiry.NewExpiryService(st, cfg.PointsTTL, cfg.PointsExpiryInterval),
+		holds:   hold.NewHoldService(st, cfg.HoldTTL, cfg.HoldExpiryInterval),
+		trans:   transfer.NewTransferService(st, cfg.TransferDailyLimit),
 	}
 }
 
@@ -38,7 +47,7 @@ func NewURLHandler(st storage.Storage, cfg config.Config) URLHandler {
 func (uh URLHandler) UserRegister(w http.ResponseWriter, r *http.Request) {
 	logger.Info("UserRegister hit by POST /api/user/register")
 
-	user, err := models.ReadUserFromBody(r.Body)
+	user, err := models.ReadUserFromBody(r.Body, uh.config.PasswordPolicy())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -56,19 +65,15 @@ func (uh URLHandler) UserRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = uh.auth.SetCookie(w, authUser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// http.StatusOK sent implicitly
+	uh.startSession(w, r, authUser)
 }
 
 // UserLogin process POST /api/user/login request
 func (uh URLHandler) UserLogin(w http.ResponseWriter, r *http.Request) {
 	logger.Info("UserLogin hit by POST /api/user/login")
 
-	user, err := models.ReadUserFromBody(r.Body)
+	// the password set before the policy was tightened is still accepted
+	user, err := models.ReadUserFromBody(r.Body, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -80,12 +85,173 @@ func (uh URLHandler) UserLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = uh.auth.SetCookie(w, authUser); err != nil {
+	uh.startSession(w, r, authUser)
+}
+
+// startSession logs the user in: a new session is started, the cookies
+// and the tokens referring to it are sent back
+func (uh URLHandler) startSession(w http.ResponseWriter, r *http.Request, user *models.User) {
+	session, err := uh.auth.StartSession(r, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := uh.auth.IssueToken(r.Context(), session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = uh.auth.SetCookie(w, session, token); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// http.StatusOK sent implicitly
+	writeToken(w, token)
+}
+
+// UserRefreshToken process POST /api/user/token/refresh request, the
+// refresh token is read from the body or, if the body is empty, from the
+// refresh cookie
+func (uh URLHandler) UserRefreshToken(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserRefreshToken hit by POST /api/user/token/refresh")
+
+	refreshToken, err := readRefreshToken(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, token, err := uh.auth.Refresh(r.Context(), refreshToken)
+	if err != nil {
+		var authErr *auth.AuthError
+		if errors.As(err, &authErr) && authErr.Code == http.StatusUnauthorized {
+			uh.auth.ClearCookie(w)
+			http.Error(w, authErr.Error(), authErr.Code)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = uh.auth.SetCookie(w, session, token); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeToken(w, token)
+}
+
+// UserLogout process POST /api/user/logout request, the session the
+// request is made in is revoked
+func (uh URLHandler) UserLogout(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserLogout hit by POST /api/user/logout")
+	userID := auth.GetUserID(r.Context())
+
+	if err := uh.auth.Logout(r.Context(), userID, auth.GetSessionID(r.Context())); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uh.auth.ClearCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+// UserLogoutAll process POST /api/user/logout-all request, every session
+// of the user is revoked, the current one included
+func (uh URLHandler) UserLogoutAll(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserLogoutAll hit by POST /api/user/logout-all")
+	userID := auth.GetUserID(r.Context())
+
+	if _, err := uh.auth.LogoutAll(r.Context(), userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	uh.auth.ClearCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+// UserGetSessions process GET /api/user/sessions request, the most
+// recently used sessions go first
+func (uh URLHandler) UserGetSessions(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserGetSessions hit by GET /api/user/sessions")
+	userID := auth.GetUserID(r.Context())
+
+	sessions, err := uh.auth.GetSessions(r.Context(), userID, auth.GetSessionID(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jr, err := json.Marshal(sessions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jr)
+}
+
+// UserChangePassword process POST /api/user/password request, the user
+// stays logged in the current session only
+func (uh URLHandler) UserChangePassword(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserChangePassword hit by POST /api/user/password")
+
+	req, err := models.ReadPasswordChangeFromBody(r.Body, uh.config.PasswordPolicy())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID := auth.GetUserID(r.Context())
+	if authErr := uh.auth.ChangePassword(r.Context(), userID, auth.GetSessionID(r.Context()), req); authErr != nil {
+		http.Error(w, authErr.Error(), authErr.Code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// UserResetPassword process POST /api/user/password/reset request, the
+// response is the same whether the login exists or not
+func (uh URLHandler) UserResetPassword(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserResetPassword hit by POST /api/user/password/reset")
+
+	req, err := models.ReadPasswordResetRequestFromBody(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if authErr := uh.auth.RequestPasswordReset(r.Context(), req.Login); authErr != nil {
+		http.Error(w, authErr.Error(), authErr.Code)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// UserConfirmPasswordReset process POST /api/user/password/reset/confirm
+// request, the user has to log in with the new password then
+func (uh URLHandler) UserConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserConfirmPasswordReset hit by POST /api/user/password/reset/confirm")
+
+	req, err := models.ReadPasswordResetConfirmFromBody(r.Body, uh.config.PasswordPolicy())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if authErr := uh.auth.ConfirmPasswordReset(r.Context(), req); authErr != nil {
+		http.Error(w, authErr.Error(), authErr.Code)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
 // UserPostOrder process POST /api/user/orders request
@@ -103,13 +269,7 @@ func (uh URLHandler) UserPostOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func() {
-		retry := uh.accrual.DoAccrualStuff(order.Number)
-		if retry {
-			time.Sleep(500 * time.Microsecond)
-			_ = uh.accrual.DoAccrualStuff(order.Number)
-		}
-	}()
+	uh.accrual.AddOrderNumber(order.Number)
 
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -173,20 +333,210 @@ func (uh URLHandler) UserBalanceWithdraw(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "wrong number format", http.StatusUnprocessableEntity)
 		return
 	}
+	if req.Sum <= 0 {
+		http.Error(w, "sum must be positive", http.StatusUnprocessableEntity)
+		return
+	}
 
 	err = uh.store.ProcessWithdraw(r.Context(), req, userID)
+	var violation *models.PolicyViolation
+	switch {
+	case err == nil:
+	case errors.As(err, &violation):
+		writePolicyViolation(w, violation)
+		return
+	case errors.Is(err, storage.ErrInsufficientFunds):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	case errors.Is(err, storage.ErrZeroAmount):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, storage.ErrWithdrawalAlreadyExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// http.StatusOK sent implicitly
+}
+
+// UserBalanceTransfer process POST /api/user/balance/transfer request
+func (uh URLHandler) UserBalanceTransfer(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserBalanceTransfer hit by POST /api/user/balance/transfer")
+	userID := auth.GetUserID(r.Context())
+
+	req, err := models.ReadTransferRequestFromBody(r.Body)
 	if err != nil {
-		if errors.Is(err, storage.ErrInsufficientFunds) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !req.Validate() {
+		http.Error(w, "login must not be empty and sum must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = uh.trans.Transfer(r.Context(), req, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrInsufficientFunds):
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+		case errors.Is(err, storage.ErrLoginMissing):
+			http.Error(w, "recipient not found", http.StatusNotFound)
+		case errors.Is(err, storage.ErrTransferToSelf):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, storage.ErrTransferLimitExceeded):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// http.StatusOK sent implicitly
+}
+
+// UserGetTransfers process GET /api/user/balance/transfers request
+func (uh URLHandler) UserGetTransfers(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserGetTransfers hit by GET /api/user/balance/transfers")
+	userID := auth.GetUserID(r.Context())
+
+	transfers, err := uh.trans.Transfers(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(transfers) == 0 {
+		http.Error(w, "no transfers", http.StatusNoContent)
+		return
+	}
+
+	jr, err := json.Marshal(transfers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jr)
+}
+
+// UserGetReferrals process GET /api/user/referrals request, the response
+// carries the referral code of the user even if nobody has used it yet
+func (uh URLHandler) UserGetReferrals(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserGetReferrals hit by GET /api/user/referrals")
+	userID := auth.GetUserID(r.Context())
+
+	referrals, err := uh.store.GetReferrals(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jr, err := json.Marshal(referrals)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jr)
+}
+
+// UserBalanceHold process POST /api/user/balance/holds request
+func (uh URLHandler) UserBalanceHold(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserBalanceHold hit by POST /api/user/balance/holds")
+	userID := auth.GetUserID(r.Context())
+
+	req, err := models.ReadWithdrawRequestFromBody(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !req.Validate() {
+		http.Error(w, "wrong number format", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Sum <= 0 {
+		http.Error(w, "sum must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+
+	hold, err := uh.holds.Hold(r.Context(), req, userID)
+	if err != nil {
+		var violation *models.PolicyViolation
+		switch {
+		case errors.As(err, &violation):
+			writePolicyViolation(w, violation)
+		case errors.Is(err, storage.ErrInsufficientFunds):
 			http.Error(w, err.Error(), http.StatusPaymentRequired)
-		} else {
+		case errors.Is(err, storage.ErrZeroAmount):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, storage.ErrHoldAlreadyExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 
+	jr, err := json.Marshal(hold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jr)
+}
+
+// UserBalanceCapture process POST /api/user/balance/holds/{number}/capture request
+func (uh URLHandler) UserBalanceCapture(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserBalanceCapture hit by POST /api/user/balance/holds/{number}/capture")
+	userID := auth.GetUserID(r.Context())
+
+	err := uh.holds.Capture(r.Context(), chi.URLParam(r, "number"), userID)
+	if err != nil {
+		holdError(w, err)
+		return
+	}
+
+	// http.StatusOK sent implicitly
+}
+
+// UserBalanceRelease process POST /api/user/balance/holds/{number}/release request
+func (uh URLHandler) UserBalanceRelease(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserBalanceRelease hit by POST /api/user/balance/holds/{number}/release")
+	userID := auth.GetUserID(r.Context())
+
+	err := uh.holds.Release(r.Context(), chi.URLParam(r, "number"), userID)
+	if err != nil {
+		holdError(w, err)
+		return
+	}
+
 	// http.StatusOK sent implicitly
 }
 
+// holdError reports the error of settling a hold
+func holdError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrHoldMissing):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrHoldSettled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // UserGetWithdrawals process GET /api/user/balance/withdrawals request
 func (uh URLHandler) UserGetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	logger.Info("UserGetWithdrawals hit by GET /api/user/balance/withdrawals")
@@ -213,3 +563,45 @@ func (uh URLHandler) UserGetWithdrawals(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 	w.Write(jr)
 }
+
+// UserGetExpiring process GET /api/user/balance/expiring request
+func (uh URLHandler) UserGetExpiring(w http.ResponseWriter, r *http.Request) {
+	logger.Info("UserGetExpiring hit by GET /api/user/balance/expiring")
+	userID := auth.GetUserID(r.Context())
+
+	expiring, err := uh.expiry.Expiring(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(expiring) == 0 {
+		http.Error(w, "no expiring points", http.StatusNoContent)
+		return
+	}
+
+	jr, err := json.Marshal(expiring)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jr)
+}
+
+// AccrualStatus process GET /api/accrual/status request
+func (uh URLHandler) AccrualStatus(w http.ResponseWriter, r *http.Request) {
+	logger.Info("AccrualStatus hit by GET /api/accrual/status")
+
+	jr, err := json.Marshal(uh.accrual.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jr)
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,6 +18,10 @@ import (
 	mw "github.com/sbxb/loyalty/api/middleware"
 	"github.com/sbxb/loyalty/config"
 	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/accrual"
+	"github.com/sbxb/loyalty/services/auth"
+	"github.com/sbxb/loyalty/services/idempotency"
+	"github.com/sbxb/loyalty/storage"
 	"github.com/sbxb/loyalty/storage/inmemory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,6 +29,10 @@ import (
 
 var cfg config.Config
 
+var keyring *auth.Keyring
+
+var tokenIssuer *auth.TokenIssuer
+
 var _ = func() bool {
 	// stackoverflow.com-recommended hack to parse testing flags before
 	// application ones - prevents test failure with an error:
@@ -34,6 +43,18 @@ var _ = func() bool {
 	if cfg, err = config.New(); err != nil {
 		log.Fatal(err)
 	}
+	if keyring, err = auth.NewKeyring(cfg.CookieKeyList()); err != nil {
+		log.Fatal(err)
+	}
+	tokenIssuer, err = auth.NewTokenIssuer(auth.TokenSettings{
+		Algorithm: auth.AlgHS256,
+		Issuer:    cfg.JWTIssuer,
+		Audience:  cfg.JWTAudience,
+		TTL:       cfg.JWTTTL,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	return true
 }()
 
@@ -50,9 +71,9 @@ func TestUserRegister_NotValidInput(t *testing.T) {
 		`{"login": "<login>"}`,
 	}
 
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
 	router := chi.NewRouter()
-	urlHandler := handlers.NewURLHandler(store, cfg)
+	urlHandler := newURLHandler(store)
 	router.Post("/api/user/register", urlHandler.UserRegister)
 
 	for _, tt := range tests {
@@ -92,12 +113,17 @@ func TestUserRegister_ValidInput(t *testing.T) {
 			user:          user,
 			hasUserCookie: false,
 		},
+		{
+			wantCode:      422,
+			user:          &models.User{Login: "referee", Password: "abcdef", ReferredBy: "NOSUCHCODE"},
+			hasUserCookie: false,
+		},
 	}
 
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
 
 	router := chi.NewRouter()
-	urlHandler := handlers.NewURLHandler(store, cfg)
+	urlHandler := newURLHandler(store)
 	router.Post("/api/user/register", urlHandler.UserRegister)
 
 	for _, tt := range tests {
@@ -136,9 +162,9 @@ func TestUserLogin_NotValidInput(t *testing.T) {
 		`{"login": "<login>"}`,
 	}
 
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
 	router := chi.NewRouter()
-	urlHandler := handlers.NewURLHandler(store, cfg)
+	urlHandler := newURLHandler(store)
 	router.Post("/api/user/login", urlHandler.UserLogin)
 
 	for _, tt := range tests {
@@ -182,9 +208,9 @@ func TestUserLogin_ValidInput(t *testing.T) {
 		},
 	}
 
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
 	router := chi.NewRouter()
-	urlHandler := handlers.NewURLHandler(store, cfg)
+	urlHandler := newURLHandler(store)
 	router.Post("/api/user/login", urlHandler.UserLogin)
 
 	// add the first user
@@ -218,6 +244,361 @@ func TestUserLogin_ValidInput(t *testing.T) {
 	}
 }
 
+func TestUserLogin_BearerToken(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	urlHandler := newURLHandler(store)
+	router.Post("/api/user/login", urlHandler.UserLogin)
+	router.With(mw.AuthMW(newAuthService(store))).Get("/api/user/balance", urlHandler.UserGetBalance)
+
+	// add the first user
+	err := store.AddUser(context.Background(), &models.User{
+		Login: "user",
+		Hash:  "$2a$10$2V0TfI3A/Win8OI5Q.U1gOjffxfBxX9bLUa7Zheo3jKOaxAzwEDYa",
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "http://"+cfg.ServerAddress+"/api/user/login",
+		strings.NewReader(`{"login": "user", "password": "abcdef"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	token := models.Token{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, "Bearer "+token.AccessToken, resp.Header.Get("Authorization"))
+
+	tests := []struct {
+		name          string
+		authorization string
+		withCookie    bool
+		wantCode      int
+	}{
+		{"bearer", "Bearer " + token.AccessToken, false, http.StatusOK},
+		{"cookie", "", true, http.StatusOK},
+		// a bad token is not made up for by the cookie
+		{"bad bearer", "Bearer " + token.AccessToken + "x", true, http.StatusUnauthorized},
+		{"other scheme", "Basic dXNlcjphYmNkZWY=", false, http.StatusUnauthorized},
+		{"nothing", "", false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+cfg.ServerAddress+"/api/user/balance", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.withCookie {
+				req.AddCookie(&http.Cookie{Name: "user", Value: userCookieValue(store, 1, "user")})
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestUserLogout(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	urlHandler := newURLHandler(store)
+	authMW := mw.AuthMW(newAuthService(store))
+	router.Post("/api/user/login", urlHandler.UserLogin)
+	router.With(authMW).Post("/api/user/logout", urlHandler.UserLogout)
+	router.With(authMW).Post("/api/user/logout-all", urlHandler.UserLogoutAll)
+	router.With(authMW).Get("/api/user/sessions", urlHandler.UserGetSessions)
+
+	// add the first user
+	err := store.AddUser(context.Background(), &models.User{
+		Login: "user",
+		Hash:  "$2a$10$2V0TfI3A/Win8OI5Q.U1gOjffxfBxX9bLUa7Zheo3jKOaxAzwEDYa",
+	})
+	require.NoError(t, err)
+
+	// do sends the request with the bearer token
+	do := func(method, path, token string) *http.Response {
+		req := httptest.NewRequest(method, "http://"+cfg.ServerAddress+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// log in from two devices
+	tokens := make([]string, 0, 2)
+	for _, userAgent := range []string{"phone", "laptop"} {
+		req := httptest.NewRequest(http.MethodPost, "http://"+cfg.ServerAddress+"/api/user/login",
+			strings.NewReader(`{"login": "user", "password": "abcdef"}`))
+		req.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		token := models.Token{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+		resp.Body.Close()
+		tokens = append(tokens, token.AccessToken)
+	}
+
+	resp := do(http.MethodGet, "/api/user/sessions", tokens[0])
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	sessions := []*models.Session{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sessions))
+	resp.Body.Close()
+	require.Len(t, sessions, 2)
+	for _, s := range sessions {
+		assert.Equal(t, s.UserAgent == "phone", s.Current, s.UserAgent)
+		assert.Equal(t, "192.0.2.1", s.IP)
+	}
+
+	// the phone logs out, the laptop stays logged in
+	resp = do(http.MethodPost, "/api/user/logout", tokens[0])
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(http.MethodGet, "/api/user/sessions", tokens[0])
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = do(http.MethodGet, "/api/user/sessions", tokens[1])
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// logging out everywhere revokes the cookie sessions as well
+	cookie := userCookieValue(store, 1, "user")
+	resp = do(http.MethodPost, "/api/user/logout-all", tokens[1])
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(http.MethodGet, "/api/user/sessions", tokens[1])
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+cfg.ServerAddress+"/api/user/sessions", nil)
+	req.AddCookie(&http.Cookie{Name: "user", Value: cookie})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestUserRefreshToken(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	urlHandler := newURLHandler(store)
+	router.Post("/api/user/login", urlHandler.UserLogin)
+	router.Post("/api/user/token/refresh", urlHandler.UserRefreshToken)
+	router.With(mw.AuthMW(newAuthService(store))).Get("/api/user/balance", urlHandler.UserGetBalance)
+
+	// add the first user
+	err := store.AddUser(context.Background(), &models.User{
+		Login: "user",
+		Hash:  "$2a$10$2V0TfI3A/Win8OI5Q.U1gOjffxfBxX9bLUa7Zheo3jKOaxAzwEDYa",
+	})
+	require.NoError(t, err)
+
+	// do sends the request and decodes the tokens if there are any
+	do := func(req *http.Request) (*http.Response, models.Token) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		token := models.Token{}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+		}
+		return resp, token
+	}
+	refresh := func(body string, cookies ...*http.Cookie) (*http.Response, models.Token) {
+		req := httptest.NewRequest(http.MethodPost, "http://"+cfg.ServerAddress+"/api/user/token/refresh",
+			strings.NewReader(body))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return do(req)
+	}
+	balance := func(accessToken string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://"+cfg.ServerAddress+"/api/user/balance", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, _ := do(req)
+		return resp.StatusCode
+	}
+
+	resp, login := do(httptest.NewRequest(http.MethodPost, "http://"+cfg.ServerAddress+"/api/user/login",
+		strings.NewReader(`{"login": "user", "password": "abcdef"}`)))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEmpty(t, login.RefreshToken)
+	assert.True(t, login.RefreshExpiresAt.After(login.ExpiresAt))
+
+	// the refresh token comes in the body
+	resp, first := refresh(`{"refresh_token": "` + login.RefreshToken + `"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, login.RefreshToken, first.RefreshToken)
+	assert.Equal(t, http.StatusOK, balance(first.AccessToken))
+
+	// or in the cookie set by the previous refresh
+	var refreshCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "refresh" {
+			refreshCookie = c
+		}
+	}
+	require.NotNil(t, refreshCookie)
+	assert.Equal(t, first.RefreshToken, refreshCookie.Value)
+	resp, second := refresh("", refreshCookie)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusOK, balance(second.AccessToken))
+
+	resp, _ = refresh("")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = refresh(`{"refresh_token": "nosuchtoken"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// the replayed refresh token revokes the whole family
+	resp, _ = refresh(`{"refresh_token": "` + login.RefreshToken + `"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, balance(second.AccessToken))
+	resp, _ = refresh(`{"refresh_token": "` + second.RefreshToken + `"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestUserChangePassword(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	passwordCfg := cfg
+	passwordCfg.PasswordMinLength = 8
+	client, _ := accrual.NewAccrualClient(cfg.AccrualAddress, accrual.BreakerSettings{})
+	urlHandler := handlers.NewURLHandler(store, passwordCfg, accrual.NewAccrualService(store, client, accrual.RetryPolicy{}), newAuthService(store))
+	authMW := mw.AuthMW(newAuthService(store))
+	router.Post("/api/user/login", urlHandler.UserLogin)
+	router.With(authMW).Post("/api/user/password", urlHandler.UserChangePassword)
+	router.With(authMW).Get("/api/user/balance", urlHandler.UserGetBalance)
+
+	// add the first user
+	err := store.AddUser(context.Background(), &models.User{
+		Login: "user",
+		Hash:  "$2a$10$2V0TfI3A/Win8OI5Q.U1gOjffxfBxX9bLUa7Zheo3jKOaxAzwEDYa",
+	})
+	require.NoError(t, err)
+
+	do := func(method, path, token, body string) *http.Response {
+		req := httptest.NewRequest(method, "http://"+cfg.ServerAddress+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+	login := func(password string) (int, string) {
+		resp := do(http.MethodPost, "/api/user/login", "", `{"login": "user", "password": "`+password+`"}`)
+		defer resp.Body.Close()
+		token := models.Token{}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+		}
+		return resp.StatusCode, token.AccessToken
+	}
+
+	_, current := login("abcdef")
+	_, other := login("abcdef")
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"wrong old password", `{"old_password": "abcdefg", "new_password": "secret password"}`, http.StatusForbidden},
+		{"weak new password", `{"old_password": "abcdef", "new_password": "secret"}`, http.StatusBadRequest},
+		{"empty new password", `{"old_password": "abcdef", "new_password": ""}`, http.StatusBadRequest},
+		{"new password", `{"old_password": "abcdef", "new_password": "secret password"}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := do(http.MethodPost, "/api/user/password", current, tt.body)
+			resp.Body.Close()
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+		})
+	}
+
+	// the user stays logged in the current session only
+	resp := do(http.MethodGet, "/api/user/balance", current, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(http.MethodGet, "/api/user/balance", other, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	code, _ := login("abcdef")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = login("secret password")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestUserPasswordReset(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	urlHandler := newURLHandler(store)
+	router.Post("/api/user/login", urlHandler.UserLogin)
+	router.Post("/api/user/password/reset", urlHandler.UserResetPassword)
+	router.Post("/api/user/password/reset/confirm", urlHandler.UserConfirmPasswordReset)
+	router.With(mw.AuthMW(newAuthService(store))).Get("/api/user/balance", urlHandler.UserGetBalance)
+
+	// add the first user
+	err := store.AddUser(context.Background(), &models.User{
+		Login: "user",
+		Hash:  "$2a$10$2V0TfI3A/Win8OI5Q.U1gOjffxfBxX9bLUa7Zheo3jKOaxAzwEDYa",
+	})
+	require.NoError(t, err)
+
+	do := func(path, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "http://"+cfg.ServerAddress+path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	cookie := userCookieValue(store, 1, "user")
+
+	// an unknown login is not reported
+	assert.Equal(t, http.StatusAccepted, do("/api/user/password/reset", `{"login": "nobody"}`))
+	assert.Empty(t, notifier.token("nobody"))
+	assert.Equal(t, http.StatusBadRequest, do("/api/user/password/reset", `{"login": ""}`))
+
+	assert.Equal(t, http.StatusAccepted, do("/api/user/password/reset", `{"login": "user"}`))
+	token := notifier.token("user")
+	require.NotEmpty(t, token)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, do("/api/user/password/reset/confirm",
+		`{"token": "nosuchtoken", "new_password": "secret"}`))
+	assert.Equal(t, http.StatusOK, do("/api/user/password/reset/confirm",
+		`{"token": "`+token+`", "new_password": "secret"}`))
+	// the token is used once
+	assert.Equal(t, http.StatusUnprocessableEntity, do("/api/user/password/reset/confirm",
+		`{"token": "`+token+`", "new_password": "another secret"}`))
+
+	// every session is revoked
+	req := httptest.NewRequest(http.MethodGet, "http://"+cfg.ServerAddress+"/api/user/balance", nil)
+	req.AddCookie(&http.Cookie{Name: "user", Value: cookie})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	assert.Equal(t, http.StatusUnauthorized, do("/api/user/login", `{"login": "user", "password": "abcdef"}`))
+	assert.Equal(t, http.StatusOK, do("/api/user/login", `{"login": "user", "password": "secret"}`))
+}
+
 func TestUserPostOrder_ValidInput(t *testing.T) {
 	tests := []struct {
 		wantCode    int
@@ -233,10 +614,10 @@ func TestUserPostOrder_ValidInput(t *testing.T) {
 		},
 	}
 
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
 	router := chi.NewRouter()
-	urlHandler := handlers.NewURLHandler(store, cfg)
-	router.With(mw.AuthMW).Post("/api/user/orders", urlHandler.UserPostOrder)
+	urlHandler := newURLHandler(store)
+	router.With(mw.AuthMW(newAuthService(store))).Post("/api/user/orders", urlHandler.UserPostOrder)
 
 	// add the first user
 	user := &models.User{
@@ -255,7 +636,7 @@ func TestUserPostOrder_ValidInput(t *testing.T) {
 			)
 			cookie := http.Cookie{
 				Name:    "user",
-				Value:   "47dd2e0ab2fc35c8bd9d56847a904a3ca3cf166c5c1ffb1b4f8a87337b134ebcNoWIWEqALp/7+sHKF7Dq5/mpSvupLXgkpj6TDcdXeu/almqW9dykJ6hVZQGx/nPnhlFv",
+				Value:   userCookieValue(store, 1, "user"),
 				Expires: time.Now().Add(1 * time.Hour),
 			}
 			req.AddCookie(&cookie)
@@ -274,6 +655,339 @@ func TestUserPostOrder_ValidInput(t *testing.T) {
 
 }
 
+func TestUserGetExpiring(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	expiryCfg := cfg
+	expiryCfg.PointsTTL = 24 * time.Hour
+	client, _ := accrual.NewAccrualClient(cfg.AccrualAddress, accrual.BreakerSettings{})
+	urlHandler := handlers.NewURLHandler(store, expiryCfg, accrual.NewAccrualService(store, client, accrual.RetryPolicy{}), newAuthService(store))
+	router := chi.NewRouter()
+	router.With(mw.AuthMW(newAuthService(store))).Get("/api/user/balance/expiring", urlHandler.UserGetExpiring)
+
+	// add the first user
+	user := &models.User{
+		Login: "user",
+		Hash:  "$2a$10$2V0TfI3A/Win8OI5Q.U1gOjffxfBxX9bLUa7Zheo3jKOaxAzwEDYa",
+	}
+	err := store.AddUser(context.Background(), user)
+	require.NoError(t, err)
+
+	get := func() *http.Response {
+		req := httptest.NewRequest(
+			http.MethodGet,
+			"http://"+cfg.ServerAddress+"/api/user/balance/expiring",
+			nil,
+		)
+		cookie := http.Cookie{
+			Name:    "user",
+			Value:   userCookieValue(store, 1, "user"),
+			Expires: time.Now().Add(1 * time.Hour),
+		}
+		req.AddCookie(&cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := get()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	err = store.AddOrder(context.Background(), &models.Order{Number: "12345678903", Status: models.OrderStatusNew}, 1)
+	require.NoError(t, err)
+	err = store.ProcessOrder(context.Background(), &models.AccrualResponse{OrderNumber: "12345678903", Status: models.OrderStatusProcessed, Accrual: 72998})
+	require.NoError(t, err)
+
+	resp = get()
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var expiring []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&expiring))
+	require.Len(t, expiring, 1)
+	assert.Equal(t, "12345678903", expiring[0]["order"])
+	assert.Equal(t, 729.98, expiring[0]["sum"])
+	assert.Contains(t, expiring[0], "expires_at")
+}
+
+func TestUserBalanceWithdraw_IdempotencyKey(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	urlHandler := newURLHandler(store)
+	is := idempotency.NewIdempotencyService(store, time.Hour, time.Minute, time.Hour)
+	router.With(mw.AuthMW(newAuthService(store)), mw.IdempotencyMW(is)).Post("/api/user/balance/withdraw", urlHandler.UserBalanceWithdraw)
+
+	// add the first user along with some points
+	user := &models.User{
+		Login: "user",
+		Hash:  "$2a$10$2V0TfI3A/Win8OI5Q.U1gOjffxfBxX9bLUa7Zheo3jKOaxAzwEDYa",
+	}
+	err := store.AddUser(context.Background(), user)
+	require.NoError(t, err)
+	err = store.AddOrder(context.Background(), &models.Order{Number: "12345678903", Status: models.OrderStatusNew}, 1)
+	require.NoError(t, err)
+	err = store.ProcessOrder(context.Background(), &models.AccrualResponse{OrderNumber: "12345678903", Status: models.OrderStatusProcessed, Accrual: 1000})
+	require.NoError(t, err)
+
+	withdraw := func(key, body string) *http.Response {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"http://"+cfg.ServerAddress+"/api/user/balance/withdraw",
+			strings.NewReader(body),
+		)
+		req.Header.Set("Idempotency-Key", key)
+		cookie := http.Cookie{
+			Name:    "user",
+			Value:   userCookieValue(store, 1, "user"),
+			Expires: time.Now().Add(1 * time.Hour),
+		}
+		req.AddCookie(&cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := withdraw("key-1", `{"order": "2377225624", "sum": 1.5}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+
+	// the retry gets the same response and withdraws nothing
+	resp = withdraw("key-1", `{"order": "2377225624", "sum": 1.5}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+	balance, err := store.GetBalance(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(850), balance.Current)
+
+	// the key can not be reused for another request
+	resp = withdraw("key-1", `{"order": "2377225624", "sum": 2}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	// client errors are replayed as well
+	resp = withdraw("key-2", `{"order": "4561261212345467", "sum": 100}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	resp = withdraw("key-2", `{"order": "4561261212345467", "sum": 100}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+}
+
+func TestIdempotencyKey_HandlerPanics(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	is := idempotency.NewIdempotencyService(store, time.Hour, time.Minute, time.Hour)
+	calls := 0
+	router.With(mw.AuthMW(newAuthService(store)), mw.IdempotencyMW(is)).Post("/api/user/orders", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	err := store.AddUser(context.Background(), &models.User{Login: "user", Hash: "abcdef"})
+	require.NoError(t, err)
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"http://"+cfg.ServerAddress+"/api/user/orders",
+			strings.NewReader("12345678903"),
+		)
+		req.Header.Set("Idempotency-Key", "key-1")
+		cookie := http.Cookie{
+			Name:    "user",
+			Value:   userCookieValue(store, 1, "user"),
+			Expires: time.Now().Add(1 * time.Hour),
+		}
+		req.AddCookie(&cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Panics(t, func() { post() })
+
+	// the key has been freed, the retry is handled rather than rejected
+	// as being in progress
+	w := post()
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, 2, calls)
+}
+
+func TestUserBalanceWithdraw(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{
+		WithdrawalPolicy: &models.WithdrawalPolicy{MinSum: 500, Cooldown: time.Hour},
+	}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	urlHandler := newURLHandler(store)
+	router.With(mw.AuthMW(newAuthService(store))).Post("/api/user/balance/withdraw", urlHandler.UserBalanceWithdraw)
+
+	err := store.AddUser(context.Background(), &models.User{Login: "user", Hash: "abcdef"})
+	require.NoError(t, err)
+	err = store.AddOrder(context.Background(), &models.Order{Number: "12345678903", Status: models.OrderStatusNew}, 1)
+	require.NoError(t, err)
+	err = store.ProcessOrder(context.Background(), &models.AccrualResponse{OrderNumber: "12345678903", Status: models.OrderStatusProcessed, Accrual: 10000})
+	require.NoError(t, err)
+
+	tests := []struct {
+		body       string
+		wantCode   int
+		wantRule   string
+		retryAfter bool
+	}{
+		{`{"order": "2377225624", "sum": -7}`, http.StatusUnprocessableEntity, "", false},
+		{`{"order": "2377225624", "sum": 0}`, http.StatusUnprocessableEntity, "", false},
+		{`{"order": "2377225624", "sum": 1}`, http.StatusUnprocessableEntity, models.PolicyMinSum, false},
+		{`{"order": "2377225624", "sum": 10}`, http.StatusOK, "", false},
+		{`{"order": "4561261212345467", "sum": 10}`, http.StatusTooManyRequests, models.PolicyCooldown, true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"http://"+cfg.ServerAddress+"/api/user/balance/withdraw",
+			strings.NewReader(tt.body),
+		)
+		cookie := http.Cookie{
+			Name:    "user",
+			Value:   userCookieValue(store, 1, "user"),
+			Expires: time.Now().Add(1 * time.Hour),
+		}
+		req.AddCookie(&cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		assert.Equal(t, tt.wantCode, resp.StatusCode, tt.body)
+		if tt.wantRule != "" {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, tt.wantRule, body["code"])
+			assert.Equal(t, tt.retryAfter, resp.Header.Get("Retry-After") != "")
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestUserBalanceHold(t *testing.T) {
+	store, _ := inmemory.NewMapStorage(storage.Options{
+		WithdrawalPolicy: &models.WithdrawalPolicy{MaxSum: 5000},
+	}) // NewMapStorage() never returns non-nil error
+	router := chi.NewRouter()
+	urlHandler := newURLHandler(store)
+	router.With(mw.AuthMW(newAuthService(store))).Post("/api/user/balance/holds", urlHandler.UserBalanceHold)
+
+	err := store.AddUser(context.Background(), &models.User{Login: "user", Hash: "abcdef"})
+	require.NoError(t, err)
+	err = store.AddOrder(context.Background(), &models.Order{Number: "12345678903", Status: models.OrderStatusNew}, 1)
+	require.NoError(t, err)
+	err = store.ProcessOrder(context.Background(), &models.AccrualResponse{OrderNumber: "12345678903", Status: models.OrderStatusProcessed, Accrual: 10000})
+	require.NoError(t, err)
+
+	tests := []struct {
+		body     string
+		wantCode int
+		wantRule string
+	}{
+		{`{"order": "2377225624", "sum": -500}`, http.StatusUnprocessableEntity, ""},
+		{`{"order": "2377225624", "sum": 0}`, http.StatusUnprocessableEntity, ""},
+		{`{"order": "2377225624", "sum": 50.01}`, http.StatusUnprocessableEntity, models.PolicyMaxSum},
+		{`{"order": "2377225624", "sum": 50}`, http.StatusCreated, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"http://"+cfg.ServerAddress+"/api/user/balance/holds",
+			strings.NewReader(tt.body),
+		)
+		cookie := http.Cookie{
+			Name:    "user",
+			Value:   userCookieValue(store, 1, "user"),
+			Expires: time.Now().Add(1 * time.Hour),
+		}
+		req.AddCookie(&cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		assert.Equal(t, tt.wantCode, resp.StatusCode, tt.body)
+		if tt.wantRule != "" {
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, tt.wantRule, body["code"])
+		}
+		resp.Body.Close()
+	}
+}
+
+func newURLHandler(store storage.Storage) handlers.URLHandler {
+	client, _ := accrual.NewAccrualClient(cfg.AccrualAddress, accrual.BreakerSettings{})
+	return handlers.NewURLHandler(store, cfg, accrual.NewAccrualService(store, client, accrual.RetryPolicy{}), newAuthService(store))
+}
+
+func newAuthService(store storage.Storage) *auth.AuthService {
+	return auth.NewAuthService(store, keyring, tokenIssuer, auth.AuthSettings{
+		SessionTTL: cfg.SessionTTL,
+		ResetTTL:   cfg.PasswordResetTTL,
+		Notifier:   notifier,
+	})
+}
+
+// resetNotifier keeps the last password reset token sent to every login
+type resetNotifier struct {
+	sync.Mutex
+	tokens map[string]string
+}
+
+var notifier = &resetNotifier{tokens: make(map[string]string)}
+
+func (rn *resetNotifier) NotifyPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error {
+	rn.Lock()
+	defer rn.Unlock()
+	rn.tokens[login] = token
+	return nil
+}
+
+func (rn *resetNotifier) token(login string) string {
+	rn.Lock()
+	defer rn.Unlock()
+	return rn.tokens[login]
+}
+
+// userCookieValue starts a session of the user and returns the user
+// cookie set for it
+func userCookieValue(store storage.Storage, id int, login string) string {
+	sessionID, _ := models.NewSessionID()
+	now := time.Now()
+	session := &models.Session{
+		ID:         sessionID,
+		UserID:     id,
+		Login:      login,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(cfg.SessionTTL),
+	}
+	_ = store.AddSession(context.Background(), session)
+
+	as := newAuthService(store)
+	token, _ := as.IssueToken(context.Background(), session)
+	w := httptest.NewRecorder()
+	_ = as.SetCookie(w, session, token)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "user" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
 func checkCookie(resp *http.Response, key string) bool {
 	for _, c := range resp.Cookies() {
 		if c.Name == key {
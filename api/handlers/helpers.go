@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/sbxb/loyalty/internal/logger"
 	"github.com/sbxb/loyalty/models"
@@ -42,3 +46,72 @@ func ReadOrderNumberFromBody(body io.ReadCloser) (*models.Order, *OrderPostError
 
 	return order, nil
 }
+
+// policyErrorResponse is the body of the response to a request which
+// breaks the withdrawal policy, Code is one of models.Policy* rules
+type policyErrorResponse struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+}
+
+// writePolicyViolation responds with 422 if the sum itself is out of the
+// bounds, with 429 if the user has to wait and with 403 otherwise
+func writePolicyViolation(w http.ResponseWriter, pv *models.PolicyViolation) {
+	status := http.StatusForbidden
+	switch pv.Rule {
+	case models.PolicyMinSum, models.PolicyMaxSum:
+		status = http.StatusUnprocessableEntity
+	case models.PolicyCooldown:
+		status = http.StatusTooManyRequests
+	}
+
+	resp := policyErrorResponse{Code: pv.Rule, Message: pv.Error()}
+	if pv.RetryAfter > 0 {
+		resp.RetryAfter = int64(math.Ceil(pv.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(resp.RetryAfter, 10))
+	}
+
+	jr, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jr)
+}
+
+// writeToken responds with the bearer token both in Authorization header
+// and in the body
+func writeToken(w http.ResponseWriter, token *models.Token) {
+	jr, err := json.Marshal(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Authorization", token.TokenType+" "+token.AccessToken)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jr)
+}
+
+// readRefreshToken takes the refresh token from the body, the refresh
+// cookie is used if the body does not carry the token
+func readRefreshToken(r *http.Request) (string, error) {
+	req, err := models.ReadRefreshRequestFromBody(r.Body)
+	if err != nil {
+		return "", err
+	}
+	if req.RefreshToken != "" {
+		return req.RefreshToken, nil
+	}
+
+	if cookie, err := r.Cookie("refresh"); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	return "", errors.New("bad request: refresh token missing")
+}
@@ -2,35 +2,31 @@ package middleware
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"net/http"
 
-	"github.com/sbxb/loyalty/models"
 	"github.com/sbxb/loyalty/services/auth"
 )
 
-func AuthMW(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("user")
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+// AuthMW lets the request through if it carries either a valid bearer
+// token or the user cookie referring to an active session
+func AuthMW(as *auth.AuthService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := as.Authenticate(r)
+			if err != nil {
+				var authErr *auth.AuthError
+				if errors.As(err, &authErr) {
+					http.Error(w, authErr.Error(), authErr.Code)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 
-		payload, err := auth.GetPayload(cookie.Value)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		user := models.UserAuth{}
-		err = json.Unmarshal([]byte(payload), &user)
-		if err != nil || user.ID == 0 {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		ctx := context.WithValue(r.Context(), auth.ContextUserKey, user.ID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+			ctx := context.WithValue(r.Context(), auth.ContextUserKey, user.ID)
+			ctx = context.WithValue(ctx, auth.ContextSessionKey, user.SessionID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/auth"
+	"github.com/sbxb/loyalty/services/idempotency"
+)
+
+// maxIdempotencyKeyLen limits the length of Idempotency-Key header value
+const maxIdempotencyKeyLen = 255
+
+// IdempotencyMW replays the first response to a request made with the
+// Idempotency-Key header when the user retries it with the same key.
+// It must follow AuthMW since keys are per user
+func IdempotencyMW(is *idempotency.IdempotencyService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			userID := auth.GetUserID(r.Context())
+			requestHash := idempotency.RequestHash(r.Method, r.URL.Path, body)
+			replay, err := is.Begin(r.Context(), userID, key, requestHash)
+			switch {
+			case errors.Is(err, idempotency.ErrKeyReused):
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			case errors.Is(err, idempotency.ErrKeyInProgress):
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			case replay != nil:
+				if replay.ContentType != "" {
+					w.Header().Set("Content-Type", replay.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(replay.StatusCode)
+				w.Write(replay.Body)
+				return
+			}
+
+			// the key must not stay reserved if the handler panics, the
+			// panic goes on to the server once the key is freed
+			defer func() {
+				if p := recover(); p != nil {
+					if err := is.Abort(context.Background(), userID, key); err != nil {
+						logger.Errorf("IdempotencyMW : failed to free key: %v", err)
+					}
+					panic(p)
+				}
+			}()
+
+			rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r)
+
+			// the response has been sent already, even if the client is gone
+			// the key must not stay reserved
+			err = is.Finish(context.Background(), &models.IdempotencyRecord{
+				UserID:      userID,
+				Key:         key,
+				RequestHash: requestHash,
+				StatusCode:  rw.status,
+				ContentType: w.Header().Get("Content-Type"),
+				Body:        rw.body.Bytes(),
+			})
+			if err != nil {
+				logger.Errorf("IdempotencyMW : failed to store response: %v", err)
+			}
+		})
+	}
+}
+
+// recordingWriter passes the response through and keeps a copy of it
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
@@ -8,24 +8,47 @@ import (
 	mw "github.com/sbxb/loyalty/api/middleware"
 	"github.com/sbxb/loyalty/config"
 	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/services/accrual"
+	"github.com/sbxb/loyalty/services/auth"
+	"github.com/sbxb/loyalty/services/idempotency"
 	"github.com/sbxb/loyalty/storage"
 )
 
-func NewRouter(store storage.Storage, cfg config.Config) http.Handler {
+func NewRouter(store storage.Storage, cfg config.Config, as *accrual.AccrualService, auths *auth.AuthService, is *idempotency.IdempotencyService) http.Handler {
 	router := chi.NewRouter()
 	logger.Info("Router created")
 
-	urlHandler := handlers.NewURLHandler(store, cfg)
+	urlHandler := handlers.NewURLHandler(store, cfg, as, auths)
+	authMW := mw.AuthMW(auths)
+	// mutating requests may be retried safely with Idempotency-Key header
+	idempotencyMW := mw.IdempotencyMW(is)
 
 	router.Post("/api/user/register", urlHandler.UserRegister)
 	router.Post("/api/user/login", urlHandler.UserLogin)
-
-	router.With(mw.AuthMW).Post("/api/user/orders", urlHandler.UserPostOrder)
-	router.With(mw.AuthMW).Get("/api/user/orders", urlHandler.UserGetOrders)
-
-	router.With(mw.AuthMW).Get("/api/user/balance", urlHandler.UserGetBalance)
-	router.With(mw.AuthMW).Post("/api/user/balance/withdraw", urlHandler.UserBalanceWithdraw)
-	router.With(mw.AuthMW).Get("/api/user/balance/withdrawals", urlHandler.UserGetWithdrawals)
+	router.Post("/api/user/token/refresh", urlHandler.UserRefreshToken)
+	router.With(authMW).Post("/api/user/logout", urlHandler.UserLogout)
+	router.With(authMW).Post("/api/user/logout-all", urlHandler.UserLogoutAll)
+	router.With(authMW).Get("/api/user/sessions", urlHandler.UserGetSessions)
+	router.With(authMW).Post("/api/user/password", urlHandler.UserChangePassword)
+	router.Post("/api/user/password/reset", urlHandler.UserResetPassword)
+	router.Post("/api/user/password/reset/confirm", urlHandler.UserConfirmPasswordReset)
+
+	router.With(authMW, idempotencyMW).Post("/api/user/orders", urlHandler.UserPostOrder)
+	router.With(authMW).Get("/api/user/orders", urlHandler.UserGetOrders)
+
+	router.With(authMW).Get("/api/user/balance", urlHandler.UserGetBalance)
+	router.With(authMW, idempotencyMW).Post("/api/user/balance/withdraw", urlHandler.UserBalanceWithdraw)
+	router.With(authMW, idempotencyMW).Post("/api/user/balance/transfer", urlHandler.UserBalanceTransfer)
+	router.With(authMW).Get("/api/user/balance/transfers", urlHandler.UserGetTransfers)
+	router.With(authMW, idempotencyMW).Post("/api/user/balance/holds", urlHandler.UserBalanceHold)
+	router.With(authMW, idempotencyMW).Post("/api/user/balance/holds/{number}/capture", urlHandler.UserBalanceCapture)
+	router.With(authMW, idempotencyMW).Post("/api/user/balance/holds/{number}/release", urlHandler.UserBalanceRelease)
+	router.With(authMW).Get("/api/user/balance/withdrawals", urlHandler.UserGetWithdrawals)
+	router.With(authMW).Get("/api/user/balance/expiring", urlHandler.UserGetExpiring)
+
+	router.With(authMW).Get("/api/user/referrals", urlHandler.UserGetReferrals)
+
+	router.Get("/api/accrual/status", urlHandler.AccrualStatus)
 
 	logger.Info("Routes loaded")
 
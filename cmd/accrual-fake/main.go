@@ -0,0 +1,70 @@
+// accrual-fake serves a scriptable fake of the accrual system API, so the
+// loyalty service can be run and tested without the real accrual system
+//
+//	accrual-fake -a localhost:8888 -script cmd/accrual-fake/example.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sbxb/loyalty/api"
+	"github.com/sbxb/loyalty/config"
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/services/accrual/accrualtest"
+)
+
+func main() {
+	logger.SetLevel("DEBUG")
+
+	address := flag.String("a", "localhost:8888", "network address the server listens on")
+	scriptPath := flag.String("script", "", "JSON file with the order scripts, every order gets 204 if omitted")
+	flag.Parse()
+
+	if err := config.ValidateServerAddress(*address); err != nil {
+		logger.Fatalln(err)
+	}
+
+	fake := accrualtest.NewFake()
+	if *scriptPath != "" {
+		script, err := readScript(*scriptPath)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		fake.Load(script)
+		logger.Infof("Script loaded from %s", *scriptPath)
+	}
+
+	server, _ := api.NewHTTPServer(*address, fake)
+	defer server.Close()
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(), syscall.SIGTERM, syscall.SIGINT,
+	)
+	defer stop()
+
+	go func() {
+		if err := server.Start(ctx); err != nil {
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	server.Close()
+}
+
+func readScript(path string) (accrualtest.Script, error) {
+	script := accrualtest.Script{}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return script, err
+	}
+	err = json.Unmarshal(data, &script)
+
+	return script, err
+}
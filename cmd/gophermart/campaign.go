@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage/psql"
+)
+
+const campaignUsage = `usage: gophermart campaign [flags] <command>
+
+the server flags and env variables apply, e.g. -d or DATABASE_URI for the
+database dsn and the ones setting tiers, referrals and withdrawal policy
+
+commands:
+  add NAME CONDITION MULTIPLIER BONUS STARTS ENDS
+                 add the campaign; CONDITION is ALL, FIRST_ORDER or WEEKEND,
+                 BONUS is in points, STARTS and ENDS are RFC 3339 times
+  list           list the campaigns
+  end ID         end the campaign now
+`
+
+// runCampaign handles "gophermart campaign ..."
+func runCampaign(args []string) error {
+	fs, cfg, err := parseCommandFlags("campaign", campaignUsage, args)
+	if err != nil {
+		return err
+	}
+
+	store, err := psql.NewDBStorage(cfg.DatabaseDSN, storageOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	switch cmd, rest := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "add":
+		c, err := parseCampaign(rest)
+		if err != nil {
+			return fmt.Errorf("campaign: add: %v", err)
+		}
+		if err := store.AddCampaign(ctx, c); err != nil {
+			return err
+		}
+		fmt.Printf("campaign %d added\n", c.ID)
+		return nil
+	case "list":
+		return printCampaigns(ctx, store)
+	case "end":
+		if len(rest) < 1 {
+			return errors.New("campaign: end: campaign id expected")
+		}
+		id, err := strconv.ParseInt(rest[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("campaign: end: %v", err)
+		}
+		return store.EndCampaign(ctx, id, time.Now())
+	default:
+		fs.Usage()
+		return fmt.Errorf("campaign: unknown command %s", cmd)
+	}
+}
+
+func parseCampaign(args []string) (*models.Campaign, error) {
+	if len(args) != 6 {
+		return nil, errors.New("name, condition, multiplier, bonus, start and end expected")
+	}
+
+	c := &models.Campaign{Name: args[0], Condition: args[1]}
+	var err error
+	if c.Multiplier, err = strconv.ParseFloat(args[2], 64); err != nil {
+		return nil, err
+	}
+	if c.Bonus, err = parseAmount(args[3]); err != nil {
+		return nil, err
+	}
+	if c.StartsAt, err = time.Parse(time.RFC3339, args[4]); err != nil {
+		return nil, err
+	}
+	if c.EndsAt, err = time.Parse(time.RFC3339, args[5]); err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+func printCampaigns(ctx context.Context, store *psql.DBStorage) error {
+	campaigns, err := store.GetCampaigns(ctx)
+	if err != nil {
+		return err
+	}
+
+	// bonuses are printed the way they are stored, in hundredths of a point
+	for _, c := range campaigns {
+		fmt.Printf("%d %q: %s x%g +%d, %s - %s\n", c.ID, c.Name, c.Condition, c.Multiplier, c.Bonus,
+			c.StartsAt.Format(time.RFC3339), c.EndsAt.Format(time.RFC3339))
+	}
+	fmt.Printf("%d campaign(s)\n", len(campaigns))
+	return nil
+}
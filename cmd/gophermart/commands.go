@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/sbxb/loyalty/config"
+	"github.com/sbxb/loyalty/storage"
+)
+
+// commands are run instead of the server when their name is the first argument
+var commands = map[string]func(args []string) error{
+	"migrate":  runMigrate,
+	"ledger":   runLedger,
+	"campaign": runCampaign,
+}
+
+// parseCommandFlags parses the flags of the subcommand, the config (the
+// database dsn, tiers, referral bonuses and withdrawal policy) comes from
+// the server flags and env variables just like for the server
+func parseCommandFlags(name, usage string, args []string) (*flag.FlagSet, config.Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage) }
+	cfg, err := config.NewForCommand(fs, args)
+	if err != nil {
+		return nil, cfg, err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return nil, cfg, errors.New(name + ": command missing")
+	}
+
+	return fs, cfg, nil
+}
+
+// storageOptions returns the business rules the storage is created with
+func storageOptions(cfg config.Config) storage.Options {
+	return storage.Options{
+		Tiers:            cfg.TierProgram(),
+		Referrals:        cfg.ReferralProgram(),
+		WithdrawalPolicy: cfg.WithdrawalPolicy(),
+	}
+}
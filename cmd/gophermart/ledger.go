@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage/psql"
+)
+
+const ledgerUsage = `usage: gophermart ledger [flags] <command>
+
+the server flags and env variables apply, e.g. -d or DATABASE_URI for the
+database dsn and the ones setting tiers, referrals and withdrawal policy
+
+commands:
+  reconcile                        list the balances which differ from the ledger
+  rebuild                          recalculate the balances from the ledger
+  adjust USER_ID AMOUNT [COMMENT]  add (or subtract if negative) AMOUNT points
+  reverse ORDER WHO REASON         return the points withdrawn for ORDER
+  tiers USER_ID                    list the tier changes of the user
+`
+
+// runLedger handles "gophermart ledger ..."
+func runLedger(args []string) error {
+	fs, cfg, err := parseCommandFlags("ledger", ledgerUsage, args)
+	if err != nil {
+		return err
+	}
+
+	store, err := psql.NewDBStorage(cfg.DatabaseDSN, storageOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	switch cmd, rest := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "reconcile":
+		return printMismatches(ctx, store)
+	case "rebuild":
+		if err := store.RebuildBalances(ctx); err != nil {
+			return err
+		}
+		return printMismatches(ctx, store)
+	case "adjust":
+		if len(rest) < 2 {
+			return errors.New("ledger: adjust: user id and amount expected")
+		}
+		userID, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return fmt.Errorf("ledger: adjust: %v", err)
+		}
+		amount, err := parseAmount(rest[1])
+		if err != nil {
+			return fmt.Errorf("ledger: adjust: %v", err)
+		}
+		return store.AddAdjustment(ctx, userID, amount, strings.Join(rest[2:], " "))
+	case "reverse":
+		if len(rest) < 3 {
+			return errors.New("ledger: reverse: order number, who and reason expected")
+		}
+		return store.ReverseWithdrawal(ctx, rest[0], rest[1], strings.Join(rest[2:], " "))
+	case "tiers":
+		if len(rest) < 1 {
+			return errors.New("ledger: tiers: user id expected")
+		}
+		userID, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return fmt.Errorf("ledger: tiers: %v", err)
+		}
+		return printTierChanges(ctx, store, userID)
+	default:
+		fs.Usage()
+		return fmt.Errorf("ledger: unknown command %s", cmd)
+	}
+}
+
+// parseAmount accepts the amount of points in the API format, e.g. -12.5
+func parseAmount(s string) (models.Money, error) {
+	var amount models.Money
+	negative := strings.HasPrefix(s, "-")
+	if err := amount.UnmarshalJSON([]byte(strings.TrimPrefix(s, "-"))); err != nil {
+		return 0, err
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+func printMismatches(ctx context.Context, store *psql.DBStorage) error {
+	mismatches, err := store.ReconcileBalances(ctx)
+	if err != nil {
+		return err
+	}
+
+	// amounts are printed the way they are stored, in hundredths of a point
+	for _, m := range mismatches {
+		fmt.Printf("user %d: current/withdrawn %d/%d, ledger %d/%d\n", m.UserID,
+			m.Cached.Current, m.Cached.Withdrawn, m.Ledger.Current, m.Ledger.Withdrawn)
+	}
+	fmt.Printf("%d balance(s) differ from the ledger\n", len(mismatches))
+	return nil
+}
+
+func printTierChanges(ctx context.Context, store *psql.DBStorage, userID int) error {
+	changes, err := store.GetTierChanges(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		fmt.Printf("%s: %q -> %q\n", c.ChangedAt.Format(time.RFC3339), c.From, c.To)
+	}
+	fmt.Printf("%d tier change(s)\n", len(changes))
+	return nil
+}
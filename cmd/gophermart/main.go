@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/sbxb/loyalty/api"
 	"github.com/sbxb/loyalty/config"
 	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/services/accrual"
+	"github.com/sbxb/loyalty/services/accrual/engine"
+	"github.com/sbxb/loyalty/services/auth"
+	"github.com/sbxb/loyalty/services/expiry"
+	"github.com/sbxb/loyalty/services/hold"
+	"github.com/sbxb/loyalty/services/idempotency"
+	"github.com/sbxb/loyalty/services/notify"
 	"github.com/sbxb/loyalty/storage"
 	"github.com/sbxb/loyalty/storage/inmemory"
 	"github.com/sbxb/loyalty/storage/psql"
@@ -16,6 +24,15 @@ import (
 func main() {
 	logger.SetLevel("DEBUG")
 
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				logger.Fatalln(err)
+			}
+			return
+		}
+	}
+
 	cfg, err := config.New()
 	if err != nil {
 		logger.Fatalln(err)
@@ -24,9 +41,9 @@ func main() {
 
 	var store storage.Storage
 	if cfg.DatabaseDSN != "" {
-		store, err = psql.NewDBStorage(cfg.DatabaseDSN)
+		store, err = psql.NewDBStorage(cfg.DatabaseDSN, storageOptions(cfg))
 	} else {
-		store, err = inmemory.NewMapStorage()
+		store, err = inmemory.NewMapStorage(storageOptions(cfg))
 	}
 	if err != nil {
 		logger.Fatalln(err)
@@ -34,7 +51,56 @@ func main() {
 	logger.Info("Storage created")
 	defer store.Close()
 
-	router := api.NewRouter(store, cfg)
+	retryPolicy := accrual.RetryPolicy{
+		InitialDelay: cfg.AccrualRetryInitial,
+		Multiplier:   cfg.AccrualRetryMultiplier,
+		MaxDelay:     cfg.AccrualRetryMax,
+		Jitter:       cfg.AccrualRetryJitter,
+		MaxAttempts:  cfg.AccrualMaxAttempts,
+		MaxAge:       cfg.AccrualMaxAge,
+	}
+	// Either the remote accrual system or the built-in engine
+	var fetcher accrual.Fetcher
+	var engineServer *api.HTTPServer
+	if cfg.AccrualLocal {
+		eng := engine.New()
+		engineServer, _ = api.NewHTTPServer(cfg.AccrualLocalAddress, engine.NewRouter(eng))
+		defer engineServer.Close()
+		fetcher = eng
+	} else {
+		breakerSettings := accrual.BreakerSettings{
+			FailureThreshold: cfg.AccrualBreakerFailures,
+			OpenTimeout:      cfg.AccrualBreakerOpenTimeout,
+			SuccessThreshold: cfg.AccrualBreakerSuccesses,
+		}
+		fetcher, _ = accrual.NewAccrualClient(cfg.AccrualAddress, breakerSettings)
+	}
+	accrualService := accrual.NewAccrualService(store, fetcher, retryPolicy)
+	expiryService := expiry.NewExpiryService(store, cfg.PointsTTL, cfg.PointsExpiryInterval)
+	holdService := hold.NewHoldService(store, cfg.HoldTTL, cfg.HoldExpiryInterval)
+	idempotencyService := idempotency.NewIdempotencyService(store, cfg.IdempotencyKeyTTL, cfg.IdempotencyKeyLease, cfg.IdempotencyPurgeInterval)
+
+	keyring, err := auth.NewKeyring(cfg.CookieKeyList())
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	tokenIssuer, err := auth.NewTokenIssuer(auth.TokenSettings{
+		Algorithm: cfg.JWTAlgorithm,
+		Secret:    cfg.JWTSecret,
+		KeyFile:   cfg.JWTKeyFile,
+		Issuer:    cfg.JWTIssuer,
+		Audience:  cfg.JWTAudience,
+		TTL:       cfg.JWTTTL,
+	})
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	authService := auth.NewAuthService(store, keyring, tokenIssuer, auth.AuthSettings{
+		SessionTTL: cfg.SessionTTL,
+		ResetTTL:   cfg.PasswordResetTTL,
+		Notifier:   notify.NewNotifier(cfg.NotifierFile),
+	})
+	router := api.NewRouter(store, cfg, accrualService, authService, idempotencyService)
 	server, _ := api.NewHTTPServer(cfg.ServerAddress, router)
 	defer server.Close()
 
@@ -43,6 +109,36 @@ func main() {
 	)
 	defer stop()
 
+	// Accrual service must be stopped before the storage gets closed
+	accrualDone := make(chan struct{})
+	go func() {
+		accrualService.Run(ctx)
+		close(accrualDone)
+	}()
+	expiryDone := make(chan struct{})
+	go func() {
+		expiryService.Run(ctx)
+		close(expiryDone)
+	}()
+	holdDone := make(chan struct{})
+	go func() {
+		holdService.Run(ctx)
+		close(holdDone)
+	}()
+	idempotencyDone := make(chan struct{})
+	go func() {
+		idempotencyService.Run(ctx)
+		close(idempotencyDone)
+	}()
+
+	if engineServer != nil {
+		go func() {
+			if err := engineServer.Start(ctx); err != nil {
+				stop()
+			}
+		}()
+	}
+
 	go func() {
 		err := server.Start(ctx)
 		if err != nil {
@@ -54,4 +150,11 @@ func main() {
 
 	<-ctx.Done()
 	server.Close()
+	<-accrualDone
+	<-expiryDone
+	<-holdDone
+	<-idempotencyDone
+	if engineServer != nil {
+		engineServer.Close()
+	}
 }
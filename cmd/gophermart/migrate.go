@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sbxb/loyalty/storage/psql"
+)
+
+const migrateUsage = `usage: gophermart migrate [-d dsn] <command>
+
+commands:
+  up            apply all the pending migrations
+  down [N]      roll back the last N applied migrations (default 1)
+  to VERSION    migrate up or down to VERSION, 0 rolls back everything
+  status        list the migrations and whether they are applied
+`
+
+// runMigrate handles "gophermart migrate ..."
+func runMigrate(args []string) error {
+	fs, cfg, err := parseCommandFlags("migrate", migrateUsage, args)
+	if err != nil {
+		return err
+	}
+
+	migrator, err := psql.OpenMigrator(cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	ctx := context.Background()
+	switch cmd, rest := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "up":
+		err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(rest) > 0 {
+			if steps, err = strconv.Atoi(rest[0]); err != nil {
+				return fmt.Errorf("migrate: down: %v", err)
+			}
+		}
+		err = migrator.Down(ctx, steps)
+	case "to":
+		if len(rest) == 0 {
+			return errors.New("migrate: to: version missing")
+		}
+		var version int
+		if version, err = strconv.Atoi(rest[0]); err != nil {
+			return fmt.Errorf("migrate: to: %v", err)
+		}
+		err = migrator.To(ctx, version)
+	case "status":
+	default:
+		fs.Usage()
+		return fmt.Errorf("migrate: unknown command %s", cmd)
+	}
+	if err != nil {
+		return err
+	}
+
+	return printMigrationStatus(ctx, migrator)
+}
+
+func printMigrationStatus(ctx context.Context, migrator *psql.Migrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		applied := "pending"
+		if s.Applied {
+			applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%04d %-24s %s\n", s.Version, s.Name, applied)
+	}
+	return nil
+}
@@ -1,14 +1,72 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"math"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
 )
 
 const (
 	defaultServerAddress  = "localhost:8080"
 	defaultAccrualAddress = "http://localhost:8888"
+
+	defaultAccrualLocalAddress = "localhost:8888"
+
+	defaultAccrualRetryInitial    = 1 * time.Second
+	defaultAccrualRetryMultiplier = 2.0
+	defaultAccrualRetryMax        = 10 * time.Minute
+	defaultAccrualRetryJitter     = 0.2
+	defaultAccrualMaxAttempts     = 0
+	defaultAccrualMaxAge          = 72 * time.Hour
+
+	defaultAccrualBreakerFailures    = 5
+	defaultAccrualBreakerOpenTimeout = 10 * time.Second
+	defaultAccrualBreakerSuccesses   = 1
+
+	defaultPointsTTL            = 0
+	defaultPointsExpiryInterval = 1 * time.Hour
+
+	defaultHoldTTL            = 15 * time.Minute
+	defaultHoldExpiryInterval = 1 * time.Minute
+
+	defaultIdempotencyKeyTTL        = 24 * time.Hour
+	defaultIdempotencyKeyLease      = 1 * time.Minute
+	defaultIdempotencyPurgeInterval = 1 * time.Hour
+
+	defaultTransferDailyLimit = 0
+
+	defaultTiers      = ""
+	defaultTierBasis  = models.TierBasisLifetime
+	defaultTierWindow = 365 * 24 * time.Hour
+
+	defaultReferrerBonus      = 0
+	defaultRefereeBonus       = 0
+	defaultReferralMinAccrual = 0
+	defaultReferralMaxRewards = 0
+
+	defaultWithdrawMinSum        = 0
+	defaultWithdrawMaxSum        = 0
+	defaultWithdrawDailyLimit    = 0
+	defaultWithdrawMonthlyLimit  = 0
+	defaultWithdrawMinAccountAge = 0
+	defaultWithdrawCooldown      = 0
+
+	defaultJWTAlgorithm = "HS256"
+	defaultJWTIssuer    = "gophermart"
+	defaultJWTAudience  = "gophermart"
+	defaultJWTTTL       = 15 * time.Minute
+
+	defaultSessionTTL = 7 * 24 * time.Hour
+
+	defaultPasswordMinLength = 0
+	defaultPasswordResetTTL  = 1 * time.Hour
 )
 
 // Config contains application settings
@@ -16,11 +74,162 @@ type Config struct {
 	ServerAddress  string
 	DatabaseDSN    string
 	AccrualAddress string
+
+	// AccrualLocal replaces the remote accrual system at AccrualAddress with
+	// the built-in engine whose API is served at AccrualLocalAddress
+	AccrualLocal        bool
+	AccrualLocalAddress string
+
+	// Accrual system polling policy, see accrual.RetryPolicy
+	AccrualRetryInitial    time.Duration
+	AccrualRetryMultiplier float64
+	AccrualRetryMax        time.Duration
+	AccrualRetryJitter     float64
+	AccrualMaxAttempts     int
+	AccrualMaxAge          time.Duration
+
+	// Accrual system circuit breaker, see accrual.BreakerSettings
+	AccrualBreakerFailures    int
+	AccrualBreakerOpenTimeout time.Duration
+	AccrualBreakerSuccesses   int
+
+	// PointsTTL is the lifetime of credited points, 0 means points never
+	// expire; expired points are written off every PointsExpiryInterval
+	PointsTTL            time.Duration
+	PointsExpiryInterval time.Duration
+
+	// HoldTTL is the time a hold reserves the points for; holds neither
+	// captured nor released in time are released every HoldExpiryInterval
+	HoldTTL            time.Duration
+	HoldExpiryInterval time.Duration
+
+	// IdempotencyKeyTTL is the time the response to a request with
+	// Idempotency-Key header is replayed for; older responses are purged
+	// every IdempotencyPurgeInterval. A key stays reserved for a request
+	// in progress for IdempotencyKeyLease at most, so the key of a request
+	// which never finished can be used again
+	IdempotencyKeyTTL        time.Duration
+	IdempotencyKeyLease      time.Duration
+	IdempotencyPurgeInterval time.Duration
+
+	// TransferDailyLimit is the number of points a user may transfer to
+	// other users in 24 hours, 0 means no limit
+	TransferDailyLimit float64
+
+	// Tiers are comma separated NAME:THRESHOLD:MULTIPLIER triples, see
+	// models.ParseTierProgram; the tier of a user is computed from either
+	// the lifetime accrued points or the points spent within TierWindow
+	Tiers      string
+	TierBasis  string
+	TierWindow time.Duration
+
+	// Referral bonuses in points are credited to the referrer and the
+	// referee once the first order of the referee is processed with at
+	// least ReferralMinAccrual points; a referrer is rewarded at most
+	// ReferralMaxRewards times, 0 means no limit
+	ReferrerBonus      float64
+	RefereeBonus       float64
+	ReferralMinAccrual float64
+	ReferralMaxRewards int
+
+	// Withdrawal policy, see models.WithdrawalPolicy; sums and limits are
+	// in points, the limits are per 24 hours and per 30 days, 0 means
+	// no restriction
+	WithdrawMinSum        float64
+	WithdrawMaxSum        float64
+	WithdrawDailyLimit    float64
+	WithdrawMonthlyLimit  float64
+	WithdrawMinAccountAge time.Duration
+	WithdrawCooldown      time.Duration
+
+	// CookieKeys are comma separated ID:SECRET:SIGNATURE triples the user
+	// cookie is sealed with, see models.ParseCookieKeys; CookieKeyFile is
+	// an alternative source of the keys listing them one per line
+	CookieKeys    string
+	CookieKeyFile string
+
+	// Bearer tokens are JWTs signed with either JWTSecret (HS256) or the
+	// PEM private key in JWTKeyFile (EdDSA, RS256); they and the user cookie
+	// are valid for JWTTTL, then they are renewed with the refresh token
+	JWTAlgorithm string
+	JWTSecret    string
+	JWTKeyFile   string
+	JWTIssuer    string
+	JWTAudience  string
+	JWTTTL       time.Duration
+
+	// SessionTTL is the time a login session lasts unless the user logs out,
+	// both the cookie and the bearer tokens refer to the session; every
+	// refresh extends the session by SessionTTL
+	SessionTTL time.Duration
+
+	// New passwords must be at least PasswordMinLength characters long and
+	// contain the character classes required, see models.PasswordPolicy
+	PasswordMinLength        int
+	PasswordRequireMixedCase bool
+	PasswordRequireDigit     bool
+	PasswordRequireSymbol    bool
+
+	// PasswordResetTTL is the time a password reset token is valid for,
+	// the tokens are written to NotifierFile or, if it is empty, to the log
+	PasswordResetTTL time.Duration
+	NotifierFile     string
 }
 
 var defaultConfig = Config{
 	ServerAddress:  defaultServerAddress,
 	AccrualAddress: defaultAccrualAddress,
+
+	AccrualLocalAddress: defaultAccrualLocalAddress,
+
+	AccrualRetryInitial:    defaultAccrualRetryInitial,
+	AccrualRetryMultiplier: defaultAccrualRetryMultiplier,
+	AccrualRetryMax:        defaultAccrualRetryMax,
+	AccrualRetryJitter:     defaultAccrualRetryJitter,
+	AccrualMaxAttempts:     defaultAccrualMaxAttempts,
+	AccrualMaxAge:          defaultAccrualMaxAge,
+
+	AccrualBreakerFailures:    defaultAccrualBreakerFailures,
+	AccrualBreakerOpenTimeout: defaultAccrualBreakerOpenTimeout,
+	AccrualBreakerSuccesses:   defaultAccrualBreakerSuccesses,
+
+	PointsTTL:            defaultPointsTTL,
+	PointsExpiryInterval: defaultPointsExpiryInterval,
+
+	HoldTTL:            defaultHoldTTL,
+	HoldExpiryInterval: defaultHoldExpiryInterval,
+
+	IdempotencyKeyTTL:        defaultIdempotencyKeyTTL,
+	IdempotencyKeyLease:      defaultIdempotencyKeyLease,
+	IdempotencyPurgeInterval: defaultIdempotencyPurgeInterval,
+
+	TransferDailyLimit: defaultTransferDailyLimit,
+
+	Tiers:      defaultTiers,
+	TierBasis:  defaultTierBasis,
+	TierWindow: defaultTierWindow,
+
+	ReferrerBonus:      defaultReferrerBonus,
+	RefereeBonus:       defaultRefereeBonus,
+	ReferralMinAccrual: defaultReferralMinAccrual,
+	ReferralMaxRewards: defaultReferralMaxRewards,
+
+	WithdrawMinSum:        defaultWithdrawMinSum,
+	WithdrawMaxSum:        defaultWithdrawMaxSum,
+	WithdrawDailyLimit:    defaultWithdrawDailyLimit,
+	WithdrawMonthlyLimit:  defaultWithdrawMonthlyLimit,
+	WithdrawMinAccountAge: defaultWithdrawMinAccountAge,
+	WithdrawCooldown:      defaultWithdrawCooldown,
+
+	JWTAlgorithm: defaultJWTAlgorithm,
+	JWTIssuer:    defaultJWTIssuer,
+	JWTAudience:  defaultJWTAudience,
+	JWTTTL:       defaultJWTTTL,
+
+	SessionTTL: defaultSessionTTL,
+
+	PasswordMinLength: defaultPasswordMinLength,
+	PasswordResetTTL:  defaultPasswordResetTTL,
 }
 
 // New creates config by merging default settings with flags, then with env variables
@@ -29,21 +238,105 @@ var defaultConfig = Config{
 // New also handles validation and returns non-nil error if validation failed
 func New() (Config, error) {
 	c := defaultConfig
-	c.parseFlags()
-	c.parseEnvVars()
+	// flag.CommandLine exits on parse errors
+	_ = c.parseFlags(flag.CommandLine, os.Args[1:])
+	if err := c.parseEnvVars(); err != nil {
+		return c, err
+	}
+	if err := c.readCookieKeyFile(); err != nil {
+		return c, err
+	}
 	err := c.Validate()
 	return c, err
 }
 
-func (c *Config) parseFlags() {
-	flag.StringVar(&c.ServerAddress, "a", defaultServerAddress, "network address the server listens on")
-	flag.StringVar(&c.DatabaseDSN, "d", "", `database dsn (default "")`)
-	flag.StringVar(&c.AccrualAddress, "r", defaultAccrualAddress, "accrual system address")
+// NewForCommand creates config for the subcommands of the server binary, the
+// server flags are defined in fs and parsed from args, env variables are
+// handled the same way as by New
+// Only the settings the storage depends on are validated so that a command
+// can be run with the environment of the server
+func NewForCommand(fs *flag.FlagSet, args []string) (Config, error) {
+	c := defaultConfig
+	if err := c.parseFlags(fs, args); err != nil {
+		return c, err
+	}
+	if err := c.parseEnvVars(); err != nil {
+		return c, err
+	}
+	err := c.validatePrograms()
+	return c, err
+}
+
+func (c *Config) parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.StringVar(&c.ServerAddress, "a", defaultServerAddress, "network address the server listens on")
+	fs.StringVar(&c.DatabaseDSN, "d", "", `database dsn (default "")`)
+	fs.StringVar(&c.AccrualAddress, "r", defaultAccrualAddress, "accrual system address")
+
+	fs.BoolVar(&c.AccrualLocal, "accrual-local", false, "use the built-in accrual engine instead of the accrual system")
+	fs.StringVar(&c.AccrualLocalAddress, "accrual-local-address", defaultAccrualLocalAddress, "network address the built-in accrual engine API listens on")
 
-	flag.Parse()
+	fs.DurationVar(&c.AccrualRetryInitial, "accrual-retry-initial", defaultAccrualRetryInitial, "delay before the second poll of an order")
+	fs.Float64Var(&c.AccrualRetryMultiplier, "accrual-retry-multiplier", defaultAccrualRetryMultiplier, "factor each next poll delay grows by")
+	fs.DurationVar(&c.AccrualRetryMax, "accrual-retry-max", defaultAccrualRetryMax, "maximum delay between polls of an order")
+	fs.Float64Var(&c.AccrualRetryJitter, "accrual-retry-jitter", defaultAccrualRetryJitter, "fraction a poll delay is randomly changed by, 0..1")
+	fs.IntVar(&c.AccrualMaxAttempts, "accrual-max-attempts", defaultAccrualMaxAttempts, "polls of an order before giving up, 0 means no limit")
+	fs.DurationVar(&c.AccrualMaxAge, "accrual-max-age", defaultAccrualMaxAge, "time since upload before giving up on an order, 0 means no limit")
+
+	fs.IntVar(&c.AccrualBreakerFailures, "accrual-breaker-failures", defaultAccrualBreakerFailures, "consecutive accrual system failures which stop polling")
+	fs.DurationVar(&c.AccrualBreakerOpenTimeout, "accrual-breaker-open-timeout", defaultAccrualBreakerOpenTimeout, "pause before probing the failed accrual system")
+	fs.IntVar(&c.AccrualBreakerSuccesses, "accrual-breaker-successes", defaultAccrualBreakerSuccesses, "successful probes which resume polling")
+
+	fs.DurationVar(&c.PointsTTL, "points-ttl", defaultPointsTTL, "lifetime of credited points, 0 means points never expire")
+	fs.DurationVar(&c.PointsExpiryInterval, "points-expiry-interval", defaultPointsExpiryInterval, "how often expired points are written off")
+
+	fs.DurationVar(&c.HoldTTL, "hold-ttl", defaultHoldTTL, "time a hold reserves the points for")
+	fs.DurationVar(&c.HoldExpiryInterval, "hold-expiry-interval", defaultHoldExpiryInterval, "how often expired holds are released")
+
+	fs.DurationVar(&c.IdempotencyKeyTTL, "idempotency-key-ttl", defaultIdempotencyKeyTTL, "time the response to a request with Idempotency-Key is replayed for")
+	fs.DurationVar(&c.IdempotencyKeyLease, "idempotency-key-lease", defaultIdempotencyKeyLease, "time an Idempotency-Key stays reserved for the request in progress")
+	fs.DurationVar(&c.IdempotencyPurgeInterval, "idempotency-purge-interval", defaultIdempotencyPurgeInterval, "how often outdated idempotency keys are purged")
+
+	fs.Float64Var(&c.TransferDailyLimit, "transfer-daily-limit", defaultTransferDailyLimit, "points a user may transfer in 24 hours, 0 means no limit")
+
+	fs.StringVar(&c.Tiers, "tiers", defaultTiers, `loyalty tiers as NAME:THRESHOLD:MULTIPLIER list, e.g. "Bronze:0:1,Silver:1000:1.25"`)
+	fs.StringVar(&c.TierBasis, "tier-basis", defaultTierBasis, "what tiers are computed from: lifetime (accrued points) or spend (points withdrawn within tier window)")
+	fs.DurationVar(&c.TierWindow, "tier-window", defaultTierWindow, "period the points spent are counted for with spend tier basis")
+
+	fs.Float64Var(&c.ReferrerBonus, "referrer-bonus", defaultReferrerBonus, "points the referrer gets for the first order of the referee")
+	fs.Float64Var(&c.RefereeBonus, "referee-bonus", defaultRefereeBonus, "points the referee gets for their first order")
+	fs.Float64Var(&c.ReferralMinAccrual, "referral-min-accrual", defaultReferralMinAccrual, "points the first order of the referee must bring to be rewarded")
+	fs.IntVar(&c.ReferralMaxRewards, "referral-max-rewards", defaultReferralMaxRewards, "referees a referrer is rewarded for, 0 means no limit")
+
+	fs.Float64Var(&c.WithdrawMinSum, "withdraw-min-sum", defaultWithdrawMinSum, "minimum points per withdrawal, 0 means no limit")
+	fs.Float64Var(&c.WithdrawMaxSum, "withdraw-max-sum", defaultWithdrawMaxSum, "maximum points per withdrawal, 0 means no limit")
+	fs.Float64Var(&c.WithdrawDailyLimit, "withdraw-daily-limit", defaultWithdrawDailyLimit, "points a user may withdraw in 24 hours, 0 means no limit")
+	fs.Float64Var(&c.WithdrawMonthlyLimit, "withdraw-monthly-limit", defaultWithdrawMonthlyLimit, "points a user may withdraw in 30 days, 0 means no limit")
+	fs.DurationVar(&c.WithdrawMinAccountAge, "withdraw-min-account-age", defaultWithdrawMinAccountAge, "time since registration before the first withdrawal")
+	fs.DurationVar(&c.WithdrawCooldown, "withdraw-cooldown", defaultWithdrawCooldown, "minimum time between withdrawals of a user")
+
+	fs.StringVar(&c.CookieKeys, "cookie-keys", "", "cookie keys as ID:SECRET:SIGNATURE list, the first one is primary")
+	fs.StringVar(&c.CookieKeyFile, "cookie-key-file", "", "file listing cookie keys as ID:SECRET:SIGNATURE, one per line")
+
+	fs.StringVar(&c.JWTAlgorithm, "jwt-algorithm", defaultJWTAlgorithm, "bearer token signing algorithm: HS256, EdDSA or RS256")
+	fs.StringVar(&c.JWTSecret, "jwt-secret", "", "HS256 bearer token secret")
+	fs.StringVar(&c.JWTKeyFile, "jwt-key-file", "", "PEM private key file for EdDSA and RS256 bearer tokens")
+	fs.StringVar(&c.JWTIssuer, "jwt-issuer", defaultJWTIssuer, "bearer token issuer")
+	fs.StringVar(&c.JWTAudience, "jwt-audience", defaultJWTAudience, "bearer token audience")
+	fs.DurationVar(&c.JWTTTL, "jwt-ttl", defaultJWTTTL, "bearer token lifetime")
+
+	fs.DurationVar(&c.SessionTTL, "session-ttl", defaultSessionTTL, "login session lifetime")
+
+	fs.IntVar(&c.PasswordMinLength, "password-min-length", defaultPasswordMinLength, "minimum length of new passwords")
+	fs.BoolVar(&c.PasswordRequireMixedCase, "password-require-mixed-case", false, "new passwords must contain upper and lower case letters")
+	fs.BoolVar(&c.PasswordRequireDigit, "password-require-digit", false, "new passwords must contain a digit")
+	fs.BoolVar(&c.PasswordRequireSymbol, "password-require-symbol", false, "new passwords must contain a symbol")
+	fs.DurationVar(&c.PasswordResetTTL, "password-reset-ttl", defaultPasswordResetTTL, "time a password reset token is valid for")
+	fs.StringVar(&c.NotifierFile, "notifier-file", "", "file the password reset tokens are written to instead of the log")
+
+	return fs.Parse(args)
 }
 
-func (c *Config) parseEnvVars() {
+func (c *Config) parseEnvVars() error {
 	sa := os.Getenv("RUN_ADDRESS")
 	if sa != "" {
 		c.ServerAddress = sa
@@ -59,6 +352,240 @@ func (c *Config) parseEnvVars() {
 	if aa != "" {
 		c.AccrualAddress = aa
 	}
+
+	la := os.Getenv("ACCRUAL_LOCAL_ADDRESS")
+	if la != "" {
+		c.AccrualLocalAddress = la
+	}
+
+	var err error
+	if c.AccrualLocal, err = boolEnv("ACCRUAL_LOCAL", c.AccrualLocal); err != nil {
+		return err
+	}
+	if c.AccrualRetryInitial, err = durationEnv("ACCRUAL_RETRY_INITIAL", c.AccrualRetryInitial); err != nil {
+		return err
+	}
+	if c.AccrualRetryMultiplier, err = floatEnv("ACCRUAL_RETRY_MULTIPLIER", c.AccrualRetryMultiplier); err != nil {
+		return err
+	}
+	if c.AccrualRetryMax, err = durationEnv("ACCRUAL_RETRY_MAX", c.AccrualRetryMax); err != nil {
+		return err
+	}
+	if c.AccrualRetryJitter, err = floatEnv("ACCRUAL_RETRY_JITTER", c.AccrualRetryJitter); err != nil {
+		return err
+	}
+	if c.AccrualMaxAttempts, err = intEnv("ACCRUAL_MAX_ATTEMPTS", c.AccrualMaxAttempts); err != nil {
+		return err
+	}
+	if c.AccrualMaxAge, err = durationEnv("ACCRUAL_MAX_AGE", c.AccrualMaxAge); err != nil {
+		return err
+	}
+	if c.AccrualBreakerFailures, err = intEnv("ACCRUAL_BREAKER_FAILURES", c.AccrualBreakerFailures); err != nil {
+		return err
+	}
+	if c.AccrualBreakerOpenTimeout, err = durationEnv("ACCRUAL_BREAKER_OPEN_TIMEOUT", c.AccrualBreakerOpenTimeout); err != nil {
+		return err
+	}
+	if c.AccrualBreakerSuccesses, err = intEnv("ACCRUAL_BREAKER_SUCCESSES", c.AccrualBreakerSuccesses); err != nil {
+		return err
+	}
+	if c.PointsTTL, err = durationEnv("POINTS_TTL", c.PointsTTL); err != nil {
+		return err
+	}
+	if c.PointsExpiryInterval, err = durationEnv("POINTS_EXPIRY_INTERVAL", c.PointsExpiryInterval); err != nil {
+		return err
+	}
+	if c.HoldTTL, err = durationEnv("HOLD_TTL", c.HoldTTL); err != nil {
+		return err
+	}
+	if c.HoldExpiryInterval, err = durationEnv("HOLD_EXPIRY_INTERVAL", c.HoldExpiryInterval); err != nil {
+		return err
+	}
+	if c.IdempotencyKeyTTL, err = durationEnv("IDEMPOTENCY_KEY_TTL", c.IdempotencyKeyTTL); err != nil {
+		return err
+	}
+	if c.IdempotencyKeyLease, err = durationEnv("IDEMPOTENCY_KEY_LEASE", c.IdempotencyKeyLease); err != nil {
+		return err
+	}
+	if c.IdempotencyPurgeInterval, err = durationEnv("IDEMPOTENCY_PURGE_INTERVAL", c.IdempotencyPurgeInterval); err != nil {
+		return err
+	}
+	if c.TransferDailyLimit, err = floatEnv("TRANSFER_DAILY_LIMIT", c.TransferDailyLimit); err != nil {
+		return err
+	}
+	if t := os.Getenv("TIERS"); t != "" {
+		c.Tiers = t
+	}
+	if tb := os.Getenv("TIER_BASIS"); tb != "" {
+		c.TierBasis = tb
+	}
+	if c.TierWindow, err = durationEnv("TIER_WINDOW", c.TierWindow); err != nil {
+		return err
+	}
+	if c.ReferrerBonus, err = floatEnv("REFERRER_BONUS", c.ReferrerBonus); err != nil {
+		return err
+	}
+	if c.RefereeBonus, err = floatEnv("REFEREE_BONUS", c.RefereeBonus); err != nil {
+		return err
+	}
+	if c.ReferralMinAccrual, err = floatEnv("REFERRAL_MIN_ACCRUAL", c.ReferralMinAccrual); err != nil {
+		return err
+	}
+	if c.ReferralMaxRewards, err = intEnv("REFERRAL_MAX_REWARDS", c.ReferralMaxRewards); err != nil {
+		return err
+	}
+	if c.WithdrawMinSum, err = floatEnv("WITHDRAW_MIN_SUM", c.WithdrawMinSum); err != nil {
+		return err
+	}
+	if c.WithdrawMaxSum, err = floatEnv("WITHDRAW_MAX_SUM", c.WithdrawMaxSum); err != nil {
+		return err
+	}
+	if c.WithdrawDailyLimit, err = floatEnv("WITHDRAW_DAILY_LIMIT", c.WithdrawDailyLimit); err != nil {
+		return err
+	}
+	if c.WithdrawMonthlyLimit, err = floatEnv("WITHDRAW_MONTHLY_LIMIT", c.WithdrawMonthlyLimit); err != nil {
+		return err
+	}
+	if c.WithdrawMinAccountAge, err = durationEnv("WITHDRAW_MIN_ACCOUNT_AGE", c.WithdrawMinAccountAge); err != nil {
+		return err
+	}
+	if c.WithdrawCooldown, err = durationEnv("WITHDRAW_COOLDOWN", c.WithdrawCooldown); err != nil {
+		return err
+	}
+	if ck := os.Getenv("COOKIE_KEYS"); ck != "" {
+		c.CookieKeys = ck
+	}
+	if kf := os.Getenv("COOKIE_KEY_FILE"); kf != "" {
+		c.CookieKeyFile = kf
+	}
+	if ja := os.Getenv("JWT_ALGORITHM"); ja != "" {
+		c.JWTAlgorithm = ja
+	}
+	if js := os.Getenv("JWT_SECRET"); js != "" {
+		c.JWTSecret = js
+	}
+	if jk := os.Getenv("JWT_KEY_FILE"); jk != "" {
+		c.JWTKeyFile = jk
+	}
+	if ji := os.Getenv("JWT_ISSUER"); ji != "" {
+		c.JWTIssuer = ji
+	}
+	if jd := os.Getenv("JWT_AUDIENCE"); jd != "" {
+		c.JWTAudience = jd
+	}
+	if c.JWTTTL, err = durationEnv("JWT_TTL", c.JWTTTL); err != nil {
+		return err
+	}
+
+	if c.SessionTTL, err = durationEnv("SESSION_TTL", c.SessionTTL); err != nil {
+		return err
+	}
+
+	if c.PasswordMinLength, err = intEnv("PASSWORD_MIN_LENGTH", c.PasswordMinLength); err != nil {
+		return err
+	}
+	if c.PasswordRequireMixedCase, err = boolEnv("PASSWORD_REQUIRE_MIXED_CASE", c.PasswordRequireMixedCase); err != nil {
+		return err
+	}
+	if c.PasswordRequireDigit, err = boolEnv("PASSWORD_REQUIRE_DIGIT", c.PasswordRequireDigit); err != nil {
+		return err
+	}
+	if c.PasswordRequireSymbol, err = boolEnv("PASSWORD_REQUIRE_SYMBOL", c.PasswordRequireSymbol); err != nil {
+		return err
+	}
+	if c.PasswordResetTTL, err = durationEnv("PASSWORD_RESET_TTL", c.PasswordResetTTL); err != nil {
+		return err
+	}
+	if nf := os.Getenv("NOTIFIER_FILE"); nf != "" {
+		c.NotifierFile = nf
+	}
+
+	return nil
+}
+
+// readCookieKeyFile loads the cookie keys from the key file if it is set;
+// empty lines and lines starting with # are skipped
+func (c *Config) readCookieKeyFile() error {
+	if c.CookieKeyFile == "" {
+		return nil
+	}
+	if c.CookieKeys != "" {
+		return errors.New("cookie keys and cookie key file must not be set both")
+	}
+
+	data, err := os.ReadFile(c.CookieKeyFile)
+	if err != nil {
+		return fmt.Errorf("cookie key file: %v", err)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("cookie key file: no keys found")
+	}
+	c.CookieKeys = strings.Join(keys, ",")
+
+	return nil
+}
+
+// durationEnv returns the value of env variable parsed as time.Duration,
+// or the current value if the variable is empty
+func durationEnv(name string, current time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return current, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return current, fmt.Errorf("%s: %v", name, err)
+	}
+	return d, nil
+}
+
+// floatEnv returns the value of env variable parsed as float64,
+// or the current value if the variable is empty
+func floatEnv(name string, current float64) (float64, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return current, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return current, fmt.Errorf("%s: %v", name, err)
+	}
+	return f, nil
+}
+
+// intEnv returns the value of env variable parsed as int,
+// or the current value if the variable is empty
+func intEnv(name string, current int) (int, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return current, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return current, fmt.Errorf("%s: %v", name, err)
+	}
+	return i, nil
+}
+
+// boolEnv returns the value of env variable parsed as bool,
+// or the current value if the variable is empty
+func boolEnv(name string, current bool) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return current, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return current, fmt.Errorf("%s: %v", name, err)
+	}
+	return b, nil
 }
 
 func (c *Config) Validate() error {
@@ -66,15 +593,255 @@ func (c *Config) Validate() error {
 	// Other mistakes and typos are to be considered as errors
 	c.ServerAddress = strings.TrimSpace(c.ServerAddress)
 	c.AccrualAddress = strings.TrimSpace(c.AccrualAddress)
+	c.AccrualLocalAddress = strings.TrimSpace(c.AccrualLocalAddress)
 
 	if err := ValidateServerAddress(c.ServerAddress); err != nil {
 		return err
 	}
 
-	if err := ValidateURL(c.AccrualAddress); err != nil {
+	if c.AccrualLocal {
+		if err := ValidateServerAddress(c.AccrualLocalAddress); err != nil {
+			return err
+		}
+	} else if err := ValidateURL(c.AccrualAddress); err != nil {
+		return err
+	}
+
+	if err := c.validateAccrualRetry(); err != nil {
+		return err
+	}
+
+	if err := c.validateAccrualBreaker(); err != nil {
+		return err
+	}
+
+	if err := c.validatePoints(); err != nil {
+		return err
+	}
+
+	if err := c.validateHolds(); err != nil {
+		return err
+	}
+
+	if err := c.validateIdempotency(); err != nil {
+		return err
+	}
+
+	if c.TransferDailyLimit < 0 {
+		return errors.New("transfer daily limit must not be negative")
+	}
+
+	if err := c.validatePrograms(); err != nil {
+		return err
+	}
+
+	if _, err := models.ParseCookieKeys(c.CookieKeys); err != nil {
+		return err
+	}
+
+	if err := c.validateJWT(); err != nil {
+		return err
+	}
+
+	if c.SessionTTL <= 0 {
+		return errors.New("session ttl must be positive")
+	}
+
+	if err := c.validatePasswords(); err != nil {
 		return err
 	}
 
 	// No need to validate c.DatabaseDSN, storage itself will do the job
 	return nil
 }
+
+func (c *Config) validateAccrualRetry() error {
+	switch {
+	case c.AccrualRetryInitial <= 0:
+		return errors.New("accrual retry initial delay must be positive")
+	case c.AccrualRetryMultiplier < 1:
+		return errors.New("accrual retry multiplier must not be less than 1")
+	case c.AccrualRetryMax < c.AccrualRetryInitial:
+		return errors.New("accrual retry max delay must not be less than the initial one")
+	case c.AccrualRetryJitter < 0 || c.AccrualRetryJitter > 1:
+		return errors.New("accrual retry jitter must be in 0..1 range")
+	case c.AccrualMaxAttempts < 0:
+		return errors.New("accrual max attempts must not be negative")
+	case c.AccrualMaxAge < 0:
+		return errors.New("accrual max age must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) validateAccrualBreaker() error {
+	switch {
+	case c.AccrualBreakerFailures < 1:
+		return errors.New("accrual breaker failures must be positive")
+	case c.AccrualBreakerOpenTimeout <= 0:
+		return errors.New("accrual breaker open timeout must be positive")
+	case c.AccrualBreakerSuccesses < 1:
+		return errors.New("accrual breaker successes must be positive")
+	}
+	return nil
+}
+
+func (c *Config) validatePoints() error {
+	switch {
+	case c.PointsTTL < 0:
+		return errors.New("points ttl must not be negative")
+	case c.PointsExpiryInterval <= 0:
+		return errors.New("points expiry interval must be positive")
+	}
+	return nil
+}
+
+func (c *Config) validateHolds() error {
+	switch {
+	case c.HoldTTL <= 0:
+		return errors.New("hold ttl must be positive")
+	case c.HoldExpiryInterval <= 0:
+		return errors.New("hold expiry interval must be positive")
+	}
+	return nil
+}
+
+func (c *Config) validateIdempotency() error {
+	switch {
+	case c.IdempotencyKeyTTL <= 0:
+		return errors.New("idempotency key ttl must be positive")
+	case c.IdempotencyKeyLease <= 0:
+		return errors.New("idempotency key lease must be positive")
+	case c.IdempotencyKeyLease > c.IdempotencyKeyTTL:
+		return errors.New("idempotency key lease must not exceed idempotency key ttl")
+	case c.IdempotencyPurgeInterval <= 0:
+		return errors.New("idempotency purge interval must be positive")
+	}
+	return nil
+}
+
+// validatePrograms checks the tiers, referral bonuses and withdrawal policy
+func (c *Config) validatePrograms() error {
+	c.TierBasis = strings.TrimSpace(c.TierBasis)
+	if _, err := models.ParseTierProgram(c.Tiers, c.TierBasis, c.TierWindow); err != nil {
+		return err
+	}
+
+	if err := c.validateReferrals(); err != nil {
+		return err
+	}
+
+	return c.validateWithdrawalPolicy()
+}
+
+func (c *Config) validateReferrals() error {
+	switch {
+	case c.ReferrerBonus < 0 || c.RefereeBonus < 0:
+		return errors.New("referral bonuses must not be negative")
+	case c.ReferralMinAccrual < 0:
+		return errors.New("referral min accrual must not be negative")
+	case c.ReferralMaxRewards < 0:
+		return errors.New("referral max rewards must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) validatePasswords() error {
+	switch {
+	case c.PasswordMinLength < 0:
+		return errors.New("password min length must not be negative")
+	case c.PasswordResetTTL <= 0:
+		return errors.New("password reset ttl must be positive")
+	}
+	return nil
+}
+
+func (c *Config) validateWithdrawalPolicy() error {
+	switch {
+	case c.WithdrawMinSum < 0 || c.WithdrawMaxSum < 0:
+		return errors.New("withdraw min and max sums must not be negative")
+	case c.WithdrawMaxSum > 0 && c.WithdrawMaxSum < c.WithdrawMinSum:
+		return errors.New("withdraw max sum must not be less than the min one")
+	case c.WithdrawDailyLimit < 0 || c.WithdrawMonthlyLimit < 0:
+		return errors.New("withdraw limits must not be negative")
+	case c.WithdrawMinAccountAge < 0:
+		return errors.New("withdraw min account age must not be negative")
+	case c.WithdrawCooldown < 0:
+		return errors.New("withdraw cooldown must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) validateJWT() error {
+	switch c.JWTAlgorithm {
+	case "HS256":
+	case "EdDSA", "RS256":
+		if c.JWTKeyFile == "" {
+			return errors.New("jwt key file must be set for " + c.JWTAlgorithm)
+		}
+	default:
+		return errors.New("jwt algorithm must be HS256, EdDSA or RS256")
+	}
+	if c.JWTTTL <= 0 {
+		return errors.New("jwt ttl must be positive")
+	}
+	return nil
+}
+
+// TierProgram returns the loyalty tiers, nil if there are none; the
+// config is expected to be validated already
+func (c Config) TierProgram() *models.TierProgram {
+	program, _ := models.ParseTierProgram(c.Tiers, c.TierBasis, c.TierWindow)
+	return program
+}
+
+// ReferralProgram returns the referral bonuses, nil if there are none
+func (c Config) ReferralProgram() *models.ReferralProgram {
+	if c.ReferrerBonus == 0 && c.RefereeBonus == 0 {
+		return nil
+	}
+	return &models.ReferralProgram{
+		ReferrerBonus: models.Money(math.Round(c.ReferrerBonus * 100)),
+		RefereeBonus:  models.Money(math.Round(c.RefereeBonus * 100)),
+		MinAccrual:    models.Money(math.Round(c.ReferralMinAccrual * 100)),
+		MaxRewards:    c.ReferralMaxRewards,
+	}
+}
+
+// WithdrawalPolicy returns the restrictions on withdrawals, nil if there
+// are none
+func (c Config) WithdrawalPolicy() *models.WithdrawalPolicy {
+	p := models.WithdrawalPolicy{
+		MinSum:        models.Money(math.Round(c.WithdrawMinSum * 100)),
+		MaxSum:        models.Money(math.Round(c.WithdrawMaxSum * 100)),
+		DailyLimit:    models.Money(math.Round(c.WithdrawDailyLimit * 100)),
+		MonthlyLimit:  models.Money(math.Round(c.WithdrawMonthlyLimit * 100)),
+		MinAccountAge: c.WithdrawMinAccountAge,
+		Cooldown:      c.WithdrawCooldown,
+	}
+	if p == (models.WithdrawalPolicy{}) {
+		return nil
+	}
+	return &p
+}
+
+// PasswordPolicy returns the requirements for new passwords, nil if there
+// are none
+func (c Config) PasswordPolicy() *models.PasswordPolicy {
+	p := models.PasswordPolicy{
+		MinLength:        c.PasswordMinLength,
+		RequireMixedCase: c.PasswordRequireMixedCase,
+		RequireDigit:     c.PasswordRequireDigit,
+		RequireSymbol:    c.PasswordRequireSymbol,
+	}
+	if p == (models.PasswordPolicy{}) {
+		return nil
+	}
+	return &p
+}
+
+// CookieKeyList returns the cookie keys, the primary one first; the
+// config is expected to be validated already
+func (c Config) CookieKeyList() []models.CookieKey {
+	keys, _ := models.ParseCookieKeys(c.CookieKeys)
+	return keys
+}
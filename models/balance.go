@@ -64,15 +64,59 @@ type AccrualResponse struct {
 	Accrual     Money  `json:"accrual"`
 }
 
+// Balance tells how many points the user has; Current is what is available
+// to spend, Held is reserved by holds which are neither captured nor
+// released yet; Tier is empty unless there is a tier program
 type Balance struct {
-	Current   Money `json:"current"`
-	Withdrawn Money `json:"withdrawn"`
+	Current   Money  `json:"current"`
+	Withdrawn Money  `json:"withdrawn"`
+	Expired   Money  `json:"expired"`
+	Held      Money  `json:"held"`
+	Tier      string `json:"tier,omitempty"`
 }
 
-type WithdrawalInfo struct {
+// PointLot is a portion of points credited at once; points are spent
+// and expire lot by lot, the oldest first
+type PointLot struct {
+	OrderNumber string
+	Amount      Money
+	Remaining   Money
+	CreditedAt  time.Time
+}
+
+// ExpiringPoints tells when the points left from a lot expire
+type ExpiringPoints struct {
+	OrderNumber string    `json:"order,omitempty"`
+	Sum         Money     `json:"sum"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Hold statuses
+const (
+	HoldStatusHeld     = "HELD"
+	HoldStatusCaptured = "CAPTURED"
+	HoldStatusReleased = "RELEASED"
+	HoldStatusExpired  = "EXPIRED"
+)
+
+// Hold reserves the points for the order until it is captured, which
+// turns it into a withdrawal, or released; a hold not settled by ExpiresAt
+// is released automatically
+type Hold struct {
 	OrderNumber string    `json:"order"`
 	Sum         Money     `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+type WithdrawalInfo struct {
+	OrderNumber    string     `json:"order"`
+	Sum            Money      `json:"sum"`
+	ProcessedAt    time.Time  `json:"processed_at"`
+	Reversed       bool       `json:"reversed"`
+	ReversedAt     *time.Time `json:"reversed_at,omitempty"`
+	ReversalReason string     `json:"reversal_reason,omitempty"`
 }
 
 type WithdrawRequest struct {
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Campaign conditions, the orders a campaign applies to
+const (
+	// CampaignAllOrders applies to every order uploaded during the campaign
+	CampaignAllOrders = "ALL"
+	// CampaignFirstOrder applies to the first processed order of the user
+	CampaignFirstOrder = "FIRST_ORDER"
+	// CampaignWeekend applies to the orders uploaded on Saturday or Sunday, UTC
+	CampaignWeekend = "WEEKEND"
+)
+
+// Campaign grants bonus points for the orders uploaded between StartsAt and
+// EndsAt which meet Condition: the accrual multiplied by Multiplier - 1,
+// e.g. 2 doubles the points, plus the fixed Bonus
+type Campaign struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Condition  string    `json:"condition"`
+	Multiplier float64   `json:"multiplier"`
+	Bonus      Money     `json:"bonus"`
+	StartsAt   time.Time `json:"starts_at"`
+	EndsAt     time.Time `json:"ends_at"`
+}
+
+func (c *Campaign) Validate() error {
+	switch {
+	case c.Name == "":
+		return errors.New("campaign name must not be empty")
+	case c.Condition != CampaignAllOrders && c.Condition != CampaignFirstOrder && c.Condition != CampaignWeekend:
+		return errors.New("campaign condition must be ALL, FIRST_ORDER or WEEKEND")
+	case c.Multiplier < 1:
+		return errors.New("campaign multiplier must not be less than 1")
+	case c.Bonus < 0:
+		return errors.New("campaign bonus must not be negative")
+	case c.Multiplier == 1 && c.Bonus == 0:
+		return errors.New("campaign grants nothing")
+	case !c.EndsAt.After(c.StartsAt):
+		return errors.New("campaign must end after it starts")
+	}
+	return nil
+}
+
+// BonusFor returns the bonus points the campaign grants for the order
+// uploaded at uploadedAt; firstOrder tells if it is the first processed
+// order of the user
+func (c *Campaign) BonusFor(accrual Money, uploadedAt time.Time, firstOrder bool) Money {
+	if uploadedAt.Before(c.StartsAt) || !uploadedAt.Before(c.EndsAt) {
+		return 0
+	}
+	switch c.Condition {
+	case CampaignFirstOrder:
+		if !firstOrder {
+			return 0
+		}
+	case CampaignWeekend:
+		if wd := uploadedAt.UTC().Weekday(); wd != time.Saturday && wd != time.Sunday {
+			return 0
+		}
+	}
+	return Money(math.Round(float64(accrual)*(c.Multiplier-1))) + c.Bonus
+}
+
+// CampaignBonus sums the bonus points granted for the order by the
+// campaigns and returns the names of the campaigns which granted any
+func CampaignBonus(campaigns []*Campaign, accrual Money, uploadedAt time.Time, firstOrder bool) (Money, []string) {
+	var bonus Money
+	names := []string{}
+	for _, c := range campaigns {
+		if b := c.BonusFor(accrual, uploadedAt, firstOrder); b > 0 {
+			bonus += b
+			names = append(names, c.Name)
+		}
+	}
+	return bonus, names
+}
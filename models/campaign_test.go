@@ -0,0 +1,60 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCampaignBonusFor(t *testing.T) {
+	saturday := time.Date(2022, 1, 8, 12, 0, 0, 0, time.UTC)
+	monday := saturday.Add(48 * time.Hour)
+	window := Campaign{StartsAt: saturday.Add(-24 * time.Hour), EndsAt: monday.Add(time.Hour)}
+
+	tests := []struct {
+		name       string
+		condition  string
+		multiplier float64
+		bonus      Money
+		uploadedAt time.Time
+		firstOrder bool
+		want       Money
+	}{
+		{"double", CampaignAllOrders, 2, 0, monday, false, 1000},
+		{"fixed bonus", CampaignAllOrders, 1, 500, monday, false, 500},
+		{"both", CampaignAllOrders, 1.5, 100, monday, false, 600},
+		{"before start", CampaignAllOrders, 2, 0, window.StartsAt.Add(-time.Second), false, 0},
+		{"at end", CampaignAllOrders, 2, 0, window.EndsAt, false, 0},
+		{"first order", CampaignFirstOrder, 1, 10000, monday, true, 10000},
+		{"not first order", CampaignFirstOrder, 1, 10000, monday, false, 0},
+		{"weekend", CampaignWeekend, 2, 0, saturday, false, 1000},
+		{"weekday", CampaignWeekend, 2, 0, monday, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := window
+			c.Condition, c.Multiplier, c.Bonus = tt.condition, tt.multiplier, tt.bonus
+			assert.Equal(t, tt.want, c.BonusFor(1000, tt.uploadedAt, tt.firstOrder))
+		})
+	}
+}
+
+func TestCampaignValidate(t *testing.T) {
+	now := time.Now()
+	c := Campaign{Name: "Double", Condition: CampaignAllOrders, Multiplier: 2, StartsAt: now, EndsAt: now.Add(time.Hour)}
+	assert.NoError(t, c.Validate())
+
+	noop := c
+	noop.Multiplier = 1
+	assert.Error(t, noop.Validate())
+
+	unknown := c
+	unknown.Condition = "HOLIDAY"
+	assert.Error(t, unknown.Validate())
+
+	backwards := c
+	backwards.EndsAt = now
+	assert.Error(t, backwards.Validate())
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// minCookieSecretLen is the minimum length of cookie secrets
+const minCookieSecretLen = 16
+
+// CookieKey is a pair of secrets the user cookie is encrypted and signed
+// with; ID is embedded in the cookie so the key can be found on the way back
+type CookieKey struct {
+	ID        string
+	Secret    string
+	Signature string
+}
+
+// ParseCookieKeys parses the keys given as comma separated
+// ID:SECRET:SIGNATURE triples; the first key is the primary one, the others
+// are only used to accept the cookies issued before the keys were rotated.
+// Empty spec means there are no keys and the function returns nil
+func ParseCookieKeys(spec string) ([]CookieKey, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var keys []CookieKey
+	ids := make(map[string]bool)
+	for i, s := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(s), ":")
+		// the secrets themselves are not quoted in errors
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("cookie key %d: ID:SECRET:SIGNATURE expected", i+1)
+		}
+		if strings.Contains(parts[0], ".") {
+			return nil, fmt.Errorf("cookie key %q: ID must not contain dots", parts[0])
+		}
+		if ids[parts[0]] {
+			return nil, fmt.Errorf("cookie key %q: duplicate ID", parts[0])
+		}
+		ids[parts[0]] = true
+		if len(parts[1]) < minCookieSecretLen || len(parts[2]) < minCookieSecretLen {
+			return nil, fmt.Errorf("cookie key %q: secrets must be at least %d characters long", parts[0], minCookieSecretLen)
+		}
+		keys = append(keys, CookieKey{ID: parts[0], Secret: parts[1], Signature: parts[2]})
+	}
+
+	return keys, nil
+}
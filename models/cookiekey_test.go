@@ -0,0 +1,32 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCookieKeys(t *testing.T) {
+	keys, err := ParseCookieKeys("")
+	require.NoError(t, err)
+	assert.Nil(t, keys)
+
+	keys, err = ParseCookieKeys(" new:0123456789abcdef:fedcba9876543210 , old:aaaaaaaaaaaaaaaa:bbbbbbbbbbbbbbbb")
+	require.NoError(t, err)
+	assert.Equal(t, []CookieKey{
+		{ID: "new", Secret: "0123456789abcdef", Signature: "fedcba9876543210"},
+		{ID: "old", Secret: "aaaaaaaaaaaaaaaa", Signature: "bbbbbbbbbbbbbbbb"},
+	}, keys)
+
+	for _, spec := range []string{
+		"new:0123456789abcdef",
+		":0123456789abcdef:fedcba9876543210",
+		"v.1:0123456789abcdef:fedcba9876543210",
+		"new:short:fedcba9876543210",
+		"new:0123456789abcdef:fedcba9876543210,new:aaaaaaaaaaaaaaaa:bbbbbbbbbbbbbbbb",
+	} {
+		_, err := ParseCookieKeys(spec)
+		assert.Error(t, err, spec)
+	}
+}
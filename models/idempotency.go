@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// IdempotencyRecord keeps the first response to a request made with the
+// Idempotency-Key header, so the response is replayed when the user retries
+// the request with the same key. A record is not Completed while the first
+// request is being handled
+type IdempotencyRecord struct {
+	UserID      int
+	Key         string
+	RequestHash string
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
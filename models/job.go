@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// AccrualJob describes an order waiting for the accrual system to calculate
+// its reward. Jobs are leased by a worker for a limited period of time, so
+// several workers (or several application instances) never poll the accrual
+// system for the same order simultaneously
+type AccrualJob struct {
+	OrderNumber   string
+	OrderStatus   string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+
+	// GaveUp is set when the accrual system has not resolved the order
+	// in time, such jobs are never leased again and wait for an operator
+	GaveUp bool
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Ledger entry kinds
+const (
+	LedgerAccrual    = "ACCRUAL"
+	LedgerWithdrawal = "WITHDRAWAL"
+	LedgerAdjustment = "ADJUSTMENT"
+	LedgerExpiration = "EXPIRATION"
+	LedgerReversal   = "REVERSAL"
+	LedgerHold       = "HOLD"
+	LedgerRelease    = "RELEASE"
+	LedgerTransfer   = "TRANSFER"
+	LedgerBonus      = "BONUS"
+	LedgerReferral   = "REFERRAL"
+)
+
+// System accounts the points come from and go to, every user has an
+// account of their own named by UserAccount()
+const (
+	AccountAccruals    = "accruals"
+	AccountWithdrawals = "withdrawals"
+	AccountAdjustments = "adjustments"
+	AccountExpirations = "expirations"
+	AccountHolds       = "holds"
+	AccountCampaigns   = "campaigns"
+	AccountReferrals   = "referrals"
+)
+
+// LedgerEntry moves Amount points from one account to another; entries
+// are never changed or deleted, so the balance of any account is the sum
+// of the entries to it minus the sum of the entries from it
+type LedgerEntry struct {
+	ID          int64     `json:"id"`
+	Kind        string    `json:"kind"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Amount      Money     `json:"amount"`
+	OrderNumber string    `json:"order,omitempty"`
+	Comment     string    `json:"comment,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// UserAccount returns the name of the user's ledger account, DBStorage
+// relies on the format in its queries
+func UserAccount(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// NewAccrualEntry credits the points accrued for the order, the tier the
+// user belongs to is mentioned in the comment
+func NewAccrualEntry(userID int, accrual Money, orderNumber string, tier Tier) *LedgerEntry {
+	e := &LedgerEntry{
+		Kind:        LedgerAccrual,
+		From:        AccountAccruals,
+		To:          UserAccount(userID),
+		Amount:      accrual,
+		OrderNumber: orderNumber,
+	}
+	if tier.Name != "" {
+		e.Comment = fmt.Sprintf("tier %s x%g", tier.Name, tier.Multiplier)
+	}
+	return e
+}
+
+// NewBonusEntry credits the bonus points granted for the order by the
+// campaigns named
+func NewBonusEntry(userID int, bonus Money, orderNumber string, campaigns []string) *LedgerEntry {
+	return &LedgerEntry{
+		Kind:        LedgerBonus,
+		From:        AccountCampaigns,
+		To:          UserAccount(userID),
+		Amount:      bonus,
+		OrderNumber: orderNumber,
+		Comment:     strings.Join(campaigns, ", "),
+	}
+}
+
+// NewReferralEntry credits the referral bonus for the first order of the
+// referee, comment tells who was invited by whom
+func NewReferralEntry(userID int, bonus Money, orderNumber, comment string) *LedgerEntry {
+	return &LedgerEntry{
+		Kind:        LedgerReferral,
+		From:        AccountReferrals,
+		To:          UserAccount(userID),
+		Amount:      bonus,
+		OrderNumber: orderNumber,
+		Comment:     comment,
+	}
+}
+
+// NewAdjustmentEntry moves the points from the adjustments account to the
+// user's one, or the other way round if amount is negative
+func NewAdjustmentEntry(userID int, amount Money, comment string) *LedgerEntry {
+	e := &LedgerEntry{
+		Kind:    LedgerAdjustment,
+		From:    AccountAdjustments,
+		To:      UserAccount(userID),
+		Amount:  amount,
+		Comment: comment,
+	}
+	if amount < 0 {
+		e.From, e.To, e.Amount = e.To, e.From, -amount
+	}
+	return e
+}
+
+// NewReversalEntry returns the withdrawn points back to the user, the
+// comment keeps who reversed the withdrawal and why
+func NewReversalEntry(userID int, sum Money, orderNumber, reversedBy, reason string) *LedgerEntry {
+	return &LedgerEntry{
+		Kind:        LedgerReversal,
+		From:        AccountWithdrawals,
+		To:          UserAccount(userID),
+		Amount:      sum,
+		OrderNumber: orderNumber,
+		Comment:     fmt.Sprintf("%s (by %s)", reason, reversedBy),
+	}
+}
+
+// NewHoldEntry moves the points reserved for the order to the holds account
+func NewHoldEntry(userID int, sum Money, orderNumber string) *LedgerEntry {
+	return &LedgerEntry{
+		Kind:        LedgerHold,
+		From:        UserAccount(userID),
+		To:          AccountHolds,
+		Amount:      sum,
+		OrderNumber: orderNumber,
+	}
+}
+
+// NewReleaseEntry returns the points reserved for the order back to the
+// user; a captured hold is released and then withdrawn as usual
+func NewReleaseEntry(userID int, sum Money, orderNumber string) *LedgerEntry {
+	return &LedgerEntry{
+		Kind:        LedgerRelease,
+		From:        AccountHolds,
+		To:          UserAccount(userID),
+		Amount:      sum,
+		OrderNumber: orderNumber,
+	}
+}
+
+// BalanceMismatch is a user balance which differs from the one derived
+// from the ledger
+type BalanceMismatch struct {
+	UserID int
+	Cached Balance
+	Ledger Balance
+}
@@ -9,6 +9,7 @@ type Order struct {
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
 	Accrual    Money     `json:"accrual"`
+	Bonus      Money     `json:"bonus,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
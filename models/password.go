@@ -0,0 +1,145 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy is the strength new passwords must have, zero value of a
+// field means no restriction; MinLength counts characters, not bytes
+type PasswordPolicy struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+// Check returns an error describing the first requirement the password
+// does not meet, it is safe to call on nil policy
+func (p *PasswordPolicy) Check(password string) error {
+	if p == nil {
+		return nil
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+
+	switch {
+	case utf8.RuneCountInString(password) < p.MinLength:
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	case p.RequireMixedCase && !(upper && lower):
+		return errors.New("password must contain both upper and lower case letters")
+	case p.RequireDigit && !digit:
+		return errors.New("password must contain a digit")
+	case p.RequireSymbol && !symbol:
+		return errors.New("password must contain a character other than a letter or a digit")
+	}
+	return nil
+}
+
+// PasswordChange is the body of POST /api/user/password request
+type PasswordChange struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// PasswordResetRequest is the body of POST /api/user/password/reset request
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+// PasswordResetConfirm is the body of POST /api/user/password/reset/confirm
+// request, Token is the one delivered to the user
+type PasswordResetConfirm struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// PasswordReset is kept by the hash of the token only, the token is used
+// once and is valid until ExpiresAt
+type PasswordReset struct {
+	Hash      string
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// ReadPasswordChangeFromBody checks the new password against the policy
+func ReadPasswordChangeFromBody(r io.Reader, policy *PasswordPolicy) (*PasswordChange, error) {
+	req := &PasswordChange{}
+	if err := decodeStrict(r, req); err != nil {
+		return nil, err
+	}
+
+	req.OldPassword = strings.TrimSpace(req.OldPassword)
+	req.NewPassword = strings.TrimSpace(req.NewPassword)
+	if req.OldPassword == "" || req.NewPassword == "" {
+		return nil, errors.New("bad request: old and/or new password cannot be empty")
+	}
+	if err := policy.Check(req.NewPassword); err != nil {
+		return nil, errors.New("bad request: " + err.Error())
+	}
+
+	return req, nil
+}
+
+func ReadPasswordResetRequestFromBody(r io.Reader) (*PasswordResetRequest, error) {
+	req := &PasswordResetRequest{}
+	if err := decodeStrict(r, req); err != nil {
+		return nil, err
+	}
+
+	req.Login = strings.TrimSpace(req.Login)
+	if req.Login == "" {
+		return nil, errors.New("bad request: login cannot be empty")
+	}
+
+	return req, nil
+}
+
+// ReadPasswordResetConfirmFromBody checks the new password against the policy
+func ReadPasswordResetConfirmFromBody(r io.Reader, policy *PasswordPolicy) (*PasswordResetConfirm, error) {
+	req := &PasswordResetConfirm{}
+	if err := decodeStrict(r, req); err != nil {
+		return nil, err
+	}
+
+	req.Token = strings.TrimSpace(req.Token)
+	req.NewPassword = strings.TrimSpace(req.NewPassword)
+	if req.Token == "" || req.NewPassword == "" {
+		return nil, errors.New("bad request: token and/or new password cannot be empty")
+	}
+	if err := policy.Check(req.NewPassword); err != nil {
+		return nil, errors.New("bad request: " + err.Error())
+	}
+
+	return req, nil
+}
+
+func decodeStrict(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return errors.New("Bad request: " + err.Error())
+	}
+	return nil
+}
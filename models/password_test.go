@@ -0,0 +1,63 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := &PasswordPolicy{
+		MinLength:        8,
+		RequireMixedCase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"ok", "Secret-42", false},
+		{"too short", "Sec-42", true},
+		// length is counted in characters
+		{"multibyte", "Пароль-42", false},
+		{"lower case only", "secret-42", true},
+		{"upper case only", "SECRET-42", true},
+		{"no digit", "Secret-forty-two", true},
+		{"no symbol", "Secret42", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.password)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	// nil policy accepts anything
+	var none *PasswordPolicy
+	assert.NoError(t, none.Check("a"))
+}
+
+func TestReadUserFromBody_PasswordPolicy(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 8}
+
+	_, err := ReadUserFromBody(strings.NewReader(`{"login": "user", "password": "abcdef"}`), policy)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "at least 8 characters")
+
+	user, err := ReadUserFromBody(strings.NewReader(`{"login": " user ", "password": "abcdef"}`), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "user", user.Login)
+
+	_, err = ReadUserFromBody(strings.NewReader(`{"login": "user", "password": " "}`), nil)
+	assert.Error(t, err)
+}
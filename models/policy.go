@@ -0,0 +1,95 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Withdrawal policy rules, the machine-readable codes of the violations
+const (
+	PolicyMinSum        = "WITHDRAWAL_BELOW_MIN"
+	PolicyMaxSum        = "WITHDRAWAL_ABOVE_MAX"
+	PolicyDailyLimit    = "DAILY_LIMIT_EXCEEDED"
+	PolicyMonthlyLimit  = "MONTHLY_LIMIT_EXCEEDED"
+	PolicyMinAccountAge = "ACCOUNT_TOO_NEW"
+	PolicyCooldown      = "WITHDRAWAL_COOLDOWN"
+)
+
+// Withdrawal limits are counted over the sliding windows
+const (
+	PolicyDay   = 24 * time.Hour
+	PolicyMonth = 30 * 24 * time.Hour
+)
+
+// WithdrawalPolicy restricts the withdrawals, zero value of a field
+// means no restriction; holds are checked when created, and the points
+// held count towards the limits and the cooldown as well
+type WithdrawalPolicy struct {
+	MinSum        Money
+	MaxSum        Money
+	DailyLimit    Money
+	MonthlyLimit  Money
+	MinAccountAge time.Duration
+	Cooldown      time.Duration
+}
+
+// WithdrawalHistory is the part of the user history the policy is checked
+// against; reversed withdrawals are not counted, active holds are counted
+// as of their creation
+type WithdrawalHistory struct {
+	RegisteredAt     time.Time
+	LastWithdrawalAt time.Time // zero if there are none
+	Day              Money     // withdrawn within PolicyDay
+	Month            Money     // withdrawn within PolicyMonth
+}
+
+// PolicyViolation is returned when a withdrawal breaks the policy,
+// RetryAfter is set if the withdrawal may succeed later
+type PolicyViolation struct {
+	Rule       string
+	msg        string
+	RetryAfter time.Duration
+}
+
+func (pv *PolicyViolation) Error() string {
+	return pv.msg
+}
+
+// Check returns *PolicyViolation if the user can not withdraw sum now,
+// it is safe to call on nil policy
+func (p *WithdrawalPolicy) Check(sum Money, h WithdrawalHistory, now time.Time) error {
+	if p == nil {
+		return nil
+	}
+
+	switch {
+	case p.MinSum > 0 && sum < p.MinSum:
+		return &PolicyViolation{Rule: PolicyMinSum, msg: fmt.Sprintf("withdrawal must not be less than %s", points(p.MinSum))}
+	case p.MaxSum > 0 && sum > p.MaxSum:
+		return &PolicyViolation{Rule: PolicyMaxSum, msg: fmt.Sprintf("withdrawal must not be more than %s", points(p.MaxSum))}
+	}
+
+	if age := now.Sub(h.RegisteredAt); p.MinAccountAge > 0 && age < p.MinAccountAge {
+		return &PolicyViolation{Rule: PolicyMinAccountAge, msg: "account is too new to withdraw",
+			RetryAfter: p.MinAccountAge - age}
+	}
+	if since := now.Sub(h.LastWithdrawalAt); p.Cooldown > 0 && !h.LastWithdrawalAt.IsZero() && since < p.Cooldown {
+		return &PolicyViolation{Rule: PolicyCooldown, msg: "too soon after the previous withdrawal",
+			RetryAfter: p.Cooldown - since}
+	}
+
+	switch {
+	case p.DailyLimit > 0 && h.Day+sum > p.DailyLimit:
+		return &PolicyViolation{Rule: PolicyDailyLimit, msg: fmt.Sprintf("daily withdrawal limit of %s exceeded", points(p.DailyLimit))}
+	case p.MonthlyLimit > 0 && h.Month+sum > p.MonthlyLimit:
+		return &PolicyViolation{Rule: PolicyMonthlyLimit, msg: fmt.Sprintf("monthly withdrawal limit of %s exceeded", points(p.MonthlyLimit))}
+	}
+
+	return nil
+}
+
+// points formats the amount the way the API does, e.g. 12.5
+func points(a Money) string {
+	b, _ := a.MarshalJSON()
+	return string(b)
+}
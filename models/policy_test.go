@@ -0,0 +1,55 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithdrawalPolicyCheck(t *testing.T) {
+	now := time.Now()
+	policy := &WithdrawalPolicy{
+		MinSum:        100,
+		MaxSum:        10000,
+		DailyLimit:    15000,
+		MonthlyLimit:  50000,
+		MinAccountAge: 24 * time.Hour,
+		Cooldown:      time.Hour,
+	}
+	old := WithdrawalHistory{RegisteredAt: now.Add(-48 * time.Hour)}
+
+	tests := []struct {
+		name       string
+		sum        Money
+		history    WithdrawalHistory
+		wantRule   string
+		retryAfter time.Duration
+	}{
+		{"ok", 5000, old, "", 0},
+		{"below min", 99, old, PolicyMinSum, 0},
+		{"above max", 10001, old, PolicyMaxSum, 0},
+		{"new account", 5000, WithdrawalHistory{RegisteredAt: now.Add(-23 * time.Hour)}, PolicyMinAccountAge, time.Hour},
+		{"cooldown", 5000, WithdrawalHistory{RegisteredAt: old.RegisteredAt, LastWithdrawalAt: now.Add(-time.Minute)}, PolicyCooldown, 59 * time.Minute},
+		{"daily limit", 5001, WithdrawalHistory{RegisteredAt: old.RegisteredAt, Day: 10000, Month: 10000}, PolicyDailyLimit, 0},
+		{"monthly limit", 5001, WithdrawalHistory{RegisteredAt: old.RegisteredAt, Month: 45000}, PolicyMonthlyLimit, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.sum, tt.history, now)
+			if tt.wantRule == "" {
+				require.NoError(t, err)
+				return
+			}
+			var violation *PolicyViolation
+			require.ErrorAs(t, err, &violation)
+			assert.Equal(t, tt.wantRule, violation.Rule)
+			assert.Equal(t, tt.retryAfter, violation.RetryAfter)
+		})
+	}
+
+	var noPolicy *WithdrawalPolicy
+	assert.NoError(t, noPolicy.Check(1, WithdrawalHistory{}, now))
+}
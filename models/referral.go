@@ -0,0 +1,62 @@
+package models
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+)
+
+// Referral statuses
+const (
+	// ReferralPending waits for the first processed order of the referee
+	ReferralPending = "PENDING"
+	// ReferralRewarded means the referrer has got the bonus
+	ReferralRewarded = "REWARDED"
+	// ReferralIneligible means the first processed order of the referee
+	// brought the referrer nothing: its accrual was too low or the referrer
+	// had been rewarded the maximum number of times already
+	ReferralIneligible = "INELIGIBLE"
+)
+
+// referralCodeAlphabet avoids the characters easily confused with each other
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const referralCodeLen = 10
+
+// ReferralProgram defines the bonuses the referrer and the referee get once
+// the first order of the referee is processed with at least MinAccrual
+// points; a referrer is rewarded at most MaxRewards times, 0 means no limit
+type ReferralProgram struct {
+	ReferrerBonus Money
+	RefereeBonus  Money
+	MinAccrual    Money
+	MaxRewards    int
+}
+
+// ReferralInfo describes a user invited by the referrer
+type ReferralInfo struct {
+	Login      string     `json:"login"`
+	Status     string     `json:"status"`
+	Bonus      Money      `json:"bonus"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RewardedAt *time.Time `json:"rewarded_at,omitempty"`
+}
+
+// Referrals is the response to GET /api/user/referrals
+type Referrals struct {
+	Code      string          `json:"code"`
+	Referrals []*ReferralInfo `json:"referrals"`
+}
+
+// NewReferralCode returns a random referral code
+func NewReferralCode() (string, error) {
+	b := make([]byte, referralCodeLen)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	// the alphabet length divides 256, so every character is equally likely
+	for i := range b {
+		b[i] = referralCodeAlphabet[int(b[i])%len(referralCodeAlphabet)]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+const sessionIDBytes = 32
+
+// Session is a login of the user, the user cookie and the bearer tokens
+// refer to it by ID; the session lasts until ExpiresAt unless revoked
+// by logging out, refreshing the tokens moves ExpiresAt forward
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"-"`
+	Login      string     `json:"-"`
+	UserAgent  string     `json:"device"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+	// Current marks the session the request is made in
+	Current bool `json:"current"`
+}
+
+// Active reports whether the session is neither revoked nor expired
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// NewSessionID returns a random session ID
+func NewSessionID() (string, error) {
+	b := make([]byte, sessionIDBytes)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RefreshToken is kept by its hash only. Refresh tokens of a session make
+// a family: a token is used once to get the next one, and if a used token
+// is presented again the session is revoked, so the family is no longer
+// valid whoever holds it
+type RefreshToken struct {
+	Hash      string
+	SessionID string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tier bases, the value a user's tier is computed from
+const (
+	// TierBasisLifetime is the sum of points ever accrued to the user
+	TierBasisLifetime = "lifetime"
+	// TierBasisSpend is the sum of points withdrawn within the program window
+	TierBasisSpend = "spend"
+)
+
+// Tier is reached once the basis value gets to Threshold, the points
+// accrued to the users of the tier are multiplied by Multiplier
+type Tier struct {
+	Name       string
+	Threshold  Money
+	Multiplier float64
+}
+
+// TierProgram lists the tiers in ascending order of their thresholds
+type TierProgram struct {
+	Basis  string
+	Window time.Duration
+	Tiers  []Tier
+}
+
+// TierChange records the user moving from one tier to another
+type TierChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// ParseTierProgram parses the tiers given as comma separated
+// NAME:THRESHOLD:MULTIPLIER triples, e.g. "Bronze:0:1,Silver:1000:1.25";
+// thresholds are in points. Empty spec means there are no tiers and
+// the function returns nil program
+func ParseTierProgram(spec, basis string, window time.Duration) (*TierProgram, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	switch {
+	case basis != TierBasisLifetime && basis != TierBasisSpend:
+		return nil, fmt.Errorf("tier basis must be %s or %s", TierBasisLifetime, TierBasisSpend)
+	case basis == TierBasisSpend && window <= 0:
+		return nil, errors.New("tier window must be positive")
+	}
+
+	p := &TierProgram{Basis: basis, Window: window}
+	names := make(map[string]bool)
+	for _, s := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(s), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("tier %q: NAME:THRESHOLD:MULTIPLIER expected", s)
+		}
+		if names[parts[0]] {
+			return nil, fmt.Errorf("tier %q: duplicate name", s)
+		}
+		names[parts[0]] = true
+
+		var threshold Money
+		if err := threshold.UnmarshalJSON([]byte(parts[1])); err != nil || threshold < 0 {
+			return nil, fmt.Errorf("tier %q: wrong threshold", s)
+		}
+		multiplier, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || multiplier <= 0 {
+			return nil, fmt.Errorf("tier %q: wrong multiplier", s)
+		}
+		p.Tiers = append(p.Tiers, Tier{Name: parts[0], Threshold: threshold, Multiplier: multiplier})
+	}
+	sort.SliceStable(p.Tiers, func(i, j int) bool {
+		return p.Tiers[i].Threshold < p.Tiers[j].Threshold
+	})
+
+	return p, nil
+}
+
+// TierFor returns the highest tier the value reaches; a tier with no name
+// and no bonus is returned if the value reaches none of them
+func (p *TierProgram) TierFor(value Money) Tier {
+	tier := Tier{Multiplier: 1}
+	if p == nil {
+		return tier
+	}
+	for _, t := range p.Tiers {
+		if value < t.Threshold {
+			break
+		}
+		tier = t
+	}
+	return tier
+}
+
+// Apply multiplies the points accrued by the tier multiplier
+func (t Tier) Apply(accrual Money) Money {
+	return Money(math.Round(float64(accrual) * t.Multiplier))
+}
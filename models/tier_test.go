@@ -0,0 +1,50 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTierProgram(t *testing.T) {
+	p, err := ParseTierProgram("", TierBasisLifetime, 0)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+	assert.Equal(t, Tier{Multiplier: 1}, p.TierFor(100000))
+
+	p, err = ParseTierProgram("Gold:5000:1.5, Bronze:0:1,Silver:1000.5:1.25", TierBasisLifetime, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []Tier{
+		{Name: "Bronze", Threshold: 0, Multiplier: 1},
+		{Name: "Silver", Threshold: 100050, Multiplier: 1.25},
+		{Name: "Gold", Threshold: 500000, Multiplier: 1.5},
+	}, p.Tiers)
+	assert.Equal(t, "Bronze", p.TierFor(100049).Name)
+	assert.Equal(t, "Silver", p.TierFor(100050).Name)
+	assert.Equal(t, "Gold", p.TierFor(1000000).Name)
+
+	wrong := []struct {
+		spec   string
+		basis  string
+		window time.Duration
+	}{
+		{"Bronze:0", TierBasisLifetime, 0},
+		{"Bronze:0:1,Bronze:10:2", TierBasisLifetime, 0},
+		{"Bronze:-1:1", TierBasisLifetime, 0},
+		{"Bronze:0:0", TierBasisLifetime, 0},
+		{"Bronze:0:1", "orders", 0},
+		{"Bronze:0:1", TierBasisSpend, 0},
+	}
+	for _, tt := range wrong {
+		_, err := ParseTierProgram(tt.spec, tt.basis, tt.window)
+		assert.Error(t, err, tt.spec)
+	}
+}
+
+func TestTierApply(t *testing.T) {
+	assert.Equal(t, Money(1000), Tier{Multiplier: 1}.Apply(1000))
+	assert.Equal(t, Money(1250), Tier{Multiplier: 1.25}.Apply(1000))
+	assert.Equal(t, Money(13), Tier{Multiplier: 1.25}.Apply(10))
+}
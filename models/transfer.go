@@ -0,0 +1,47 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// Transfer directions as seen by the user
+const (
+	TransferOut = "OUT"
+	TransferIn  = "IN"
+)
+
+// TransferRequest gifts Sum points to the user with Login
+type TransferRequest struct {
+	Login string `json:"login"`
+	Sum   Money  `json:"sum"`
+}
+
+// TransferInfo is a transfer sent to or received from the user with Login
+type TransferInfo struct {
+	Direction   string    `json:"direction"`
+	Login       string    `json:"login"`
+	Sum         Money     `json:"sum"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+func ReadTransferRequestFromBody(r io.Reader) (*TransferRequest, error) {
+	req := &TransferRequest{}
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(req); err != nil {
+		return nil, errors.New("Bad request: " + err.Error())
+	}
+
+	return req, nil
+}
+
+func (req *TransferRequest) Validate() bool {
+	req.Login = strings.TrimSpace(req.Login)
+	return req.Login != "" && req.Sum > 0
+}
@@ -5,27 +5,52 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"time"
 )
 
+// User is registered with an optional ReferredBy, the referral code of
+// the user who invited them; ReferralCode is the own code of the user
 type User struct {
-	Login    string `json:"login"`
-	Password string `json:"password"`
-	Hash     string `json:"-"`
-	ID       int    `json:"-"`
+	Login        string `json:"login"`
+	Password     string `json:"password"`
+	ReferredBy   string `json:"referral_code,omitempty"`
+	Hash         string `json:"-"`
+	ID           int    `json:"-"`
+	ReferralCode string `json:"-"`
 }
 
+// UserAuth is what the user cookie and the bearer tokens carry,
+// SessionID refers to the login session they were issued for
 type UserAuth struct {
-	Login string `json:"login"`
-	ID    int    `json:"id"`
+	Login     string `json:"login"`
+	ID        int    `json:"id"`
+	SessionID string `json:"sid,omitempty"`
 }
 
-func (u *User) Validate() bool {
+// Token is the response to successful login, registration or refresh, the
+// access token is to be sent back in Authorization: Bearer header; once it
+// expires the refresh token gets the next pair of tokens
+type Token struct {
+	AccessToken      string    `json:"access_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// Validate checks the password against the policy, nil policy accepts
+// any password which is not empty, e.g. on login
+func (u *User) Validate(policy *PasswordPolicy) error {
 	u.Login = strings.TrimSpace(u.Login)
 	u.Password = strings.TrimSpace(u.Password)
-	return u.Login != "" && u.Password != ""
+	u.ReferredBy = strings.ToUpper(strings.TrimSpace(u.ReferredBy))
+	if u.Login == "" || u.Password == "" {
+		return errors.New("login and/or password cannot be empty")
+	}
+	return policy.Check(u.Password)
 }
 
-func ReadUserFromBody(r io.Reader) (*User, error) {
+func ReadUserFromBody(r io.Reader, policy *PasswordPolicy) (*User, error) {
 	user := &User{}
 
 	dec := json.NewDecoder(r)
@@ -35,9 +60,30 @@ func ReadUserFromBody(r io.Reader) (*User, error) {
 		return nil, errors.New("Bad request: " + err.Error())
 	}
 
-	if !user.Validate() {
-		return nil, errors.New("bad request: login and/or password cannot be empty")
+	if err := user.Validate(policy); err != nil {
+		return nil, errors.New("bad request: " + err.Error())
 	}
 
 	return user, nil
 }
+
+// RefreshRequest is the body of POST /api/user/token/refresh request
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// ReadRefreshRequestFromBody accepts an empty body as well, then the
+// refresh token is expected in the cookie
+func ReadRefreshRequestFromBody(r io.Reader) (*RefreshRequest, error) {
+	req := &RefreshRequest{}
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(req); err != nil && err != io.EOF {
+		return nil, errors.New("Bad request: " + err.Error())
+	}
+	req.RefreshToken = strings.TrimSpace(req.RefreshToken)
+
+	return req, nil
+}
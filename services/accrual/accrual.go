@@ -2,6 +2,9 @@ package accrual
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
 	"sync"
 	"time"
 
@@ -10,81 +13,321 @@ import (
 	"github.com/sbxb/loyalty/storage"
 )
 
-type Job struct {
-	orderNumber string
-	status      string
-}
-
-// Code below is not finished and not used anywhere !!!
+// accrual system status which is not a part of our order status set
+const statusRegistered = "REGISTERED"
 
 const (
-	QueueLength = 500 // Should not be less than 5
-	AddTimeout  = 100 * time.Millisecond
+	QueueLength = 20 // Jobs waiting in the queue are leased, keep it short
+
+	maxWorkers    = 2
+	restartDelay  = 1 * time.Second
+	pollInterval  = 1 * time.Second
+	leaseDuration = 1 * time.Minute
+	// used for storage calls made after ctx has been cancelled
+	shutdownTimeout = 3 * time.Second
 )
 
+// AccrualService polls the accrual system in the background until every
+// order it knows about reaches one of the final states (INVALID or PROCESSED).
+// Orders waiting for the accrual system are kept in the storage as jobs, the
+// service leases the due ones, so several instances of the application can
+// share the work and nothing is lost if the application crashes
 type AccrualService struct {
-	store          storage.Storage
-	address        string
-	newJobQueue    chan Job
-	updateJobQueue chan Job
+	store       storage.Storage
+	fetcher     Fetcher
+	policy      RetryPolicy
+	workerID    string
+	newJobQueue chan *models.AccrualJob
+	wakeup      chan struct{}
+}
+
+// Fetcher gets the results of accrual calculation for orders, it is either
+// a client of the remote accrual system or a local engine
+type Fetcher interface {
+	GetAccrual(ctx context.Context, orderNumber string) (*models.AccrualResponse, error)
 }
 
-func NewAccrualService(st storage.Storage, address string) *AccrualService {
+func NewAccrualService(st storage.Storage, fetcher Fetcher, policy RetryPolicy) *AccrualService {
 	logger.Info("Accrual Service : created")
 
 	return &AccrualService{
-		store:          st,
-		newJobQueue:    make(chan Job, QueueLength),
-		updateJobQueue: make(chan Job, QueueLength),
-		address:        address,
+		store:       st,
+		fetcher:     fetcher,
+		policy:      policy,
+		workerID:    newWorkerID(),
+		newJobQueue: make(chan *models.AccrualJob, QueueLength),
+		wakeup:      make(chan struct{}, 1),
 	}
 }
 
-func (as *AccrualService) AddOrderNumber(orderNumber string) {
-	job := Job{
-		orderNumber: orderNumber,
-		status:      models.OrderStatusNew,
+// Status describes the state of the accrual system as seen by the service
+type Status struct {
+	Source      string         `json:"source"`
+	Breaker     *BreakerStatus `json:"breaker,omitempty"`
+	PausedUntil *time.Time     `json:"paused_until,omitempty"`
+}
+
+func (as *AccrualService) Status() Status {
+	client, ok := as.fetcher.(*AccrualClient)
+	if !ok {
+		return Status{Source: "local"}
 	}
 
-	select {
-	case as.newJobQueue <- job:
-		logger.Infof("Accrual Service : job %v added", job)
-		return
-	case <-time.After(AddTimeout):
-		logger.Infof("Accrual Service : job %v can not be added", job)
-		return
+	breaker := client.Breaker().Status()
+	status := Status{
+		Source:  "remote",
+		Breaker: &breaker,
+	}
+	if pausedUntil := client.PausedUntil(); time.Now().Before(pausedUntil) {
+		status.PausedUntil = &pausedUntil
+	}
+
+	return status
+}
+
+// newWorkerID returns an identifier the jobs are leased under, it has
+// to be unique among all the running instances of the application
+func newWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
 	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
 }
 
-func (as *AccrualService) PrepareNewJobQueue() {
-	limit := QueueLength / 10 * 8
-	if limit == 0 {
-		limit = QueueLength - 2
+// AddOrderNumber tells the service that a new order has been stored, so
+// the service does not wait for the next poll to pick it up
+func (as *AccrualService) AddOrderNumber(orderNumber string) {
+	logger.Debugf("Accrual Service : order %s added", orderNumber)
+	select {
+	case as.wakeup <- struct{}{}:
+	default:
+		// a wakeup is already pending
 	}
-	orders, err := as.store.GetUnprocessedOrders(context.TODO(), limit)
-	// TODO to be continued
-	_ = orders
-	_ = err
 }
 
-func (as *AccrualService) ProcessNewJobQueue() {
-	const maxWorkers = 2
+// Run starts the workers and blocks until ctx is cancelled and all
+// the workers have stopped. Jobs are leased from the storage on every
+// poll as long as there is room in the queue
+func (as *AccrualService) Run(ctx context.Context) {
+	logger.Infof("Accrual Service : queue processing started by %s", as.workerID)
 
 	var wg sync.WaitGroup
-	logger.Info("Accrual Service: Queue processing started")
-	d := time.Now().Add(8 * time.Second)                         // dev & debug only
-	ctx, cancel := context.WithDeadline(context.Background(), d) // dev & debug only
-	defer cancel()
-
 	for i := 0; i < maxWorkers; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			logger.Infof("Accrual Service: Client goroutines #%d started", i)
-			client, _ := NewAccrualClient(as.address)
-			client.DoWork(ctx, as.newJobQueue)
+			as.superviseWorker(ctx, i)
 		}(i)
 	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		as.dispatch(ctx)
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-as.wakeup:
+		case <-ticker.C:
+		}
+	}
+
 	wg.Wait()
-	logger.Info("Accrual Service: Queue processing stopped")
+	as.releaseQueued()
+	logger.Info("Accrual Service : queue processing stopped")
+}
+
+// dispatch leases as many due jobs as the queue can take
+func (as *AccrualService) dispatch(ctx context.Context) {
+	free := cap(as.newJobQueue) - len(as.newJobQueue)
+	if free == 0 || ctx.Err() != nil {
+		return
+	}
+	if client, ok := as.fetcher.(*AccrualClient); ok {
+		// do not lease jobs while the accrual system asks us to back off
+		if time.Now().Before(client.PausedUntil()) {
+			return
+		}
+		switch client.Breaker().State() {
+		case BreakerOpen:
+			return
+		case BreakerHalfOpen:
+			// a single job is enough to probe the accrual system
+			free = 1
+		}
+	}
+
+	jobs, err := as.store.AcquireAccrualJobs(ctx, as.workerID, free, leaseDuration)
+	if err != nil {
+		logger.Errorf("Accrual Service : failed to acquire jobs: %v", err)
+		return
+	}
+
+	// dispatch is the only sender, so there is always room for the jobs
+	for _, job := range jobs {
+		logger.Debugf("Accrual Service : job %v leased", *job)
+		as.newJobQueue <- job
+	}
+}
+
+// releaseQueued gives the jobs left in the queue back to the storage,
+// so they can be taken by other instances without waiting for the lease
+func (as *AccrualService) releaseQueued() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case job := <-as.newJobQueue:
+			if err := as.store.ReleaseAccrualJob(ctx, job, as.workerID); err != nil {
+				logger.Warningf("Accrual Service : job %v: failed to release: %v", *job, err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// superviseWorker restarts the worker if it panics until ctx is cancelled
+func (as *AccrualService) superviseWorker(ctx context.Context, i int) {
+	for {
+		err := as.runWorker(ctx, i)
+		if err == nil {
+			return
+		}
+		logger.Errorf("Accrual Service : worker #%d crashed: %v", i, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+			logger.Infof("Accrual Service : worker #%d restarting", i)
+		}
+	}
+}
+
+func (as *AccrualService) runWorker(ctx context.Context, i int) (err error) {
+	var job *models.AccrualJob
+	defer func() {
+		if r := recover(); r != nil {
+			// the job stays leased until the lease expires
+			err = fmt.Errorf("panic while processing job %v: %v", job, r)
+		}
+	}()
+
+	logger.Debugf("Accrual Service : worker #%d started", i)
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debugf("Accrual Service : worker #%d stopped", i)
+			return nil
+		case job = <-as.newJobQueue:
+			as.processJob(ctx, job)
+		}
+	}
+}
+
+// processJob polls the accrual system once and either stores the final
+// result or schedules another try
+func (as *AccrualService) processJob(ctx context.Context, job *models.AccrualJob) {
+	ar, err := as.fetcher.GetAccrual(ctx, job.OrderNumber)
+	if err != nil {
+		var rlErr *RateLimitError
+		var coErr *CircuitOpenError
+		switch {
+		case ctx.Err() != nil:
+			// shutting down, give the job back as it is
+			as.release(job)
+			return
+		case errors.As(err, &rlErr):
+			// not the order's fault, so the attempt is not counted
+			logger.Infof("Accrual Service : job %v: %v", *job, err)
+			job.NextAttemptAt = rlErr.Until
+			job.LastError = err.Error()
+			as.release(job)
+			return
+		case errors.As(err, &coErr):
+			// the accrual system is down, the attempt is not counted either
+			logger.Debugf("Accrual Service : job %v: %v", *job, err)
+			job.NextAttemptAt = coErr.Until
+			as.release(job)
+			return
+		case errors.Is(err, ErrNoContent):
+			logger.Infof("Accrual Service : job %v: order is not registered in the accrual system yet", *job)
+		default:
+			logger.Warningf("Accrual Service : job %v: %v", *job, err)
+		}
+		as.retryLater(job, err.Error())
+		return
+	}
+
+	logger.Debugf("Accrual Service : job %v: got response %v", *job, ar)
+	switch ar.Status {
+	case statusRegistered:
+		as.retryLater(job, "order is registered, but not processed yet")
+	case models.OrderStatusProcessing:
+		if job.OrderStatus != models.OrderStatusProcessing {
+			if err := as.store.UpdateOrderStatus(ctx, ar); err != nil {
+				logger.Warningf("Accrual Service : job %v: store failed to change the order status: %v", *job, err)
+			}
+		}
+		as.retryLater(job, "order is being processed")
+	case models.OrderStatusInvalid:
+		if err := as.store.UpdateOrderStatus(ctx, ar); err != nil {
+			logger.Warningf("Accrual Service : job %v: store failed to change the order status: %v", *job, err)
+			as.retryLater(job, err.Error())
+			return
+		}
+		as.complete(job)
+	case models.OrderStatusProcessed:
+		if err := as.store.ProcessOrder(ctx, ar); err != nil {
+			logger.Warningf("Accrual Service : job %v: store failed to process the order: %v", *job, err)
+			as.retryLater(job, err.Error())
+			return
+		}
+		as.complete(job)
+	default:
+		logger.Warningf("Accrual Service : job %v: unknown status %q", *job, ar.Status)
+		as.retryLater(job, "unknown status "+ar.Status)
+	}
+}
+
+// retryLater counts the failed attempt and gives the job back to the
+// storage to be tried again after the delay defined by the retry policy,
+// or marks the job as given up if the policy limits have been reached
+func (as *AccrualService) retryLater(job *models.AccrualJob, reason string) {
+	now := time.Now()
+	job.Attempts++
+	job.LastError = reason
+
+	if as.policy.GiveUp(job, now) {
+		job.GaveUp = true
+		logger.Errorf("Accrual Service : job %v: giving up after %d attempts", *job, job.Attempts)
+	} else {
+		job.NextAttemptAt = now.Add(as.policy.Delay(job.Attempts))
+	}
+	as.release(job)
+}
+
+func (as *AccrualService) release(job *models.AccrualJob) {
+	// the job has to be released even if the service is shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := as.store.ReleaseAccrualJob(ctx, job, as.workerID); err != nil {
+		logger.Warningf("Accrual Service : job %v: failed to release: %v", *job, err)
+	}
+}
+
+func (as *AccrualService) complete(job *models.AccrualJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// the order is final already, a job left behind is harmless as
+	// storing the final result again changes nothing
+	if err := as.store.CompleteAccrualJob(ctx, job.OrderNumber); err != nil {
+		logger.Warningf("Accrual Service : job %v: failed to complete: %v", *job, err)
+	}
 }
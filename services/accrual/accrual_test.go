@@ -1,25 +1,199 @@
 package accrual
 
 import (
+	"context"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/accrual/accrualtest"
+	"github.com/sbxb/loyalty/storage"
 	"github.com/sbxb/loyalty/storage/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestSmth(t *testing.T) {
-	t.Skip()
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+func TestRunOrdersBatch(t *testing.T) {
+	fake := accrualtest.NewFake()
+	fake.Script("1149", accrualtest.Registered(), accrualtest.Processed(42000))
+	fake.Script("2238", accrualtest.Invalid())
+	fake.Script("3327", accrualtest.TooManyRequests("1"), accrualtest.Processed(100))
+	fake.Script("4416", accrualtest.NoContent(), accrualtest.Processing(), accrualtest.Processed(0))
+	fake.Script("5512", accrualtest.InternalError(), accrualtest.Processed(500).After(100*time.Millisecond))
+	srv := accrualtest.NewServer(fake)
+	defer srv.Close()
 
-	accrual := NewAccrualService(store, "http://localhost:8888")
-	//numbers := []string{"1149", "1156", "1172", "2238", "2253", "2279", "3327", "3376", "3384", "4416", "4457", "4481", "5512", "5538", "5587"}
-	numbers := []string{"1149", "2238", "3327", "4416", "5512"}
-	//numbers := []string{"1149", "2238"}
+	store := newRecordingStore()
+	client, _ := NewAccrualClient(srv.URL, testBreaker)
+	as := NewAccrualService(store, client, testPolicy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	go func() {
-		for _, n := range numbers {
-			time.Sleep(100 * time.Millisecond)
-			accrual.AddOrderNumber(n)
+		as.Run(ctx)
+		close(done)
+	}()
+
+	want := map[string]string{
+		"1149": models.OrderStatusProcessed,
+		"2238": models.OrderStatusInvalid,
+		"3327": models.OrderStatusProcessed,
+		"4416": models.OrderStatusProcessed,
+		"5512": models.OrderStatusProcessed,
+	}
+	for n := range want {
+		err := store.AddOrder(ctx, &models.Order{Number: n, Status: models.OrderStatusNew}, 1)
+		require.NoError(t, err)
+		as.AddOrderNumber(n)
+	}
+
+	require.Eventually(t, func() bool {
+		for n, status := range want {
+			if store.status(n) != status {
+				return false
+			}
 		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	cancel()
+	<-done
+
+	assert.Equal(t, models.Money(42000), store.processed["1149"])
+	assert.Equal(t, models.Money(100), store.processed["3327"])
+	assert.Equal(t, models.Money(500), store.processed["5512"])
+}
+
+var testPolicy = RetryPolicy{
+	InitialDelay: 100 * time.Millisecond,
+	Multiplier:   2,
+	MaxDelay:     time.Second,
+}
+
+var testBreaker = BreakerSettings{
+	FailureThreshold: 5,
+	OpenTimeout:      time.Second,
+	SuccessThreshold: 1,
+}
+
+// recordingStore remembers final results passed to the storage
+type recordingStore struct {
+	*inmemory.MapStorage
+
+	mu        sync.Mutex
+	statuses  map[string]string
+	processed map[string]models.Money
+}
+
+func newRecordingStore() *recordingStore {
+	mapStore, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+	return &recordingStore{
+		MapStorage: mapStore,
+		statuses:   map[string]string{},
+		processed:  map[string]models.Money{},
+	}
+}
+
+func (rs *recordingStore) UpdateOrderStatus(ctx context.Context, ar *models.AccrualResponse) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.statuses[ar.OrderNumber] = ar.Status
+	return nil
+}
+
+func (rs *recordingStore) ProcessOrder(ctx context.Context, ar *models.AccrualResponse) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.statuses[ar.OrderNumber] = ar.Status
+	rs.processed[ar.OrderNumber] += ar.Accrual
+	return nil
+}
+
+func (rs *recordingStore) status(number string) string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.statuses[number]
+}
+
+func TestRunPollsUntilFinalStatus(t *testing.T) {
+	fake := accrualtest.NewFake()
+	fake.Script("1149", accrualtest.Registered(), accrualtest.Processing(), accrualtest.Processed(500))
+	fake.Script("2238", accrualtest.Invalid())
+	srv := accrualtest.NewServer(fake)
+	defer srv.Close()
+
+	store := newRecordingStore()
+	client, _ := NewAccrualClient(srv.URL, testBreaker)
+	as := NewAccrualService(store, client, testPolicy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		as.Run(ctx)
+		close(done)
 	}()
-	accrual.ProcessNewJobQueue()
+
+	for _, n := range []string{"1149", "2238"} {
+		err := store.AddOrder(ctx, &models.Order{Number: n, Status: models.OrderStatusNew}, 1)
+		require.NoError(t, err)
+		as.AddOrderNumber(n)
+	}
+
+	require.Eventually(t, func() bool {
+		return store.status("1149") == models.OrderStatusProcessed &&
+			store.status("2238") == models.OrderStatusInvalid
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	<-done
+
+	assert.Equal(t, models.Money(500), store.processed["1149"])
+	assert.Equal(t, 3, fake.Hits("1149"))
+	assert.Equal(t, 1, fake.Hits("2238"))
+
+	// both jobs are completed
+	jobs, err := store.AcquireAccrualJobs(context.Background(), "test", 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+}
+
+func TestRunGivesUp(t *testing.T) {
+	fake := accrualtest.NewFake()
+	srv := accrualtest.NewServer(fake)
+	defer srv.Close()
+
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+
+	policy := testPolicy
+	policy.InitialDelay = time.Millisecond
+	policy.MaxAttempts = 2
+	client, _ := NewAccrualClient(srv.URL, testBreaker)
+	as := NewAccrualService(store, client, policy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		as.Run(ctx)
+		close(done)
+	}()
+
+	err := store.AddOrder(ctx, &models.Order{Number: "1149", Status: models.OrderStatusNew}, 1)
+	require.NoError(t, err)
+	as.AddOrderNumber("1149")
+
+	require.Eventually(t, func() bool {
+		return fake.Hits("1149") == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// give the service a chance to poll once more, it must not
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, 2, fake.Hits("1149"))
+
+	jobs, err := store.AcquireAccrualJobs(context.Background(), "test", 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
 }
@@ -0,0 +1,228 @@
+// Package accrualtest provides a fake accrual system for tests and local
+// development. Every order is answered according to its script: a list of
+// steps, one step per request, the last step being repeated forever
+package accrualtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+// accrual system statuses
+const (
+	StatusRegistered = "REGISTERED"
+	StatusProcessing = models.OrderStatusProcessing
+	StatusProcessed  = models.OrderStatusProcessed
+	StatusInvalid    = models.OrderStatusInvalid
+)
+
+// Step defines the response to a single request. Code other than 200 is
+// sent with an empty body (or a text message for 429)
+type Step struct {
+	Code       int           `json:"code,omitempty"`
+	Status     string        `json:"status,omitempty"`
+	Accrual    models.Money  `json:"accrual,omitempty"`
+	RetryAfter string        `json:"retry_after,omitempty"`
+	Delay      time.Duration `json:"-"`
+}
+
+func Registered() Step {
+	return Step{Code: http.StatusOK, Status: StatusRegistered}
+}
+
+func Processing() Step {
+	return Step{Code: http.StatusOK, Status: StatusProcessing}
+}
+
+func Processed(accrual models.Money) Step {
+	return Step{Code: http.StatusOK, Status: StatusProcessed, Accrual: accrual}
+}
+
+func Invalid() Step {
+	return Step{Code: http.StatusOK, Status: StatusInvalid}
+}
+
+func NoContent() Step {
+	return Step{Code: http.StatusNoContent}
+}
+
+// TooManyRequests responds with 429 and Retry-After set to the given
+// value, e.g. "60" or an HTTP-date
+func TooManyRequests(retryAfter string) Step {
+	return Step{Code: http.StatusTooManyRequests, RetryAfter: retryAfter}
+}
+
+func InternalError() Step {
+	return Step{Code: http.StatusInternalServerError}
+}
+
+// After returns the same step answered with the given latency
+func (s Step) After(delay time.Duration) Step {
+	s.Delay = delay
+	return s
+}
+
+// UnmarshalJSON accepts delay as a duration string, e.g. "100ms"
+func (s *Step) UnmarshalJSON(data []byte) error {
+	type plainStep Step
+	aux := struct {
+		*plainStep
+		Delay string `json:"delay"`
+	}{plainStep: (*plainStep)(s)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Delay != "" {
+		d, err := time.ParseDuration(aux.Delay)
+		if err != nil {
+			return err
+		}
+		s.Delay = d
+	}
+	if s.Code == 0 {
+		s.Code = http.StatusOK
+	}
+
+	return nil
+}
+
+// Script describes the behaviour of the whole fake, Default is used for
+// orders without their own script
+type Script struct {
+	Default []Step            `json:"default"`
+	Orders  map[string][]Step `json:"orders"`
+}
+
+// Fake is an http.Handler serving GET /api/orders/{number}
+type Fake struct {
+	mu      sync.Mutex
+	def     []Step
+	scripts map[string][]Step
+	hits    map[string]int
+}
+
+// NewFake returns a fake answering 204 to every order until scripted
+func NewFake() *Fake {
+	return &Fake{
+		def:     []Step{NoContent()},
+		scripts: make(map[string][]Step),
+		hits:    make(map[string]int),
+	}
+}
+
+// NewServer starts a test server backed by the fake, the caller has to
+// close it when finished
+func NewServer(f *Fake) *httptest.Server {
+	return httptest.NewServer(f)
+}
+
+// Load replaces all the scripts with the given ones
+func (f *Fake) Load(script Script) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(script.Default) > 0 {
+		f.def = script.Default
+	}
+	f.scripts = make(map[string][]Step)
+	for number, steps := range script.Orders {
+		f.scripts[number] = steps
+	}
+}
+
+// Script sets the steps for the order and resets its request counter
+func (f *Fake) Script(number string, steps ...Step) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.scripts[number] = steps
+	f.hits[number] = 0
+}
+
+// Default sets the steps for orders without their own script
+func (f *Fake) Default(steps ...Step) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.def = steps
+}
+
+// Hits returns the number of requests made for the order
+func (f *Fake) Hits(number string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.hits[number]
+}
+
+func (f *Fake) next(number string) Step {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	steps, ok := f.scripts[number]
+	if !ok || len(steps) == 0 {
+		steps = f.def
+	}
+	n := f.hits[number]
+	f.hits[number]++
+
+	if len(steps) == 0 {
+		return NoContent()
+	}
+	if n >= len(steps) {
+		n = len(steps) - 1
+	}
+
+	return steps[n]
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/api/orders/"
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	number := strings.TrimPrefix(r.URL.Path, prefix)
+	step := f.next(number)
+
+	if step.Delay > 0 {
+		select {
+		case <-time.After(step.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch step.Code {
+	case 0, http.StatusOK:
+		ar := models.AccrualResponse{
+			OrderNumber: number,
+			Status:      step.Status,
+			Accrual:     step.Accrual,
+		}
+		jr, err := json.Marshal(ar)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jr)
+	case http.StatusTooManyRequests:
+		if step.RetryAfter != "" {
+			w.Header().Set("Retry-After", step.RetryAfter)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("No more than N requests per minute allowed"))
+	default:
+		w.WriteHeader(step.Code)
+	}
+}
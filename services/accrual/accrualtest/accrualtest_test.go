@@ -0,0 +1,118 @@
+package accrualtest_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/accrual/accrualtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeScript(t *testing.T) {
+	fake := accrualtest.NewFake()
+	fake.Script("1149",
+		accrualtest.TooManyRequests("60"),
+		accrualtest.InternalError().After(50*time.Millisecond),
+		accrualtest.Processing(),
+		accrualtest.Processed(42000),
+	)
+	srv := accrualtest.NewServer(fake)
+	defer srv.Close()
+
+	tests := []struct {
+		wantCode       int
+		wantRetryAfter string
+		wantStatus     string
+		wantAccrual    models.Money
+	}{
+		{
+			wantCode:       429,
+			wantRetryAfter: "60",
+		},
+		{
+			wantCode: 500,
+		},
+		{
+			wantCode:   200,
+			wantStatus: models.OrderStatusProcessing,
+		},
+		{
+			wantCode:    200,
+			wantStatus:  models.OrderStatusProcessed,
+			wantAccrual: 42000,
+		},
+		{
+			// the last step is repeated
+			wantCode:    200,
+			wantStatus:  models.OrderStatusProcessed,
+			wantAccrual: 42000,
+		},
+	}
+
+	for _, tt := range tests {
+		resp, err := srv.Client().Get(srv.URL + "/api/orders/1149")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, tt.wantCode, resp.StatusCode)
+		assert.Equal(t, tt.wantRetryAfter, resp.Header.Get("Retry-After"))
+		if tt.wantCode == 200 {
+			ar := models.AccrualResponse{}
+			require.NoError(t, json.Unmarshal(body, &ar))
+			assert.Equal(t, "1149", ar.OrderNumber)
+			assert.Equal(t, tt.wantStatus, ar.Status)
+			assert.Equal(t, tt.wantAccrual, ar.Accrual)
+		}
+	}
+	assert.Equal(t, len(tests), fake.Hits("1149"))
+
+	// unscripted orders are not registered
+	resp, err := srv.Client().Get(srv.URL + "/api/orders/2238")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 204, resp.StatusCode)
+}
+
+func TestFakeLoad(t *testing.T) {
+	data := `{
+		"default": [{"status": "REGISTERED"}, {"status": "PROCESSED", "accrual": 1.5}],
+		"orders": {
+			"2238": [{"code": 429, "retry_after": "5", "delay": "10ms"}]
+		}
+	}`
+	script := accrualtest.Script{}
+	require.NoError(t, json.Unmarshal([]byte(data), &script))
+
+	require.Len(t, script.Default, 2)
+	assert.Equal(t, accrualtest.Registered(), script.Default[0])
+	assert.Equal(t, accrualtest.Processed(150), script.Default[1])
+	assert.Equal(t, accrualtest.TooManyRequests("5").After(10*time.Millisecond), script.Orders["2238"][0])
+
+	fake := accrualtest.NewFake()
+	fake.Load(script)
+	srv := accrualtest.NewServer(fake)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/api/orders/2238")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+}
+
+func TestFakeNotFound(t *testing.T) {
+	srv := accrualtest.NewServer(accrualtest.NewFake())
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/api/orders/1149", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,198 @@
+package accrual
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sbxb/loyalty/internal/logger"
+)
+
+type BreakerState int
+
+const (
+	// BreakerClosed lets all the requests through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all the requests until OpenTimeout passes
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request through at a time
+	BreakerHalfOpen
+)
+
+var breakerStateNames = []string{"closed", "open", "half-open"}
+
+func (bs BreakerState) String() string {
+	return breakerStateNames[bs]
+}
+
+// BreakerSettings defines when the circuit breaker opens and closes
+type BreakerSettings struct {
+	FailureThreshold int           // consecutive failures which open the breaker
+	OpenTimeout      time.Duration // time the breaker stays open before probing
+	SuccessThreshold int           // successful probes which close the breaker
+}
+
+// CircuitOpenError is returned when a request is rejected by the circuit
+// breaker, requests are not sent until the Until moment
+type CircuitOpenError struct {
+	Until time.Time
+}
+
+func (coe *CircuitOpenError) Error() string {
+	return fmt.Sprintf("AccrualClient : circuit breaker is open until %s", coe.Until.Format(time.RFC3339))
+}
+
+// CircuitBreaker stops requests to the accrual system after a series of
+// failures and probes it periodically until it gets back to normal
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	settings  BreakerSettings
+	state     BreakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	if settings.FailureThreshold < 1 {
+		settings.FailureThreshold = 1
+	}
+	if settings.SuccessThreshold < 1 {
+		settings.SuccessThreshold = 1
+	}
+	return &CircuitBreaker{settings: settings}
+}
+
+// Allow returns non-nil error if the request must not be sent; otherwise
+// the caller has to report the outcome with Success, Failure or Cancel
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	if cb.state == BreakerOpen {
+		retryAt := cb.openedAt.Add(cb.settings.OpenTimeout)
+		if now.Before(retryAt) {
+			return &CircuitOpenError{Until: retryAt}
+		}
+		cb.setState(BreakerHalfOpen, now)
+	}
+
+	if cb.state == BreakerHalfOpen {
+		if cb.probing {
+			return &CircuitOpenError{Until: now.Add(cb.settings.OpenTimeout)}
+		}
+		cb.probing = true
+	}
+
+	return nil
+}
+
+// Success reports the accrual system has responded properly
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	if cb.state != BreakerHalfOpen {
+		return
+	}
+
+	cb.probing = false
+	cb.successes++
+	if cb.successes >= cb.settings.SuccessThreshold {
+		cb.setState(BreakerClosed, time.Now())
+	}
+}
+
+// Failure reports the accrual system is unavailable or broken
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	switch cb.state {
+	case BreakerClosed:
+		cb.failures++
+		if cb.failures >= cb.settings.FailureThreshold {
+			cb.setState(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		cb.probing = false
+		cb.setState(BreakerOpen, now)
+	}
+}
+
+// Cancel reports the request has been abandoned for reasons unrelated
+// to the accrual system, e.g. the context has been cancelled
+func (cb *CircuitBreaker) Cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == BreakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// State returns the current state; open breaker whose timeout has passed
+// is reported as half-open as the next request is going to be a probe
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == BreakerOpen && !time.Now().Before(cb.openedAt.Add(cb.settings.OpenTimeout)) {
+		return BreakerHalfOpen
+	}
+	return cb.state
+}
+
+// BreakerStatus is a snapshot of the circuit breaker state
+type BreakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+}
+
+func (cb *CircuitBreaker) Status() BreakerStatus {
+	state := cb.State()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	status := BreakerStatus{
+		State:    state.String(),
+		Failures: cb.failures,
+	}
+	if state != BreakerClosed {
+		openedAt := cb.openedAt
+		retryAt := cb.openedAt.Add(cb.settings.OpenTimeout)
+		status.OpenedAt = &openedAt
+		status.RetryAt = &retryAt
+	}
+
+	return status
+}
+
+// setState must be called with the mutex locked
+func (cb *CircuitBreaker) setState(state BreakerState, now time.Time) {
+	if cb.state == state {
+		return
+	}
+	cb.state = state
+
+	switch state {
+	case BreakerOpen:
+		cb.openedAt = now
+		cb.successes = 0
+		logger.Warningf("AccrualClient : circuit breaker opened, next probe at %s",
+			now.Add(cb.settings.OpenTimeout).Format(time.RFC3339))
+	case BreakerHalfOpen:
+		cb.successes = 0
+		logger.Infof("AccrualClient : circuit breaker half-open, probing")
+	case BreakerClosed:
+		cb.failures = 0
+		logger.Infof("AccrualClient : circuit breaker closed")
+	}
+}
@@ -0,0 +1,71 @@
+package accrual
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerSettings{
+		FailureThreshold: 2,
+		OpenTimeout:      100 * time.Millisecond,
+		SuccessThreshold: 1,
+	})
+
+	// a success resets the failure counter
+	require.NoError(t, cb.Allow())
+	cb.Failure()
+	require.NoError(t, cb.Allow())
+	cb.Success()
+	require.NoError(t, cb.Allow())
+	cb.Failure()
+	assert.Equal(t, BreakerClosed, cb.State())
+
+	// the second failure in a row opens the breaker
+	require.NoError(t, cb.Allow())
+	cb.Failure()
+	assert.Equal(t, BreakerOpen, cb.State())
+
+	var coErr *CircuitOpenError
+	require.ErrorAs(t, cb.Allow(), &coErr)
+	assert.Equal(t, "open", cb.Status().State)
+
+	// a single probe at a time is allowed after the timeout
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, cb.State())
+	require.NoError(t, cb.Allow())
+	require.ErrorAs(t, cb.Allow(), &coErr)
+
+	// failed probe opens the breaker again
+	cb.Failure()
+	assert.Equal(t, BreakerOpen, cb.State())
+
+	// successful probe closes it
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, cb.Allow())
+	cb.Success()
+	assert.Equal(t, BreakerClosed, cb.State())
+	assert.Nil(t, cb.Status().RetryAt)
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	cb := NewCircuitBreaker(BreakerSettings{
+		FailureThreshold: 1,
+		OpenTimeout:      10 * time.Millisecond,
+		SuccessThreshold: 1,
+	})
+
+	require.NoError(t, cb.Allow())
+	cb.Failure()
+	time.Sleep(20 * time.Millisecond)
+
+	// a cancelled probe lets the next one through
+	require.NoError(t, cb.Allow())
+	cb.Cancel()
+	require.NoError(t, cb.Allow())
+	cb.Success()
+	assert.Equal(t, BreakerClosed, cb.State())
+}
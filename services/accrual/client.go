@@ -3,15 +3,28 @@ package accrual
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sbxb/loyalty/internal/logger"
 	"github.com/sbxb/loyalty/models"
 )
 
-const defaultTimeout = 1 * time.Second
+const (
+	defaultTimeout = 1 * time.Second
+
+	// used when the accrual system sends 429 without a usable Retry-After
+	defaultRetryAfter = 60 * time.Second
+)
+
+// ErrNoContent is returned when the order is not registered in the accrual system
+var ErrNoContent = errors.New("AccrualClient : No content")
 
 type ClientError struct {
 	msg string
@@ -27,52 +40,139 @@ func NewClientError(msg string) *ClientError {
 	}
 }
 
+// RateLimitError is returned when the accrual system responds with 429,
+// no requests are sent by the client until the Until moment
+type RateLimitError struct {
+	msg   string
+	Until time.Time
+}
+
+func (rle *RateLimitError) Error() string {
+	return fmt.Sprintf("AccrualClient : rate limited until %s: %s", rle.Until.Format(time.RFC3339), rle.msg)
+}
+
+func NewRateLimitError(msg string, until time.Time) *RateLimitError {
+	return &RateLimitError{
+		msg:   msg,
+		Until: until,
+	}
+}
+
+// AccrualClient is safe for concurrent use; a 429 received by any of
+// the goroutines sharing the client pauses all of them
 type AccrualClient struct {
-	client http.Client
-	url    string
+	client  http.Client
+	url     string
+	breaker *CircuitBreaker
+
+	mu          sync.Mutex
+	pausedUntil time.Time
 }
 
-func NewAccrualClient(address string) (*AccrualClient, error) {
+func NewAccrualClient(address string, breaker BreakerSettings) (*AccrualClient, error) {
 	accrualURL := address + "/api/orders/"
 	return &AccrualClient{
 		client: http.Client{
 			Timeout: defaultTimeout,
 		},
-		url: accrualURL,
+		url:     accrualURL,
+		breaker: NewCircuitBreaker(breaker),
 	}, nil
 }
 
-func (ac *AccrualClient) DoWork(ctx context.Context, jobQueue chan Job) {
-	logger.Info("client: DoWork(): begin")
+// GetAccrual asks the accrual system about the order with the given number
+func (ac *AccrualClient) GetAccrual(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	if err := ac.waitPause(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := ac.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	logger.Debugf("AccrualClient : trying to get %s", ac.url+orderNumber)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ac.url+orderNumber, nil)
+	if err != nil {
+		ac.breaker.Cancel()
+		return nil, NewClientError("AccrualClient : failed to build request: " + err.Error())
+	}
+
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			ac.breaker.Cancel()
+		} else {
+			ac.breaker.Failure()
+		}
+		return nil, NewClientError("AccrualClient : Get request failed: " + err.Error())
+	}
+
+	ar, err := processResponse(resp)
+	if err != nil {
+		var rlErr *RateLimitError
+		var clientErr *ClientError
+		switch {
+		case errors.As(err, &rlErr):
+			// the accrual system is alive, it just asks to slow down
+			ac.breaker.Success()
+			ac.pause(rlErr.Until)
+		case errors.As(err, &clientErr):
+			ac.breaker.Failure()
+		default:
+			ac.breaker.Success()
+		}
+		return nil, err
+	}
+
+	ac.breaker.Success()
+	return ar, nil
+}
+
+// Breaker returns the circuit breaker guarding the accrual system
+func (ac *AccrualClient) Breaker() *CircuitBreaker {
+	return ac.breaker
+}
+
+// PausedUntil returns the moment the client is paused until, zero time
+// or a moment in the past mean the client is not paused
+func (ac *AccrualClient) PausedUntil() time.Time {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.pausedUntil
+}
+
+func (ac *AccrualClient) pause(until time.Time) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if until.After(ac.pausedUntil) {
+		ac.pausedUntil = until
+		logger.Warningf("AccrualClient : paused until %s", until.Format(time.RFC3339))
+	}
+}
+
+// waitPause blocks until the pause is over or ctx is cancelled
+func (ac *AccrualClient) waitPause(ctx context.Context) error {
 	for {
+		d := time.Until(ac.PausedUntil())
+		if d <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(d)
 		select {
 		case <-ctx.Done():
-			logger.Info("client: DoWork(): context cancelled")
-			return
-		case job := <-jobQueue:
-			logger.Infof("client: DoWork(): got job %v", job)
-			time.Sleep(500 * time.Millisecond)
-			logger.Infof("client: DoWork(): Trying to get " + ac.url + job.orderNumber)
-			resp, err := ac.client.Get(ac.url + job.orderNumber)
-			if err != nil {
-				logger.Infof("client: DoWork(): Get request failed")
-				jobQueue <- job
-				break
-			}
-			ar, clientErr := processResponse(resp)
-			if clientErr != nil {
-				logger.Warning(clientErr.Error())
-				jobQueue <- job
-				break
-			}
-			logger.Infof("client: DoWork(): got response %v", ar)
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			// the pause might have been extended meanwhile, check again
 		}
 	}
 }
 
-func processResponse(resp *http.Response) (*models.AccrualResponse, *ClientError) {
+func processResponse(resp *http.Response) (*models.AccrualResponse, error) {
 	defer resp.Body.Close()
-	logger.Infof("client: processResponse(): got code %d", resp.StatusCode)
+	logger.Debugf("AccrualClient : processResponse(): got code %d", resp.StatusCode)
 	switch resp.StatusCode {
 	case 200:
 		ar := &models.AccrualResponse{}
@@ -81,14 +181,29 @@ func processResponse(resp *http.Response) (*models.AccrualResponse, *ClientError
 		}
 		return ar, nil
 	case 204:
-		return nil, NewClientError("AccrualClient : No content")
+		return nil, ErrNoContent
 	case 429:
+		until := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
 		msg, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, NewClientError("AccrualClient : server failed to read the request's body")
+			return nil, NewRateLimitError("server failed to read the request's body", until)
 		}
-		return nil, NewClientError("AccrualClient : " + string(msg))
+		return nil, NewRateLimitError(strings.TrimSpace(string(msg)), until)
 	default:
 		return nil, NewClientError("AccrualClient : internal server error (or some unknown error)")
 	}
 }
+
+// parseRetryAfter converts Retry-After header value (either delay in seconds
+// or HTTP-date) to the moment requests are allowed again
+func parseRetryAfter(value string, now time.Time) time.Time {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date
+	}
+
+	return now.Add(defaultRetryAfter)
+}
@@ -0,0 +1,132 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 2, 20, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{
+			value: "60",
+			want:  now.Add(60 * time.Second),
+		},
+		{
+			value: " 0 ",
+			want:  now,
+		},
+		{
+			value: "Sun, 20 Feb 2022 12:05:00 GMT",
+			want:  now.Add(5 * time.Minute),
+		},
+		{
+			value: "",
+			want:  now.Add(defaultRetryAfter),
+		},
+		{
+			value: "-5",
+			want:  now.Add(defaultRetryAfter),
+		},
+		{
+			value: "soon",
+			want:  now.Add(defaultRetryAfter),
+		},
+	}
+
+	for _, tt := range tests {
+		assert.True(t, tt.want.Equal(parseRetryAfter(tt.value, now)), tt.value)
+	}
+}
+
+func TestGetAccrualErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  int
+		check func(err error) bool
+	}{
+		{
+			name:  "No content",
+			code:  204,
+			check: func(err error) bool { return errors.Is(err, ErrNoContent) },
+		},
+		{
+			name: "Too many requests",
+			code: 429,
+			check: func(err error) bool {
+				var rlErr *RateLimitError
+				return errors.As(err, &rlErr)
+			},
+		},
+		{
+			name: "Internal server error",
+			code: 500,
+			check: func(err error) bool {
+				var clientErr *ClientError
+				return errors.As(err, &clientErr)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			client, _ := NewAccrualClient(srv.URL, testBreaker)
+			_, err := client.GetAccrual(context.Background(), "1149")
+			require.Error(t, err)
+			assert.True(t, tt.check(err), err.Error())
+		})
+	}
+}
+
+func TestGetAccrualPausesAllCallers(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+			w.Write([]byte("No more than 1 requests per minute allowed"))
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer srv.Close()
+
+	client, _ := NewAccrualClient(srv.URL, testBreaker)
+
+	_, err := client.GetAccrual(context.Background(), "1149")
+	var rlErr *RateLimitError
+	require.ErrorAs(t, err, &rlErr)
+	assert.True(t, rlErr.Until.Equal(client.PausedUntil()))
+
+	// the context expires before the pause is over, no request is sent
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.GetAccrual(ctx, "2238")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// the next call waits for the pause to end and then gets through
+	start := time.Now()
+	_, err = client.GetAccrual(context.Background(), "2238")
+	require.ErrorIs(t, err, ErrNoContent)
+	assert.True(t, time.Since(start) > 500*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,163 @@
+// Package engine implements the accrual system in-process: reward rules
+// are registered for goods, orders are registered along with their goods
+// and get their accrual calculated by the rules
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/accrual"
+)
+
+const (
+	RewardTypePercent = "%"
+	RewardTypePoints  = "pt"
+)
+
+var ErrRewardExists = errors.New("reward for the match already exists")
+var ErrOrderExists = errors.New("order already exists")
+var ErrBadReward = errors.New("reward must have nonempty match, positive reward and valid reward type")
+var ErrBadOrder = errors.New("order must have a valid number and goods with descriptions")
+
+// Reward is a rule applied to goods whose description contains Match;
+// Reward is either a percentage of the price or a fixed number of points
+type Reward struct {
+	Match      string       `json:"match"`
+	Reward     models.Money `json:"reward"`
+	RewardType string       `json:"reward_type"`
+}
+
+func (rw *Reward) Validate() bool {
+	rw.Match = strings.TrimSpace(rw.Match)
+	if rw.Match == "" || rw.Reward <= 0 {
+		return false
+	}
+	return rw.RewardType == RewardTypePercent || rw.RewardType == RewardTypePoints
+}
+
+type Goods struct {
+	Description string       `json:"description"`
+	Price       models.Money `json:"price"`
+}
+
+type Order struct {
+	Number string  `json:"order"`
+	Goods  []Goods `json:"goods"`
+}
+
+func (ord *Order) Validate() bool {
+	ord.Number = strings.TrimSpace(ord.Number)
+	if ord.Number == "" || !models.IsAllDigits(ord.Number) || !models.CheckLuhn(ord.Number) {
+		return false
+	}
+	if len(ord.Goods) == 0 {
+		return false
+	}
+	for _, g := range ord.Goods {
+		if strings.TrimSpace(g.Description) == "" || g.Price < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Engine keeps reward rules and calculated orders in memory
+type Engine struct {
+	sync.RWMutex
+
+	rewards []Reward
+	orders  map[string]*models.AccrualResponse
+}
+
+// Engine can be used by accrual service instead of the remote accrual system
+var _ accrual.Fetcher = (*Engine)(nil)
+
+func New() *Engine {
+	logger.Info("Accrual Engine : created")
+	return &Engine{
+		orders: make(map[string]*models.AccrualResponse),
+	}
+}
+
+func (e *Engine) RegisterReward(rw Reward) error {
+	if !rw.Validate() {
+		return ErrBadReward
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	for _, existing := range e.rewards {
+		if existing.Match == rw.Match {
+			return ErrRewardExists
+		}
+	}
+	e.rewards = append(e.rewards, rw)
+
+	return nil
+}
+
+// RegisterOrder calculates the accrual for the order right away; goods
+// matching no reward rule earn nothing
+func (e *Engine) RegisterOrder(ord Order) error {
+	if !ord.Validate() {
+		return ErrBadOrder
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if _, ok := e.orders[ord.Number]; ok {
+		return ErrOrderExists
+	}
+
+	var total models.Money
+	for _, g := range ord.Goods {
+		total += e.goodsAccrual(g)
+	}
+	e.orders[ord.Number] = &models.AccrualResponse{
+		OrderNumber: ord.Number,
+		Status:      models.OrderStatusProcessed,
+		Accrual:     total,
+	}
+	logger.Debugf("Accrual Engine : order %s registered, accrual %d", ord.Number, total)
+
+	return nil
+}
+
+// goodsAccrual applies the first matching reward rule to the goods,
+// must be called with the mutex locked
+func (e *Engine) goodsAccrual(g Goods) models.Money {
+	description := strings.ToLower(g.Description)
+	for _, rw := range e.rewards {
+		if !strings.Contains(description, strings.ToLower(rw.Match)) {
+			continue
+		}
+		if rw.RewardType == RewardTypePoints {
+			return rw.Reward
+		}
+		// both price and percentage are kept in hundredths
+		return g.Price * rw.Reward / 10000
+	}
+	return 0
+}
+
+// GetAccrual returns accrual.ErrNoContent for unknown orders, just
+// like the remote accrual system does
+func (e *Engine) GetAccrual(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	ar, ok := e.orders[orderNumber]
+	if !ok {
+		return nil, accrual.ErrNoContent
+	}
+	res := *ar
+
+	return &res, nil
+}
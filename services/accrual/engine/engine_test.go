@@ -0,0 +1,176 @@
+package engine_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/accrual"
+	"github.com/sbxb/loyalty/services/accrual/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Rewards and orders below are taken from accrual_init.sh
+func loadEngine(t *testing.T) *engine.Engine {
+	e := engine.New()
+
+	rewards := []engine.Reward{
+		{Match: "FirstBrand", Reward: 1000, RewardType: engine.RewardTypePercent},
+		{Match: "SecondBrand", Reward: 2000, RewardType: engine.RewardTypePercent},
+		{Match: "ThirdBrand", Reward: 500, RewardType: engine.RewardTypePercent},
+	}
+	for _, rw := range rewards {
+		require.NoError(t, e.RegisterReward(rw))
+	}
+
+	return e
+}
+
+func TestRegisterOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order engine.Order
+		want  models.Money
+	}{
+		{
+			name: "FirstBrand",
+			order: engine.Order{Number: "1149", Goods: []engine.Goods{
+				{Description: "Чайник FirstBrand", Price: 70000},
+				{Description: "Ноутбук FirstBrand", Price: 350000},
+			}},
+			want: 42000,
+		},
+		{
+			name: "ThirdBrand",
+			order: engine.Order{Number: "3376", Goods: []engine.Goods{
+				{Description: "Фонарь ThirdBrand", Price: 20000},
+				{Description: "Планшет ThirdBrand", Price: 50000},
+			}},
+			want: 3500,
+		},
+		{
+			name: "No reward",
+			order: engine.Order{Number: "5587", Goods: []engine.Goods{
+				{Description: "Пароварка FifthBrand", Price: 230000},
+				{Description: "Клавиатура FourthBrand", Price: 15000},
+			}},
+			want: 0,
+		},
+	}
+
+	e := loadEngine(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, e.RegisterOrder(tt.order))
+
+			ar, err := e.GetAccrual(context.Background(), tt.order.Number)
+			require.NoError(t, err)
+			assert.Equal(t, models.OrderStatusProcessed, ar.Status)
+			assert.Equal(t, tt.want, ar.Accrual)
+		})
+	}
+}
+
+func TestPointsReward(t *testing.T) {
+	e := loadEngine(t)
+	require.NoError(t, e.RegisterReward(engine.Reward{Match: "Bonus", Reward: 5000, RewardType: engine.RewardTypePoints}))
+
+	err := e.RegisterOrder(engine.Order{Number: "2238", Goods: []engine.Goods{
+		{Description: "bonus item", Price: 100},
+		{Description: "Bonus item", Price: 200},
+	}})
+	require.NoError(t, err)
+
+	ar, err := e.GetAccrual(context.Background(), "2238")
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(10000), ar.Accrual)
+}
+
+func TestRegisterErrors(t *testing.T) {
+	e := loadEngine(t)
+
+	err := e.RegisterReward(engine.Reward{Match: "FirstBrand", Reward: 1, RewardType: engine.RewardTypePoints})
+	assert.ErrorIs(t, err, engine.ErrRewardExists)
+
+	err = e.RegisterReward(engine.Reward{Match: "Other", Reward: 1, RewardType: "$"})
+	assert.ErrorIs(t, err, engine.ErrBadReward)
+
+	err = e.RegisterOrder(engine.Order{Number: "1148", Goods: []engine.Goods{{Description: "x"}}})
+	assert.ErrorIs(t, err, engine.ErrBadOrder)
+
+	err = e.RegisterOrder(engine.Order{Number: "1149"})
+	assert.ErrorIs(t, err, engine.ErrBadOrder)
+
+	order := engine.Order{Number: "1149", Goods: []engine.Goods{{Description: "x"}}}
+	require.NoError(t, e.RegisterOrder(order))
+	assert.ErrorIs(t, e.RegisterOrder(order), engine.ErrOrderExists)
+
+	_, err = e.GetAccrual(context.Background(), "2238")
+	assert.ErrorIs(t, err, accrual.ErrNoContent)
+}
+
+func TestRouter(t *testing.T) {
+	srv := httptest.NewServer(engine.NewRouter(engine.New()))
+	defer srv.Close()
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{
+			method:   http.MethodPost,
+			path:     "/api/goods",
+			body:     `{"match": "FirstBrand","reward": 10, "reward_type": "%"}`,
+			wantCode: 200,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/api/goods",
+			body:     `{"match": "FirstBrand","reward": 10, "reward_type": "%"}`,
+			wantCode: 409,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/api/orders/1149",
+			wantCode: 204,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/api/orders",
+			body:     `{"order": "1149", "goods": [{"description": "Чайник FirstBrand", "price": 700}]}`,
+			wantCode: 202,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/api/orders",
+			body:     `{"order": "1149", "goods": [{"description": "Чайник FirstBrand", "price": 700}]}`,
+			wantCode: 409,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/api/orders",
+			body:     `{"order": "1149"`,
+			wantCode: 400,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/api/orders/1149",
+			wantCode: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+		require.NoError(t, err)
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, tt.wantCode, resp.StatusCode, tt.method+" "+tt.path)
+	}
+}
@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sbxb/loyalty/internal/logger"
+)
+
+// NewRouter serves the same API the remote accrual system does, so the
+// engine can be loaded with rewards and orders by the same scripts
+func NewRouter(e *Engine) http.Handler {
+	router := chi.NewRouter()
+
+	router.Post("/api/goods", e.postReward)
+	router.Post("/api/orders", e.postOrder)
+	router.Get("/api/orders/{number}", e.getOrder)
+
+	return router
+}
+
+// postReward process POST /api/goods request
+func (e *Engine) postReward(w http.ResponseWriter, r *http.Request) {
+	logger.Info("Accrual Engine : POST /api/goods")
+
+	rw := Reward{}
+	if err := json.NewDecoder(r.Body).Decode(&rw); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := e.RegisterReward(rw); err != nil {
+		if errors.Is(err, ErrRewardExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	// http.StatusOK sent implicitly
+}
+
+// postOrder process POST /api/orders request
+func (e *Engine) postOrder(w http.ResponseWriter, r *http.Request) {
+	logger.Info("Accrual Engine : POST /api/orders")
+
+	ord := Order{}
+	if err := json.NewDecoder(r.Body).Decode(&ord); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := e.RegisterOrder(ord); err != nil {
+		if errors.Is(err, ErrOrderExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// getOrder process GET /api/orders/{number} request
+func (e *Engine) getOrder(w http.ResponseWriter, r *http.Request) {
+	ar, err := e.GetAccrual(r.Context(), chi.URLParam(r, "number"))
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	jr, err := json.Marshal(ar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jr)
+}
@@ -0,0 +1,63 @@
+package accrual
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+// RetryPolicy defines how often the accrual system is polled for the same
+// order and when the service stops trying
+type RetryPolicy struct {
+	InitialDelay time.Duration // delay after the first failed attempt
+	Multiplier   float64       // each next delay is that many times longer
+	MaxDelay     time.Duration // delays never grow beyond that value
+	Jitter       float64       // delay is randomly changed by up to that fraction, 0..1
+
+	// The service gives up on the order when either of the limits is
+	// reached, zero value disables the limit
+	MaxAttempts int
+	MaxAge      time.Duration
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay returns the time to wait after the given number of failed attempts
+func (rp RetryPolicy) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(rp.InitialDelay) * math.Pow(rp.Multiplier, float64(attempts-1))
+	if delay > float64(rp.MaxDelay) || math.IsInf(delay, 0) || math.IsNaN(delay) {
+		delay = float64(rp.MaxDelay)
+	}
+
+	if rp.Jitter > 0 {
+		jitterMu.Lock()
+		r := jitterRand.Float64()
+		jitterMu.Unlock()
+		// spread the delay evenly over [delay*(1-jitter), delay*(1+jitter)]
+		delay *= 1 + rp.Jitter*(2*r-1)
+	}
+
+	return time.Duration(delay)
+}
+
+// GiveUp reports whether the service should stop polling for the job
+func (rp RetryPolicy) GiveUp(job *models.AccrualJob, now time.Time) bool {
+	if rp.MaxAttempts > 0 && job.Attempts >= rp.MaxAttempts {
+		return true
+	}
+	if rp.MaxAge > 0 && !job.CreatedAt.IsZero() && now.Sub(job.CreatedAt) >= rp.MaxAge {
+		return true
+	}
+
+	return false
+}
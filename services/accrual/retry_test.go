@@ -0,0 +1,113 @@
+package accrual
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		MaxDelay:     10 * time.Second,
+	}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{
+			attempts: 0,
+			want:     time.Second,
+		},
+		{
+			attempts: 1,
+			want:     time.Second,
+		},
+		{
+			attempts: 2,
+			want:     2 * time.Second,
+		},
+		{
+			attempts: 4,
+			want:     8 * time.Second,
+		},
+		{
+			attempts: 5,
+			want:     10 * time.Second,
+		},
+		{
+			attempts: 5000,
+			want:     10 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, policy.Delay(tt.attempts), tt.attempts)
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   1,
+		MaxDelay:     time.Second,
+		Jitter:       0.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		d := policy.Delay(1)
+		assert.True(t, d >= 500*time.Millisecond && d <= 1500*time.Millisecond, d)
+	}
+}
+
+func TestRetryPolicyGiveUp(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		job    models.AccrualJob
+		want   bool
+	}{
+		{
+			name:   "No limits",
+			policy: RetryPolicy{},
+			job:    models.AccrualJob{Attempts: 1000, CreatedAt: now.Add(-1000 * time.Hour)},
+			want:   false,
+		},
+		{
+			name:   "Attempts left",
+			policy: RetryPolicy{MaxAttempts: 3},
+			job:    models.AccrualJob{Attempts: 2},
+			want:   false,
+		},
+		{
+			name:   "Out of attempts",
+			policy: RetryPolicy{MaxAttempts: 3},
+			job:    models.AccrualJob{Attempts: 3},
+			want:   true,
+		},
+		{
+			name:   "Young enough",
+			policy: RetryPolicy{MaxAge: time.Hour},
+			job:    models.AccrualJob{CreatedAt: now.Add(-59 * time.Minute)},
+			want:   false,
+		},
+		{
+			name:   "Too old",
+			policy: RetryPolicy{MaxAge: time.Hour},
+			job:    models.AccrualJob{CreatedAt: now.Add(-61 * time.Minute)},
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.GiveUp(&tt.job, now))
+		})
+	}
+}
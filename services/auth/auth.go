@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/sbxb/loyalty/internal/logger"
 	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/notify"
 	"github.com/sbxb/loyalty/storage"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -16,13 +19,54 @@ import (
 type contextKey string
 
 var ContextUserKey = contextKey("user")
+var ContextSessionKey = contextKey("session")
+
+// sessionTouchInterval limits how often the last seen time of a session
+// is updated, so not every request writes to the storage
+const sessionTouchInterval = 1 * time.Minute
+
+// maxUserAgentLen is the length the User-Agent header is stored up to
+const maxUserAgentLen = 256
+
+// refreshCookiePath limits the refresh cookie to the refresh endpoint
+const refreshCookiePath = "/api/user/token/refresh"
+
+// ErrSessionInvalid means the session is unknown, revoked or expired
+var ErrSessionInvalid = errors.New("session is revoked or expired")
+
+// cookiePayload is what the user cookie carries, the cookie expires at
+// ExpiresAt just like the access token does
+type cookiePayload struct {
+	models.UserAuth
+	ExpiresAt int64 `json:"exp"`
+}
+
+// AuthSettings are the lifetimes of the login sessions and the password
+// reset tokens, the reset tokens are delivered to the users by Notifier
+type AuthSettings struct {
+	SessionTTL time.Duration
+	ResetTTL   time.Duration
+	Notifier   notify.Notifier
+}
 
 type AuthService struct {
-	store storage.Storage
+	store      storage.Storage
+	keyring    *Keyring
+	tokens     *TokenIssuer
+	sessionTTL time.Duration
+	resetTTL   time.Duration
+	notifier   notify.Notifier
 }
 
-func NewAuthService(st storage.Storage) *AuthService {
-	return &AuthService{store: st}
+func NewAuthService(st storage.Storage, kr *Keyring, ti *TokenIssuer, settings AuthSettings) *AuthService {
+	return &AuthService{
+		store:      st,
+		keyring:    kr,
+		tokens:     ti,
+		sessionTTL: settings.SessionTTL,
+		resetTTL:   settings.ResetTTL,
+		notifier:   settings.Notifier,
+	}
 }
 
 type AuthError struct {
@@ -67,6 +111,9 @@ func (as *AuthService) RegisterUser(ctx context.Context, user *models.User) *Aut
 		if errors.Is(err, storage.ErrLoginAlreadyExists) {
 			return NewAuthError(err.Error(), http.StatusConflict)
 		}
+		if errors.Is(err, storage.ErrReferralCodeMissing) {
+			return NewAuthError(err.Error(), http.StatusUnprocessableEntity)
+		}
 		return NewAuthError("Server failed to register user", http.StatusInternalServerError)
 	}
 
@@ -91,28 +138,336 @@ func (as *AuthService) LoginUser(ctx context.Context, user *models.User) (*model
 	return dbUser, nil
 }
 
-func (as *AuthService) SetCookie(w http.ResponseWriter, user *models.User) error {
-	b, err := json.Marshal(models.UserAuth{Login: user.Login, ID: user.ID})
+// ChangePassword sets the new password once the old one is checked, the
+// sessions of the user but the current one are revoked
+func (as *AuthService) ChangePassword(ctx context.Context, userID int, sessionID string, req *models.PasswordChange) *AuthError {
+	dbUser, err := as.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return NewAuthError("Server failed to change password", http.StatusInternalServerError)
+	}
+
+	if !checkPassword(req.OldPassword, dbUser.Hash) {
+		return NewAuthError("Wrong password", http.StatusForbidden)
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return NewAuthError("Crypto failed to process password", http.StatusInternalServerError)
+	}
+
+	if err = as.store.ChangePassword(ctx, userID, hash, sessionID, time.Now()); err != nil {
+		return NewAuthError("Server failed to change password", http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// RequestPasswordReset sends the user a one-time password reset token;
+// an unknown login is not reported, so the logins can not be probed
+func (as *AuthService) RequestPasswordReset(ctx context.Context, login string) *AuthError {
+	dbUser, err := as.store.GetUser(ctx, &models.User{Login: login})
+	if errors.Is(err, storage.ErrLoginMissing) {
+		return nil
+	}
+	if err != nil {
+		return NewAuthError("Server failed to reset password", http.StatusInternalServerError)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return NewAuthError("Auth: RequestPasswordReset: failed to generate token", http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	reset := &models.PasswordReset{
+		Hash:      hashToken(token),
+		UserID:    dbUser.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(as.resetTTL),
+	}
+	if err = as.store.AddPasswordReset(ctx, reset); err != nil {
+		return NewAuthError("Server failed to reset password", http.StatusInternalServerError)
+	}
+
+	if err = as.notifier.NotifyPasswordReset(ctx, dbUser.Login, token, reset.ExpiresAt); err != nil {
+		logger.Warningf("Auth: RequestPasswordReset: %v", err)
+		return NewAuthError("Server failed to send password reset token", http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// ConfirmPasswordReset sets the new password if the reset token is valid,
+// every session of the user is revoked
+func (as *AuthService) ConfirmPasswordReset(ctx context.Context, req *models.PasswordResetConfirm) *AuthError {
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return NewAuthError("Crypto failed to process password", http.StatusInternalServerError)
+	}
+
+	_, err = as.store.ResetPassword(ctx, hashToken(req.Token), hash, time.Now())
+	if errors.Is(err, storage.ErrPasswordResetMissing) {
+		return NewAuthError(err.Error(), http.StatusUnprocessableEntity)
+	}
+	if err != nil {
+		return NewAuthError("Server failed to reset password", http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+// StartSession records a new login session of the user, the device and the
+// IP address are taken from the request
+func (as *AuthService) StartSession(r *http.Request, user *models.User) (*models.Session, error) {
+	id, err := models.NewSessionID()
+	if err != nil {
+		return nil, NewAuthError("Auth: StartSession: failed to generate session ID", http.StatusInternalServerError)
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLen {
+		userAgent = userAgent[:maxUserAgentLen]
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:         id,
+		UserID:     user.ID,
+		Login:      user.Login,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(as.sessionTTL),
+	}
+	if err = as.store.AddSession(r.Context(), session); err != nil {
+		return nil, NewAuthError("Server failed to start session", http.StatusInternalServerError)
+	}
+
+	return session, nil
+}
+
+// SetCookie sets the user cookie which lasts as long as the access token
+// does and the refresh cookie the refresh endpoint reads the refresh token
+// from if it is not in the request body
+func (as *AuthService) SetCookie(w http.ResponseWriter, session *models.Session, token *models.Token) error {
+	b, err := json.Marshal(cookiePayload{
+		UserAuth:  models.UserAuth{Login: session.Login, ID: session.UserID, SessionID: session.ID},
+		ExpiresAt: token.ExpiresAt.Unix(),
+	})
 	if err != nil {
 		return NewAuthError("Auth: SetCookie: JSON.Marshal() failed to serialize user", http.StatusInternalServerError)
 	}
 
-	encUserInfo, err := encryptString(string(b), secretKey)
+	sealed, err := as.keyring.Seal(string(b))
 	if err != nil {
-		return NewAuthError("Auth: SetCookie: encryptString failed to encrypt user", http.StatusInternalServerError)
+		return NewAuthError("Auth: SetCookie: Keyring failed to seal user", http.StatusInternalServerError)
 	}
 
-	signedEncMessage := GetSignedString(encUserInfo, signatureKey)
 	cookie := http.Cookie{
-		Name:    "user",
-		Value:   signedEncMessage,
-		Expires: time.Now().Add(1 * time.Hour),
+		Name:     "user",
+		Value:    sealed,
+		Path:     "/",
+		Expires:  token.ExpiresAt,
+		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
 
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh",
+		Value:    token.RefreshToken,
+		Path:     refreshCookiePath,
+		Expires:  token.RefreshExpiresAt,
+		HttpOnly: true,
+	})
+
+	return nil
+}
+
+// ClearCookie asks the client to drop the user and the refresh cookies
+func (as *AuthService) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "user", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: "refresh", Path: refreshCookiePath, MaxAge: -1, HttpOnly: true})
+}
+
+// IssueToken returns the access token of the session along with the first
+// refresh token of the session
+func (as *AuthService) IssueToken(ctx context.Context, session *models.Session) (*models.Token, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, NewAuthError("Auth: IssueToken: failed to generate refresh token", http.StatusInternalServerError)
+	}
+
+	err = as.store.AddRefreshToken(ctx, &models.RefreshToken{
+		Hash:      hashToken(refreshToken),
+		SessionID: session.ID,
+		CreatedAt: time.Now(),
+		ExpiresAt: session.ExpiresAt,
+	})
+	if err != nil {
+		return nil, NewAuthError("Server failed to store refresh token", http.StatusInternalServerError)
+	}
+
+	return as.accessToken(session, refreshToken)
+}
+
+// Refresh exchanges the refresh token for the next pair of tokens and
+// extends the session by the session TTL. The refresh token is single use:
+// presenting it again revokes the session
+func (as *AuthService) Refresh(ctx context.Context, refreshToken string) (*models.Session, *models.Token, error) {
+	nextToken, err := randomToken()
+	if err != nil {
+		return nil, nil, NewAuthError("Auth: Refresh: failed to generate refresh token", http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	next := &models.RefreshToken{
+		Hash:      hashToken(nextToken),
+		CreatedAt: now,
+		ExpiresAt: now.Add(as.sessionTTL),
+	}
+	session, err := as.store.RotateRefreshToken(ctx, hashToken(refreshToken), next, now)
+	switch {
+	case errors.Is(err, storage.ErrRefreshTokenReused):
+		logger.Warningf("Auth: Refresh: refresh token reused, session revoked")
+		return nil, nil, NewAuthError(err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, storage.ErrRefreshTokenMissing):
+		return nil, nil, NewAuthError(err.Error(), http.StatusUnauthorized)
+	case err != nil:
+		logger.Warningf("Auth: Refresh: %v", err)
+		return nil, nil, NewAuthError("Server failed to refresh token", http.StatusInternalServerError)
+	}
+
+	token, err := as.accessToken(session, nextToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return session, token, nil
+}
+
+// accessToken signs the bearer token of the session
+func (as *AuthService) accessToken(session *models.Session, refreshToken string) (*models.Token, error) {
+	token, expiresAt, err := as.tokens.Issue(models.UserAuth{Login: session.Login, ID: session.UserID, SessionID: session.ID})
+	if err != nil {
+		return nil, NewAuthError("Auth: IssueToken: failed to sign token", http.StatusInternalServerError)
+	}
+
+	return &models.Token{
+		AccessToken:      token,
+		TokenType:        "Bearer",
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// Authenticate returns the user the request is made by: the bearer token
+// is checked if the request carries Authorization header, the user cookie
+// otherwise; either must refer to an active session. The error is
+// *AuthError if the storage failed to check the session
+func (as *AuthService) Authenticate(r *http.Request) (models.UserAuth, error) {
+	user, err := as.credentials(r)
+	if err != nil {
+		return models.UserAuth{}, err
+	}
+
+	session, err := as.store.GetSession(r.Context(), user.SessionID)
+	switch {
+	case errors.Is(err, storage.ErrSessionMissing):
+		return models.UserAuth{}, ErrSessionInvalid
+	case err != nil:
+		logger.Warningf("Auth: Authenticate: %v", err)
+		return models.UserAuth{}, NewAuthError("Server failed to check session", http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	if session.UserID != user.ID || !session.Active(now) {
+		return models.UserAuth{}, ErrSessionInvalid
+	}
+
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		if err = as.store.TouchSession(r.Context(), session.ID, now); err != nil {
+			logger.Warningf("Auth: Authenticate: %v", err)
+		}
+	}
+
+	return user, nil
+}
+
+// credentials reads the user from either the bearer token or the cookie
+func (as *AuthService) credentials(r *http.Request) (models.UserAuth, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header {
+			return models.UserAuth{}, ErrInvalidToken
+		}
+		return as.tokens.Verify(token)
+	}
+
+	cookie, err := r.Cookie("user")
+	if err != nil {
+		return models.UserAuth{}, err
+	}
+	payload, err := as.keyring.Open(cookie.Value)
+	if err != nil {
+		return models.UserAuth{}, err
+	}
+
+	user := cookiePayload{}
+	if err = json.Unmarshal([]byte(payload), &user); err != nil {
+		return models.UserAuth{}, err
+	}
+	if user.ID == 0 {
+		return models.UserAuth{}, errors.New("user id missing")
+	}
+	if time.Now().Unix() >= user.ExpiresAt {
+		return models.UserAuth{}, errors.New("cookie expired")
+	}
+
+	return user.UserAuth, nil
+}
+
+// GetSessions lists the active sessions of the user marking the current one
+func (as *AuthService) GetSessions(ctx context.Context, userID int, current string) ([]*models.Session, error) {
+	sessions, err := as.store.GetSessions(ctx, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		s.Current = s.ID == current
+	}
+
+	return sessions, nil
+}
+
+// Logout revokes the session
+func (as *AuthService) Logout(ctx context.Context, userID int, sessionID string) error {
+	err := as.store.RevokeSession(ctx, userID, sessionID, time.Now())
+	// the session may have been revoked by a concurrent request
+	if err != nil && !errors.Is(err, storage.ErrSessionMissing) {
+		return err
+	}
+
 	return nil
 }
 
+// LogoutAll revokes every session of the user, the current one included,
+// and returns the number of sessions revoked
+func (as *AuthService) LogoutAll(ctx context.Context, userID int) (int, error) {
+	return as.store.RevokeSessions(ctx, userID, time.Now())
+}
+
+// GetSessionID returns the ID of the session the request is made in
+func GetSessionID(ctx context.Context) string {
+	sessionID, _ := ctx.Value(ContextSessionKey).(string)
+	return sessionID
+}
+
 func GetUserID(ctx context.Context) int {
 	UserID, _ := ctx.Value(ContextUserKey).(int)
 	if UserID == 0 {
@@ -13,11 +13,6 @@ import (
 	"io"
 )
 
-const (
-	secretKey    = "my-super-secret-key"
-	signatureKey = "another-super-secret-key"
-)
-
 const (
 	signBytes = 32
 	signChars = signBytes * 2
@@ -123,15 +118,18 @@ func CheckSignedString(str string, key string) bool {
 	return hmac.Equal(newSign, sign)
 }
 
-func GetPayload(signedEncrypted string) (string, error) {
-	if !CheckSignedString(signedEncrypted, signatureKey) {
-		return "", errors.New("signature check failed")
-	}
-	encrypted := GetStringPart(signedEncrypted)
-	decrypted, err := decryptString(encrypted, secretKey)
-	if err != nil {
-		return "", errors.New("unable to decrypt the input string")
+// randomToken returns 256 random bits hex encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(b), nil
+}
 
-	return decrypted, nil
+// hashToken is how refresh and password reset tokens are stored, the token itself is random
+// enough not to need a salt
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/models"
+)
+
+// JWT signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenSettings configure the tokens: HS256 tokens are signed with Secret,
+// EdDSA and RS256 ones with the PEM encoded private key from KeyFile
+type TokenSettings struct {
+	Algorithm string
+	Secret    string
+	KeyFile   string
+	Issuer    string
+	Audience  string
+	TTL       time.Duration
+}
+
+// tokenClaims are the registered claims along with models.UserAuth
+type tokenClaims struct {
+	models.UserAuth
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// TokenIssuer issues and verifies JWT access tokens
+type TokenIssuer struct {
+	settings TokenSettings
+	header   string // encoded, it never changes
+	sign     func(data []byte) ([]byte, error)
+	verify   func(data, signature []byte) bool
+}
+
+// NewTokenIssuer prepares the keys of the algorithm; HS256 without
+// a secret gets a random one, then the tokens do not survive the restart
+func NewTokenIssuer(settings TokenSettings) (*TokenIssuer, error) {
+	ti := &TokenIssuer{settings: settings}
+
+	switch settings.Algorithm {
+	case AlgHS256:
+		secret := []byte(settings.Secret)
+		if len(secret) == 0 {
+			logger.Warning("TokenIssuer: no JWT secret configured, using a random one")
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, err
+			}
+		}
+		ti.sign = func(data []byte) ([]byte, error) {
+			h := hmac.New(sha256.New, secret)
+			h.Write(data)
+			return h.Sum(nil), nil
+		}
+		ti.verify = func(data, signature []byte) bool {
+			expected, _ := ti.sign(data)
+			return hmac.Equal(expected, signature)
+		}
+	case AlgEdDSA, AlgRS256:
+		key, err := readPrivateKey(settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("TokenIssuer: %v", err)
+		}
+		if err := ti.setKey(key); err != nil {
+			return nil, fmt.Errorf("TokenIssuer: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("TokenIssuer: unsupported algorithm %q", settings.Algorithm)
+	}
+
+	header, _ := json.Marshal(tokenHeader{Algorithm: settings.Algorithm, Type: "JWT"})
+	ti.header = base64.RawURLEncoding.EncodeToString(header)
+
+	return ti, nil
+}
+
+func (ti *TokenIssuer) setKey(key crypto.PrivateKey) error {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		if ti.settings.Algorithm != AlgEdDSA {
+			return errors.New("Ed25519 key given for " + ti.settings.Algorithm)
+		}
+		public := k.Public().(ed25519.PublicKey)
+		ti.sign = func(data []byte) ([]byte, error) {
+			return ed25519.Sign(k, data), nil
+		}
+		ti.verify = func(data, signature []byte) bool {
+			return ed25519.Verify(public, data, signature)
+		}
+	case *rsa.PrivateKey:
+		if ti.settings.Algorithm != AlgRS256 {
+			return errors.New("RSA key given for " + ti.settings.Algorithm)
+		}
+		ti.sign = func(data []byte) ([]byte, error) {
+			digest := sha256.Sum256(data)
+			return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+		ti.verify = func(data, signature []byte) bool {
+			digest := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(&k.PublicKey, crypto.SHA256, digest[:], signature) == nil
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+// readPrivateKey reads PKCS #8 (Ed25519 or RSA) or PKCS #1 (RSA) PEM key
+func readPrivateKey(path string) (crypto.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("key file must be set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// Issue returns the token of the user along with its expiration time
+func (ti *TokenIssuer) Issue(user models.UserAuth) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ti.settings.TTL)
+	claims, err := json.Marshal(tokenClaims{
+		UserAuth:  user,
+		Issuer:    ti.settings.Issuer,
+		Audience:  ti.settings.Audience,
+		Subject:   fmt.Sprint(user.ID),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signed := ti.header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature, err := ti.sign([]byte(signed))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), expiresAt, nil
+}
+
+// Verify checks the token and returns the user it was issued to
+func (ti *TokenIssuer) Verify(token string) (models.UserAuth, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return models.UserAuth{}, ErrInvalidToken
+	}
+
+	// the algorithm is fixed by the settings, the header must agree
+	header := tokenHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Algorithm != ti.settings.Algorithm {
+		return models.UserAuth{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ti.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return models.UserAuth{}, ErrInvalidToken
+	}
+
+	claims := tokenClaims{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return models.UserAuth{}, ErrInvalidToken
+	}
+	switch {
+	case claims.Issuer != ti.settings.Issuer, claims.Audience != ti.settings.Audience:
+		return models.UserAuth{}, ErrInvalidToken
+	case time.Now().Unix() >= claims.ExpiresAt:
+		return models.UserAuth{}, ErrInvalidToken
+	case claims.ID == 0:
+		return models.UserAuth{}, ErrInvalidToken
+	}
+
+	return claims.UserAuth, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
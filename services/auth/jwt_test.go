@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		algorithm string
+		key       interface{}
+	}{
+		{AlgHS256, nil},
+		{AlgEdDSA, edKey},
+		{AlgRS256, rsaKey},
+	}
+
+	user := models.UserAuth{Login: "user", ID: 1}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			settings := TokenSettings{Algorithm: tt.algorithm, Secret: "jwt-secret", Issuer: "gophermart", Audience: "app", TTL: time.Hour}
+			if tt.key != nil {
+				settings.KeyFile = writeKeyFile(t, tt.key)
+			}
+			ti, err := NewTokenIssuer(settings)
+			require.NoError(t, err)
+
+			token, expiresAt, err := ti.Issue(user)
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+			verified, err := ti.Verify(token)
+			require.NoError(t, err)
+			assert.Equal(t, user, verified)
+
+			// tampered claims
+			parts := strings.Split(token, ".")
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			forged := strings.Replace(string(claims), `"id":1`, `"id":2`, 1)
+			parts[1] = base64.RawURLEncoding.EncodeToString([]byte(forged))
+			_, err = ti.Verify(strings.Join(parts, "."))
+			assert.ErrorIs(t, err, ErrInvalidToken)
+
+			// unsigned token
+			none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+			_, err = ti.Verify(none + "." + strings.Split(token, ".")[1] + ".")
+			assert.ErrorIs(t, err, ErrInvalidToken)
+
+			// another audience
+			other := settings
+			other.Audience = "partner"
+			otherIssuer, err := NewTokenIssuer(other)
+			require.NoError(t, err)
+			_, err = otherIssuer.Verify(token)
+			assert.ErrorIs(t, err, ErrInvalidToken)
+		})
+	}
+}
+
+func TestTokenIssuerExpired(t *testing.T) {
+	ti, err := NewTokenIssuer(TokenSettings{Algorithm: AlgHS256, Secret: "jwt-secret", TTL: -time.Second})
+	require.NoError(t, err)
+
+	token, _, err := ti.Issue(models.UserAuth{Login: "user", ID: 1})
+	require.NoError(t, err)
+	_, err = ti.Verify(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestTokenIssuerWrongKey(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = NewTokenIssuer(TokenSettings{Algorithm: AlgRS256, KeyFile: writeKeyFile(t, edKey), TTL: time.Hour})
+	assert.Error(t, err)
+	_, err = NewTokenIssuer(TokenSettings{Algorithm: AlgEdDSA, TTL: time.Hour})
+	assert.Error(t, err)
+	_, err = NewTokenIssuer(TokenSettings{Algorithm: "none", TTL: time.Hour})
+	assert.Error(t, err)
+}
+
+func writeKeyFile(t *testing.T, key interface{}) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	require.NoError(t, err)
+
+	return path
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/models"
+)
+
+// ephemeralKeyID is the ID of the key generated when none is configured
+const ephemeralKeyID = "ephemeral"
+
+// Keyring holds the keys the user cookie is sealed with: the primary key
+// seals new cookies, any key opens the cookies sealed with it
+type Keyring struct {
+	primary models.CookieKey
+	keys    map[string]models.CookieKey
+}
+
+// NewKeyring makes the first key the primary one; if there are no keys a
+// random one is generated, then the cookies do not survive the restart and
+// are not accepted by other instances of the service
+func NewKeyring(keys []models.CookieKey) (*Keyring, error) {
+	if len(keys) == 0 {
+		logger.Warning("Keyring: no cookie keys configured, using a random one")
+		key, err := randomKey(ephemeralKeyID)
+		if err != nil {
+			return nil, err
+		}
+		keys = []models.CookieKey{key}
+	}
+
+	kr := &Keyring{
+		primary: keys[0],
+		keys:    make(map[string]models.CookieKey, len(keys)),
+	}
+	for _, key := range keys {
+		if _, ok := kr.keys[key.ID]; ok {
+			return nil, errors.New("Keyring: duplicate key ID " + key.ID)
+		}
+		kr.keys[key.ID] = key
+	}
+
+	return kr, nil
+}
+
+// Seal encrypts and signs the payload with the primary key,
+// the result is ID.SIGNATURE+CIPHERTEXT
+func (kr *Keyring) Seal(payload string) (string, error) {
+	encrypted, err := encryptString(payload, kr.primary.Secret)
+	if err != nil {
+		return "", err
+	}
+
+	// the key ID is signed along with the ciphertext
+	prefix := kr.primary.ID + "."
+	return prefix + makeSignature(prefix+encrypted, kr.primary.Signature) + encrypted, nil
+}
+
+// Open checks the signature and decrypts the payload with the key
+// the value was sealed with
+func (kr *Keyring) Open(value string) (string, error) {
+	dot := strings.IndexByte(value, '.')
+	if dot < 0 {
+		return "", errors.New("key ID missing")
+	}
+	key, ok := kr.keys[value[:dot]]
+	if !ok {
+		return "", errors.New("unknown key ID")
+	}
+
+	// move the signature ahead of the key ID the way it was signed
+	prefix, signed := value[:dot+1], value[dot+1:]
+	if len(signed) <= signChars || !CheckSignedString(signed[:signChars]+prefix+signed[signChars:], key.Signature) {
+		return "", errors.New("signature check failed")
+	}
+
+	decrypted, err := decryptString(signed[signChars:], key.Secret)
+	if err != nil {
+		return "", errors.New("unable to decrypt the input string")
+	}
+
+	return decrypted, nil
+}
+
+func randomKey(id string) (models.CookieKey, error) {
+	b := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return models.CookieKey{}, err
+	}
+	return models.CookieKey{
+		ID:        id,
+		Secret:    hex.EncodeToString(b[:32]),
+		Signature: hex.EncodeToString(b[32:]),
+	}, nil
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey := models.CookieKey{ID: "2021", Secret: "old-secret-0123456789", Signature: "old-signature-0123456789"}
+	newKey := models.CookieKey{ID: "2022", Secret: "new-secret-0123456789", Signature: "new-signature-0123456789"}
+	payload := `{"login":"user","id":1}`
+
+	before, err := NewKeyring([]models.CookieKey{oldKey})
+	require.NoError(t, err)
+	sealedBefore, err := before.Seal(payload)
+	require.NoError(t, err)
+	assert.Regexp(t, `^2021\.`, sealedBefore)
+
+	// the new key is primary, the old one still opens the cookies issued before
+	after, err := NewKeyring([]models.CookieKey{newKey, oldKey})
+	require.NoError(t, err)
+	sealedAfter, err := after.Seal(payload)
+	require.NoError(t, err)
+	assert.Regexp(t, `^2022\.`, sealedAfter)
+
+	for _, sealed := range []string{sealedBefore, sealedAfter} {
+		opened, err := after.Open(sealed)
+		require.NoError(t, err)
+		assert.Equal(t, payload, opened)
+	}
+
+	// once the old key is dropped its cookies are rejected
+	dropped, err := NewKeyring([]models.CookieKey{newKey})
+	require.NoError(t, err)
+	_, err = dropped.Open(sealedBefore)
+	assert.Error(t, err)
+}
+
+func TestKeyringTampering(t *testing.T) {
+	key := models.CookieKey{ID: "k1", Secret: "secret-0123456789", Signature: "signature-0123456789"}
+	other := models.CookieKey{ID: "k2", Secret: "secret-0123456789", Signature: "another-signature-0123456789"}
+	kr, err := NewKeyring([]models.CookieKey{key, other})
+	require.NoError(t, err)
+
+	sealed, err := kr.Seal("payload")
+	require.NoError(t, err)
+
+	tests := []string{
+		"",
+		"no-key-id",
+		"unknown." + sealed[len("k1."):],
+		// the key ID is signed too, it can not be swapped
+		"k2." + sealed[len("k1."):],
+		sealed[:len(sealed)-2] + "AA",
+		"k1.abc",
+	}
+	for _, tt := range tests {
+		_, err := kr.Open(tt)
+		assert.Error(t, err, tt)
+	}
+}
+
+func TestEphemeralKeyring(t *testing.T) {
+	kr1, err := NewKeyring(nil)
+	require.NoError(t, err)
+	kr2, err := NewKeyring(nil)
+	require.NoError(t, err)
+
+	sealed, err := kr1.Seal("payload")
+	require.NoError(t, err)
+	_, err = kr2.Open(sealed)
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package expiry
+
+import (
+	"context"
+	"time"
+
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+// ExpiryService writes off the points which have outlived their TTL and
+// tells users when the points they have are going to expire
+type ExpiryService struct {
+	store    storage.Storage
+	ttl      time.Duration
+	interval time.Duration
+}
+
+// NewExpiryService creates the service, zero ttl means points never expire
+func NewExpiryService(st storage.Storage, ttl, interval time.Duration) *ExpiryService {
+	return &ExpiryService{
+		store:    st,
+		ttl:      ttl,
+		interval: interval,
+	}
+}
+
+// Run writes off the expired points every interval until ctx is cancelled
+func (es *ExpiryService) Run(ctx context.Context) {
+	if es.ttl == 0 {
+		logger.Info("Expiry Service : points never expire")
+		return
+	}
+	logger.Infof("Expiry Service : started, points expire after %s", es.ttl)
+
+	ticker := time.NewTicker(es.interval)
+	defer ticker.Stop()
+
+	for {
+		es.ExpireNow(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Info("Expiry Service : stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExpireNow writes off the points credited more than ttl ago
+func (es *ExpiryService) ExpireNow(ctx context.Context) {
+	if es.ttl == 0 {
+		return
+	}
+
+	expired, err := es.store.ExpirePoints(ctx, time.Now().Add(-es.ttl))
+	if err != nil {
+		logger.Errorf("Expiry Service : failed to expire points: %v", err)
+		return
+	}
+	if expired > 0 {
+		logger.Infof("Expiry Service : %d points expired", expired)
+	}
+}
+
+// Expiring lists the points of the user in the order they expire in
+func (es *ExpiryService) Expiring(ctx context.Context, userID int) ([]*models.ExpiringPoints, error) {
+	res := []*models.ExpiringPoints{}
+	if es.ttl == 0 {
+		return res, nil
+	}
+
+	lots, err := es.store.GetPointLots(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, lot := range lots {
+		res = append(res, &models.ExpiringPoints{
+			OrderNumber: lot.OrderNumber,
+			Sum:         lot.Remaining,
+			ExpiresAt:   lot.CreditedAt.Add(es.ttl),
+		})
+	}
+
+	return res, nil
+}
@@ -0,0 +1,75 @@
+package expiry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/services/expiry"
+	"github.com/sbxb/loyalty/storage"
+	"github.com/sbxb/loyalty/storage/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+
+	user := &models.User{Login: "user", Hash: "abcdef"}
+	require.NoError(t, store.AddUser(ctx, user))
+	user, err := store.GetUser(ctx, user)
+	require.NoError(t, err)
+
+	require.NoError(t, store.AddOrder(ctx, &models.Order{Number: "79927398713", Status: models.OrderStatusNew}, user.ID))
+	require.NoError(t, store.ProcessOrder(ctx, &models.AccrualResponse{OrderNumber: "79927398713", Status: models.OrderStatusProcessed, Accrual: 1000}))
+
+	ttl := 50 * time.Millisecond
+	es := expiry.NewExpiryService(store, ttl, time.Hour)
+
+	expiring, err := es.Expiring(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, expiring, 1)
+	assert.Equal(t, "79927398713", expiring[0].OrderNumber)
+	assert.Equal(t, models.Money(1000), expiring[0].Sum)
+	assert.WithinDuration(t, time.Now().Add(ttl), expiring[0].ExpiresAt, ttl)
+
+	// too early
+	es.ExpireNow(ctx)
+	balance, err := store.GetBalance(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 1000}, balance)
+
+	time.Sleep(2 * ttl)
+	es.ExpireNow(ctx)
+	balance, err = store.GetBalance(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Expired: 1000}, balance)
+
+	expiring, err = es.Expiring(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, expiring)
+}
+
+func TestNeverExpire(t *testing.T) {
+	ctx := context.Background()
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
+
+	user := &models.User{Login: "user", Hash: "abcdef"}
+	require.NoError(t, store.AddUser(ctx, user))
+	user, err := store.GetUser(ctx, user)
+	require.NoError(t, err)
+	require.NoError(t, store.AddAdjustment(ctx, user.ID, 1000, "gift"))
+
+	es := expiry.NewExpiryService(store, 0, time.Hour)
+	es.ExpireNow(ctx)
+
+	expiring, err := es.Expiring(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, expiring)
+
+	balance, err := store.GetBalance(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(1000), balance.Current)
+}
@@ -0,0 +1,79 @@
+package hold
+
+import (
+	"context"
+	"time"
+
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+// HoldService reserves the points of a user for the order while its
+// payment is pending and releases the holds which have outlived their TTL
+type HoldService struct {
+	store    storage.Storage
+	ttl      time.Duration
+	interval time.Duration
+}
+
+func NewHoldService(st storage.Storage, ttl, interval time.Duration) *HoldService {
+	return &HoldService{
+		store:    st,
+		ttl:      ttl,
+		interval: interval,
+	}
+}
+
+// Hold reserves the sum requested for ttl
+func (hs *HoldService) Hold(ctx context.Context, req *models.WithdrawRequest, userID int) (*models.Hold, error) {
+	hold := &models.Hold{
+		OrderNumber: req.OrderNumber,
+		Sum:         req.Sum,
+		ExpiresAt:   time.Now().Add(hs.ttl),
+	}
+	if err := hs.store.CreateHold(ctx, hold, userID); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// Capture withdraws the points held for the order
+func (hs *HoldService) Capture(ctx context.Context, orderNumber string, userID int) error {
+	return hs.store.CaptureHold(ctx, orderNumber, userID)
+}
+
+// Release returns the points held for the order to the user
+func (hs *HoldService) Release(ctx context.Context, orderNumber string, userID int) error {
+	return hs.store.ReleaseHold(ctx, orderNumber, userID)
+}
+
+// Run releases the expired holds every interval until ctx is cancelled
+func (hs *HoldService) Run(ctx context.Context) {
+	logger.Infof("Hold Service : started, holds expire after %s", hs.ttl)
+
+	ticker := time.NewTicker(hs.interval)
+	defer ticker.Stop()
+
+	for {
+		hs.ExpireNow(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Info("Hold Service : stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExpireNow releases the holds which are past their expiration time
+func (hs *HoldService) ExpireNow(ctx context.Context) {
+	expired, err := hs.store.ExpireHolds(ctx, time.Now())
+	if err != nil {
+		logger.Errorf("Hold Service : failed to expire holds: %v", err)
+		return
+	}
+	if expired > 0 {
+		logger.Infof("Hold Service : %d holds expired", expired)
+	}
+}
@@ -0,0 +1,112 @@
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/sbxb/loyalty/internal/logger"
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+var ErrKeyReused = errors.New("idempotency key has been used for a different request")
+var ErrKeyInProgress = errors.New("request with the idempotency key is still in progress")
+
+// IdempotencyService remembers the first response to a request made with
+// an idempotency key, so a retried request is answered the same way
+// instead of being handled once again
+type IdempotencyService struct {
+	store    storage.Storage
+	ttl      time.Duration
+	lease    time.Duration
+	interval time.Duration
+}
+
+func NewIdempotencyService(st storage.Storage, ttl, lease, interval time.Duration) *IdempotencyService {
+	return &IdempotencyService{
+		store:    st,
+		ttl:      ttl,
+		lease:    lease,
+		interval: interval,
+	}
+}
+
+// RequestHash tells the requests made with the same key apart
+func RequestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Begin reserves the key for the request; it returns the response to replay
+// if the same request has already been made with the key, or nil if the
+// request is to be handled
+func (is *IdempotencyService) Begin(ctx context.Context, userID int, key, requestHash string) (*models.IdempotencyRecord, error) {
+	rec := &models.IdempotencyRecord{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: requestHash,
+	}
+	now := time.Now()
+	existing, err := is.store.ReserveIdempotencyKey(ctx, rec, now.Add(-is.ttl), now.Add(-is.lease))
+	switch {
+	case err != nil:
+		return nil, err
+	case existing == nil:
+		return nil, nil
+	case existing.RequestHash != requestHash:
+		return nil, ErrKeyReused
+	case !existing.Completed:
+		return nil, ErrKeyInProgress
+	}
+	return existing, nil
+}
+
+// Finish stores the response to replay; server errors are not replayed,
+// the key is freed so the request can be retried
+func (is *IdempotencyService) Finish(ctx context.Context, rec *models.IdempotencyRecord) error {
+	if rec.StatusCode >= 500 {
+		return is.store.DeleteIdempotencyKey(ctx, rec.UserID, rec.Key)
+	}
+	return is.store.CompleteIdempotencyKey(ctx, rec)
+}
+
+// Abort frees the key of the request which has not finished, so the
+// request can be retried
+func (is *IdempotencyService) Abort(ctx context.Context, userID int, key string) error {
+	return is.store.DeleteIdempotencyKey(ctx, userID, key)
+}
+
+// Run purges the outdated keys every interval until ctx is cancelled
+func (is *IdempotencyService) Run(ctx context.Context) {
+	logger.Infof("Idempotency Service : started, keys are kept for %s", is.ttl)
+
+	ticker := time.NewTicker(is.interval)
+	defer ticker.Stop()
+
+	for {
+		is.PurgeNow(ctx)
+		select {
+		case <-ctx.Done():
+			logger.Info("Idempotency Service : stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeNow deletes the keys used more than ttl ago
+func (is *IdempotencyService) PurgeNow(ctx context.Context) {
+	purged, err := is.store.PurgeIdempotencyKeys(ctx, time.Now().Add(-is.ttl))
+	if err != nil {
+		logger.Errorf("Idempotency Service : failed to purge keys: %v", err)
+		return
+	}
+	if purged > 0 {
+		logger.Infof("Idempotency Service : %d keys purged", purged)
+	}
+}
@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sbxb/loyalty/internal/logger"
+)
+
+// Notifier delivers messages to the users, an implementation sending
+// e-mail or SMS is expected to be plugged in for production
+type Notifier interface {
+	// NotifyPasswordReset delivers the password reset token to the user
+	NotifyPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error
+}
+
+// NewNotifier returns FileNotifier if path is not empty, LogNotifier
+// otherwise; both are meant for local use only
+func NewNotifier(path string) Notifier {
+	if path == "" {
+		logger.Warning("Notifier: no notifier file configured, password reset tokens go to the log")
+		return LogNotifier{}
+	}
+	return &FileNotifier{path: path}
+}
+
+// LogNotifier writes the messages to the log
+type LogNotifier struct{}
+
+func (LogNotifier) NotifyPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error {
+	logger.Infof("Notifier: password reset token for %s: %s, valid until %s", login, token, expiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// FileNotifier appends the messages to the file as JSON lines
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+// message is a line of the notifier file
+type message struct {
+	Kind      string    `json:"kind"`
+	Login     string    `json:"login"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+func (fn *FileNotifier) NotifyPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error {
+	return fn.write(message{
+		Kind:      "password_reset",
+		Login:     login,
+		Token:     token,
+		ExpiresAt: expiresAt,
+		SentAt:    time.Now(),
+	})
+}
+
+func (fn *FileNotifier) write(m message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("FileNotifier: %v", err)
+	}
+
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	f, err := os.OpenFile(fn.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("FileNotifier: %v", err)
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("FileNotifier: %v", err)
+	}
+
+	return nil
+}
@@ -5,13 +5,14 @@ import (
 	"testing"
 
 	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
 	"github.com/sbxb/loyalty/storage/inmemory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestRegisterOrder(t *testing.T) {
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
 
 	orderService := NewOrderService(store)
 
@@ -60,7 +61,7 @@ func TestRegisterOrder(t *testing.T) {
 }
 
 func TestListOrders(t *testing.T) {
-	store, _ := inmemory.NewMapStorage() // NewMapStorage() never returns non-nil error
+	store, _ := inmemory.NewMapStorage(storage.Options{}) // NewMapStorage() never returns non-nil error
 
 	orderService := NewOrderService(store)
 
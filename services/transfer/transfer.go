@@ -0,0 +1,38 @@
+package transfer
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+// limitWindow is the period the daily transfer limit applies to
+const limitWindow = 24 * time.Hour
+
+// TransferService moves points from one user to another
+type TransferService struct {
+	store      storage.Storage
+	dailyLimit models.Money
+}
+
+// NewTransferService creates the service, dailyLimit is the number of
+// points a user may transfer in 24 hours, 0 means no limit
+func NewTransferService(st storage.Storage, dailyLimit float64) *TransferService {
+	return &TransferService{
+		store:      st,
+		dailyLimit: models.Money(math.Round(dailyLimit * 100)),
+	}
+}
+
+// Transfer gifts the points requested to another user
+func (ts *TransferService) Transfer(ctx context.Context, req *models.TransferRequest, userID int) error {
+	return ts.store.ProcessTransfer(ctx, req, userID, ts.dailyLimit, time.Now().Add(-limitWindow))
+}
+
+// Transfers lists the transfers sent and received by the user
+func (ts *TransferService) Transfers(ctx context.Context, userID int) ([]*models.TransferInfo, error) {
+	return ts.store.GetTransfers(ctx, userID)
+}
@@ -7,8 +7,33 @@ var ErrLoginMissing = errors.New("login missing")
 
 var ErrInsufficientFunds = errors.New("insufficient amount of loyalty points to withdraw")
 
+var ErrTransferToSelf = errors.New("loyalty points can not be transferred to oneself")
+var ErrTransferLimitExceeded = errors.New("daily transfer limit exceeded")
+
+var ErrCampaignMissing = errors.New("campaign missing")
+
+var ErrReferralCodeMissing = errors.New("referral code missing")
+
+var ErrSessionMissing = errors.New("session missing")
+var ErrRefreshTokenMissing = errors.New("refresh token missing, expired or revoked")
+var ErrRefreshTokenReused = errors.New("refresh token has already been used")
+
+var ErrPasswordResetMissing = errors.New("password reset token missing, expired or used")
+
+var ErrZeroAmount = errors.New("amount of loyalty points must not be zero")
+
+var ErrWithdrawalAlreadyExists = errors.New("order already has a withdrawal")
+var ErrWithdrawalMissing = errors.New("withdrawal missing")
+var ErrWithdrawalReversed = errors.New("withdrawal has already been reversed")
+
+var ErrHoldAlreadyExists = errors.New("order already has a hold or a withdrawal")
+var ErrHoldMissing = errors.New("hold missing")
+var ErrHoldSettled = errors.New("hold has already been captured, released or expired")
+
 var ErrOrderAlreadyExists = errors.New("order already exists")
 
+var ErrAccrualJobLeaseLost = errors.New("accrual job is not leased by the worker")
+
 type ExistingOrderError struct {
 	Err    error
 	UserID int
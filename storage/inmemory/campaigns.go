@@ -0,0 +1,67 @@
+package inmemory
+
+import (
+	"context"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (ms *MapStorage) AddCampaign(ctx context.Context, campaign *models.Campaign) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.lastCampID++
+	campaign.ID = ms.lastCampID
+	c := *campaign
+	ms.campaigns = append(ms.campaigns, &c)
+
+	return nil
+}
+
+func (ms *MapStorage) GetCampaigns(ctx context.Context) ([]*models.Campaign, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := []*models.Campaign{}
+	for _, campaign := range ms.campaigns {
+		c := *campaign
+		res = append(res, &c)
+	}
+
+	return res, nil
+}
+
+func (ms *MapStorage) EndCampaign(ctx context.Context, id int64, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, c := range ms.campaigns {
+		if c.ID != id {
+			continue
+		}
+		// a campaign that has not started yet ends before it starts
+		// and so never grants anything
+		if at.Before(c.StartsAt) {
+			at = c.StartsAt
+		}
+		if at.Before(c.EndsAt) {
+			c.EndsAt = at
+		}
+		return nil
+	}
+
+	return storage.ErrCampaignMissing
+}
+
+// isFirstOrder tells if the user has no processed orders yet,
+// the caller holds the lock
+func (ms *MapStorage) isFirstOrder(userID int) bool {
+	for _, rec := range ms.userOrder[userID] {
+		if rec.status == models.OrderStatusProcessed {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+type holdRecord struct {
+	number    string
+	sum       models.Money
+	status    string
+	createdAt time.Time
+	expiresAt time.Time
+	userID    int
+	lots      []lotTake
+}
+
+func (ms *MapStorage) CreateHold(ctx context.Context, hold *models.Hold, userID int) error {
+	if hold.Sum <= 0 {
+		return storage.ErrZeroAmount
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+
+	balance, ok := ms.balance[userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: CreateHold: balance of user %d not found", userID)
+	}
+
+	now := time.Now()
+	if err := ms.policy.Check(hold.Sum, ms.withdrawalHistory(userID, now), now); err != nil {
+		return err
+	}
+
+	if balance.current < hold.Sum {
+		return storage.ErrInsufficientFunds
+	}
+
+	// the order number identifies the hold and later the withdrawal
+	_, held := ms.hold[hold.OrderNumber]
+	_, withdrawn := ms.withdrawal[hold.OrderNumber]
+	if held || withdrawn {
+		return storage.ErrHoldAlreadyExists
+	}
+
+	balance.current -= hold.Sum
+	balance.held += hold.Sum
+
+	hold.Status = models.HoldStatusHeld
+	hold.CreatedAt = now
+	ms.addLedgerEntry(models.NewHoldEntry(userID, hold.Sum, hold.OrderNumber))
+	// remember the lots, so the points keep their lifetime if returned
+	ms.hold[hold.OrderNumber] = &holdRecord{
+		number:    hold.OrderNumber,
+		sum:       hold.Sum,
+		status:    hold.Status,
+		createdAt: hold.CreatedAt,
+		expiresAt: hold.ExpiresAt,
+		userID:    userID,
+		lots:      ms.takePointLots(userID, hold.Sum),
+	}
+
+	return nil
+}
+
+func (ms *MapStorage) CaptureHold(ctx context.Context, orderNumber string, userID int) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	rec, err := ms.activeHold(orderNumber, userID)
+	if err != nil {
+		return err
+	}
+	if !rec.expiresAt.After(time.Now()) {
+		return storage.ErrHoldSettled
+	}
+
+	balance, ok := ms.balance[userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: CaptureHold: balance of user %d not found", userID)
+	}
+
+	// check unique constraint on withdrawal number
+	if _, ok := ms.withdrawal[rec.number]; ok {
+		return fmt.Errorf("MapStorage: CaptureHold: withdrawal for order %s already exists", rec.number)
+	}
+
+	balance.held -= rec.sum
+	balance.withdrawn += rec.sum
+	rec.status = models.HoldStatusCaptured
+
+	withd := &withdrawalRecord{
+		number:      rec.number,
+		sum:         rec.sum,
+		processedAt: time.Now(),
+		userID:      userID,
+	}
+	ms.withdrawal[rec.number] = withd
+	ms.userWithd[userID] = append(ms.userWithd[userID], withd)
+
+	ms.addLedgerEntry(models.NewReleaseEntry(userID, rec.sum, rec.number))
+	ms.addLedgerEntry(&models.LedgerEntry{
+		Kind:        models.LedgerWithdrawal,
+		From:        models.UserAccount(userID),
+		To:          models.AccountWithdrawals,
+		Amount:      rec.sum,
+		OrderNumber: rec.number,
+	})
+	// the points spent may move the user to a higher tier
+	ms.updateTier(userID, balance)
+
+	return nil
+}
+
+func (ms *MapStorage) ReleaseHold(ctx context.Context, orderNumber string, userID int) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	rec, err := ms.activeHold(orderNumber, userID)
+	if err != nil {
+		return err
+	}
+
+	return ms.releaseHold(rec, models.HoldStatusReleased)
+}
+
+func (ms *MapStorage) ExpireHolds(ctx context.Context, now time.Time) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	due := []*holdRecord{}
+	for _, rec := range ms.hold {
+		if rec.status == models.HoldStatusHeld && !rec.expiresAt.After(now) {
+			due = append(due, rec)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].expiresAt.Before(due[j].expiresAt)
+	})
+
+	for _, rec := range due {
+		if err := ms.releaseHold(rec, models.HoldStatusExpired); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(due), nil
+}
+
+// activeHold returns the user's hold which is neither captured nor
+// released yet, the caller holds the lock
+func (ms *MapStorage) activeHold(orderNumber string, userID int) (*holdRecord, error) {
+	rec, ok := ms.hold[orderNumber]
+	if !ok || rec.userID != userID {
+		return nil, storage.ErrHoldMissing
+	}
+	if rec.status != models.HoldStatusHeld {
+		return nil, storage.ErrHoldSettled
+	}
+	return rec, nil
+}
+
+// releaseHold returns the points held back to the user and settles the
+// hold with status, the caller holds the lock
+func (ms *MapStorage) releaseHold(rec *holdRecord, status string) error {
+	balance, ok := ms.balance[rec.userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: ReleaseHold: balance of user %d not found", rec.userID)
+	}
+
+	balance.held -= rec.sum
+	balance.current += rec.sum
+	rec.status = status
+
+	ms.addLedgerEntry(models.NewReleaseEntry(rec.userID, rec.sum, rec.number))
+	// the points go back to the lots they were taken from, so holding the
+	// points does not prolong their lifetime
+	restored := ms.restorePointLots(rec.userID, rec.lots)
+	rec.lots = nil
+	// the points held without lots to take them from start their lifetime anew
+	if restored < rec.sum {
+		ms.addPointLot(rec.userID, rec.sum-restored, rec.number)
+	}
+
+	return nil
+}
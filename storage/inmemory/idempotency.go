@@ -0,0 +1,77 @@
+package inmemory
+
+import (
+	"context"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+// idempotencyKey identifies an idempotency record, keys are per user
+type idempotencyKey struct {
+	userID int
+	key    string
+}
+
+func (ms *MapStorage) ReserveIdempotencyKey(ctx context.Context, rec *models.IdempotencyRecord, staleBefore, leaseBefore time.Time) (*models.IdempotencyRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	id := idempotencyKey{userID: rec.UserID, key: rec.Key}
+
+	// the record which has outlived the retention window is no longer
+	// replayed, and the request which has outlived its lease is assumed
+	// to have never finished
+	if existing, ok := ms.idempotency[id]; ok && !existing.CreatedAt.Before(staleBefore) &&
+		(existing.Completed || !existing.CreatedAt.Before(leaseBefore)) {
+		res := *existing
+		return &res, nil
+	}
+
+	rec.Completed = false
+	rec.CreatedAt = time.Now()
+	stored := *rec
+	ms.idempotency[id] = &stored
+
+	return nil, nil
+}
+
+func (ms *MapStorage) CompleteIdempotencyKey(ctx context.Context, rec *models.IdempotencyRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	stored, ok := ms.idempotency[idempotencyKey{userID: rec.UserID, key: rec.Key}]
+	if !ok {
+		return nil
+	}
+	stored.Completed = true
+	stored.StatusCode = rec.StatusCode
+	stored.ContentType = rec.ContentType
+	stored.Body = append([]byte(nil), rec.Body...)
+
+	return nil
+}
+
+func (ms *MapStorage) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	delete(ms.idempotency, idempotencyKey{userID: userID, key: key})
+
+	return nil
+}
+
+func (ms *MapStorage) PurgeIdempotencyKeys(ctx context.Context, createdBefore time.Time) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	purged := 0
+	for id, rec := range ms.idempotency {
+		if rec.CreatedAt.Before(createdBefore) {
+			delete(ms.idempotency, id)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
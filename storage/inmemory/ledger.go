@@ -0,0 +1,128 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+// addLedgerEntry appends the entry to the ledger, the caller holds the lock
+func (ms *MapStorage) addLedgerEntry(e *models.LedgerEntry) {
+	e.ID = int64(len(ms.ledger) + 1)
+	e.CreatedAt = time.Now()
+	ms.ledger = append(ms.ledger, e)
+	ms.accLedger[e.From] = append(ms.accLedger[e.From], e)
+	ms.accLedger[e.To] = append(ms.accLedger[e.To], e)
+}
+
+// ledgerBalance derives the balance of the account from the ledger,
+// the caller holds the lock
+func (ms *MapStorage) ledgerBalance(account string) models.Balance {
+	balance := models.Balance{}
+	for _, e := range ms.accLedger[account] {
+		if e.To == account {
+			balance.Current += e.Amount
+			switch e.Kind {
+			case models.LedgerReversal:
+				balance.Withdrawn -= e.Amount
+			case models.LedgerRelease:
+				balance.Held -= e.Amount
+			}
+			continue
+		}
+		balance.Current -= e.Amount
+		switch e.Kind {
+		case models.LedgerWithdrawal:
+			balance.Withdrawn += e.Amount
+		case models.LedgerExpiration:
+			balance.Expired += e.Amount
+		case models.LedgerHold:
+			balance.Held += e.Amount
+		}
+	}
+	return balance
+}
+
+func (ms *MapStorage) AddAdjustment(ctx context.Context, userID int, amount models.Money, comment string) error {
+	if amount == 0 {
+		return storage.ErrZeroAmount
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+
+	balance, ok := ms.balance[userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: AddAdjustment: balance of user %d not found", userID)
+	}
+
+	if balance.current+amount < 0 {
+		return storage.ErrInsufficientFunds
+	}
+
+	balance.current += amount
+	ms.addLedgerEntry(models.NewAdjustmentEntry(userID, amount, comment))
+	if amount > 0 {
+		ms.addPointLot(userID, amount, "")
+	} else {
+		ms.consumePointLots(userID, -amount)
+	}
+
+	return nil
+}
+
+func (ms *MapStorage) GetLedger(ctx context.Context, userID int) ([]*models.LedgerEntry, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := []*models.LedgerEntry{}
+	for _, e := range ms.accLedger[models.UserAccount(userID)] {
+		entry := *e
+		res = append(res, &entry)
+	}
+
+	return res, nil
+}
+
+func (ms *MapStorage) ReconcileBalances(ctx context.Context) ([]*models.BalanceMismatch, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := []*models.BalanceMismatch{}
+	for userID, rec := range ms.balance {
+		cached := rec.toBalance()
+		ledger := ms.ledgerBalance(models.UserAccount(userID))
+		ledger.Tier = cached.Tier // tiers are not kept in the ledger
+		if cached != ledger {
+			res = append(res, &models.BalanceMismatch{
+				UserID: userID,
+				Cached: cached,
+				Ledger: ledger,
+			})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].UserID < res[j].UserID
+	})
+
+	return res, nil
+}
+
+func (ms *MapStorage) RebuildBalances(ctx context.Context) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for userID, rec := range ms.balance {
+		ledger := ms.ledgerBalance(models.UserAccount(userID))
+		rec.current = ledger.Current
+		rec.withdrawn = ledger.Withdrawn
+		rec.expired = ledger.Expired
+		rec.held = ledger.Held
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package inmemory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileAndRebuildBalances(t *testing.T) {
+	ctx := context.Background()
+	store, _ := NewMapStorage(storage.Options{}) // NewMapStorage never returns non-nil error
+
+	user := &models.User{Login: "user", Hash: "abcdef"}
+	require.NoError(t, store.AddUser(ctx, user))
+	user, err := store.GetUser(ctx, user)
+	require.NoError(t, err)
+
+	require.NoError(t, store.AddOrder(ctx, &models.Order{Number: "79927398713", Status: models.OrderStatusNew}, user.ID))
+	require.NoError(t, store.ProcessOrder(ctx, &models.AccrualResponse{OrderNumber: "79927398713", Status: models.OrderStatusProcessed, Accrual: 1000}))
+	require.NoError(t, store.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 300}, user.ID))
+
+	// a bug has changed the cached balance bypassing the ledger
+	store.balance[user.ID].current = 5000
+
+	mismatches, err := store.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, models.BalanceMismatch{
+		UserID: user.ID,
+		Cached: models.Balance{Current: 5000, Withdrawn: 300},
+		Ledger: models.Balance{Current: 700, Withdrawn: 300},
+	}, *mismatches[0])
+
+	require.NoError(t, store.RebuildBalances(ctx))
+
+	mismatches, err = store.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	balance, err := store.GetBalance(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 700, Withdrawn: 300}, balance)
+}
@@ -0,0 +1,142 @@
+package inmemory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+// addPointLot records the points credited to the user, the caller holds the lock
+func (ms *MapStorage) addPointLot(userID int, amount models.Money, orderNumber string) {
+	ms.lots[userID] = append(ms.lots[userID], &models.PointLot{
+		OrderNumber: orderNumber,
+		Amount:      amount,
+		Remaining:   amount,
+		CreditedAt:  time.Now(),
+	})
+}
+
+// lotTake is the part of a lot the points were taken from
+type lotTake struct {
+	lot    *models.PointLot
+	amount models.Money
+}
+
+// consumePointLots takes amount from the oldest lots of the user, the
+// caller holds the lock and has checked the balance already
+func (ms *MapStorage) consumePointLots(userID int, amount models.Money) {
+	ms.takePointLots(userID, amount)
+}
+
+// takePointLots is consumePointLots which tells where the points were taken from
+func (ms *MapStorage) takePointLots(userID int, amount models.Money) []lotTake {
+	taken := []lotTake{}
+	for _, lot := range ms.lots[userID] {
+		if amount == 0 {
+			break
+		}
+		spent := lot.Remaining
+		if spent > amount {
+			spent = amount
+		}
+		lot.Remaining -= spent
+		amount -= spent
+		taken = append(taken, lotTake{lot: lot, amount: spent})
+	}
+	ms.dropEmptyLots(userID)
+
+	return taken
+}
+
+// restorePointLots returns the points taken back to their lots and returns
+// the sum restored, the caller holds the lock
+func (ms *MapStorage) restorePointLots(userID int, taken []lotTake) models.Money {
+	var restored models.Money
+	for _, t := range taken {
+		// a lot taken to the last point has been dropped, it is put back
+		if t.lot.Remaining == 0 {
+			ms.lots[userID] = append(ms.lots[userID], t.lot)
+		}
+		t.lot.Remaining += t.amount
+		restored += t.amount
+	}
+	sort.SliceStable(ms.lots[userID], func(i, j int) bool {
+		return ms.lots[userID][i].CreditedAt.Before(ms.lots[userID][j].CreditedAt)
+	})
+
+	return restored
+}
+
+// dropEmptyLots forgets the lots with no points left, the caller holds the lock
+func (ms *MapStorage) dropEmptyLots(userID int) {
+	lots := ms.lots[userID][:0]
+	for _, lot := range ms.lots[userID] {
+		if lot.Remaining > 0 {
+			lots = append(lots, lot)
+		}
+	}
+	ms.lots[userID] = lots
+}
+
+func (ms *MapStorage) GetPointLots(ctx context.Context, userID int) ([]*models.PointLot, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := []*models.PointLot{}
+	for _, lot := range ms.lots[userID] {
+		l := *lot
+		res = append(res, &l)
+	}
+
+	return res, nil
+}
+
+func (ms *MapStorage) ExpirePoints(ctx context.Context, creditedBefore time.Time) (models.Money, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	userIDs := make([]int, 0, len(ms.lots))
+	for userID := range ms.lots {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+
+	var total models.Money
+	for _, userID := range userIDs {
+		var expired models.Money
+		for _, lot := range ms.lots[userID] {
+			if !lot.CreditedAt.Before(creditedBefore) {
+				break
+			}
+			expired += lot.Remaining
+			lot.Remaining = 0
+		}
+		ms.dropEmptyLots(userID)
+
+		// the balance is the authority, lots never take more than it has
+		balance, ok := ms.balance[userID]
+		if !ok {
+			continue
+		}
+		if expired > balance.current {
+			expired = balance.current
+		}
+		if expired == 0 {
+			continue
+		}
+
+		balance.current -= expired
+		balance.expired += expired
+		ms.addLedgerEntry(&models.LedgerEntry{
+			Kind:   models.LedgerExpiration,
+			From:   models.UserAccount(userID),
+			To:     models.AccountExpirations,
+			Amount: expired,
+		})
+		total += expired
+	}
+
+	return total, nil
+}
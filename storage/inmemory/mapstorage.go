@@ -3,8 +3,7 @@ package inmemory
 import (
 	"context"
 	"fmt"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -13,23 +12,108 @@ import (
 )
 
 // MapStorage defines a simple in-memory storage implemented as a wrapper
-// around Go maps
+// around Go maps. It follows DBStorage semantics except for foreign keys:
+// orders and withdrawals are not checked to belong to an existing user
 type MapStorage struct {
 	sync.RWMutex
 
-	user    map[string]string // login -> id|login|hash
-	order   map[string]string // number -> status|accrual|uploaded_at|user_id
-	balance map[int]string    // user_id -> current|withdrawn
+	lastUserID  int
+	user        map[string]*userRecord // login -> user
+	order       map[string]*orderRecord
+	orderList   []*orderRecord         // all orders in upload order
+	userOrder   map[int][]*orderRecord // user_id -> orders in upload order
+	balance     map[int]*balanceRecord
+	withdrawal  map[string]*withdrawalRecord
+	userWithd   map[int][]*withdrawalRecord // user_id -> withdrawals in processing order
+	job         map[string]*accrualJob
+	ledger      []*models.LedgerEntry
+	accLedger   map[string][]*models.LedgerEntry // account -> entries from or to it
+	lots        map[int][]*models.PointLot       // user_id -> lots in credit order
+	hold        map[string]*holdRecord
+	idempotency map[idempotencyKey]*models.IdempotencyRecord
+	tiers       *models.TierProgram
+	tierChanges map[int][]*models.TierChange // user_id -> tier changes in time order
+	campaigns   []*models.Campaign
+	lastCampID  int64
+	refCode     map[string]int          // referral code -> user_id
+	referral    map[int]*referralRecord // referee user_id -> referral
+	referrals   *models.ReferralProgram
+	policy      *models.WithdrawalPolicy
+	session     map[string]*models.Session
+	userSess    map[int][]*models.Session        // user_id -> sessions in login order
+	refresh     map[string]*models.RefreshToken  // hash -> refresh token
+	reset       map[string]*models.PasswordReset // hash -> password reset
+}
+
+type userRecord struct {
+	id           int
+	login        string
+	hash         string
+	referralCode string
+	createdAt    time.Time
+}
+
+type orderRecord struct {
+	number     string
+	status     string
+	accrual    models.Money
+	bonus      models.Money
+	uploadedAt time.Time
+	userID     int
+}
+
+type balanceRecord struct {
+	current   models.Money
+	withdrawn models.Money
+	expired   models.Money
+	held      models.Money
+	tier      string
+}
+
+type withdrawalRecord struct {
+	number         string
+	sum            models.Money
+	processedAt    time.Time
+	userID         int
+	reversedAt     time.Time
+	reversedBy     string
+	reversalReason string
+}
+
+// accrualJob is an accrual job along with its lease
+type accrualJob struct {
+	models.AccrualJob
+	lockedBy    string
+	lockedUntil time.Time
 }
 
 // MapStorage implements Storage interface
 var _ storage.Storage = (*MapStorage)(nil)
 
-func NewMapStorage() (*MapStorage, error) {
-	user := make(map[string]string)
-	order := make(map[string]string)
-	balance := make(map[int]string)
-	return &MapStorage{user: user, order: order, balance: balance}, nil
+func NewMapStorage(opts storage.Options) (*MapStorage, error) {
+	return &MapStorage{
+		user:        make(map[string]*userRecord),
+		order:       make(map[string]*orderRecord),
+		userOrder:   make(map[int][]*orderRecord),
+		balance:     make(map[int]*balanceRecord),
+		withdrawal:  make(map[string]*withdrawalRecord),
+		userWithd:   make(map[int][]*withdrawalRecord),
+		job:         make(map[string]*accrualJob),
+		accLedger:   make(map[string][]*models.LedgerEntry),
+		lots:        make(map[int][]*models.PointLot),
+		hold:        make(map[string]*holdRecord),
+		idempotency: make(map[idempotencyKey]*models.IdempotencyRecord),
+		tierChanges: make(map[int][]*models.TierChange),
+		refCode:     make(map[string]int),
+		referral:    make(map[int]*referralRecord),
+		session:     make(map[string]*models.Session),
+		userSess:    make(map[int][]*models.Session),
+		refresh:     make(map[string]*models.RefreshToken),
+		reset:       make(map[string]*models.PasswordReset),
+		policy:      opts.WithdrawalPolicy,
+		referrals:   opts.Referrals,
+		tiers:       opts.Tiers,
+	}, nil
 }
 
 func (ms *MapStorage) AddUser(ctx context.Context, user *models.User) error {
@@ -37,35 +121,70 @@ func (ms *MapStorage) AddUser(ctx context.Context, user *models.User) error {
 	defer ms.Unlock()
 
 	// check unique constraint on login
-	for key := range ms.user {
-		if key == user.Login {
-			return storage.ErrLoginAlreadyExists
+	if _, ok := ms.user[user.Login]; ok {
+		return storage.ErrLoginAlreadyExists
+	}
+
+	referrerID := 0
+	if user.ReferredBy != "" {
+		id, ok := ms.refCode[user.ReferredBy]
+		if !ok {
+			return storage.ErrReferralCodeMissing
 		}
+		referrerID = id
 	}
 
-	// add new user
-	uid := len(ms.user) + 1
-	ms.user[user.Login] = fmt.Sprintf("%d|%s|%s", uid, user.Login, user.Hash)
-	ms.balance[uid] = fmt.Sprintf("%d|%d", 0, 0)
+	if user.ReferralCode == "" {
+		code, err := models.NewReferralCode()
+		if err != nil {
+			return fmt.Errorf("MapStorage: AddUser: %v", err)
+		}
+		user.ReferralCode = code
+	}
+	// check unique constraint on referral code
+	if _, ok := ms.refCode[user.ReferralCode]; ok {
+		return fmt.Errorf("MapStorage: AddUser: referral code %s already exists", user.ReferralCode)
+	}
+
+	// add new user along with the empty balance
+	ms.lastUserID++
+	ms.user[user.Login] = &userRecord{
+		id:           ms.lastUserID,
+		login:        user.Login,
+		hash:         user.Hash,
+		referralCode: user.ReferralCode,
+		createdAt:    time.Now(),
+	}
+	ms.balance[ms.lastUserID] = &balanceRecord{}
+	ms.refCode[user.ReferralCode] = ms.lastUserID
+
+	if referrerID != 0 {
+		ms.referral[ms.lastUserID] = &referralRecord{
+			referrerID: referrerID,
+			refereeID:  ms.lastUserID,
+			status:     models.ReferralPending,
+			createdAt:  time.Now(),
+		}
+	}
 
 	return nil
 }
 
 func (ms *MapStorage) GetUser(ctx context.Context, user *models.User) (*models.User, error) {
-	ms.Lock()
-	defer ms.Unlock()
-	dbUser := &models.User{}
-
-	for key, payload := range ms.user {
-		if key == user.Login {
-			parts := strings.SplitN(payload, "|", 3)
-			dbUser.ID, _ = strconv.Atoi(parts[0])
-			dbUser.Login = parts[1]
-			dbUser.Hash = parts[2]
-			return dbUser, nil
-		}
+	ms.RLock()
+	defer ms.RUnlock()
+
+	rec, ok := ms.user[user.Login]
+	if !ok {
+		return nil, storage.ErrLoginMissing
 	}
-	return nil, storage.ErrLoginMissing
+
+	return &models.User{
+		ID:           rec.id,
+		Login:        rec.login,
+		Hash:         rec.hash,
+		ReferralCode: rec.referralCode,
+	}, nil
 }
 
 func (ms *MapStorage) AddOrder(ctx context.Context, order *models.Order, userID int) error {
@@ -73,65 +192,57 @@ func (ms *MapStorage) AddOrder(ctx context.Context, order *models.Order, userID
 	defer ms.Unlock()
 
 	// check unique constraint on number
-	for key, payload := range ms.order {
-		if key == order.Number {
-			parts := strings.SplitN(payload, "|", 4)
-			uid, _ := strconv.Atoi(parts[3])
-			return storage.NewExistingOrderError(uid)
-		}
+	if existing, ok := ms.order[order.Number]; ok {
+		return storage.NewExistingOrderError(existing.userID)
+	}
+
+	now := time.Now()
+	rec := &orderRecord{
+		number:     order.Number,
+		status:     order.Status,
+		accrual:    order.Accrual,
+		uploadedAt: now,
+		userID:     userID,
+	}
+	ms.order[order.Number] = rec
+	ms.orderList = append(ms.orderList, rec)
+	ms.userOrder[userID] = append(ms.userOrder[userID], rec)
+
+	ms.job[order.Number] = &accrualJob{
+		AccrualJob: models.AccrualJob{
+			OrderNumber:   order.Number,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		},
 	}
-	currDate := time.Now().Format(time.RFC3339)
-	ms.order[order.Number] = fmt.Sprintf("%s|%d|%s|%d", order.Status, order.Accrual, currDate, userID)
 
 	return nil
 }
 
 func (ms *MapStorage) GetOrders(ctx context.Context, userID int) ([]*models.Order, error) {
-	ms.Lock()
-	defer ms.Unlock()
+	ms.RLock()
+	defer ms.RUnlock()
 
 	res := []*models.Order{}
-
-	// TODO Sort orders by upload time ?
-	for key, payload := range ms.order {
-		parts := strings.SplitN(payload, "|", 4)
-		uid, _ := strconv.Atoi(parts[3])
-		if uid != userID {
-			continue
-		}
-		var err error
-		order := &models.Order{}
-		order.Number = key
-		order.Status = parts[0]
-
-		var acc int64
-		if acc, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
-			return nil, fmt.Errorf("MapStorage: GetOrders: %v", err)
-		}
-		order.Accrual = models.Money(acc)
-		if order.UploadedAt, err = time.Parse(time.RFC3339, parts[2]); err != nil {
-			return nil, fmt.Errorf("MapStorage: GetOrders: %v", err)
-		}
-		res = append(res, order)
+	for _, rec := range ms.userOrder[userID] {
+		res = append(res, rec.toOrder())
 	}
 
 	return res, nil
 }
 
 func (ms *MapStorage) GetBalance(ctx context.Context, userID int) (models.Balance, error) {
-	ms.Lock()
-	defer ms.Unlock()
+	ms.RLock()
+	defer ms.RUnlock()
 
 	balance := models.Balance{}
-
-	for uid, payload := range ms.balance {
-		if uid == userID {
-			var current, withdrawn int64
-			parts := strings.SplitN(payload, "|", 2)
-			current, _ = strconv.ParseInt(parts[0], 10, 64)
-			balance.Current = models.Money(current)
-			withdrawn, _ = strconv.ParseInt(parts[1], 10, 64)
-			balance.Withdrawn = models.Money(withdrawn)
+	if rec, ok := ms.balance[userID]; ok {
+		balance = rec.toBalance()
+		// the spend basis is counted over a sliding window, so the tier
+		// may have lapsed since it was last updated; the change is
+		// recorded by the next operation on the balance
+		if ms.tiers != nil {
+			balance.Tier = ms.tiers.TierFor(ms.tierBasis(userID, time.Now())).Name
 		}
 	}
 
@@ -139,54 +250,258 @@ func (ms *MapStorage) GetBalance(ctx context.Context, userID int) (models.Balanc
 }
 
 func (ms *MapStorage) GetWithdrawals(ctx context.Context, userID int) ([]*models.WithdrawalInfo, error) {
-	ms.Lock()
-	defer ms.Unlock()
-	// TODO implementation
+	ms.RLock()
+	defer ms.RUnlock()
+
 	res := []*models.WithdrawalInfo{}
+	for _, rec := range ms.userWithd[userID] {
+		res = append(res, rec.toWithdrawalInfo())
+	}
 
 	return res, nil
 }
 
 func (ms *MapStorage) GetUnprocessedOrders(ctx context.Context, limit int) ([]*models.Order, error) {
-	ms.Lock()
-	defer ms.Unlock()
+	ms.RLock()
+	defer ms.RUnlock()
 
 	res := []*models.Order{}
-
-	// TODO Sort orders by upload time ?
-	for key, payload := range ms.order {
-		parts := strings.SplitN(payload, "|", 4)
-		status := parts[0]
-		if status != models.OrderStatusNew && status != models.OrderStatusProcessing {
-			continue
-		}
-
-		order := &models.Order{}
-		order.Number = key // All we are interested in is the current order's number
-
-		res = append(res, order)
+	for _, rec := range ms.orderList {
 		if len(res) >= limit {
 			break
 		}
+		if rec.status != models.OrderStatusNew && rec.status != models.OrderStatusProcessing {
+			continue
+		}
+		// All we are interested in is the current order's number
+		res = append(res, &models.Order{Number: rec.number})
 	}
 
 	return res, nil
 }
 
 func (ms *MapStorage) UpdateOrderStatus(ctx context.Context, ar *models.AccrualResponse) error {
-	//
+	ms.Lock()
+	defer ms.Unlock()
+
+	// final statuses are never overwritten, missing order is not an error
+	// just like UPDATE affecting no rows
+	rec, ok := ms.order[ar.OrderNumber]
+	if !ok || rec.isFinal() {
+		return nil
+	}
+	rec.status = ar.Status
 
 	return nil
 }
 
 func (ms *MapStorage) ProcessOrder(ctx context.Context, ar *models.AccrualResponse) error {
-	//
+	ms.Lock()
+	defer ms.Unlock()
+
+	rec, ok := ms.order[ar.OrderNumber]
+	if !ok {
+		return fmt.Errorf("MapStorage: ProcessOrder: order %s not found", ar.OrderNumber)
+	}
+
+	// The order has already been processed
+	if rec.isFinal() {
+		return nil
+	}
+
+	balance, ok := ms.balance[rec.userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: ProcessOrder: balance of user %d not found", rec.userID)
+	}
+
+	// the points are multiplied according to the tier the user is in
+	// before the order, the order itself may move the user to a higher one
+	tier := ms.updateTier(rec.userID, balance)
+	accrual := tier.Apply(ar.Accrual)
+
+	// campaign bonuses are computed from the points the accrual system
+	// granted, not multiplied by the tier
+	var bonus models.Money
+	var campaigns []string
+	firstOrder := ar.Status == models.OrderStatusProcessed && ms.isFirstOrder(rec.userID)
+	// the fixed bonuses are granted even if the order earned nothing
+	if ar.Status == models.OrderStatusProcessed {
+		bonus, campaigns = models.CampaignBonus(ms.campaigns, ar.Accrual, rec.uploadedAt, firstOrder)
+	}
+
+	balance.current += accrual + bonus
+	rec.status = ar.Status
+	rec.accrual = accrual
+	rec.bonus = bonus
+
+	if accrual > 0 {
+		ms.addLedgerEntry(models.NewAccrualEntry(rec.userID, accrual, ar.OrderNumber, tier))
+	}
+	if bonus > 0 {
+		ms.addLedgerEntry(models.NewBonusEntry(rec.userID, bonus, ar.OrderNumber, campaigns))
+	}
+	if accrual+bonus > 0 {
+		ms.addPointLot(rec.userID, accrual+bonus, ar.OrderNumber)
+	}
+	ms.updateTier(rec.userID, balance)
+
+	if firstOrder {
+		ms.rewardReferral(rec.userID, ar.Accrual, ar.OrderNumber)
+	}
 
 	return nil
 }
 
 func (ms *MapStorage) ProcessWithdraw(ctx context.Context, wr *models.WithdrawRequest, userID int) error {
-	//
+	if wr.Sum <= 0 {
+		return storage.ErrZeroAmount
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+
+	balance, ok := ms.balance[userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: ProcessWithdraw: balance of user %d not found", userID)
+	}
+
+	now := time.Now()
+	if err := ms.policy.Check(wr.Sum, ms.withdrawalHistory(userID, now), now); err != nil {
+		return err
+	}
+
+	if balance.current < wr.Sum {
+		return storage.ErrInsufficientFunds
+	}
+
+	// check unique constraint on number
+	if _, ok := ms.withdrawal[wr.OrderNumber]; ok {
+		return storage.ErrWithdrawalAlreadyExists
+	}
+	// the number of an active hold is taken until the hold is settled
+	if h, ok := ms.hold[wr.OrderNumber]; ok && h.status == models.HoldStatusHeld {
+		return storage.ErrWithdrawalAlreadyExists
+	}
+
+	balance.current -= wr.Sum
+	balance.withdrawn += wr.Sum
+
+	rec := &withdrawalRecord{
+		number:      wr.OrderNumber,
+		sum:         wr.Sum,
+		processedAt: now,
+		userID:      userID,
+	}
+	ms.withdrawal[wr.OrderNumber] = rec
+	ms.userWithd[userID] = append(ms.userWithd[userID], rec)
+
+	ms.addLedgerEntry(&models.LedgerEntry{
+		Kind:        models.LedgerWithdrawal,
+		From:        models.UserAccount(userID),
+		To:          models.AccountWithdrawals,
+		Amount:      wr.Sum,
+		OrderNumber: wr.OrderNumber,
+	})
+	ms.consumePointLots(userID, wr.Sum)
+	// the points spent may move the user to a higher tier
+	ms.updateTier(userID, balance)
+
+	return nil
+}
+
+func (ms *MapStorage) ReverseWithdrawal(ctx context.Context, orderNumber, reversedBy, reason string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	rec, ok := ms.withdrawal[orderNumber]
+	if !ok {
+		return storage.ErrWithdrawalMissing
+	}
+	if !rec.reversedAt.IsZero() {
+		return storage.ErrWithdrawalReversed
+	}
+
+	balance, ok := ms.balance[rec.userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: ReverseWithdrawal: balance of user %d not found", rec.userID)
+	}
+
+	balance.current += rec.sum
+	balance.withdrawn -= rec.sum
+	rec.reversedAt = time.Now()
+	rec.reversedBy = reversedBy
+	rec.reversalReason = reason
+
+	if rec.sum > 0 {
+		ms.addLedgerEntry(models.NewReversalEntry(rec.userID, rec.sum, rec.number, reversedBy, reason))
+		// the lots the points were taken from are not tracked, so the
+		// points returned start their lifetime anew
+		ms.addPointLot(rec.userID, rec.sum, rec.number)
+	}
+	// the points returned are not spent, the user may drop to a lower tier
+	ms.updateTier(rec.userID, balance)
+
+	return nil
+}
+
+func (ms *MapStorage) AcquireAccrualJobs(ctx context.Context, workerID string, limit int, lease time.Duration) ([]*models.AccrualJob, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	now := time.Now()
+	due := []*accrualJob{}
+	for _, job := range ms.job {
+		if job.GaveUp || job.NextAttemptAt.After(now) || job.lockedUntil.After(now) {
+			continue
+		}
+		due = append(due, job)
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	res := []*models.AccrualJob{}
+	for _, job := range due {
+		job.lockedBy = workerID
+		job.lockedUntil = now.Add(lease)
+
+		leased := job.AccrualJob
+		if rec, ok := ms.order[job.OrderNumber]; ok {
+			leased.OrderStatus = rec.status
+		}
+		res = append(res, &leased)
+	}
+
+	return res, nil
+}
+
+func (ms *MapStorage) ReleaseAccrualJob(ctx context.Context, job *models.AccrualJob, workerID string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	stored, ok := ms.job[job.OrderNumber]
+	if !ok || stored.lockedBy != workerID {
+		return storage.ErrAccrualJobLeaseLost
+	}
+
+	stored.Attempts = job.Attempts
+	stored.NextAttemptAt = job.NextAttemptAt
+	stored.LastError = job.LastError
+	stored.GaveUp = job.GaveUp
+	stored.lockedBy = ""
+	stored.lockedUntil = time.Time{}
+
+	return nil
+}
+
+func (ms *MapStorage) CompleteAccrualJob(ctx context.Context, orderNumber string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	delete(ms.job, orderNumber)
 
 	return nil
 }
@@ -195,20 +510,65 @@ func (ms *MapStorage) Close() error {
 	return nil
 }
 
+func (rec *orderRecord) toOrder() *models.Order {
+	return &models.Order{
+		Number:     rec.number,
+		Status:     rec.status,
+		Accrual:    rec.accrual,
+		Bonus:      rec.bonus,
+		UploadedAt: rec.uploadedAt,
+	}
+}
+
+func (rec *balanceRecord) toBalance() models.Balance {
+	return models.Balance{
+		Current:   rec.current,
+		Withdrawn: rec.withdrawn,
+		Expired:   rec.expired,
+		Held:      rec.held,
+		Tier:      rec.tier,
+	}
+}
+
+func (rec *withdrawalRecord) toWithdrawalInfo() *models.WithdrawalInfo {
+	info := &models.WithdrawalInfo{
+		OrderNumber: rec.number,
+		Sum:         rec.sum,
+		ProcessedAt: rec.processedAt,
+	}
+	if !rec.reversedAt.IsZero() {
+		reversedAt := rec.reversedAt
+		info.Reversed = true
+		info.ReversedAt = &reversedAt
+		info.ReversalReason = rec.reversalReason
+	}
+	return info
+}
+
+func (rec *orderRecord) isFinal() bool {
+	return rec.status == models.OrderStatusProcessed || rec.status == models.OrderStatusInvalid
+}
+
 func (ms *MapStorage) DumpUser() {
-	for key, payload := range ms.user {
-		fmt.Println(key, "=>", payload)
+	ms.RLock()
+	defer ms.RUnlock()
+	for key, rec := range ms.user {
+		fmt.Println(key, "=>", *rec)
 	}
 }
 
 func (ms *MapStorage) DumpOrder() {
-	for key, payload := range ms.order {
-		fmt.Println(key, "=>", payload)
+	ms.RLock()
+	defer ms.RUnlock()
+	for _, rec := range ms.orderList {
+		fmt.Println(rec.number, "=>", *rec)
 	}
 }
 
 func (ms *MapStorage) DumpBalance() {
-	for key, payload := range ms.balance {
-		fmt.Println(key, "=>", payload)
+	ms.RLock()
+	defer ms.RUnlock()
+	for key, rec := range ms.balance {
+		fmt.Println(key, "=>", *rec)
 	}
 }
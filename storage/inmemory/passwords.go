@@ -0,0 +1,88 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (ms *MapStorage) GetUserByID(ctx context.Context, userID int) (*models.User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	rec := ms.userByID(userID)
+	if rec == nil {
+		return nil, storage.ErrLoginMissing
+	}
+
+	return &models.User{
+		ID:           rec.id,
+		Login:        rec.login,
+		Hash:         rec.hash,
+		ReferralCode: rec.referralCode,
+	}, nil
+}
+
+func (ms *MapStorage) ChangePassword(ctx context.Context, userID int, hash string, keepSession string, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	rec := ms.userByID(userID)
+	if rec == nil {
+		return fmt.Errorf("MapStorage: ChangePassword: user %d not found", userID)
+	}
+	rec.hash = hash
+	ms.revokeSessions(userID, keepSession, at)
+
+	return nil
+}
+
+func (ms *MapStorage) AddPasswordReset(ctx context.Context, reset *models.PasswordReset) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	// the token issued last is the only one valid
+	for hash, r := range ms.reset {
+		if r.UserID == reset.UserID && r.UsedAt == nil {
+			delete(ms.reset, hash)
+		}
+	}
+
+	stored := *reset
+	ms.reset[reset.Hash] = &stored
+
+	return nil
+}
+
+func (ms *MapStorage) ResetPassword(ctx context.Context, tokenHash string, hash string, at time.Time) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	reset, ok := ms.reset[tokenHash]
+	if !ok || reset.UsedAt != nil || !at.Before(reset.ExpiresAt) {
+		return 0, storage.ErrPasswordResetMissing
+	}
+	rec := ms.userByID(reset.UserID)
+	if rec == nil {
+		return 0, storage.ErrPasswordResetMissing
+	}
+
+	reset.UsedAt = &at
+	rec.hash = hash
+	ms.revokeSessions(reset.UserID, "", at)
+
+	return reset.UserID, nil
+}
+
+// userByID returns nil if there is no such user, the caller holds the lock
+func (ms *MapStorage) userByID(userID int) *userRecord {
+	for _, rec := range ms.user {
+		if rec.id == userID {
+			return rec
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package inmemory
+
+import (
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+// withdrawalHistory collects what the withdrawal policy is checked
+// against, the active holds included; the caller holds the lock
+func (ms *MapStorage) withdrawalHistory(userID int, now time.Time) models.WithdrawalHistory {
+	h := models.WithdrawalHistory{}
+	if ms.policy == nil {
+		return h
+	}
+
+	for _, rec := range ms.user {
+		if rec.id == userID {
+			h.RegisteredAt = rec.createdAt
+			break
+		}
+	}
+	for _, rec := range ms.userWithd[userID] {
+		if !rec.reversedAt.IsZero() {
+			continue
+		}
+		if rec.processedAt.After(h.LastWithdrawalAt) {
+			h.LastWithdrawalAt = rec.processedAt
+		}
+		if now.Sub(rec.processedAt) < models.PolicyDay {
+			h.Day += rec.sum
+		}
+		if now.Sub(rec.processedAt) < models.PolicyMonth {
+			h.Month += rec.sum
+		}
+	}
+	// the points held are about to be withdrawn, so the active holds count
+	// as withdrawals made when they were created
+	for _, rec := range ms.hold {
+		if rec.userID != userID || rec.status != models.HoldStatusHeld {
+			continue
+		}
+		if rec.createdAt.After(h.LastWithdrawalAt) {
+			h.LastWithdrawalAt = rec.createdAt
+		}
+		if now.Sub(rec.createdAt) < models.PolicyDay {
+			h.Day += rec.sum
+		}
+		if now.Sub(rec.createdAt) < models.PolicyMonth {
+			h.Month += rec.sum
+		}
+	}
+
+	return h
+}
@@ -0,0 +1,105 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+type referralRecord struct {
+	referrerID int
+	refereeID  int
+	status     string
+	bonus      models.Money
+	createdAt  time.Time
+	rewardedAt time.Time
+}
+
+func (ms *MapStorage) GetReferrals(ctx context.Context, userID int) (*models.Referrals, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := &models.Referrals{Referrals: []*models.ReferralInfo{}}
+	logins := make(map[int]string) // user_id -> login
+	for _, rec := range ms.user {
+		logins[rec.id] = rec.login
+		if rec.id == userID {
+			res.Code = rec.referralCode
+		}
+	}
+	if res.Code == "" {
+		return nil, fmt.Errorf("MapStorage: GetReferrals: user %d not found", userID)
+	}
+
+	// the referees are listed in the order they registered
+	for id := 1; id <= ms.lastUserID; id++ {
+		rec, ok := ms.referral[id]
+		if !ok || rec.referrerID != userID {
+			continue
+		}
+		info := &models.ReferralInfo{
+			Login:     logins[rec.refereeID],
+			Status:    rec.status,
+			Bonus:     rec.bonus,
+			CreatedAt: rec.createdAt,
+		}
+		if !rec.rewardedAt.IsZero() {
+			rewardedAt := rec.rewardedAt
+			info.RewardedAt = &rewardedAt
+		}
+		res.Referrals = append(res.Referrals, info)
+	}
+
+	return res, nil
+}
+
+// rewardReferral credits the referral bonuses for the first processed
+// order of the referee, the caller holds the lock
+func (ms *MapStorage) rewardReferral(refereeID int, accrual models.Money, orderNumber string) {
+	rec, ok := ms.referral[refereeID]
+	if !ok || rec.status != models.ReferralPending {
+		return
+	}
+	rec.status = models.ReferralIneligible
+	rec.rewardedAt = time.Now()
+
+	p := ms.referrals
+	if p == nil || accrual < p.MinAccrual {
+		return
+	}
+
+	if p.RefereeBonus > 0 {
+		ms.creditReferral(refereeID, p.RefereeBonus, orderNumber, fmt.Sprintf("referred by user %d", rec.referrerID))
+	}
+	if p.ReferrerBonus > 0 && (p.MaxRewards == 0 || ms.referralRewards(rec.referrerID) < p.MaxRewards) {
+		ms.creditReferral(rec.referrerID, p.ReferrerBonus, orderNumber, fmt.Sprintf("referee user %d", refereeID))
+		rec.status = models.ReferralRewarded
+		rec.bonus = p.ReferrerBonus
+	}
+}
+
+// creditReferral credits the referral bonus to the user,
+// the caller holds the lock
+func (ms *MapStorage) creditReferral(userID int, bonus models.Money, orderNumber, comment string) {
+	balance, ok := ms.balance[userID]
+	if !ok {
+		return
+	}
+	balance.current += bonus
+	ms.addLedgerEntry(models.NewReferralEntry(userID, bonus, orderNumber, comment))
+	ms.addPointLot(userID, bonus, "")
+}
+
+// referralRewards counts the referrals the referrer has been rewarded for,
+// the caller holds the lock
+func (ms *MapStorage) referralRewards(referrerID int) int {
+	n := 0
+	for _, rec := range ms.referral {
+		if rec.referrerID == referrerID && rec.status == models.ReferralRewarded {
+			n++
+		}
+	}
+	return n
+}
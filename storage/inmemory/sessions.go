@@ -0,0 +1,148 @@
+package inmemory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (ms *MapStorage) AddSession(ctx context.Context, session *models.Session) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	stored := *session
+	stored.Current = false
+	ms.session[session.ID] = &stored
+	ms.userSess[session.UserID] = append(ms.userSess[session.UserID], &stored)
+
+	return nil
+}
+
+func (ms *MapStorage) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	session, ok := ms.session[id]
+	if !ok {
+		return nil, storage.ErrSessionMissing
+	}
+
+	res := *session
+	return &res, nil
+}
+
+func (ms *MapStorage) GetSessions(ctx context.Context, userID int, now time.Time) ([]*models.Session, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := []*models.Session{}
+	for _, session := range ms.userSess[userID] {
+		if session.Active(now) {
+			s := *session
+			res = append(res, &s)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].LastSeenAt.After(res[j].LastSeenAt)
+	})
+
+	return res, nil
+}
+
+func (ms *MapStorage) TouchSession(ctx context.Context, id string, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if session, ok := ms.session[id]; ok && session.LastSeenAt.Before(at) {
+		session.LastSeenAt = at
+	}
+
+	return nil
+}
+
+func (ms *MapStorage) RevokeSession(ctx context.Context, userID int, id string, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	session, ok := ms.session[id]
+	if !ok || session.UserID != userID || session.RevokedAt != nil {
+		return storage.ErrSessionMissing
+	}
+	session.RevokedAt = &at
+
+	return nil
+}
+
+func (ms *MapStorage) RevokeSessions(ctx context.Context, userID int, at time.Time) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	return ms.revokeSessions(userID, "", at), nil
+}
+
+// revokeSessions revokes the sessions of the user but keep, the caller
+// holds the lock
+func (ms *MapStorage) revokeSessions(userID int, keep string, at time.Time) int {
+	revoked := 0
+	for _, session := range ms.userSess[userID] {
+		if session.RevokedAt == nil && session.ID != keep {
+			revokedAt := at
+			session.RevokedAt = &revokedAt
+			revoked++
+		}
+	}
+
+	return revoked
+}
+
+func (ms *MapStorage) AddRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	stored := *token
+	ms.refresh[token.Hash] = &stored
+
+	return nil
+}
+
+func (ms *MapStorage) RotateRefreshToken(ctx context.Context, hash string, next *models.RefreshToken, now time.Time) (*models.Session, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	token, ok := ms.refresh[hash]
+	if !ok {
+		return nil, storage.ErrRefreshTokenMissing
+	}
+	session, ok := ms.session[token.SessionID]
+	if !ok {
+		return nil, storage.ErrRefreshTokenMissing
+	}
+
+	// the token has leaked, revoke the whole family
+	if token.UsedAt != nil {
+		if session.RevokedAt == nil {
+			session.RevokedAt = &now
+		}
+		return nil, storage.ErrRefreshTokenReused
+	}
+
+	if !now.Before(token.ExpiresAt) || !session.Active(now) {
+		return nil, storage.ErrRefreshTokenMissing
+	}
+
+	token.UsedAt = &now
+	next.SessionID = session.ID
+	stored := *next
+	ms.refresh[next.Hash] = &stored
+
+	session.ExpiresAt = next.ExpiresAt
+	if session.LastSeenAt.Before(now) {
+		session.LastSeenAt = now
+	}
+
+	res := *session
+	return &res, nil
+}
@@ -0,0 +1,68 @@
+package inmemory
+
+import (
+	"context"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+func (ms *MapStorage) GetTierChanges(ctx context.Context, userID int) ([]*models.TierChange, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	res := []*models.TierChange{}
+	for _, change := range ms.tierChanges[userID] {
+		c := *change
+		res = append(res, &c)
+	}
+
+	return res, nil
+}
+
+// updateTier moves the user to the tier the user has reached and returns
+// it, the caller holds the lock
+func (ms *MapStorage) updateTier(userID int, balance *balanceRecord) models.Tier {
+	if ms.tiers == nil {
+		return models.Tier{Multiplier: 1}
+	}
+
+	tier := ms.tiers.TierFor(ms.tierBasis(userID, time.Now()))
+	if tier.Name != balance.tier {
+		ms.tierChanges[userID] = append(ms.tierChanges[userID], &models.TierChange{
+			From:      balance.tier,
+			To:        tier.Name,
+			ChangedAt: time.Now(),
+		})
+		balance.tier = tier.Name
+	}
+
+	return tier
+}
+
+// tierBasis derives the value the tier of the user depends on from the
+// ledger, the caller holds the lock
+func (ms *MapStorage) tierBasis(userID int, now time.Time) models.Money {
+	var value models.Money
+	account := models.UserAccount(userID)
+	since := now.Add(-ms.tiers.Window)
+	for _, e := range ms.accLedger[account] {
+		switch ms.tiers.Basis {
+		case models.TierBasisLifetime:
+			if e.Kind == models.LedgerAccrual && e.To == account {
+				value += e.Amount
+			}
+		case models.TierBasisSpend:
+			if e.CreatedAt.Before(since) {
+				continue
+			}
+			if e.Kind == models.LedgerWithdrawal && e.From == account {
+				value += e.Amount
+			}
+			if e.Kind == models.LedgerReversal && e.To == account {
+				value -= e.Amount
+			}
+		}
+	}
+	return value
+}
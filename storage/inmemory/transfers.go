@@ -0,0 +1,102 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (ms *MapStorage) ProcessTransfer(ctx context.Context, tr *models.TransferRequest, userID int, limit models.Money, since time.Time) error {
+	if tr.Sum == 0 {
+		return storage.ErrZeroAmount
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+
+	recipient, ok := ms.user[tr.Login]
+	if !ok {
+		return storage.ErrLoginMissing
+	}
+	if recipient.id == userID {
+		return storage.ErrTransferToSelf
+	}
+
+	from, ok := ms.balance[userID]
+	if !ok {
+		return fmt.Errorf("MapStorage: ProcessTransfer: balance of user %d not found", userID)
+	}
+	to, ok := ms.balance[recipient.id]
+	if !ok {
+		return fmt.Errorf("MapStorage: ProcessTransfer: balance of user %d not found", recipient.id)
+	}
+
+	if from.current < tr.Sum {
+		return storage.ErrInsufficientFunds
+	}
+
+	if limit > 0 && ms.transferredSince(userID, since)+tr.Sum > limit {
+		return storage.ErrTransferLimitExceeded
+	}
+
+	from.current -= tr.Sum
+	to.current += tr.Sum
+
+	ms.addLedgerEntry(&models.LedgerEntry{
+		Kind:   models.LedgerTransfer,
+		From:   models.UserAccount(userID),
+		To:     models.UserAccount(recipient.id),
+		Amount: tr.Sum,
+	})
+	ms.consumePointLots(userID, tr.Sum)
+	ms.addPointLot(recipient.id, tr.Sum, "")
+
+	return nil
+}
+
+func (ms *MapStorage) GetTransfers(ctx context.Context, userID int) ([]*models.TransferInfo, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	logins := make(map[string]string, len(ms.user)) // account -> login
+	for _, rec := range ms.user {
+		logins[models.UserAccount(rec.id)] = rec.login
+	}
+
+	res := []*models.TransferInfo{}
+	account := models.UserAccount(userID)
+	for _, e := range ms.accLedger[account] {
+		if e.Kind != models.LedgerTransfer {
+			continue
+		}
+		info := &models.TransferInfo{
+			Direction:   models.TransferOut,
+			Login:       logins[e.To],
+			Sum:         e.Amount,
+			ProcessedAt: e.CreatedAt,
+		}
+		if e.To == account {
+			info.Direction = models.TransferIn
+			info.Login = logins[e.From]
+		}
+		res = append(res, info)
+	}
+
+	return res, nil
+}
+
+// transferredSince sums the points the user has transferred since the
+// time given, the caller holds the lock
+func (ms *MapStorage) transferredSince(userID int, since time.Time) models.Money {
+	var sum models.Money
+	account := models.UserAccount(userID)
+	for _, e := range ms.accLedger[account] {
+		if e.Kind == models.LedgerTransfer && e.From == account && !e.CreatedAt.Before(since) {
+			sum += e.Amount
+		}
+	}
+	return sum
+}
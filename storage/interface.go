@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"time"
 
 	"github.com/sbxb/loyalty/models"
 )
@@ -10,6 +11,10 @@ import (
 type Storage interface {
 	AddUser(ctx context.Context, user *models.User) error
 	GetUser(ctx context.Context, user *models.User) (*models.User, error)
+	GetUserByID(ctx context.Context, userID int) (*models.User, error)
+	ChangePassword(ctx context.Context, userID int, hash string, keepSession string, at time.Time) error
+	AddPasswordReset(ctx context.Context, reset *models.PasswordReset) error
+	ResetPassword(ctx context.Context, tokenHash string, hash string, at time.Time) (int, error)
 	AddOrder(ctx context.Context, order *models.Order, userID int) error
 	GetOrders(ctx context.Context, userID int) ([]*models.Order, error)
 	GetBalance(ctx context.Context, userID int) (models.Balance, error)
@@ -18,5 +23,46 @@ type Storage interface {
 	UpdateOrderStatus(ctx context.Context, ar *models.AccrualResponse) error
 	ProcessOrder(ctx context.Context, ar *models.AccrualResponse) error
 	ProcessWithdraw(ctx context.Context, wr *models.WithdrawRequest, userID int) error
+	ProcessTransfer(ctx context.Context, tr *models.TransferRequest, userID int, limit models.Money, since time.Time) error
+	GetTransfers(ctx context.Context, userID int) ([]*models.TransferInfo, error)
+	ReverseWithdrawal(ctx context.Context, orderNumber, reversedBy, reason string) error
+	CreateHold(ctx context.Context, hold *models.Hold, userID int) error
+	CaptureHold(ctx context.Context, orderNumber string, userID int) error
+	ReleaseHold(ctx context.Context, orderNumber string, userID int) error
+	ExpireHolds(ctx context.Context, now time.Time) (int, error)
+	AcquireAccrualJobs(ctx context.Context, workerID string, limit int, lease time.Duration) ([]*models.AccrualJob, error)
+	ReleaseAccrualJob(ctx context.Context, job *models.AccrualJob, workerID string) error
+	CompleteAccrualJob(ctx context.Context, orderNumber string) error
+	AddAdjustment(ctx context.Context, userID int, amount models.Money, comment string) error
+	GetLedger(ctx context.Context, userID int) ([]*models.LedgerEntry, error)
+	ReconcileBalances(ctx context.Context) ([]*models.BalanceMismatch, error)
+	RebuildBalances(ctx context.Context) error
+	ReserveIdempotencyKey(ctx context.Context, rec *models.IdempotencyRecord, staleBefore, leaseBefore time.Time) (*models.IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, rec *models.IdempotencyRecord) error
+	DeleteIdempotencyKey(ctx context.Context, userID int, key string) error
+	PurgeIdempotencyKeys(ctx context.Context, createdBefore time.Time) (int, error)
+	AddCampaign(ctx context.Context, campaign *models.Campaign) error
+	GetCampaigns(ctx context.Context) ([]*models.Campaign, error)
+	EndCampaign(ctx context.Context, id int64, at time.Time) error
+	GetReferrals(ctx context.Context, userID int) (*models.Referrals, error)
+	AddSession(ctx context.Context, session *models.Session) error
+	GetSession(ctx context.Context, id string) (*models.Session, error)
+	GetSessions(ctx context.Context, userID int, now time.Time) ([]*models.Session, error)
+	TouchSession(ctx context.Context, id string, at time.Time) error
+	RevokeSession(ctx context.Context, userID int, id string, at time.Time) error
+	RevokeSessions(ctx context.Context, userID int, at time.Time) (int, error)
+	AddRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, hash string, next *models.RefreshToken, now time.Time) (*models.Session, error)
+	GetTierChanges(ctx context.Context, userID int) ([]*models.TierChange, error)
+	GetPointLots(ctx context.Context, userID int) ([]*models.PointLot, error)
+	ExpirePoints(ctx context.Context, creditedBefore time.Time) (models.Money, error)
 	Close() error
 }
+
+// Options are the business rules a storage is created with, nil fields
+// mean there are none
+type Options struct {
+	Tiers            *models.TierProgram
+	Referrals        *models.ReferralProgram
+	WithdrawalPolicy *models.WithdrawalPolicy
+}
@@ -0,0 +1,101 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (st *DBStorage) AddCampaign(ctx context.Context, campaign *models.Campaign) error {
+	AddCampaignQuery := `INSERT INTO ` + st.campaignTable + ` (name, condition, multiplier,
+		bonus, starts_at, ends_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	err := st.db.QueryRowContext(ctx, AddCampaignQuery, campaign.Name, campaign.Condition,
+		campaign.Multiplier, campaign.Bonus, campaign.StartsAt, campaign.EndsAt).Scan(&campaign.ID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddCampaign: %v :: %v", campaign.Name, err)
+	}
+
+	return nil
+}
+
+func (st *DBStorage) GetCampaigns(ctx context.Context) ([]*models.Campaign, error) {
+	GetCampaignsQuery := `SELECT id, name, condition, multiplier, bonus, starts_at, ends_at
+		FROM ` + st.campaignTable + ` ORDER BY id ASC`
+	rows, err := st.db.QueryContext(ctx, GetCampaignsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetCampaigns: %v", err)
+	}
+	defer rows.Close()
+
+	res, err := scanCampaigns(rows)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetCampaigns: %v", err)
+	}
+
+	return res, nil
+}
+
+func (st *DBStorage) EndCampaign(ctx context.Context, id int64, at time.Time) error {
+	// a campaign that has not started yet ends as it starts and so never
+	// grants anything, a campaign that has ended already is kept as is
+	EndCampaignQuery := `UPDATE ` + st.campaignTable + ` SET
+		ends_at = LEAST(ends_at, GREATEST(starts_at, $1)) WHERE id = $2`
+	res, err := st.db.ExecContext(ctx, EndCampaignQuery, at, id)
+	if err != nil {
+		return fmt.Errorf("DBStorage: EndCampaign: %v :: %v", id, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("DBStorage: EndCampaign: %v :: %v", id, err)
+	}
+	if n == 0 {
+		return storage.ErrCampaignMissing
+	}
+
+	return nil
+}
+
+// campaignBonus sums the bonus points the campaigns running at the time
+// the order was uploaded grant for it and returns their names
+func (st *DBStorage) campaignBonus(tx *sql.Tx, accrual models.Money, uploadedAt time.Time, firstOrder bool) (models.Money, []string, error) {
+	ActiveCampaignsQuery := `SELECT id, name, condition, multiplier, bonus, starts_at, ends_at
+		FROM ` + st.campaignTable + ` WHERE starts_at <= $1 AND ends_at > $1 ORDER BY id ASC`
+	rows, err := tx.Query(ActiveCampaignsQuery, uploadedAt)
+	if err != nil {
+		return 0, nil, err
+	}
+	campaigns, err := scanCampaigns(rows)
+	rows.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	bonus, names := models.CampaignBonus(campaigns, accrual, uploadedAt, firstOrder)
+	return bonus, names, nil
+}
+
+// isFirstOrder tells if the user has no processed orders yet
+func (st *DBStorage) isFirstOrder(tx *sql.Tx, userID int) (bool, error) {
+	var firstOrder bool
+	FirstOrderQuery := `SELECT NOT EXISTS (SELECT 1 FROM ` + st.orderTable + `
+		WHERE user_id = $1 AND status = $2)`
+	err := tx.QueryRow(FirstOrderQuery, userID, models.OrderStatusProcessed).Scan(&firstOrder)
+	return firstOrder, err
+}
+
+func scanCampaigns(rows *sql.Rows) ([]*models.Campaign, error) {
+	res := []*models.Campaign{}
+	for rows.Next() {
+		c := &models.Campaign{}
+		err := rows.Scan(&c.ID, &c.Name, &c.Condition, &c.Multiplier, &c.Bonus, &c.StartsAt, &c.EndsAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
@@ -16,11 +16,27 @@ import (
 // DBStorage defines a database storage implemented as a wrapper
 // around any database/sql implementation
 type DBStorage struct {
-	db              *sql.DB
-	userTable       string
-	orderTable      string
-	balanceTable    string
-	withdrawalTable string
+	db               *sql.DB
+	userTable        string
+	orderTable       string
+	balanceTable     string
+	withdrawalTable  string
+	jobTable         string
+	ledgerTable      string
+	lotTable         string
+	holdTable        string
+	holdLotTable     string
+	idempotencyTable string
+	tierChangeTable  string
+	campaignTable    string
+	referralTable    string
+	sessionTable     string
+	refreshTable     string
+	resetTable       string
+
+	tiers     *models.TierProgram
+	referrals *models.ReferralProgram
+	policy    *models.WithdrawalPolicy
 }
 
 // DBStorage implements Storage interface
@@ -30,84 +46,67 @@ var _ storage.Storage = (*DBStorage)(nil)
 // is considered unavailable
 const pingTimeout = 2 * time.Second
 
-func NewDBStorage(dsn string) (*DBStorage, error) {
-	if dsn == "" {
-		return nil, fmt.Errorf("DBStorage: empty dsn")
-	}
-
-	db, err := sql.Open("pgx", dsn)
+func NewDBStorage(dsn string, opts storage.Options) (*DBStorage, error) {
+	db, err := openDB(dsn)
 	if err != nil {
-		return nil, fmt.Errorf("DBStorage: Open: %v", err)
+		return nil, err
 	}
 
-	// ping the database before returning DBStorage instance
-	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
-	defer cancel()
-	if err := db.PingContext(ctx); err != nil {
+	// bring the database schema up to date
+	migrator, err := newMigrator(db)
+	if err != nil {
 		db.Close()
-		return nil, fmt.Errorf("DBStorage: Ping: %v", err)
+		return nil, fmt.Errorf("DBStorage: %v", err)
 	}
-
-	// create all the necessary tables in the database
-	userTable := "users"
-	orderTable := "orders"
-	balanceTable := "balance"
-	withdrawalTable := "withdrawals"
-	if err := createTables(db, userTable, orderTable, balanceTable, withdrawalTable); err != nil {
+	if err := migrator.Up(context.Background()); err != nil {
 		db.Close()
-		return nil, fmt.Errorf("DBStorage: Create Tables: %v", err)
+		return nil, fmt.Errorf("DBStorage: Migrate: %v", err)
 	}
 
 	return &DBStorage{
-		db:              db,
-		userTable:       userTable,
-		orderTable:      orderTable,
-		balanceTable:    balanceTable,
-		withdrawalTable: withdrawalTable,
+		db:               db,
+		userTable:        "users",
+		orderTable:       "orders",
+		balanceTable:     "balance",
+		withdrawalTable:  "withdrawals",
+		jobTable:         "accrual_jobs",
+		ledgerTable:      "ledger",
+		lotTable:         "point_lots",
+		holdTable:        "holds",
+		holdLotTable:     "hold_lots",
+		idempotencyTable: "idempotency_keys",
+		tierChangeTable:  "tier_changes",
+		campaignTable:    "campaigns",
+		referralTable:    "referrals",
+		sessionTable:     "sessions",
+		refreshTable:     "refresh_tokens",
+		resetTable:       "password_resets",
+		policy:           opts.WithdrawalPolicy,
+		referrals:        opts.Referrals,
+		tiers:            opts.Tiers,
 	}, nil
 }
 
-func createTables(db *sql.DB, userTable, orderTable, balanceTable, withdrawalTable string) error {
-	userTableQuery := `CREATE TABLE IF NOT EXISTS ` + userTable + ` (
-		id INT primary key GENERATED ALWAYS AS IDENTITY,
-		login VARCHAR(128) NOT NULL UNIQUE,
-		hash VARCHAR(256) NOT NULL
-	)`
-	orderTableQuery := `CREATE TABLE IF NOT EXISTS ` + orderTable + ` (
-		id INT primary key GENERATED ALWAYS AS IDENTITY,
-		number TEXT NOT NULL UNIQUE,
-		status VARCHAR(16) NOT NULL,
-		accrual BIGINT NOT NULL DEFAULT 0,
-		uploaded_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
-		user_id INT NOT NULL REFERENCES ` + userTable + ` (id) ON DELETE CASCADE
-	)`
-	balanceTableQuery := `CREATE TABLE IF NOT EXISTS ` + balanceTable + ` (
-		id INT primary key GENERATED ALWAYS AS IDENTITY,
-		current BIGINT NOT NULL DEFAULT 0,
-		withdrawn BIGINT NOT NULL DEFAULT 0,
-		user_id INT NOT NULL UNIQUE REFERENCES ` + userTable + ` (id) ON DELETE CASCADE
-	)`
-	withdrawalTableQuery := `CREATE TABLE IF NOT EXISTS ` + withdrawalTable + ` (
-		id INT primary key GENERATED ALWAYS AS IDENTITY,
-		number TEXT NOT NULL UNIQUE,
-		withdrawn BIGINT NOT NULL DEFAULT 0,
-		processed_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
-		user_id INT NOT NULL REFERENCES ` + userTable + ` (id) ON DELETE CASCADE
-	)`
-	tx, err := db.BeginTx(context.Background(), nil)
+// openDB connects to the database and makes sure it is available
+func openDB(dsn string) (*sql.DB, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("DBStorage: empty dsn")
+	}
+
+	db, err := sql.Open("pgx", dsn)
 	if err != nil {
-		return fmt.Errorf("DBStorage: createTables: %v", err)
+		return nil, fmt.Errorf("DBStorage: Open: %v", err)
 	}
-	defer tx.Rollback()
 
-	tables := []string{userTableQuery, orderTableQuery, balanceTableQuery, withdrawalTableQuery}
-	for _, tableName := range tables {
-		if _, err := tx.Exec(tableName); err != nil {
-			return fmt.Errorf("DBStorage: createTables: %v", err)
-		}
+	// ping the database before returning the connection pool
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("DBStorage: Ping: %v", err)
 	}
 
-	return tx.Commit()
+	return db, nil
 }
 
 // tests use Truncate() to reset changes
@@ -118,7 +117,7 @@ func (st *DBStorage) TruncateTables() error {
 	}
 	defer tx.Rollback()
 
-	tables := []string{st.userTable, st.orderTable, st.balanceTable, st.withdrawalTable}
+	tables := []string{st.userTable, st.orderTable, st.balanceTable, st.withdrawalTable, st.jobTable, st.ledgerTable, st.lotTable, st.holdTable, st.holdLotTable, st.idempotencyTable, st.tierChangeTable, st.campaignTable, st.referralTable, st.sessionTable, st.refreshTable, st.resetTable}
 	for _, tableName := range tables {
 		if _, err := tx.Exec(`TRUNCATE ` + tableName + ` RESTART IDENTITY CASCADE`); err != nil {
 			return fmt.Errorf("DBStorage: truncateTables: %v", err)
@@ -135,12 +134,30 @@ func (st *DBStorage) AddUser(ctx context.Context, user *models.User) error {
 	}
 	defer tx.Rollback()
 
-	var userID int
+	var userID, referrerID int
+
+	if user.ReferredBy != "" {
+		GetReferrerQuery := `SELECT id FROM ` + st.userTable + ` WHERE referral_code = $1`
+		err = tx.QueryRow(GetReferrerQuery, user.ReferredBy).Scan(&referrerID)
+		switch {
+		case err == sql.ErrNoRows:
+			return storage.ErrReferralCodeMissing
+		case err != nil:
+			return fmt.Errorf("DBStorage: AddUser: %v", err)
+		}
+	}
+
+	if user.ReferralCode == "" {
+		if user.ReferralCode, err = models.NewReferralCode(); err != nil {
+			return fmt.Errorf("DBStorage: AddUser: %v", err)
+		}
+	}
 
-	AddUserQuery := `INSERT INTO ` + st.userTable + `(login, hash) VALUES($1, $2) RETURNING id`
-	err = tx.QueryRow(AddUserQuery, user.Login, user.Hash).Scan(&userID)
+	AddUserQuery := `INSERT INTO ` + st.userTable + `(login, hash, referral_code) VALUES($1, $2, $3) RETURNING id`
+	err = tx.QueryRow(AddUserQuery, user.Login, user.Hash, user.ReferralCode).Scan(&userID)
 	if err != nil {
-		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+		// referral codes are random and practically never collide
+		if strings.Contains(err.Error(), "SQLSTATE 23505") && !strings.Contains(err.Error(), "referral_code") {
 			return storage.ErrLoginAlreadyExists
 		}
 		return fmt.Errorf("DBStorage: AddUser: %v", err)
@@ -152,15 +169,24 @@ func (st *DBStorage) AddUser(ctx context.Context, user *models.User) error {
 		return fmt.Errorf("DBStorage: AddUser: %v", err)
 	}
 
+	if referrerID != 0 {
+		AddReferralQuery := `INSERT INTO ` + st.referralTable + `(referee_id, referrer_id, status)
+			VALUES($1, $2, $3)`
+		_, err = tx.Exec(AddReferralQuery, userID, referrerID, models.ReferralPending)
+		if err != nil {
+			return fmt.Errorf("DBStorage: AddUser: %v", err)
+		}
+	}
+
 	return tx.Commit()
 }
 
 func (st *DBStorage) GetUser(ctx context.Context, user *models.User) (*models.User, error) {
 	dbUser := &models.User{}
 
-	GetURLQuery := `SELECT id, login, hash FROM ` + st.userTable + ` WHERE login=$1`
+	GetURLQuery := `SELECT id, login, hash, referral_code FROM ` + st.userTable + ` WHERE login=$1`
 	err := st.db.QueryRowContext(ctx, GetURLQuery, user.Login).Scan(
-		&dbUser.ID, &dbUser.Login, &dbUser.Hash,
+		&dbUser.ID, &dbUser.Login, &dbUser.Hash, &dbUser.ReferralCode,
 	)
 	switch {
 	case err == sql.ErrNoRows:
@@ -173,9 +199,7 @@ func (st *DBStorage) GetUser(ctx context.Context, user *models.User) (*models.Us
 }
 
 func (st *DBStorage) AddOrder(ctx context.Context, order *models.Order, userID int) error {
-	AddOrderQuery := `INSERT INTO ` + st.orderTable + `(number, status, user_id) 
-		VALUES($1, $2, $3)`
-	_, err := st.db.ExecContext(ctx, AddOrderQuery, order.Number, order.Status, userID)
+	err := st.addOrder(ctx, order, userID)
 
 	if err == nil {
 		return nil
@@ -197,11 +221,33 @@ func (st *DBStorage) AddOrder(ctx context.Context, order *models.Order, userID i
 	return storage.NewExistingOrderError(uid)
 }
 
+// addOrder stores the order along with its accrual job
+func (st *DBStorage) addOrder(ctx context.Context, order *models.Order, userID int) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	AddOrderQuery := `INSERT INTO ` + st.orderTable + `(number, status, user_id) 
+		VALUES($1, $2, $3)`
+	if _, err = tx.Exec(AddOrderQuery, order.Number, order.Status, userID); err != nil {
+		return err
+	}
+
+	AddJobQuery := `INSERT INTO ` + st.jobTable + `(order_number) VALUES($1)`
+	if _, err = tx.Exec(AddJobQuery, order.Number); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (st *DBStorage) GetOrders(ctx context.Context, userID int) ([]*models.Order, error) {
 	res := []*models.Order{}
 
-	GetOrdersQuery := `SELECT number, status, accrual, uploaded_at FROM ` + st.orderTable + `
-		WHERE user_id = $1 ORDER BY uploaded_at ASC`
+	GetOrdersQuery := `SELECT number, status, accrual, bonus, uploaded_at FROM ` + st.orderTable + `
+		WHERE user_id = $1 ORDER BY uploaded_at ASC, id ASC`
 
 	rows, err := st.db.QueryContext(ctx, GetOrdersQuery, userID)
 	if err != nil {
@@ -211,7 +257,7 @@ func (st *DBStorage) GetOrders(ctx context.Context, userID int) ([]*models.Order
 
 	for rows.Next() {
 		order := &models.Order{}
-		err = rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt)
+		err = rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.Bonus, &order.UploadedAt)
 		if err != nil {
 			return nil, fmt.Errorf("DBStorage: GetOrders: %v", err)
 		}
@@ -228,25 +274,50 @@ func (st *DBStorage) GetOrders(ctx context.Context, userID int) ([]*models.Order
 
 func (st *DBStorage) GetBalance(ctx context.Context, userID int) (models.Balance, error) {
 	balance := models.Balance{}
-	GetBalanceQuery := `SELECT current, withdrawn FROM ` + st.balanceTable + ` WHERE user_id=$1`
-	err := st.db.QueryRowContext(ctx, GetBalanceQuery, userID).Scan(
-		&balance.Current, &balance.Withdrawn,
+
+	// The balance and the ledger the tier is derived from are read from the
+	// same snapshot, so the figures and the tier agree; nothing gets locked
+	tx, err := st.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return balance, fmt.Errorf("DBStorage: GetBalance (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	GetBalanceQuery := `SELECT current, withdrawn, expired, held, tier FROM ` + st.balanceTable + ` WHERE user_id=$1`
+	err = tx.QueryRow(GetBalanceQuery, userID).Scan(
+		&balance.Current, &balance.Withdrawn, &balance.Expired, &balance.Held, &balance.Tier,
 	)
 	switch {
 	case err == sql.ErrNoRows:
 		return balance, nil
 	case err != nil:
-		return balance, fmt.Errorf("DBStorage: GetBalance: %v", err)
-	default:
-		return balance, nil
+		return balance, fmt.Errorf("DBStorage: GetBalance (1): %v", err)
+	}
+
+	// The spend basis is counted over a sliding window, so the tier may
+	// have lapsed since it was last updated; the change is recorded by the
+	// next operation on the balance
+	if st.tiers != nil {
+		value, err := st.tierBasis(tx, userID, time.Now())
+		if err != nil {
+			return balance, fmt.Errorf("DBStorage: GetBalance (2): %v", err)
+		}
+		balance.Tier = st.tiers.TierFor(value).Name
+	}
+
+	if err = tx.Commit(); err != nil {
+		return balance, fmt.Errorf("DBStorage: GetBalance (3): %v", err)
 	}
+
+	return balance, nil
 }
 
 func (st *DBStorage) GetWithdrawals(ctx context.Context, userID int) ([]*models.WithdrawalInfo, error) {
 	res := []*models.WithdrawalInfo{}
 
-	GetWithdrawalsQuery := `SELECT number, withdrawn, processed_at FROM ` + st.withdrawalTable + `
-		WHERE user_id = $1 ORDER BY processed_at ASC`
+	GetWithdrawalsQuery := `SELECT number, withdrawn, processed_at, reversed_at,
+		reversal_reason FROM ` + st.withdrawalTable + `
+		WHERE user_id = $1 ORDER BY processed_at ASC, id ASC`
 	rows, err := st.db.QueryContext(ctx, GetWithdrawalsQuery, userID)
 	if err != nil {
 		return nil, fmt.Errorf("DBStorage: GetWithdrawals: %v", err)
@@ -255,10 +326,11 @@ func (st *DBStorage) GetWithdrawals(ctx context.Context, userID int) ([]*models.
 
 	for rows.Next() {
 		info := &models.WithdrawalInfo{}
-		err = rows.Scan(&info.OrderNumber, &info.Sum, &info.ProcessedAt)
+		err = rows.Scan(&info.OrderNumber, &info.Sum, &info.ProcessedAt, &info.ReversedAt, &info.ReversalReason)
 		if err != nil {
 			return nil, fmt.Errorf("DBStorage: GetWithdrawals: %v", err)
 		}
+		info.Reversed = info.ReversedAt != nil
 		res = append(res, info)
 	}
 
@@ -274,7 +346,7 @@ func (st *DBStorage) GetUnprocessedOrders(ctx context.Context, limit int) ([]*mo
 	res := []*models.Order{}
 
 	GetOrdersQuery := `SELECT number FROM ` + st.orderTable + `
-		WHERE STATUS = $1 OR STATUS = $2 ORDER BY uploaded_at ASC LIMIT $3`
+		WHERE STATUS = $1 OR STATUS = $2 ORDER BY uploaded_at ASC, id ASC LIMIT $3`
 
 	rows, err := st.db.QueryContext(
 		ctx,
@@ -306,9 +378,17 @@ func (st *DBStorage) GetUnprocessedOrders(ctx context.Context, limit int) ([]*mo
 }
 
 func (st *DBStorage) UpdateOrderStatus(ctx context.Context, ar *models.AccrualResponse) error {
+	// final statuses are never overwritten
 	UpdateStatusQuery := `UPDATE ` + st.orderTable + ` SET status = $1 WHERE 
-		number = $2`
-	_, err := st.db.ExecContext(ctx, UpdateStatusQuery, ar.Status, ar.OrderNumber)
+		number = $2 AND status NOT IN ($3, $4)`
+	_, err := st.db.ExecContext(
+		ctx,
+		UpdateStatusQuery,
+		ar.Status,
+		ar.OrderNumber,
+		models.OrderStatusInvalid,
+		models.OrderStatusProcessed,
+	)
 	if err != nil {
 		return fmt.Errorf("DBStorage: UpdateOrderStatus: %v", err)
 	}
@@ -324,37 +404,95 @@ func (st *DBStorage) ProcessOrder(ctx context.Context, ar *models.AccrualRespons
 	defer tx.Rollback()
 
 	var userID int
+	var status string
+	var uploadedAt time.Time
 
 	// Get user_id of the order; lock the order row
-	SelectUserIDQuery := `SELECT user_id FROM ` + st.orderTable + ` WHERE 
+	SelectUserIDQuery := `SELECT user_id, status, uploaded_at FROM ` + st.orderTable + ` WHERE 
 		number = $1 FOR UPDATE`
-	err = tx.QueryRow(SelectUserIDQuery, ar.OrderNumber).Scan(&userID)
+	err = tx.QueryRow(SelectUserIDQuery, ar.OrderNumber).Scan(&userID, &status, &uploadedAt)
 	if err != nil {
 		return fmt.Errorf("DBStorage: ProcessOrder (1): %v :: %v", ar, err)
 	}
 
-	var balance int64
+	// The order has already been processed (e.g. by another instance)
+	if status == models.OrderStatusProcessed || status == models.OrderStatusInvalid {
+		return nil
+	}
 
-	// Get the current balance of the user; lock the user row
-	SelectBalanceQuery := `SELECT current FROM ` + st.balanceTable + ` WHERE 
-		user_id = $1 FOR UPDATE`
-	err = tx.QueryRow(SelectBalanceQuery, userID).Scan(&balance)
+	// Lock the user row along with the row of the referrer the order may
+	// reward, in the order of user ids, so the order never deadlocks with
+	// transfers between the two users
+	if err = st.lockReferralBalances(tx, userID); err != nil {
+		return fmt.Errorf("DBStorage: ProcessOrder (2): %v :: %v", ar, err)
+	}
+
+	// The points are multiplied according to the tier the user is in
+	// before the order
+	tier, err := st.updateTier(tx, userID)
 	if err != nil {
 		return fmt.Errorf("DBStorage: ProcessOrder (2): %v :: %v", ar, err)
 	}
+	accrual := tier.Apply(ar.Accrual)
 
-	// Update the user balance; release the user row
-	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = $1 
+	// Campaign bonuses are computed from the points the accrual system
+	// granted, not multiplied by the tier
+	var bonus models.Money
+	var campaigns []string
+	var firstOrder bool
+	if ar.Status == models.OrderStatusProcessed {
+		if firstOrder, err = st.isFirstOrder(tx, userID); err != nil {
+			return fmt.Errorf("DBStorage: ProcessOrder (2): %v :: %v", ar, err)
+		}
+		// the fixed bonuses are granted even if the order earned nothing
+		bonus, campaigns, err = st.campaignBonus(tx, ar.Accrual, uploadedAt, firstOrder)
+		if err != nil {
+			return fmt.Errorf("DBStorage: ProcessOrder (2): %v :: %v", ar, err)
+		}
+	}
+
+	// Credit the user balance
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current + $1 
 		WHERE user_id = $2`
-	_, err = tx.Exec(UpdateBalanceQuery, balance+int64(ar.Accrual), userID)
+	_, err = tx.Exec(UpdateBalanceQuery, accrual+bonus, userID)
 	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessOrder (2): %v :: %v", ar, err)
+	}
+
+	if accrual > 0 {
+		err = st.addLedgerEntry(tx, models.NewAccrualEntry(userID, accrual, ar.OrderNumber, tier))
+		if err != nil {
+			return fmt.Errorf("DBStorage: ProcessOrder (3): %v :: %v", ar, err)
+		}
+	}
+	if bonus > 0 {
+		err = st.addLedgerEntry(tx, models.NewBonusEntry(userID, bonus, ar.OrderNumber, campaigns))
+		if err != nil {
+			return fmt.Errorf("DBStorage: ProcessOrder (3): %v :: %v", ar, err)
+		}
+	}
+	if accrual+bonus > 0 {
+		err = st.addPointLot(tx, userID, accrual+bonus, ar.OrderNumber)
+		if err != nil {
+			return fmt.Errorf("DBStorage: ProcessOrder (3): %v :: %v", ar, err)
+		}
+	}
+
+	// The order itself may move the user to a higher tier
+	if _, err = st.updateTier(tx, userID); err != nil {
 		return fmt.Errorf("DBStorage: ProcessOrder (3): %v :: %v", ar, err)
 	}
 
-	// Update the order status and accrual; release the order row
+	if firstOrder {
+		if err = st.rewardReferral(tx, userID, ar.Accrual, ar.OrderNumber); err != nil {
+			return fmt.Errorf("DBStorage: ProcessOrder (3): %v :: %v", ar, err)
+		}
+	}
+
+	// Update the order status, accrual and bonus; release the order row
 	UpdateOrderQuery := `UPDATE ` + st.orderTable + ` SET status = $1, 
-		accrual = $2 WHERE number = $3`
-	_, err = tx.Exec(UpdateOrderQuery, ar.Status, ar.Accrual, ar.OrderNumber)
+		accrual = $2, bonus = $3 WHERE number = $4`
+	_, err = tx.Exec(UpdateOrderQuery, ar.Status, accrual, bonus, ar.OrderNumber)
 	if err != nil {
 		return fmt.Errorf("DBStorage: ProcessOrder (4): %v :: %v", ar, err)
 	}
@@ -364,45 +502,239 @@ func (st *DBStorage) ProcessOrder(ctx context.Context, ar *models.AccrualRespons
 }
 
 func (st *DBStorage) ProcessWithdraw(ctx context.Context, wr *models.WithdrawRequest, userID int) error {
+	if wr.Sum <= 0 {
+		return storage.ErrZeroAmount
+	}
+
 	tx, err := st.db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("DBStorage: ProcessWithdraw (0): %v", err)
 	}
 	defer tx.Rollback()
 
-	var balance, withdrawn models.Money
+	var balance models.Money
 
-	// Get the current balance and the sum withdrawn of the user; lock the user row
-	SelectBalanceQuery := `SELECT current, withdrawn FROM ` + st.balanceTable + ` WHERE 
+	// Get the current balance of the user; lock the user row
+	SelectBalanceQuery := `SELECT current FROM ` + st.balanceTable + ` WHERE 
 		user_id = $1 FOR UPDATE`
-	err = tx.QueryRow(SelectBalanceQuery, userID).Scan(&balance, &withdrawn)
+	err = tx.QueryRow(SelectBalanceQuery, userID).Scan(&balance)
 	if err != nil {
-		return fmt.Errorf("DBStorage: ProcessOrder (1): %v :: %v", wr, err)
+		return fmt.Errorf("DBStorage: ProcessWithdraw (1): %v :: %v", wr, err)
+	}
+
+	if st.policy != nil {
+		now := time.Now()
+		h, err := st.withdrawalHistory(tx, userID, now)
+		if err != nil {
+			return fmt.Errorf("DBStorage: ProcessWithdraw (1): %v :: %v", wr, err)
+		}
+		if err := st.policy.Check(wr.Sum, h, now); err != nil {
+			return err
+		}
 	}
 
 	if balance < wr.Sum {
 		return storage.ErrInsufficientFunds
 	}
 
-	// Update the user balance and the sum withdrawn; release the user row
-	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = $1, 
-		withdrawn = $2 WHERE user_id = $3`
-	_, err = tx.Exec(UpdateBalanceQuery, balance-wr.Sum, withdrawn+wr.Sum, userID)
+	// the number of an active hold is taken until the hold is settled
+	var held bool
+	CheckHoldQuery := `SELECT EXISTS(SELECT 1 FROM ` + st.holdTable + `
+		WHERE number = $1 AND status = $2)`
+	err = tx.QueryRow(CheckHoldQuery, wr.OrderNumber, models.HoldStatusHeld).Scan(&held)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessWithdraw (2): %v :: %v", wr, err)
+	}
+	if held {
+		return storage.ErrWithdrawalAlreadyExists
+	}
+
+	// Update the user balance and the sum withdrawn
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current - $1, 
+		withdrawn = withdrawn + $1 WHERE user_id = $2`
+	_, err = tx.Exec(UpdateBalanceQuery, wr.Sum, userID)
 	if err != nil {
-		return fmt.Errorf("DBStorage: ProcessOrder (2): %v :: %v", wr, err)
+		return fmt.Errorf("DBStorage: ProcessWithdraw (3): %v :: %v", wr, err)
 	}
 
 	UpdateWithdrawalsQuery := `INSERT INTO ` + st.withdrawalTable + `(number, 
 		withdrawn, user_id) VALUES($1, $2, $3)`
 	_, err = tx.Exec(UpdateWithdrawalsQuery, wr.OrderNumber, wr.Sum, userID)
 	if err != nil {
-		return fmt.Errorf("DBStorage: ProcessOrder (3): %v :: %v", wr, err)
+		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+			return storage.ErrWithdrawalAlreadyExists
+		}
+		return fmt.Errorf("DBStorage: ProcessWithdraw (4): %v :: %v", wr, err)
+	}
+
+	err = st.addLedgerEntry(tx, &models.LedgerEntry{
+		Kind:        models.LedgerWithdrawal,
+		From:        models.UserAccount(userID),
+		To:          models.AccountWithdrawals,
+		Amount:      wr.Sum,
+		OrderNumber: wr.OrderNumber,
+	})
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessWithdraw (5): %v :: %v", wr, err)
+	}
+	err = st.consumePointLots(tx, userID, wr.Sum)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessWithdraw (5): %v :: %v", wr, err)
+	}
+
+	// The points spent may move the user to a higher tier
+	if _, err = st.updateTier(tx, userID); err != nil {
+		return fmt.Errorf("DBStorage: ProcessWithdraw (6): %v :: %v", wr, err)
 	}
 
 	// Good luck with all the above mentioned stuff
 	return tx.Commit()
 }
 
+func (st *DBStorage) ReverseWithdrawal(ctx context.Context, orderNumber, reversedBy, reason string) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ReverseWithdrawal (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var sum models.Money
+	var reversedAt sql.NullTime
+
+	// Get the withdrawal; lock the withdrawal row
+	SelectWithdrawalQuery := `SELECT user_id, withdrawn, reversed_at FROM ` + st.withdrawalTable + `
+		WHERE number = $1 FOR UPDATE`
+	err = tx.QueryRow(SelectWithdrawalQuery, orderNumber).Scan(&userID, &sum, &reversedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return storage.ErrWithdrawalMissing
+	case err != nil:
+		return fmt.Errorf("DBStorage: ReverseWithdrawal (1): %s :: %v", orderNumber, err)
+	case reversedAt.Valid:
+		return storage.ErrWithdrawalReversed
+	}
+
+	// Return the sum to the user balance; lock the user row
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current + $1,
+		withdrawn = withdrawn - $1 WHERE user_id = $2`
+	_, err = tx.Exec(UpdateBalanceQuery, sum, userID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ReverseWithdrawal (2): %s :: %v", orderNumber, err)
+	}
+
+	UpdateWithdrawalQuery := `UPDATE ` + st.withdrawalTable + ` SET reversed_at = NOW(),
+		reversed_by = $1, reversal_reason = $2 WHERE number = $3`
+	_, err = tx.Exec(UpdateWithdrawalQuery, reversedBy, reason, orderNumber)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ReverseWithdrawal (3): %s :: %v", orderNumber, err)
+	}
+
+	if sum > 0 {
+		err = st.addLedgerEntry(tx, models.NewReversalEntry(userID, sum, orderNumber, reversedBy, reason))
+		if err != nil {
+			return fmt.Errorf("DBStorage: ReverseWithdrawal (4): %s :: %v", orderNumber, err)
+		}
+		// the lots the points were taken from are not tracked, so the
+		// points returned start their lifetime anew
+		err = st.addPointLot(tx, userID, sum, orderNumber)
+		if err != nil {
+			return fmt.Errorf("DBStorage: ReverseWithdrawal (5): %s :: %v", orderNumber, err)
+		}
+	}
+
+	// The points returned are not spent, the user may drop to a lower tier
+	if _, err = st.updateTier(tx, userID); err != nil {
+		return fmt.Errorf("DBStorage: ReverseWithdrawal (6): %s :: %v", orderNumber, err)
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) AcquireAccrualJobs(ctx context.Context, workerID string, limit int, lease time.Duration) ([]*models.AccrualJob, error) {
+	res := []*models.AccrualJob{}
+
+	// Lease due jobs which are not leased by anyone else; rows locked by
+	// concurrent transactions are skipped instead of being waited for
+	AcquireJobsQuery := `UPDATE ` + st.jobTable + ` AS j SET locked_by = $1, 
+		locked_until = NOW() + $2::BIGINT * INTERVAL '1 millisecond'
+		FROM ` + st.orderTable + ` AS o
+		WHERE o.number = j.order_number AND j.id IN (
+			SELECT id FROM ` + st.jobTable + `
+			WHERE next_attempt_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW()) 
+				AND gave_up_at IS NULL
+			ORDER BY next_attempt_at ASC LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING j.order_number, o.status, j.attempts, j.next_attempt_at, j.last_error, j.created_at`
+
+	rows, err := st.db.QueryContext(ctx, AcquireJobsQuery, workerID, lease.Milliseconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: AcquireAccrualJobs: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		job := &models.AccrualJob{}
+		err = rows.Scan(
+			&job.OrderNumber, &job.OrderStatus, &job.Attempts,
+			&job.NextAttemptAt, &job.LastError, &job.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: AcquireAccrualJobs: %v", err)
+		}
+		res = append(res, job)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: AcquireAccrualJobs: %v", err)
+	}
+
+	return res, nil
+}
+
+func (st *DBStorage) ReleaseAccrualJob(ctx context.Context, job *models.AccrualJob, workerID string) error {
+	// jobs given up on keep the moment it happened, so ops can find them
+	ReleaseJobQuery := `UPDATE ` + st.jobTable + ` SET attempts = $1, next_attempt_at = $2, 
+		last_error = $3, locked_by = '', locked_until = NULL, 
+		gave_up_at = CASE WHEN $4::BOOLEAN THEN NOW() ELSE NULL END 
+		WHERE order_number = $5 AND locked_by = $6`
+	res, err := st.db.ExecContext(
+		ctx,
+		ReleaseJobQuery,
+		job.Attempts,
+		job.NextAttemptAt,
+		job.LastError,
+		job.GaveUp,
+		job.OrderNumber,
+		workerID,
+	)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ReleaseAccrualJob: %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("DBStorage: ReleaseAccrualJob: %v", err)
+	}
+	if n == 0 {
+		return storage.ErrAccrualJobLeaseLost
+	}
+
+	return nil
+}
+
+func (st *DBStorage) CompleteAccrualJob(ctx context.Context, orderNumber string) error {
+	CompleteJobQuery := `DELETE FROM ` + st.jobTable + ` WHERE order_number = $1`
+	_, err := st.db.ExecContext(ctx, CompleteJobQuery, orderNumber)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CompleteAccrualJob: %v", err)
+	}
+
+	return nil
+}
+
 func (st *DBStorage) Close() error {
 	if st.db == nil {
 		return nil
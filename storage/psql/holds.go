@@ -0,0 +1,324 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (st *DBStorage) CreateHold(ctx context.Context, hold *models.Hold, userID int) error {
+	if hold.Sum <= 0 {
+		return storage.ErrZeroAmount
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CreateHold (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	var balance models.Money
+
+	// Get the current balance of the user; lock the user row
+	SelectBalanceQuery := `SELECT current FROM ` + st.balanceTable + ` WHERE
+		user_id = $1 FOR UPDATE`
+	err = tx.QueryRow(SelectBalanceQuery, userID).Scan(&balance)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CreateHold (1): %v :: %v", hold, err)
+	}
+
+	if st.policy != nil {
+		now := time.Now()
+		h, err := st.withdrawalHistory(tx, userID, now)
+		if err != nil {
+			return fmt.Errorf("DBStorage: CreateHold (1): %v :: %v", hold, err)
+		}
+		if err := st.policy.Check(hold.Sum, h, now); err != nil {
+			return err
+		}
+	}
+
+	if balance < hold.Sum {
+		return storage.ErrInsufficientFunds
+	}
+
+	// the order number identifies the hold and later the withdrawal
+	var withdrawn bool
+	CheckWithdrawalQuery := `SELECT EXISTS(SELECT 1 FROM ` + st.withdrawalTable + `
+		WHERE number = $1)`
+	err = tx.QueryRow(CheckWithdrawalQuery, hold.OrderNumber).Scan(&withdrawn)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CreateHold (2): %v :: %v", hold, err)
+	}
+	if withdrawn {
+		return storage.ErrHoldAlreadyExists
+	}
+
+	var holdID int64
+	AddHoldQuery := `INSERT INTO ` + st.holdTable + ` (number, amount, status, expires_at,
+		user_id) VALUES($1, $2, $3, $4, $5) RETURNING id, created_at`
+	err = tx.QueryRow(AddHoldQuery, hold.OrderNumber, hold.Sum, models.HoldStatusHeld,
+		hold.ExpiresAt, userID).Scan(&holdID, &hold.CreatedAt)
+	if err != nil {
+		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+			return storage.ErrHoldAlreadyExists
+		}
+		return fmt.Errorf("DBStorage: CreateHold (3): %v :: %v", hold, err)
+	}
+	hold.Status = models.HoldStatusHeld
+
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current - $1,
+		held = held + $1 WHERE user_id = $2`
+	_, err = tx.Exec(UpdateBalanceQuery, hold.Sum, userID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CreateHold (4): %v :: %v", hold, err)
+	}
+
+	err = st.addLedgerEntry(tx, models.NewHoldEntry(userID, hold.Sum, hold.OrderNumber))
+	if err != nil {
+		return fmt.Errorf("DBStorage: CreateHold (5): %v :: %v", hold, err)
+	}
+	taken, err := st.takePointLots(tx, userID, hold.Sum)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CreateHold (6): %v :: %v", hold, err)
+	}
+
+	// remember the lots, so the points keep their lifetime if returned
+	AddHoldLotQuery := `INSERT INTO ` + st.holdLotTable + ` (hold_id, lot_id, amount)
+		VALUES($1, $2, $3)`
+	for _, t := range taken {
+		if t.amount == 0 {
+			continue
+		}
+		if _, err = tx.Exec(AddHoldLotQuery, holdID, t.lotID, t.amount); err != nil {
+			return fmt.Errorf("DBStorage: CreateHold (7): %v :: %v", hold, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) CaptureHold(ctx context.Context, orderNumber string, userID int) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CaptureHold (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	sum, expiresAt, err := st.lockActiveHold(tx, orderNumber, userID)
+	if err != nil {
+		return err
+	}
+	if !expiresAt.After(time.Now()) {
+		return storage.ErrHoldSettled
+	}
+
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET held = held - $1,
+		withdrawn = withdrawn + $1 WHERE user_id = $2`
+	_, err = tx.Exec(UpdateBalanceQuery, sum, userID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CaptureHold (1): %s :: %v", orderNumber, err)
+	}
+
+	err = st.settleHold(tx, orderNumber, models.HoldStatusCaptured)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CaptureHold (2): %s :: %v", orderNumber, err)
+	}
+
+	AddWithdrawalQuery := `INSERT INTO ` + st.withdrawalTable + `(number,
+		withdrawn, user_id) VALUES($1, $2, $3)`
+	_, err = tx.Exec(AddWithdrawalQuery, orderNumber, sum, userID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CaptureHold (3): %s :: %v", orderNumber, err)
+	}
+
+	err = st.addLedgerEntry(tx, models.NewReleaseEntry(userID, sum, orderNumber))
+	if err != nil {
+		return fmt.Errorf("DBStorage: CaptureHold (4): %s :: %v", orderNumber, err)
+	}
+	err = st.addLedgerEntry(tx, &models.LedgerEntry{
+		Kind:        models.LedgerWithdrawal,
+		From:        models.UserAccount(userID),
+		To:          models.AccountWithdrawals,
+		Amount:      sum,
+		OrderNumber: orderNumber,
+	})
+	if err != nil {
+		return fmt.Errorf("DBStorage: CaptureHold (5): %s :: %v", orderNumber, err)
+	}
+
+	// The points spent may move the user to a higher tier
+	if _, err = st.updateTier(tx, userID); err != nil {
+		return fmt.Errorf("DBStorage: CaptureHold (6): %s :: %v", orderNumber, err)
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) ReleaseHold(ctx context.Context, orderNumber string, userID int) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ReleaseHold (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	sum, _, err := st.lockActiveHold(tx, orderNumber, userID)
+	if err != nil {
+		return err
+	}
+
+	err = st.releaseHold(tx, orderNumber, sum, userID, models.HoldStatusReleased)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ReleaseHold (1): %s :: %v", orderNumber, err)
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) ExpireHolds(ctx context.Context, now time.Time) (int, error) {
+	type dueHold struct {
+		number string
+		userID int
+	}
+
+	SelectHoldsQuery := `SELECT number, user_id FROM ` + st.holdTable + ` WHERE
+		status = $1 AND expires_at <= $2 ORDER BY expires_at ASC, id ASC`
+	rows, err := st.db.QueryContext(ctx, SelectHoldsQuery, models.HoldStatusHeld, now)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpireHolds: %v", err)
+	}
+	due := []dueHold{}
+	for rows.Next() {
+		var h dueHold
+		if err := rows.Scan(&h.number, &h.userID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("DBStorage: ExpireHolds: %v", err)
+		}
+		due = append(due, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpireHolds: %v", err)
+	}
+
+	// every hold is handled in a transaction of own, a hold captured or
+	// released meanwhile is skipped
+	expired := 0
+	for _, h := range due {
+		ok, err := st.expireHold(ctx, h.number, h.userID)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+func (st *DBStorage) expireHold(ctx context.Context, orderNumber string, userID int) (bool, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("DBStorage: ExpireHolds (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	sum, _, err := st.lockActiveHold(tx, orderNumber, userID)
+	if err == storage.ErrHoldSettled {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = st.releaseHold(tx, orderNumber, sum, userID, models.HoldStatusExpired)
+	if err != nil {
+		return false, fmt.Errorf("DBStorage: ExpireHolds (1): %s :: %v", orderNumber, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("DBStorage: ExpireHolds (2): %s :: %v", orderNumber, err)
+	}
+
+	return true, nil
+}
+
+// lockActiveHold locks the user's balance row and then the hold row as a
+// part of tx, the hold must be neither captured nor released yet
+func (st *DBStorage) lockActiveHold(tx *sql.Tx, orderNumber string, userID int) (models.Money, time.Time, error) {
+	var sum models.Money
+	var status string
+	var expiresAt time.Time
+
+	// the balance row is locked first just like the other balance changes do
+	LockBalanceQuery := `SELECT user_id FROM ` + st.balanceTable + ` WHERE
+		user_id = $1 FOR UPDATE`
+	err := tx.QueryRow(LockBalanceQuery, userID).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, expiresAt, fmt.Errorf("DBStorage: lockActiveHold (0): %s :: %v", orderNumber, err)
+	}
+
+	SelectHoldQuery := `SELECT amount, status, expires_at FROM ` + st.holdTable + ` WHERE
+		number = $1 AND user_id = $2 FOR UPDATE`
+	err = tx.QueryRow(SelectHoldQuery, orderNumber, userID).Scan(&sum, &status, &expiresAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, expiresAt, storage.ErrHoldMissing
+	case err != nil:
+		return 0, expiresAt, fmt.Errorf("DBStorage: lockActiveHold (1): %s :: %v", orderNumber, err)
+	case status != models.HoldStatusHeld:
+		return 0, expiresAt, storage.ErrHoldSettled
+	}
+
+	return sum, expiresAt, nil
+}
+
+// settleHold sets the final status of the hold as a part of tx
+func (st *DBStorage) settleHold(tx *sql.Tx, orderNumber, status string) error {
+	SettleHoldQuery := `UPDATE ` + st.holdTable + ` SET status = $1, settled_at = NOW()
+		WHERE number = $2`
+	_, err := tx.Exec(SettleHoldQuery, status, orderNumber)
+	return err
+}
+
+// releaseHold returns the points held back to the user and settles the
+// hold with status as a part of tx
+func (st *DBStorage) releaseHold(tx *sql.Tx, orderNumber string, sum models.Money, userID int, status string) error {
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET held = held - $1,
+		current = current + $1 WHERE user_id = $2`
+	if _, err := tx.Exec(UpdateBalanceQuery, sum, userID); err != nil {
+		return err
+	}
+
+	if err := st.settleHold(tx, orderNumber, status); err != nil {
+		return err
+	}
+
+	if err := st.addLedgerEntry(tx, models.NewReleaseEntry(userID, sum, orderNumber)); err != nil {
+		return err
+	}
+
+	// the points go back to the lots they were taken from, so holding the
+	// points does not prolong their lifetime
+	var restored models.Money
+	RestoreLotsQuery := `WITH restored AS (
+			UPDATE ` + st.lotTable + ` AS l SET remaining = l.remaining + hl.amount
+			FROM ` + st.holdLotTable + ` AS hl JOIN ` + st.holdTable + ` AS h ON h.id = hl.hold_id
+			WHERE h.number = $1 AND l.id = hl.lot_id RETURNING hl.amount
+		) SELECT COALESCE(SUM(amount), 0)::BIGINT FROM restored`
+	if err := tx.QueryRow(RestoreLotsQuery, orderNumber).Scan(&restored); err != nil {
+		return err
+	}
+
+	// the points held without lots to take them from start their lifetime anew
+	if restored < sum {
+		return st.addPointLot(tx, userID, sum-restored, orderNumber)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+func (st *DBStorage) ReserveIdempotencyKey(ctx context.Context, rec *models.IdempotencyRecord, staleBefore, leaseBefore time.Time) (*models.IdempotencyRecord, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: ReserveIdempotencyKey (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	// the record which has outlived the retention window is no longer
+	// replayed, and the request which has outlived its lease is assumed
+	// to have never finished
+	DeleteStaleQuery := `DELETE FROM ` + st.idempotencyTable + ` WHERE
+		user_id = $1 AND key = $2 AND (created_at < $3 OR (NOT completed AND created_at < $4))`
+	_, err = tx.Exec(DeleteStaleQuery, rec.UserID, rec.Key, staleBefore, leaseBefore)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: ReserveIdempotencyKey (1): %v", err)
+	}
+
+	AddKeyQuery := `INSERT INTO ` + st.idempotencyTable + ` (user_id, key, request_hash)
+		VALUES($1, $2, $3) ON CONFLICT (user_id, key) DO NOTHING RETURNING created_at`
+	err = tx.QueryRow(AddKeyQuery, rec.UserID, rec.Key, rec.RequestHash).Scan(&rec.CreatedAt)
+	switch {
+	case err == nil:
+		rec.Completed = false
+		return nil, tx.Commit()
+	case err != sql.ErrNoRows:
+		return nil, fmt.Errorf("DBStorage: ReserveIdempotencyKey (2): %v", err)
+	}
+
+	// the key has already been used
+	existing := &models.IdempotencyRecord{UserID: rec.UserID, Key: rec.Key}
+	GetKeyQuery := `SELECT request_hash, completed, status_code, content_type, body,
+		created_at FROM ` + st.idempotencyTable + ` WHERE user_id = $1 AND key = $2`
+	err = tx.QueryRow(GetKeyQuery, rec.UserID, rec.Key).Scan(&existing.RequestHash,
+		&existing.Completed, &existing.StatusCode, &existing.ContentType, &existing.Body,
+		&existing.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: ReserveIdempotencyKey (3): %v", err)
+	}
+
+	return existing, tx.Commit()
+}
+
+func (st *DBStorage) CompleteIdempotencyKey(ctx context.Context, rec *models.IdempotencyRecord) error {
+	CompleteKeyQuery := `UPDATE ` + st.idempotencyTable + ` SET completed = TRUE,
+		status_code = $1, content_type = $2, body = $3 WHERE user_id = $4 AND key = $5`
+	_, err := st.db.ExecContext(ctx, CompleteKeyQuery, rec.StatusCode, rec.ContentType,
+		rec.Body, rec.UserID, rec.Key)
+	if err != nil {
+		return fmt.Errorf("DBStorage: CompleteIdempotencyKey: %v", err)
+	}
+
+	return nil
+}
+
+func (st *DBStorage) DeleteIdempotencyKey(ctx context.Context, userID int, key string) error {
+	DeleteKeyQuery := `DELETE FROM ` + st.idempotencyTable + ` WHERE user_id = $1 AND key = $2`
+	_, err := st.db.ExecContext(ctx, DeleteKeyQuery, userID, key)
+	if err != nil {
+		return fmt.Errorf("DBStorage: DeleteIdempotencyKey: %v", err)
+	}
+
+	return nil
+}
+
+func (st *DBStorage) PurgeIdempotencyKeys(ctx context.Context, createdBefore time.Time) (int, error) {
+	PurgeKeysQuery := `DELETE FROM ` + st.idempotencyTable + ` WHERE created_at < $1`
+	res, err := st.db.ExecContext(ctx, PurgeKeysQuery, createdBefore)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: PurgeIdempotencyKeys: %v", err)
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: PurgeIdempotencyKeys: %v", err)
+	}
+
+	return int(purged), nil
+}
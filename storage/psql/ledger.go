@@ -0,0 +1,187 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+// addLedgerEntry appends the entry to the ledger as a part of tx
+func (st *DBStorage) addLedgerEntry(tx *sql.Tx, e *models.LedgerEntry) error {
+	AddEntryQuery := `INSERT INTO ` + st.ledgerTable + ` (kind, from_account,
+		to_account, amount, order_number, comment) VALUES($1, $2, $3, $4, $5, $6)`
+	_, err := tx.Exec(AddEntryQuery, e.Kind, e.From, e.To, e.Amount, e.OrderNumber, e.Comment)
+	return err
+}
+
+// ledgerBalancesQuery derives the current, the withdrawn, the expired and
+// the held points of every account from the ledger; the entry kinds it
+// relies on are passed as ledgerBalancesArgs()
+func (st *DBStorage) ledgerBalancesQuery() string {
+	return `SELECT account, SUM(amount)::BIGINT AS current, SUM(withdrawn)::BIGINT AS withdrawn,
+			SUM(expired)::BIGINT AS expired, SUM(held)::BIGINT AS held FROM (
+			SELECT to_account AS account, amount, CASE WHEN kind = $3 THEN -amount ELSE 0 END AS withdrawn,
+				0 AS expired, CASE WHEN kind = $5 THEN -amount ELSE 0 END AS held FROM ` + st.ledgerTable + `
+			UNION ALL
+			SELECT from_account, -amount, CASE WHEN kind = $1 THEN amount ELSE 0 END,
+				CASE WHEN kind = $2 THEN amount ELSE 0 END,
+				CASE WHEN kind = $4 THEN amount ELSE 0 END FROM ` + st.ledgerTable + `
+		) AS entries GROUP BY account`
+}
+
+// ledgerBalancesArgs returns the arguments of ledgerBalancesQuery()
+func ledgerBalancesArgs() []interface{} {
+	return []interface{}{
+		models.LedgerWithdrawal,
+		models.LedgerExpiration,
+		models.LedgerReversal,
+		models.LedgerHold,
+		models.LedgerRelease,
+	}
+}
+
+func (st *DBStorage) AddAdjustment(ctx context.Context, userID int, amount models.Money, comment string) error {
+	if amount == 0 {
+		return storage.ErrZeroAmount
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddAdjustment (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	var balance models.Money
+
+	// Get the current balance of the user; lock the user row
+	SelectBalanceQuery := `SELECT current FROM ` + st.balanceTable + ` WHERE
+		user_id = $1 FOR UPDATE`
+	err = tx.QueryRow(SelectBalanceQuery, userID).Scan(&balance)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddAdjustment (1): %v", err)
+	}
+
+	if balance+amount < 0 {
+		return storage.ErrInsufficientFunds
+	}
+
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current + $1
+		WHERE user_id = $2`
+	_, err = tx.Exec(UpdateBalanceQuery, amount, userID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddAdjustment (2): %v", err)
+	}
+
+	err = st.addLedgerEntry(tx, models.NewAdjustmentEntry(userID, amount, comment))
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddAdjustment (3): %v", err)
+	}
+
+	if amount > 0 {
+		err = st.addPointLot(tx, userID, amount, "")
+	} else {
+		err = st.consumePointLots(tx, userID, -amount)
+	}
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddAdjustment (4): %v", err)
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) GetLedger(ctx context.Context, userID int) ([]*models.LedgerEntry, error) {
+	res := []*models.LedgerEntry{}
+
+	GetLedgerQuery := `SELECT id, kind, from_account, to_account, amount, order_number,
+		comment, created_at FROM ` + st.ledgerTable + `
+		WHERE from_account = $1 OR to_account = $1 ORDER BY id ASC`
+	rows, err := st.db.QueryContext(ctx, GetLedgerQuery, models.UserAccount(userID))
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetLedger: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &models.LedgerEntry{}
+		err = rows.Scan(&e.ID, &e.Kind, &e.From, &e.To, &e.Amount, &e.OrderNumber, &e.Comment, &e.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: GetLedger: %v", err)
+		}
+		res = append(res, e)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetLedger: %v", err)
+	}
+
+	return res, nil
+}
+
+func (st *DBStorage) ReconcileBalances(ctx context.Context) ([]*models.BalanceMismatch, error) {
+	res := []*models.BalanceMismatch{}
+
+	ReconcileQuery := `SELECT b.user_id, b.current, b.withdrawn, b.expired, b.held,
+			COALESCE(l.current, 0), COALESCE(l.withdrawn, 0), COALESCE(l.expired, 0),
+			COALESCE(l.held, 0)
+		FROM ` + st.balanceTable + ` AS b LEFT JOIN (` + st.ledgerBalancesQuery() + `) AS l
+			ON l.account = 'user:' || b.user_id
+		WHERE b.current <> COALESCE(l.current, 0) OR b.withdrawn <> COALESCE(l.withdrawn, 0)
+			OR b.expired <> COALESCE(l.expired, 0) OR b.held <> COALESCE(l.held, 0)
+		ORDER BY b.user_id ASC`
+	rows, err := st.db.QueryContext(ctx, ReconcileQuery, ledgerBalancesArgs()...)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: ReconcileBalances: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &models.BalanceMismatch{}
+		err = rows.Scan(&m.UserID, &m.Cached.Current, &m.Cached.Withdrawn, &m.Cached.Expired, &m.Cached.Held,
+			&m.Ledger.Current, &m.Ledger.Withdrawn, &m.Ledger.Expired, &m.Ledger.Held)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: ReconcileBalances: %v", err)
+		}
+		res = append(res, m)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: ReconcileBalances: %v", err)
+	}
+
+	return res, nil
+}
+
+func (st *DBStorage) RebuildBalances(ctx context.Context) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: RebuildBalances (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	// Balances changed meanwhile would be overwritten with stale values,
+	// so nobody is allowed to change them until the rebuild is committed
+	_, err = tx.ExecContext(ctx, `LOCK TABLE `+st.balanceTable+` IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return fmt.Errorf("DBStorage: RebuildBalances (1): %v", err)
+	}
+
+	RebuildQuery := `UPDATE ` + st.balanceTable + ` AS b
+		SET current = COALESCE(l.current, 0), withdrawn = COALESCE(l.withdrawn, 0),
+			expired = COALESCE(l.expired, 0), held = COALESCE(l.held, 0)
+		FROM ` + st.balanceTable + ` AS b2 LEFT JOIN (` + st.ledgerBalancesQuery() + `) AS l
+			ON l.account = 'user:' || b2.user_id
+		WHERE b2.id = b.id AND (b.current <> COALESCE(l.current, 0)
+			OR b.withdrawn <> COALESCE(l.withdrawn, 0) OR b.expired <> COALESCE(l.expired, 0)
+			OR b.held <> COALESCE(l.held, 0))`
+	_, err = tx.ExecContext(ctx, RebuildQuery, ledgerBalancesArgs()...)
+	if err != nil {
+		return fmt.Errorf("DBStorage: RebuildBalances (2): %v", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,205 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+// addPointLot records the points credited to the user as a part of tx
+func (st *DBStorage) addPointLot(tx *sql.Tx, userID int, amount models.Money, orderNumber string) error {
+	AddLotQuery := `INSERT INTO ` + st.lotTable + ` (user_id, order_number, amount,
+		remaining) VALUES($1, $2, $3, $3)`
+	_, err := tx.Exec(AddLotQuery, userID, orderNumber, amount)
+	return err
+}
+
+// lotTake is the part of a lot the points were taken from
+type lotTake struct {
+	lotID  int64
+	amount models.Money
+}
+
+// consumePointLots takes amount from the oldest lots of the user as a part
+// of tx; the caller has locked the user's balance row, which keeps the
+// lots of the user from being changed concurrently
+func (st *DBStorage) consumePointLots(tx *sql.Tx, userID int, amount models.Money) error {
+	_, err := st.takePointLots(tx, userID, amount)
+	return err
+}
+
+// takePointLots is consumePointLots which tells where the points were taken from
+func (st *DBStorage) takePointLots(tx *sql.Tx, userID int, amount models.Money) ([]lotTake, error) {
+	type lot struct {
+		id        int64
+		remaining models.Money
+	}
+
+	SelectLotsQuery := `SELECT id, remaining FROM ` + st.lotTable + ` WHERE
+		user_id = $1 AND remaining > 0 ORDER BY credited_at ASC, id ASC`
+	rows, err := tx.Query(SelectLotsQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	lots := []lot{}
+	left := amount
+	for rows.Next() && left > 0 {
+		var l lot
+		if err := rows.Scan(&l.id, &l.remaining); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lots = append(lots, l)
+		left -= l.remaining
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The balance has been checked already, lots falling short of amount
+	// mean points credited bypassing lots and there is nothing to consume
+	UpdateLotQuery := `UPDATE ` + st.lotTable + ` SET remaining = $1 WHERE id = $2`
+	taken := make([]lotTake, 0, len(lots))
+	left = amount
+	for _, l := range lots {
+		spent := l.remaining
+		if spent > left {
+			spent = left
+		}
+		if _, err := tx.Exec(UpdateLotQuery, l.remaining-spent, l.id); err != nil {
+			return nil, err
+		}
+		taken = append(taken, lotTake{lotID: l.id, amount: spent})
+		left -= spent
+	}
+
+	return taken, nil
+}
+
+func (st *DBStorage) GetPointLots(ctx context.Context, userID int) ([]*models.PointLot, error) {
+	res := []*models.PointLot{}
+
+	GetLotsQuery := `SELECT order_number, amount, remaining, credited_at FROM ` + st.lotTable + `
+		WHERE user_id = $1 AND remaining > 0 ORDER BY credited_at ASC, id ASC`
+	rows, err := st.db.QueryContext(ctx, GetLotsQuery, userID)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetPointLots: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		lot := &models.PointLot{}
+		err = rows.Scan(&lot.OrderNumber, &lot.Amount, &lot.Remaining, &lot.CreditedAt)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: GetPointLots: %v", err)
+		}
+		res = append(res, lot)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetPointLots: %v", err)
+	}
+
+	return res, nil
+}
+
+func (st *DBStorage) ExpirePoints(ctx context.Context, creditedBefore time.Time) (models.Money, error) {
+	SelectUsersQuery := `SELECT DISTINCT user_id FROM ` + st.lotTable + ` WHERE
+		remaining > 0 AND credited_at < $1`
+	rows, err := st.db.QueryContext(ctx, SelectUsersQuery, creditedBefore)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpirePoints: %v", err)
+	}
+	userIDs := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("DBStorage: ExpirePoints: %v", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpirePoints: %v", err)
+	}
+
+	// every user is handled in a transaction of own, so a long run
+	// does not keep all the balances locked
+	var total models.Money
+	for _, userID := range userIDs {
+		expired, err := st.expireUserPoints(ctx, userID, creditedBefore)
+		if err != nil {
+			return total, err
+		}
+		total += expired
+	}
+
+	return total, nil
+}
+
+func (st *DBStorage) expireUserPoints(ctx context.Context, userID int, creditedBefore time.Time) (models.Money, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpirePoints (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	var balance, expired models.Money
+
+	// Get the current balance of the user; lock the user row
+	SelectBalanceQuery := `SELECT current FROM ` + st.balanceTable + ` WHERE
+		user_id = $1 FOR UPDATE`
+	err = tx.QueryRow(SelectBalanceQuery, userID).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpirePoints (1): user %d :: %v", userID, err)
+	}
+
+	SelectExpiredQuery := `SELECT COALESCE(SUM(remaining), 0)::BIGINT FROM ` + st.lotTable + ` WHERE
+		user_id = $1 AND remaining > 0 AND credited_at < $2`
+	err = tx.QueryRow(SelectExpiredQuery, userID, creditedBefore).Scan(&expired)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpirePoints (2): user %d :: %v", userID, err)
+	}
+
+	UpdateLotsQuery := `UPDATE ` + st.lotTable + ` SET remaining = 0 WHERE
+		user_id = $1 AND remaining > 0 AND credited_at < $2`
+	_, err = tx.Exec(UpdateLotsQuery, userID, creditedBefore)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpirePoints (3): user %d :: %v", userID, err)
+	}
+
+	// the balance is the authority, lots never take more than it has
+	if expired > balance {
+		expired = balance
+	}
+	if expired > 0 {
+		UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current - $1,
+			expired = expired + $1 WHERE user_id = $2`
+		_, err = tx.Exec(UpdateBalanceQuery, expired, userID)
+		if err != nil {
+			return 0, fmt.Errorf("DBStorage: ExpirePoints (4): user %d :: %v", userID, err)
+		}
+
+		err = st.addLedgerEntry(tx, &models.LedgerEntry{
+			Kind:   models.LedgerExpiration,
+			From:   models.UserAccount(userID),
+			To:     models.AccountExpirations,
+			Amount: expired,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("DBStorage: ExpirePoints (5): user %d :: %v", userID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("DBStorage: ExpirePoints (6): user %d :: %v", userID, err)
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,78 @@
+package psql
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFS, "migrations")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "versions must have no gaps")
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		want    []Migration
+		wantErr bool
+	}{
+		{
+			name: "Sorted by version",
+			fsys: fstest.MapFS{
+				"m/0010_second.up.sql":   {Data: []byte("up 10")},
+				"m/0010_second.down.sql": {Data: []byte("down 10")},
+				"m/0002_first.up.sql":    {Data: []byte("up 2")},
+				"m/0002_first.down.sql":  {Data: []byte("down 2")},
+			},
+			want: []Migration{
+				{Version: 2, Name: "first", Up: "up 2", Down: "down 2"},
+				{Version: 10, Name: "second", Up: "up 10", Down: "down 10"},
+			},
+		},
+		{
+			name: "Down script missing",
+			fsys: fstest.MapFS{
+				"m/0001_first.up.sql": {Data: []byte("up 1")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Names differ",
+			fsys: fstest.MapFS{
+				"m/0001_first.up.sql":   {Data: []byte("up 1")},
+				"m/0001_other.down.sql": {Data: []byte("down 1")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Unexpected file",
+			fsys: fstest.MapFS{
+				"m/README.md": {Data: []byte("hello")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.fsys, "m")
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, migrations)
+		})
+	}
+}
@@ -0,0 +1,31 @@
+-- IF NOT EXISTS lets databases created before migrations were introduced
+-- adopt this version as they are
+CREATE TABLE IF NOT EXISTS users (
+	id INT primary key GENERATED ALWAYS AS IDENTITY,
+	login VARCHAR(128) NOT NULL UNIQUE,
+	hash VARCHAR(256) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+	id INT primary key GENERATED ALWAYS AS IDENTITY,
+	number TEXT NOT NULL UNIQUE,
+	status VARCHAR(16) NOT NULL,
+	accrual BIGINT NOT NULL DEFAULT 0,
+	uploaded_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS balance (
+	id INT primary key GENERATED ALWAYS AS IDENTITY,
+	current BIGINT NOT NULL DEFAULT 0,
+	withdrawn BIGINT NOT NULL DEFAULT 0,
+	user_id INT NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS withdrawals (
+	id INT primary key GENERATED ALWAYS AS IDENTITY,
+	number TEXT NOT NULL UNIQUE,
+	withdrawn BIGINT NOT NULL DEFAULT 0,
+	processed_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS accrual_jobs (
+	id INT primary key GENERATED ALWAYS AS IDENTITY,
+	order_number TEXT NOT NULL UNIQUE REFERENCES orders (number) ON DELETE CASCADE,
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	last_error TEXT NOT NULL DEFAULT '',
+	locked_by TEXT NOT NULL DEFAULT '',
+	locked_until TIMESTAMP WITH TIME ZONE,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	gave_up_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS accrual_jobs_next_attempt_at_idx ON accrual_jobs (next_attempt_at);
+
+-- orders loaded before the job table existed need jobs as well
+INSERT INTO accrual_jobs (order_number)
+	SELECT number FROM orders WHERE status IN ('NEW', 'PROCESSING')
+	ON CONFLICT (order_number) DO NOTHING;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS orders_status_idx;
+DROP INDEX IF EXISTS withdrawals_user_id_idx;
+DROP INDEX IF EXISTS orders_user_id_idx;
@@ -0,0 +1,6 @@
+-- GetOrders and GetWithdrawals
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id, uploaded_at);
+CREATE INDEX IF NOT EXISTS withdrawals_user_id_idx ON withdrawals (user_id, processed_at);
+
+-- GetUnprocessedOrders
+CREATE INDEX IF NOT EXISTS orders_status_idx ON orders (status, uploaded_at);
@@ -0,0 +1,39 @@
+CREATE TABLE ledger (
+	id BIGINT primary key GENERATED ALWAYS AS IDENTITY,
+	kind VARCHAR(16) NOT NULL,
+	from_account TEXT NOT NULL,
+	to_account TEXT NOT NULL,
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	order_number TEXT NOT NULL DEFAULT '',
+	comment TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	CHECK (from_account <> to_account)
+);
+
+CREATE INDEX ledger_from_account_idx ON ledger (from_account);
+CREATE INDEX ledger_to_account_idx ON ledger (to_account);
+
+-- the history known so far is moved to the ledger
+INSERT INTO ledger (kind, from_account, to_account, amount, order_number, created_at)
+	SELECT 'ACCRUAL', 'accruals', 'user:' || user_id, accrual, number, uploaded_at
+	FROM orders WHERE status = 'PROCESSED' AND accrual > 0
+	ORDER BY uploaded_at, id;
+
+INSERT INTO ledger (kind, from_account, to_account, amount, order_number, created_at)
+	SELECT 'WITHDRAWAL', 'user:' || user_id, 'withdrawals', withdrawn, number, processed_at
+	FROM withdrawals WHERE withdrawn > 0
+	ORDER BY processed_at, id;
+
+-- whatever the history does not explain becomes an adjustment
+INSERT INTO ledger (kind, from_account, to_account, amount, comment)
+	SELECT 'ADJUSTMENT',
+		CASE WHEN diff > 0 THEN 'adjustments' ELSE 'user:' || user_id END,
+		CASE WHEN diff > 0 THEN 'user:' || user_id ELSE 'adjustments' END,
+		ABS(diff), 'opening balance'
+	FROM (
+		SELECT b.user_id, b.current
+			- COALESCE((SELECT SUM(accrual) FROM orders o WHERE o.user_id = b.user_id AND o.status = 'PROCESSED'), 0)
+			+ COALESCE((SELECT SUM(withdrawn) FROM withdrawals w WHERE w.user_id = b.user_id), 0) AS diff
+		FROM balance b
+	) d
+	WHERE diff <> 0;
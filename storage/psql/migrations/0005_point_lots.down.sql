@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS point_lots;
+ALTER TABLE balance DROP COLUMN IF EXISTS expired;
@@ -0,0 +1,18 @@
+ALTER TABLE balance ADD COLUMN expired BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE point_lots (
+	id BIGINT primary key GENERATED ALWAYS AS IDENTITY,
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	order_number TEXT NOT NULL DEFAULT '',
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	remaining BIGINT NOT NULL CHECK (remaining >= 0 AND remaining <= amount),
+	credited_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- only the lots with points left are ever looked for
+CREATE INDEX point_lots_user_id_idx ON point_lots (user_id, credited_at) WHERE remaining > 0;
+CREATE INDEX point_lots_credited_at_idx ON point_lots (credited_at) WHERE remaining > 0;
+
+-- points credited before expiration was introduced start their lifetime now
+INSERT INTO point_lots (user_id, amount, remaining)
+	SELECT user_id, current, current FROM balance WHERE current > 0;
@@ -0,0 +1,3 @@
+ALTER TABLE withdrawals DROP COLUMN IF EXISTS reversal_reason;
+ALTER TABLE withdrawals DROP COLUMN IF EXISTS reversed_by;
+ALTER TABLE withdrawals DROP COLUMN IF EXISTS reversed_at;
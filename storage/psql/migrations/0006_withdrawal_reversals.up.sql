@@ -0,0 +1,3 @@
+ALTER TABLE withdrawals ADD COLUMN reversed_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE withdrawals ADD COLUMN reversed_by TEXT NOT NULL DEFAULT '';
+ALTER TABLE withdrawals ADD COLUMN reversal_reason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,15 @@
+ALTER TABLE balance ADD COLUMN held BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE holds (
+	id BIGINT primary key GENERATED ALWAYS AS IDENTITY,
+	number TEXT NOT NULL UNIQUE,
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	status VARCHAR(16) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	settled_at TIMESTAMP WITH TIME ZONE,
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- only the holds not settled yet are ever looked for by expiration
+CREATE INDEX holds_expires_at_idx ON holds (expires_at) WHERE status = 'HELD';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS tier_changes;
+ALTER TABLE balance DROP COLUMN IF EXISTS tier;
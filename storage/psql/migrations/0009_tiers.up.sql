@@ -0,0 +1,11 @@
+ALTER TABLE balance ADD COLUMN tier TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE tier_changes (
+	id BIGINT primary key GENERATED ALWAYS AS IDENTITY,
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	from_tier TEXT NOT NULL,
+	to_tier TEXT NOT NULL,
+	changed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX tier_changes_user_id_idx ON tier_changes (user_id);
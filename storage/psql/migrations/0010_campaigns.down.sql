@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS campaigns;
+ALTER TABLE orders DROP COLUMN IF EXISTS bonus;
@@ -0,0 +1,12 @@
+ALTER TABLE orders ADD COLUMN bonus BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE campaigns (
+	id BIGINT primary key GENERATED ALWAYS AS IDENTITY,
+	name TEXT NOT NULL,
+	condition VARCHAR(16) NOT NULL,
+	multiplier DOUBLE PRECISION NOT NULL DEFAULT 1 CHECK (multiplier >= 1),
+	bonus BIGINT NOT NULL DEFAULT 0 CHECK (bonus >= 0),
+	starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	CHECK (ends_at > starts_at)
+);
@@ -0,0 +1,15 @@
+ALTER TABLE users ADD COLUMN referral_code VARCHAR(32) UNIQUE;
+-- the users registered before get codes of their own; new codes are
+-- generated by the application
+UPDATE users SET referral_code = UPPER(SUBSTR(MD5(RANDOM()::TEXT || id::TEXT), 1, 10));
+ALTER TABLE users ALTER COLUMN referral_code SET NOT NULL;
+
+CREATE TABLE referrals (
+	referee_id INT primary key REFERENCES users (id) ON DELETE CASCADE,
+	referrer_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	status VARCHAR(16) NOT NULL,
+	bonus BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	rewarded_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX referrals_referrer_id_idx ON referrals (referrer_id, status);
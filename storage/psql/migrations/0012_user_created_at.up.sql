@@ -0,0 +1,3 @@
+-- the users registered before are considered old enough for any policy
+ALTER TABLE users ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT '1970-01-01 00:00:00+00';
+ALTER TABLE users ALTER COLUMN created_at SET DEFAULT NOW();
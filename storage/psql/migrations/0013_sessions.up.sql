@@ -0,0 +1,11 @@
+CREATE TABLE sessions (
+	id VARCHAR(64) PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip VARCHAR(64) NOT NULL DEFAULT '',
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	revoked_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
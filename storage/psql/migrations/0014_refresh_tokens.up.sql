@@ -0,0 +1,8 @@
+CREATE TABLE refresh_tokens (
+	hash VARCHAR(64) PRIMARY KEY,
+	session_id VARCHAR(64) NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX refresh_tokens_session_id_idx ON refresh_tokens (session_id);
@@ -0,0 +1,8 @@
+CREATE TABLE password_resets (
+	hash VARCHAR(64) PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	used_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
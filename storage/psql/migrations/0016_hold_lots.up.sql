@@ -0,0 +1,8 @@
+-- the lots the points of a hold were taken from, the points go back to
+-- the same lots if the hold is released or expires
+CREATE TABLE hold_lots (
+	hold_id BIGINT NOT NULL REFERENCES holds (id) ON DELETE CASCADE,
+	lot_id BIGINT NOT NULL REFERENCES point_lots (id) ON DELETE CASCADE,
+	amount BIGINT NOT NULL CHECK (amount > 0),
+	PRIMARY KEY (hold_id, lot_id)
+);
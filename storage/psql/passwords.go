@@ -0,0 +1,118 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (st *DBStorage) GetUserByID(ctx context.Context, userID int) (*models.User, error) {
+	dbUser := &models.User{}
+
+	GetUserQuery := `SELECT id, login, hash, referral_code FROM ` + st.userTable + ` WHERE id = $1`
+	err := st.db.QueryRowContext(ctx, GetUserQuery, userID).Scan(
+		&dbUser.ID, &dbUser.Login, &dbUser.Hash, &dbUser.ReferralCode,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, storage.ErrLoginMissing
+	case err != nil:
+		return nil, fmt.Errorf("DBStorage: GetUserByID: %v", err)
+	default:
+		return dbUser, nil
+	}
+}
+
+func (st *DBStorage) ChangePassword(ctx context.Context, userID int, hash string, keepSession string, at time.Time) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ChangePassword (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	if err = st.setPassword(tx, userID, hash, keepSession, at); err != nil {
+		return fmt.Errorf("DBStorage: ChangePassword (1): %v", err)
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) AddPasswordReset(ctx context.Context, reset *models.PasswordReset) error {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddPasswordReset (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	// the token issued last is the only one valid
+	DeleteResetsQuery := `DELETE FROM ` + st.resetTable + ` WHERE user_id = $1 AND used_at IS NULL`
+	if _, err = tx.Exec(DeleteResetsQuery, reset.UserID); err != nil {
+		return fmt.Errorf("DBStorage: AddPasswordReset (1): %v", err)
+	}
+
+	AddResetQuery := `INSERT INTO ` + st.resetTable + ` (hash, user_id, created_at, expires_at)
+		VALUES($1, $2, $3, $4)`
+	_, err = tx.Exec(AddResetQuery, reset.Hash, reset.UserID, reset.CreatedAt, reset.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddPasswordReset (2): %v", err)
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) ResetPassword(ctx context.Context, tokenHash string, hash string, at time.Time) (int, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: ResetPassword (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+
+	// the token is used once even if presented by concurrent requests
+	UseResetQuery := `UPDATE ` + st.resetTable + ` SET used_at = $1
+		WHERE hash = $2 AND used_at IS NULL AND expires_at > $1 RETURNING user_id`
+	err = tx.QueryRow(UseResetQuery, at, tokenHash).Scan(&userID)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, storage.ErrPasswordResetMissing
+	case err != nil:
+		return 0, fmt.Errorf("DBStorage: ResetPassword (1): %v", err)
+	}
+
+	if err = st.setPassword(tx, userID, hash, "", at); err != nil {
+		return 0, fmt.Errorf("DBStorage: ResetPassword (2): %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("DBStorage: ResetPassword (3): %v", err)
+	}
+
+	return userID, nil
+}
+
+// setPassword updates the password hash and revokes the sessions of the
+// user but keepSession
+func (st *DBStorage) setPassword(tx *sql.Tx, userID int, hash string, keepSession string, at time.Time) error {
+	UpdateHashQuery := `UPDATE ` + st.userTable + ` SET hash = $1 WHERE id = $2`
+	res, err := tx.Exec(UpdateHashQuery, hash, userID)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("user %d not found", userID)
+	}
+
+	RevokeSessionsQuery := `UPDATE ` + st.sessionTable + ` SET revoked_at = $1
+		WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL`
+	_, err = tx.Exec(RevokeSessionsQuery, at, userID, keepSession)
+	return err
+}
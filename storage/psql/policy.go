@@ -0,0 +1,55 @@
+package psql
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+// withdrawalHistory collects what the withdrawal policy is checked against,
+// the active holds included; the caller is expected to hold the balance row
+// lock of the user
+func (st *DBStorage) withdrawalHistory(tx *sql.Tx, userID int, now time.Time) (models.WithdrawalHistory, error) {
+	h := models.WithdrawalHistory{}
+	var last sql.NullTime
+
+	HistoryQuery := `SELECT u.created_at, MAX(w.processed_at),
+			COALESCE(SUM(w.withdrawn) FILTER (WHERE w.processed_at > $2), 0)::BIGINT,
+			COALESCE(SUM(w.withdrawn) FILTER (WHERE w.processed_at > $3), 0)::BIGINT
+		FROM ` + st.userTable + ` AS u LEFT JOIN ` + st.withdrawalTable + ` AS w
+			ON w.user_id = u.id AND w.reversed_at IS NULL
+		WHERE u.id = $1 GROUP BY u.created_at`
+	err := tx.QueryRow(HistoryQuery, userID, now.Add(-models.PolicyDay), now.Add(-models.PolicyMonth)).Scan(
+		&h.RegisteredAt, &last, &h.Day, &h.Month,
+	)
+	if err != nil {
+		return h, err
+	}
+	if last.Valid {
+		h.LastWithdrawalAt = last.Time
+	}
+
+	// the points held are about to be withdrawn, so the active holds count
+	// as withdrawals made when they were created
+	var held struct {
+		last       sql.NullTime
+		day, month models.Money
+	}
+	HeldQuery := `SELECT MAX(created_at),
+			COALESCE(SUM(amount) FILTER (WHERE created_at > $3), 0)::BIGINT,
+			COALESCE(SUM(amount) FILTER (WHERE created_at > $4), 0)::BIGINT
+		FROM ` + st.holdTable + ` WHERE user_id = $1 AND status = $2`
+	err = tx.QueryRow(HeldQuery, userID, models.HoldStatusHeld, now.Add(-models.PolicyDay),
+		now.Add(-models.PolicyMonth)).Scan(&held.last, &held.day, &held.month)
+	if err != nil {
+		return h, err
+	}
+	if held.last.Valid && held.last.Time.After(h.LastWithdrawalAt) {
+		h.LastWithdrawalAt = held.last.Time
+	}
+	h.Day += held.day
+	h.Month += held.month
+
+	return h, nil
+}
@@ -0,0 +1,127 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+func (st *DBStorage) GetReferrals(ctx context.Context, userID int) (*models.Referrals, error) {
+	res := &models.Referrals{Referrals: []*models.ReferralInfo{}}
+
+	GetCodeQuery := `SELECT referral_code FROM ` + st.userTable + ` WHERE id = $1`
+	err := st.db.QueryRowContext(ctx, GetCodeQuery, userID).Scan(&res.Code)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetReferrals: %v", err)
+	}
+
+	GetReferralsQuery := `SELECT u.login, r.status, r.bonus, r.created_at, r.rewarded_at
+		FROM ` + st.referralTable + ` AS r JOIN ` + st.userTable + ` AS u ON u.id = r.referee_id
+		WHERE r.referrer_id = $1 ORDER BY r.referee_id ASC`
+	rows, err := st.db.QueryContext(ctx, GetReferralsQuery, userID)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetReferrals: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		info := &models.ReferralInfo{}
+		var rewardedAt sql.NullTime
+		err = rows.Scan(&info.Login, &info.Status, &info.Bonus, &info.CreatedAt, &rewardedAt)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: GetReferrals: %v", err)
+		}
+		if rewardedAt.Valid {
+			info.RewardedAt = &rewardedAt.Time
+		}
+		res.Referrals = append(res.Referrals, info)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetReferrals: %v", err)
+	}
+
+	return res, nil
+}
+
+// lockReferralBalances locks the balance row of the referee, and the one of
+// the referrer if the referral is still pending, in the order of user ids
+// as ProcessTransfer does
+func (st *DBStorage) lockReferralBalances(tx *sql.Tx, refereeID int) error {
+	LockBalancesQuery := `SELECT b.user_id FROM ` + st.balanceTable + ` AS b
+		WHERE b.user_id = $1 OR b.user_id IN (SELECT referrer_id FROM ` + st.referralTable + `
+			WHERE referee_id = $1 AND status = $2)
+		ORDER BY b.user_id FOR UPDATE OF b`
+	_, err := tx.Exec(LockBalancesQuery, refereeID, models.ReferralPending)
+	return err
+}
+
+// rewardReferral credits the referral bonuses for the first processed
+// order of the referee; the caller holds the balance row locks of both
+// users, see lockReferralBalances
+func (st *DBStorage) rewardReferral(tx *sql.Tx, refereeID int, accrual models.Money, orderNumber string) error {
+	var referrerID int
+
+	// Lock the referral row
+	SelectReferralQuery := `SELECT referrer_id FROM ` + st.referralTable + `
+		WHERE referee_id = $1 AND status = $2 FOR UPDATE`
+	err := tx.QueryRow(SelectReferralQuery, refereeID, models.ReferralPending).Scan(&referrerID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	status, bonus := models.ReferralIneligible, models.Money(0)
+	p := st.referrals
+	if p != nil && accrual >= p.MinAccrual {
+		if p.RefereeBonus > 0 {
+			err = st.creditReferral(tx, refereeID, p.RefereeBonus, orderNumber, fmt.Sprintf("referred by user %d", referrerID))
+			if err != nil {
+				return err
+			}
+		}
+		if p.ReferrerBonus > 0 {
+			// The referrer row is locked, so concurrent referees of the
+			// same referrer never get past the limit
+			rewarded := 0
+			CountRewardsQuery := `SELECT COUNT(*) FROM ` + st.referralTable + `
+				WHERE referrer_id = $1 AND status = $2`
+			err = tx.QueryRow(CountRewardsQuery, referrerID, models.ReferralRewarded).Scan(&rewarded)
+			if err != nil {
+				return err
+			}
+			if p.MaxRewards == 0 || rewarded < p.MaxRewards {
+				err = st.creditReferral(tx, referrerID, p.ReferrerBonus, orderNumber, fmt.Sprintf("referee user %d", refereeID))
+				if err != nil {
+					return err
+				}
+				status, bonus = models.ReferralRewarded, p.ReferrerBonus
+			}
+		}
+	}
+
+	UpdateReferralQuery := `UPDATE ` + st.referralTable + ` SET status = $1, bonus = $2,
+		rewarded_at = NOW() WHERE referee_id = $3`
+	_, err = tx.Exec(UpdateReferralQuery, status, bonus, refereeID)
+	return err
+}
+
+// creditReferral credits the referral bonus to the user
+func (st *DBStorage) creditReferral(tx *sql.Tx, userID int, bonus models.Money, orderNumber, comment string) error {
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current + $1
+		WHERE user_id = $2`
+	_, err := tx.Exec(UpdateBalanceQuery, bonus, userID)
+	if err != nil {
+		return err
+	}
+	err = st.addLedgerEntry(tx, models.NewReferralEntry(userID, bonus, orderNumber, comment))
+	if err != nil {
+		return err
+	}
+	return st.addPointLot(tx, userID, bonus, "")
+}
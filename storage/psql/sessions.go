@@ -0,0 +1,219 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (st *DBStorage) AddSession(ctx context.Context, session *models.Session) error {
+	AddSessionQuery := `INSERT INTO ` + st.sessionTable + ` (id, user_id, user_agent, ip,
+		created_at, last_seen_at, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7)`
+	_, err := st.db.ExecContext(ctx, AddSessionQuery, session.ID, session.UserID, session.UserAgent,
+		session.IP, session.CreatedAt, session.LastSeenAt, session.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddSession: %v", err)
+	}
+
+	return nil
+}
+
+func (st *DBStorage) GetSession(ctx context.Context, id string) (*models.Session, error) {
+	GetSessionQuery := `SELECT s.id, s.user_id, u.login, s.user_agent, s.ip, s.created_at,
+		s.last_seen_at, s.expires_at, s.revoked_at FROM ` + st.sessionTable + ` AS s
+		JOIN ` + st.userTable + ` AS u ON u.id = s.user_id WHERE s.id = $1`
+	session, err := scanSession(st.db.QueryRowContext(ctx, GetSessionQuery, id))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, storage.ErrSessionMissing
+	case err != nil:
+		return nil, fmt.Errorf("DBStorage: GetSession: %v", err)
+	}
+
+	return session, nil
+}
+
+func (st *DBStorage) GetSessions(ctx context.Context, userID int, now time.Time) ([]*models.Session, error) {
+	GetSessionsQuery := `SELECT s.id, s.user_id, u.login, s.user_agent, s.ip, s.created_at,
+		s.last_seen_at, s.expires_at, s.revoked_at FROM ` + st.sessionTable + ` AS s
+		JOIN ` + st.userTable + ` AS u ON u.id = s.user_id WHERE s.user_id = $1
+		AND s.revoked_at IS NULL AND s.expires_at > $2 ORDER BY s.last_seen_at DESC`
+	rows, err := st.db.QueryContext(ctx, GetSessionsQuery, userID, now)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetSessions: %v", err)
+	}
+	defer rows.Close()
+
+	res := []*models.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: GetSessions: %v", err)
+		}
+		res = append(res, session)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetSessions: %v", err)
+	}
+
+	return res, nil
+}
+
+func (st *DBStorage) TouchSession(ctx context.Context, id string, at time.Time) error {
+	TouchSessionQuery := `UPDATE ` + st.sessionTable + ` SET last_seen_at = $1
+		WHERE id = $2 AND last_seen_at < $1`
+	_, err := st.db.ExecContext(ctx, TouchSessionQuery, at, id)
+	if err != nil {
+		return fmt.Errorf("DBStorage: TouchSession: %v", err)
+	}
+
+	return nil
+}
+
+func (st *DBStorage) RevokeSession(ctx context.Context, userID int, id string, at time.Time) error {
+	RevokeSessionQuery := `UPDATE ` + st.sessionTable + ` SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`
+	res, err := st.db.ExecContext(ctx, RevokeSessionQuery, at, id, userID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: RevokeSession: %v", err)
+	}
+
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("DBStorage: RevokeSession: %v", err)
+	}
+	if revoked == 0 {
+		return storage.ErrSessionMissing
+	}
+
+	return nil
+}
+
+func (st *DBStorage) RevokeSessions(ctx context.Context, userID int, at time.Time) (int, error) {
+	RevokeSessionsQuery := `UPDATE ` + st.sessionTable + ` SET revoked_at = $1
+		WHERE user_id = $2 AND revoked_at IS NULL`
+	res, err := st.db.ExecContext(ctx, RevokeSessionsQuery, at, userID)
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: RevokeSessions: %v", err)
+	}
+
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DBStorage: RevokeSessions: %v", err)
+	}
+
+	return int(revoked), nil
+}
+
+func (st *DBStorage) AddRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	AddTokenQuery := `INSERT INTO ` + st.refreshTable + ` (hash, session_id, created_at,
+		expires_at) VALUES($1, $2, $3, $4)`
+	_, err := st.db.ExecContext(ctx, AddTokenQuery, token.Hash, token.SessionID,
+		token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("DBStorage: AddRefreshToken: %v", err)
+	}
+
+	return nil
+}
+
+func (st *DBStorage) RotateRefreshToken(ctx context.Context, hash string, next *models.RefreshToken, now time.Time) (*models.Session, error) {
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: RotateRefreshToken (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	var sessionID string
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+
+	// Lock the token row, so the token is used once even if presented
+	// by concurrent requests
+	SelectTokenQuery := `SELECT session_id, expires_at, used_at FROM ` + st.refreshTable + `
+		WHERE hash = $1 FOR UPDATE`
+	err = tx.QueryRow(SelectTokenQuery, hash).Scan(&sessionID, &expiresAt, &usedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, storage.ErrRefreshTokenMissing
+	case err != nil:
+		return nil, fmt.Errorf("DBStorage: RotateRefreshToken (1): %v", err)
+	}
+
+	// the token has leaked, revoke the whole family
+	if usedAt.Valid {
+		RevokeSessionQuery := `UPDATE ` + st.sessionTable + ` SET revoked_at = $1
+			WHERE id = $2 AND revoked_at IS NULL`
+		if _, err = tx.Exec(RevokeSessionQuery, now, sessionID); err != nil {
+			return nil, fmt.Errorf("DBStorage: RotateRefreshToken (2): %v", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, fmt.Errorf("DBStorage: RotateRefreshToken (3): %v", err)
+		}
+		return nil, storage.ErrRefreshTokenReused
+	}
+
+	SelectSessionQuery := `SELECT s.id, s.user_id, u.login, s.user_agent, s.ip, s.created_at,
+		s.last_seen_at, s.expires_at, s.revoked_at FROM ` + st.sessionTable + ` AS s
+		JOIN ` + st.userTable + ` AS u ON u.id = s.user_id WHERE s.id = $1 FOR UPDATE OF s`
+	session, err := scanSession(tx.QueryRow(SelectSessionQuery, sessionID))
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: RotateRefreshToken (4): %v", err)
+	}
+	if !now.Before(expiresAt) || !session.Active(now) {
+		return nil, storage.ErrRefreshTokenMissing
+	}
+
+	UseTokenQuery := `UPDATE ` + st.refreshTable + ` SET used_at = $1 WHERE hash = $2`
+	if _, err = tx.Exec(UseTokenQuery, now, hash); err != nil {
+		return nil, fmt.Errorf("DBStorage: RotateRefreshToken (5): %v", err)
+	}
+
+	next.SessionID = session.ID
+	AddTokenQuery := `INSERT INTO ` + st.refreshTable + ` (hash, session_id, created_at,
+		expires_at) VALUES($1, $2, $3, $4)`
+	_, err = tx.Exec(AddTokenQuery, next.Hash, next.SessionID, next.CreatedAt, next.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: RotateRefreshToken (6): %v", err)
+	}
+
+	ExtendSessionQuery := `UPDATE ` + st.sessionTable + ` SET expires_at = $1,
+		last_seen_at = GREATEST(last_seen_at, $2) WHERE id = $3 RETURNING last_seen_at`
+	err = tx.QueryRow(ExtendSessionQuery, next.ExpiresAt, now, session.ID).Scan(&session.LastSeenAt)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: RotateRefreshToken (7): %v", err)
+	}
+	session.ExpiresAt = next.ExpiresAt
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("DBStorage: RotateRefreshToken (8): %v", err)
+	}
+
+	return session, nil
+}
+
+// rowScanner is either *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row rowScanner) (*models.Session, error) {
+	session := &models.Session{}
+	var revokedAt sql.NullTime
+	err := row.Scan(&session.ID, &session.UserID, &session.Login, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+
+	return session, nil
+}
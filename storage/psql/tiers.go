@@ -0,0 +1,103 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+)
+
+func (st *DBStorage) GetTierChanges(ctx context.Context, userID int) ([]*models.TierChange, error) {
+	res := []*models.TierChange{}
+
+	GetChangesQuery := `SELECT from_tier, to_tier, changed_at FROM ` + st.tierChangeTable + `
+		WHERE user_id = $1 ORDER BY id ASC`
+	rows, err := st.db.QueryContext(ctx, GetChangesQuery, userID)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetTierChanges: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		change := &models.TierChange{}
+		err = rows.Scan(&change.From, &change.To, &change.ChangedAt)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: GetTierChanges: %v", err)
+		}
+		res = append(res, change)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetTierChanges: %v", err)
+	}
+
+	return res, nil
+}
+
+// updateTier moves the user to the tier the user has reached and returns it
+// as a part of tx; the user's balance row gets locked
+func (st *DBStorage) updateTier(tx *sql.Tx, userID int) (models.Tier, error) {
+	var current string
+
+	SelectTierQuery := `SELECT tier FROM ` + st.balanceTable + ` WHERE
+		user_id = $1 FOR UPDATE`
+	err := tx.QueryRow(SelectTierQuery, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return models.Tier{}, fmt.Errorf("balance of user %d not found", userID)
+	}
+	if err != nil {
+		return models.Tier{}, err
+	}
+
+	if st.tiers == nil {
+		return models.Tier{Multiplier: 1}, nil
+	}
+
+	value, err := st.tierBasis(tx, userID, time.Now())
+	if err != nil {
+		return models.Tier{}, err
+	}
+
+	tier := st.tiers.TierFor(value)
+	if tier.Name == current {
+		return tier, nil
+	}
+
+	UpdateTierQuery := `UPDATE ` + st.balanceTable + ` SET tier = $1 WHERE user_id = $2`
+	if _, err := tx.Exec(UpdateTierQuery, tier.Name, userID); err != nil {
+		return models.Tier{}, err
+	}
+	AddChangeQuery := `INSERT INTO ` + st.tierChangeTable + ` (user_id, from_tier, to_tier)
+		VALUES($1, $2, $3)`
+	if _, err := tx.Exec(AddChangeQuery, userID, current, tier.Name); err != nil {
+		return models.Tier{}, err
+	}
+
+	return tier, nil
+}
+
+// tierBasis derives the value the tier of the user depends on from the
+// ledger as a part of tx
+func (st *DBStorage) tierBasis(tx *sql.Tx, userID int, now time.Time) (models.Money, error) {
+	var value models.Money
+	account := models.UserAccount(userID)
+
+	var err error
+	switch st.tiers.Basis {
+	case models.TierBasisLifetime:
+		LifetimeQuery := `SELECT COALESCE(SUM(amount), 0)::BIGINT FROM ` + st.ledgerTable + `
+			WHERE kind = $1 AND to_account = $2`
+		err = tx.QueryRow(LifetimeQuery, models.LedgerAccrual, account).Scan(&value)
+	case models.TierBasisSpend:
+		SpendQuery := `SELECT COALESCE(SUM(CASE WHEN kind = $1 THEN amount ELSE -amount END), 0)::BIGINT
+			FROM ` + st.ledgerTable + ` WHERE created_at >= $4 AND
+			((kind = $1 AND from_account = $3) OR (kind = $2 AND to_account = $3))`
+		err = tx.QueryRow(SpendQuery, models.LedgerWithdrawal, models.LedgerReversal, account,
+			now.Add(-st.tiers.Window)).Scan(&value)
+	}
+
+	return value, err
+}
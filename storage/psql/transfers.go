@@ -0,0 +1,143 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+)
+
+func (st *DBStorage) ProcessTransfer(ctx context.Context, tr *models.TransferRequest, userID int, limit models.Money, since time.Time) error {
+	if tr.Sum == 0 {
+		return storage.ErrZeroAmount
+	}
+
+	tx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (0): %v", err)
+	}
+	defer tx.Rollback()
+
+	var recipientID int
+	GetRecipientQuery := `SELECT id FROM ` + st.userTable + ` WHERE login = $1`
+	err = tx.QueryRow(GetRecipientQuery, tr.Login).Scan(&recipientID)
+	switch {
+	case err == sql.ErrNoRows:
+		return storage.ErrLoginMissing
+	case err != nil:
+		return fmt.Errorf("DBStorage: ProcessTransfer (1): %v :: %v", tr, err)
+	case recipientID == userID:
+		return storage.ErrTransferToSelf
+	}
+
+	// Get the current balances of both users; lock the user rows in the
+	// order of user ids, so opposite transfers never deadlock
+	SelectBalancesQuery := `SELECT user_id, current FROM ` + st.balanceTable + ` WHERE
+		user_id IN ($1, $2) ORDER BY user_id FOR UPDATE`
+	rows, err := tx.Query(SelectBalancesQuery, userID, recipientID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (2): %v :: %v", tr, err)
+	}
+	balances := make(map[int]models.Money, 2)
+	for rows.Next() {
+		var id int
+		var current models.Money
+		if err := rows.Scan(&id, &current); err != nil {
+			rows.Close()
+			return fmt.Errorf("DBStorage: ProcessTransfer (2): %v :: %v", tr, err)
+		}
+		balances[id] = current
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (2): %v :: %v", tr, err)
+	}
+	if len(balances) != 2 {
+		return fmt.Errorf("DBStorage: ProcessTransfer (2): %v :: balance not found", tr)
+	}
+
+	if balances[userID] < tr.Sum {
+		return storage.ErrInsufficientFunds
+	}
+
+	if limit > 0 {
+		var transferred models.Money
+		TransferredQuery := `SELECT COALESCE(SUM(amount), 0)::BIGINT FROM ` + st.ledgerTable + `
+			WHERE kind = $1 AND from_account = $2 AND created_at >= $3`
+		err = tx.QueryRow(TransferredQuery, models.LedgerTransfer, models.UserAccount(userID), since).Scan(&transferred)
+		if err != nil {
+			return fmt.Errorf("DBStorage: ProcessTransfer (3): %v :: %v", tr, err)
+		}
+		if transferred+tr.Sum > limit {
+			return storage.ErrTransferLimitExceeded
+		}
+	}
+
+	UpdateBalanceQuery := `UPDATE ` + st.balanceTable + ` SET current = current + $1
+		WHERE user_id = $2`
+	_, err = tx.Exec(UpdateBalanceQuery, -tr.Sum, userID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (4): %v :: %v", tr, err)
+	}
+	_, err = tx.Exec(UpdateBalanceQuery, tr.Sum, recipientID)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (5): %v :: %v", tr, err)
+	}
+
+	err = st.addLedgerEntry(tx, &models.LedgerEntry{
+		Kind:   models.LedgerTransfer,
+		From:   models.UserAccount(userID),
+		To:     models.UserAccount(recipientID),
+		Amount: tr.Sum,
+	})
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (6): %v :: %v", tr, err)
+	}
+
+	err = st.consumePointLots(tx, userID, tr.Sum)
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (7): %v :: %v", tr, err)
+	}
+	err = st.addPointLot(tx, recipientID, tr.Sum, "")
+	if err != nil {
+		return fmt.Errorf("DBStorage: ProcessTransfer (8): %v :: %v", tr, err)
+	}
+
+	return tx.Commit()
+}
+
+func (st *DBStorage) GetTransfers(ctx context.Context, userID int) ([]*models.TransferInfo, error) {
+	res := []*models.TransferInfo{}
+
+	GetTransfersQuery := `SELECT CASE WHEN l.from_account = $2 THEN $3::TEXT ELSE $4::TEXT END, u.login,
+			l.amount, l.created_at
+		FROM ` + st.ledgerTable + ` AS l JOIN ` + st.userTable + ` AS u
+			ON 'user:' || u.id = CASE WHEN l.from_account = $2 THEN l.to_account ELSE l.from_account END
+		WHERE l.kind = $1 AND (l.from_account = $2 OR l.to_account = $2)
+		ORDER BY l.id ASC`
+	rows, err := st.db.QueryContext(ctx, GetTransfersQuery, models.LedgerTransfer,
+		models.UserAccount(userID), models.TransferOut, models.TransferIn)
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetTransfers: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		info := &models.TransferInfo{}
+		err = rows.Scan(&info.Direction, &info.Login, &info.Sum, &info.ProcessedAt)
+		if err != nil {
+			return nil, fmt.Errorf("DBStorage: GetTransfers: %v", err)
+		}
+		res = append(res, info)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("DBStorage: GetTransfers: %v", err)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,1469 @@
+// Package storagetest provides a conformance test suite every implementation
+// of storage.Storage is expected to pass
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sbxb/loyalty/models"
+	"github.com/sbxb/loyalty/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new empty storage created with opts, it is called once
+// per test case
+type Factory func(t *testing.T, opts storage.Options) storage.Storage
+
+// Run runs the whole suite against the storages returned by newStorage
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, st storage.Storage)
+	}{
+		{"AddGetUser", testAddGetUser},
+		{"AddUserTwice", testAddUserTwice},
+		{"GetNonexistentUser", testGetNonexistentUser},
+		{"AddOrderExistsOwn", testAddOrderExistsOwn},
+		{"AddOrderExistsNotOwn", testAddOrderExistsNotOwn},
+		{"GetOrdersOrdered", testGetOrdersOrdered},
+		{"GetOrdersNonExistent", testGetOrdersNonExistent},
+		{"GetUnprocessedOrders", testGetUnprocessedOrders},
+		{"ProcessOrder", testProcessOrder},
+		{"UpdateOrderStatusFinal", testUpdateOrderStatusFinal},
+		{"ProcessWithdraw", testProcessWithdraw},
+		{"InsufficientFunds", testInsufficientFunds},
+		{"ConcurrentWithdrawals", testConcurrentWithdrawals},
+		{"ReverseWithdrawal", testReverseWithdrawal},
+		{"Transfer", testTransfer},
+		{"TransferLimit", testTransferLimit},
+		{"Campaigns", testCampaigns},
+		{"Holds", testHolds},
+		{"ExpireHolds", testExpireHolds},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"Sessions", testSessions},
+		{"RefreshTokens", testRefreshTokens},
+		{"Passwords", testPasswords},
+		{"AccrualJobLease", testAccrualJobLease},
+		{"Ledger", testLedger},
+		{"Adjustment", testAdjustment},
+		{"PointLots", testPointLots},
+		{"ExpirePoints", testExpirePoints},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t, storage.Options{}))
+		})
+	}
+
+	// the cases depending on the business rules the storage is created with
+	optionTests := []struct {
+		name string
+		opts storage.Options
+		test func(t *testing.T, st storage.Storage)
+	}{
+		{"WithdrawalLimits", storage.Options{
+			WithdrawalPolicy: &models.WithdrawalPolicy{MinSum: 1000, MaxSum: 50000, DailyLimit: 60000},
+		}, testWithdrawalLimits},
+		{"WithdrawalAccountAge", storage.Options{
+			WithdrawalPolicy: &models.WithdrawalPolicy{MinAccountAge: time.Hour},
+		}, testWithdrawalAccountAge},
+		{"WithdrawalCooldown", storage.Options{
+			WithdrawalPolicy: &models.WithdrawalPolicy{Cooldown: time.Hour},
+		}, testWithdrawalCooldown},
+		{"WithdrawalPolicyHolds", storage.Options{
+			WithdrawalPolicy: &models.WithdrawalPolicy{MaxSum: 50000, DailyLimit: 60000},
+		}, testWithdrawalPolicyHolds},
+		{"Tiers", storage.Options{
+			Tiers: tierProgram("Bronze:0:1,Silver:100:1.5,Gold:500:2", models.TierBasisLifetime, 0),
+		}, testTiers},
+		{"TiersBySpend", storage.Options{
+			Tiers: tierProgram("Silver:100:1.5", models.TierBasisSpend, time.Hour),
+		}, testTiersBySpend},
+		{"TiersBySpendLapse", storage.Options{
+			Tiers: tierProgram("Silver:100:1.5", models.TierBasisSpend, 500*time.Millisecond),
+		}, testTiersBySpendLapse},
+		{"Referrals", storage.Options{
+			Referrals: &models.ReferralProgram{ReferrerBonus: 5000, RefereeBonus: 2000, MinAccrual: 1000, MaxRewards: 1},
+		}, testReferrals},
+	}
+
+	for _, tt := range optionTests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t, tt.opts))
+		})
+	}
+}
+
+func testAddGetUser(t *testing.T, st storage.Storage) {
+	user := &models.User{
+		Login: "user",
+		Hash:  "abcdef",
+		ID:    1,
+	}
+
+	err := st.AddUser(context.Background(), user)
+	require.NoError(t, err)
+
+	userReturned, err := st.GetUser(context.Background(), user)
+	require.NoError(t, err)
+
+	assert.Equal(t, user, userReturned)
+}
+
+func testAddUserTwice(t *testing.T, st storage.Storage) {
+	user := &models.User{
+		Login: "user",
+		Hash:  "abcdef",
+	}
+
+	err := st.AddUser(context.Background(), user)
+	require.NoError(t, err)
+
+	err = st.AddUser(context.Background(), user)
+	require.ErrorIs(t, err, storage.ErrLoginAlreadyExists)
+}
+
+func testGetNonexistentUser(t *testing.T, st storage.Storage) {
+	user := &models.User{
+		Login: "usernonexistent",
+		Hash:  "nonexistent",
+	}
+
+	userReturned, err := st.GetUser(context.Background(), user)
+	assert.Nil(t, userReturned)
+	require.ErrorIs(t, err, storage.ErrLoginMissing)
+}
+
+func testAddOrderExistsOwn(t *testing.T, st storage.Storage) {
+	userID := addUser(t, st, "user")
+	order := newOrder("12345678903")
+
+	err := st.AddOrder(context.Background(), order, userID)
+	require.NoError(t, err)
+
+	err = st.AddOrder(context.Background(), order, userID)
+	var orderExistsError *storage.ExistingOrderError
+	require.ErrorAs(t, err, &orderExistsError)
+	assert.Equal(t, userID, orderExistsError.UserID)
+}
+
+func testAddOrderExistsNotOwn(t *testing.T, st storage.Storage) {
+	ownerID := addUser(t, st, "owner")
+	otherID := addUser(t, st, "other")
+	order := newOrder("12345678903")
+
+	err := st.AddOrder(context.Background(), order, ownerID)
+	require.NoError(t, err)
+
+	err = st.AddOrder(context.Background(), order, otherID)
+	var orderExistsError *storage.ExistingOrderError
+	require.ErrorAs(t, err, &orderExistsError)
+	assert.Equal(t, ownerID, orderExistsError.UserID)
+
+	// the order still belongs to the owner only
+	orders, err := st.GetOrders(context.Background(), otherID)
+	require.NoError(t, err)
+	assert.Empty(t, orders)
+}
+
+func testGetOrdersOrdered(t *testing.T, st storage.Storage) {
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	numbers := []string{"79927398713", "12345678903", "49927398716"}
+
+	for _, number := range numbers {
+		err := st.AddOrder(context.Background(), newOrder(number), userID)
+		require.NoError(t, err)
+	}
+	err := st.AddOrder(context.Background(), newOrder("2377225624"), otherID)
+	require.NoError(t, err)
+
+	orders, err := st.GetOrders(context.Background(), userID)
+	require.NoError(t, err)
+	require.Len(t, orders, len(numbers))
+	for i, order := range orders {
+		assert.Equal(t, numbers[i], order.Number)
+		assert.Equal(t, models.OrderStatusNew, order.Status)
+		assert.Equal(t, models.Money(0), order.Accrual)
+		assert.False(t, order.UploadedAt.IsZero())
+	}
+	for i := 1; i < len(orders); i++ {
+		assert.False(t, orders[i].UploadedAt.Before(orders[i-1].UploadedAt))
+	}
+}
+
+func testGetOrdersNonExistent(t *testing.T, st storage.Storage) {
+	userID := addUser(t, st, "user")
+
+	orders, err := st.GetOrders(context.Background(), userID)
+	require.NoError(t, err)
+	assert.NotNil(t, orders)
+	assert.Empty(t, orders)
+}
+
+func testGetUnprocessedOrders(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	for _, number := range []string{"79927398713", "12345678903", "49927398716", "2377225624"} {
+		err := st.AddOrder(ctx, newOrder(number), userID)
+		require.NoError(t, err)
+	}
+
+	err := st.ProcessOrder(ctx, processed("79927398713", 100))
+	require.NoError(t, err)
+	err = st.UpdateOrderStatus(ctx, &models.AccrualResponse{OrderNumber: "12345678903", Status: models.OrderStatusProcessing})
+	require.NoError(t, err)
+
+	orders, err := st.GetUnprocessedOrders(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, "12345678903", orders[0].Number)
+	assert.Equal(t, "49927398716", orders[1].Number)
+}
+
+func testProcessOrder(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	for _, number := range []string{"79927398713", "12345678903"} {
+		err := st.AddOrder(ctx, newOrder(number), userID)
+		require.NoError(t, err)
+	}
+
+	err := st.ProcessOrder(ctx, processed("79927398713", 50050))
+	require.NoError(t, err)
+	err = st.ProcessOrder(ctx, processed("12345678903", 1000))
+	require.NoError(t, err)
+	// the order is final already, it must not be credited twice
+	err = st.ProcessOrder(ctx, processed("79927398713", 50050))
+	require.NoError(t, err)
+
+	err = st.ProcessOrder(ctx, processed("2377225624", 1000))
+	require.Error(t, err)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 51050}, balance)
+
+	orders, err := st.GetOrders(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, models.OrderStatusProcessed, orders[0].Status)
+	assert.Equal(t, models.Money(50050), orders[0].Accrual)
+}
+
+func testUpdateOrderStatusFinal(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	for _, number := range []string{"79927398713", "12345678903"} {
+		err := st.AddOrder(ctx, newOrder(number), userID)
+		require.NoError(t, err)
+	}
+
+	err := st.UpdateOrderStatus(ctx, &models.AccrualResponse{OrderNumber: "79927398713", Status: models.OrderStatusInvalid})
+	require.NoError(t, err)
+	err = st.ProcessOrder(ctx, processed("12345678903", 1000))
+	require.NoError(t, err)
+
+	// neither of the final statuses is overwritten
+	for _, number := range []string{"79927398713", "12345678903"} {
+		err = st.UpdateOrderStatus(ctx, &models.AccrualResponse{OrderNumber: number, Status: models.OrderStatusProcessing})
+		require.NoError(t, err)
+	}
+	err = st.ProcessOrder(ctx, processed("79927398713", 1000))
+	require.NoError(t, err)
+
+	orders, err := st.GetOrders(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, models.OrderStatusInvalid, orders[0].Status)
+	assert.Equal(t, models.Money(0), orders[0].Accrual)
+	assert.Equal(t, models.OrderStatusProcessed, orders[1].Status)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 1000}, balance)
+}
+
+func testProcessWithdraw(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	credit(t, st, userID, "79927398713", 50000)
+
+	err := st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 20000}, userID)
+	require.NoError(t, err)
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "12345678903", Sum: 12550}, userID)
+	require.NoError(t, err)
+	// the same order number can not be used twice
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 100}, userID)
+	require.Error(t, err)
+	// every balance change goes to the ledger, there is nothing to record
+	// for a non-positive sum
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "4561261212345467", Sum: -700}, userID)
+	require.ErrorIs(t, err, storage.ErrZeroAmount)
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "4561261212345467", Sum: 0}, userID)
+	require.ErrorIs(t, err, storage.ErrZeroAmount)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 17450, Withdrawn: 32550}, balance)
+
+	withdrawals, err := st.GetWithdrawals(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.Equal(t, "2377225624", withdrawals[0].OrderNumber)
+	assert.Equal(t, models.Money(20000), withdrawals[0].Sum)
+	assert.Equal(t, "12345678903", withdrawals[1].OrderNumber)
+	assert.Equal(t, models.Money(12550), withdrawals[1].Sum)
+	assert.False(t, withdrawals[1].ProcessedAt.Before(withdrawals[0].ProcessedAt))
+
+	withdrawals, err = st.GetWithdrawals(ctx, otherID)
+	require.NoError(t, err)
+	assert.NotNil(t, withdrawals)
+	assert.Empty(t, withdrawals)
+}
+
+func testInsufficientFunds(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 1000)
+
+	err := st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 1001}, userID)
+	require.ErrorIs(t, err, storage.ErrInsufficientFunds)
+
+	// a failed withdrawal leaves no trace
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 1000}, balance)
+
+	withdrawals, err := st.GetWithdrawals(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, withdrawals)
+
+	// the whole balance can be withdrawn
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 1000}, userID)
+	require.NoError(t, err)
+}
+
+func testReverseWithdrawal(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 50000)
+
+	err := st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 20000}, userID)
+	require.NoError(t, err)
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "12345678903", Sum: 10000}, userID)
+	require.NoError(t, err)
+
+	err = st.ReverseWithdrawal(ctx, "4561261212345467", "support", "no such withdrawal")
+	require.ErrorIs(t, err, storage.ErrWithdrawalMissing)
+
+	err = st.ReverseWithdrawal(ctx, "2377225624", "support", "partner order cancelled")
+	require.NoError(t, err)
+	// a withdrawal is reversed only once
+	err = st.ReverseWithdrawal(ctx, "2377225624", "support", "partner order cancelled")
+	require.ErrorIs(t, err, storage.ErrWithdrawalReversed)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 40000, Withdrawn: 10000}, balance)
+
+	withdrawals, err := st.GetWithdrawals(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.True(t, withdrawals[0].Reversed)
+	require.NotNil(t, withdrawals[0].ReversedAt)
+	assert.False(t, withdrawals[0].ReversedAt.Before(withdrawals[0].ProcessedAt))
+	assert.Equal(t, "partner order cancelled", withdrawals[0].ReversalReason)
+	assert.False(t, withdrawals[1].Reversed)
+	assert.Nil(t, withdrawals[1].ReversedAt)
+
+	entries, err := st.GetLedger(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, models.LedgerReversal, entries[3].Kind)
+	assert.Equal(t, models.AccountWithdrawals, entries[3].From)
+	assert.Equal(t, models.UserAccount(userID), entries[3].To)
+	assert.Equal(t, models.Money(20000), entries[3].Amount)
+	assert.Equal(t, "2377225624", entries[3].OrderNumber)
+	assert.Contains(t, entries[3].Comment, "support")
+
+	lots, err := st.GetPointLots(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, lots, 2)
+	assert.Equal(t, models.Money(20000), lots[0].Remaining)
+	assert.Equal(t, "2377225624", lots[1].OrderNumber)
+	assert.Equal(t, models.Money(20000), lots[1].Remaining)
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+// requireViolation checks err is the violation of the withdrawal policy rule
+func requireViolation(t *testing.T, err error, rule string) *models.PolicyViolation {
+	t.Helper()
+	var violation *models.PolicyViolation
+	require.ErrorAs(t, err, &violation)
+	assert.Equal(t, rule, violation.Rule)
+	return violation
+}
+
+func testWithdrawalLimits(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 100000)
+
+	withdraw := func(number string, sum models.Money) error {
+		return st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: number, Sum: sum}, userID)
+	}
+	requireViolation(t, withdraw("2377225624", 500), models.PolicyMinSum)
+	requireViolation(t, withdraw("2377225624", 50001), models.PolicyMaxSum)
+	require.NoError(t, withdraw("2377225624", 40000))
+	requireViolation(t, withdraw("12345678903", 30000), models.PolicyDailyLimit)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 60000, Withdrawn: 40000}, balance)
+}
+
+func testWithdrawalAccountAge(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 100000)
+
+	err := st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "12345678903", Sum: 1000}, userID)
+	violation := requireViolation(t, err, models.PolicyMinAccountAge)
+	assert.True(t, violation.RetryAfter > 0)
+}
+
+func testWithdrawalCooldown(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 100000)
+
+	withdraw := func(number string, sum models.Money) error {
+		return st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: number, Sum: sum}, userID)
+	}
+	require.NoError(t, withdraw("2377225624", 40000))
+	requireViolation(t, withdraw("12345678903", 1000), models.PolicyCooldown)
+	// reversed withdrawals are not counted
+	require.NoError(t, st.ReverseWithdrawal(ctx, "2377225624", "support", "cancelled"))
+	require.NoError(t, withdraw("12345678903", 1000))
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 99000, Withdrawn: 1000}, balance)
+}
+
+// holds are checked as withdrawals, and active ones count towards limits
+func testWithdrawalPolicyHolds(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 100000)
+
+	withdraw := func(number string, sum models.Money) error {
+		return st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: number, Sum: sum}, userID)
+	}
+	hold := func(number string, sum models.Money) error {
+		return st.CreateHold(ctx, &models.Hold{OrderNumber: number, Sum: sum, ExpiresAt: time.Now().Add(time.Hour)}, userID)
+	}
+	requireViolation(t, hold("4561261212345467", 50001), models.PolicyMaxSum)
+	require.NoError(t, hold("4561261212345467", 50000))
+	requireViolation(t, withdraw("49927398716", 10001), models.PolicyDailyLimit)
+	requireViolation(t, hold("49927398716", 10001), models.PolicyDailyLimit)
+	require.NoError(t, st.ReleaseHold(ctx, "4561261212345467", userID))
+	require.NoError(t, hold("49927398716", 10001))
+	require.NoError(t, st.ReleaseHold(ctx, "49927398716", userID))
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 100000}, balance)
+}
+
+func testTransfer(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	credit(t, st, userID, "79927398713", 50000)
+	now := time.Now()
+
+	err := st.ProcessTransfer(ctx, &models.TransferRequest{Login: "nobody", Sum: 100}, userID, 0, now)
+	require.ErrorIs(t, err, storage.ErrLoginMissing)
+	err = st.ProcessTransfer(ctx, &models.TransferRequest{Login: "user", Sum: 100}, userID, 0, now)
+	require.ErrorIs(t, err, storage.ErrTransferToSelf)
+	err = st.ProcessTransfer(ctx, &models.TransferRequest{Login: "other", Sum: 50001}, userID, 0, now)
+	require.ErrorIs(t, err, storage.ErrInsufficientFunds)
+
+	err = st.ProcessTransfer(ctx, &models.TransferRequest{Login: "other", Sum: 20000}, userID, 0, now)
+	require.NoError(t, err)
+	err = st.ProcessTransfer(ctx, &models.TransferRequest{Login: "user", Sum: 5000}, otherID, 0, now)
+	require.NoError(t, err)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 35000}, balance)
+	balance, err = st.GetBalance(ctx, otherID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 15000}, balance)
+
+	// both sides see the transfers
+	transfers, err := st.GetTransfers(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, transfers, 2)
+	assert.Equal(t, models.TransferOut, transfers[0].Direction)
+	assert.Equal(t, "other", transfers[0].Login)
+	assert.Equal(t, models.Money(20000), transfers[0].Sum)
+	assert.Equal(t, models.TransferIn, transfers[1].Direction)
+	assert.Equal(t, "other", transfers[1].Login)
+	assert.Equal(t, models.Money(5000), transfers[1].Sum)
+
+	transfers, err = st.GetTransfers(ctx, otherID)
+	require.NoError(t, err)
+	require.Len(t, transfers, 2)
+	assert.Equal(t, models.TransferIn, transfers[0].Direction)
+	assert.Equal(t, "user", transfers[0].Login)
+
+	// the points received are spent like any others
+	lots, err := st.GetPointLots(ctx, otherID)
+	require.NoError(t, err)
+	require.Len(t, lots, 1)
+	assert.Equal(t, models.Money(15000), lots[0].Remaining)
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func testTransferLimit(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	addUser(t, st, "other")
+	credit(t, st, userID, "79927398713", 50000)
+	dayAgo := time.Now().Add(-24 * time.Hour)
+
+	err := st.ProcessTransfer(ctx, &models.TransferRequest{Login: "other", Sum: 6000}, userID, 10000, dayAgo)
+	require.NoError(t, err)
+	err = st.ProcessTransfer(ctx, &models.TransferRequest{Login: "other", Sum: 4001}, userID, 10000, dayAgo)
+	require.ErrorIs(t, err, storage.ErrTransferLimitExceeded)
+	err = st.ProcessTransfer(ctx, &models.TransferRequest{Login: "other", Sum: 4000}, userID, 10000, dayAgo)
+	require.NoError(t, err)
+
+	// the transfers made before the window do not count
+	err = st.ProcessTransfer(ctx, &models.TransferRequest{Login: "other", Sum: 4000}, userID, 10000, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 36000}, balance)
+}
+
+func testTiers(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 10000) // Bronze x1 -> Silver
+	credit(t, st, userID, "12345678903", 20000) // Silver x1.5
+	credit(t, st, userID, "2377225624", 10000)  // Silver x1.5 -> Gold
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 55000, Tier: "Gold"}, balance)
+
+	orders, err := st.GetOrders(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, orders, 3)
+	assert.Equal(t, models.Money(30000), orders[1].Accrual)
+
+	changes, err := st.GetTierChanges(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, models.TierChange{From: "", To: "Bronze", ChangedAt: changes[0].ChangedAt}, *changes[0])
+	assert.Equal(t, models.TierChange{From: "Bronze", To: "Silver", ChangedAt: changes[1].ChangedAt}, *changes[1])
+	assert.Equal(t, models.TierChange{From: "Silver", To: "Gold", ChangedAt: changes[2].ChangedAt}, *changes[2])
+	assert.False(t, changes[2].ChangedAt.Before(changes[0].ChangedAt))
+
+	entries, err := st.GetLedger(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, models.Money(15000), entries[2].Amount)
+	assert.Contains(t, entries[2].Comment, "Silver")
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func testTiersBySpend(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 20000)
+
+	// no tier is reached, the points are credited as they are
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 20000}, balance)
+
+	// the withdrawal itself moves the user to the tier
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 10000}, userID)
+	require.NoError(t, err)
+	balance, err = st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 10000, Withdrawn: 10000, Tier: "Silver"}, balance)
+
+	credit(t, st, userID, "12345678903", 10000)
+	balance, err = st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 25000, Withdrawn: 10000, Tier: "Silver"}, balance)
+
+	// the points returned are not spent
+	err = st.ReverseWithdrawal(ctx, "2377225624", "support", "cancelled")
+	require.NoError(t, err)
+	balance, err = st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 35000}, balance)
+
+	credit(t, st, userID, "4561261212345467", 10000)
+	balance, err = st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 45000}, balance)
+
+	changes, err := st.GetTierChanges(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "Silver", changes[0].To)
+	assert.Equal(t, "", changes[1].To)
+}
+
+// captured holds are spent as well, and the tier lapses with the window
+func testTiersBySpendLapse(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 20000)
+
+	err := st.CreateHold(ctx, &models.Hold{OrderNumber: "49927398716", Sum: 10000, ExpiresAt: time.Now().Add(time.Hour)}, userID)
+	require.NoError(t, err)
+	err = st.CaptureHold(ctx, "49927398716", userID)
+	require.NoError(t, err)
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 10000, Withdrawn: 10000, Tier: "Silver"}, balance)
+
+	// the lapse is shown at once and recorded by the next operation
+	time.Sleep(600 * time.Millisecond)
+	balance, err = st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 10000, Withdrawn: 10000}, balance)
+	changes, err := st.GetTierChanges(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+
+	credit(t, st, userID, "18", 1000)
+	balance, err = st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 11000, Withdrawn: 10000}, balance)
+
+	changes, err = st.GetTierChanges(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "Silver", changes[0].To)
+	assert.Equal(t, "", changes[1].To)
+}
+
+func testCampaigns(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	campaigns := []*models.Campaign{
+		{Name: "Double", Condition: models.CampaignAllOrders, Multiplier: 2, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)},
+		{Name: "Welcome", Condition: models.CampaignFirstOrder, Multiplier: 1, Bonus: 10000, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)},
+		{Name: "Past", Condition: models.CampaignAllOrders, Multiplier: 3, StartsAt: now.Add(-2 * time.Hour), EndsAt: now.Add(-time.Hour)},
+	}
+	for _, c := range campaigns {
+		require.NoError(t, st.AddCampaign(ctx, c))
+	}
+	assert.NotEqual(t, campaigns[0].ID, campaigns[1].ID)
+
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 10000) // x2 and the first order bonus
+	credit(t, st, userID, "12345678903", 5000)  // x2
+
+	err := st.EndCampaign(ctx, campaigns[0].ID, time.Now())
+	require.NoError(t, err)
+	err = st.EndCampaign(ctx, 999, time.Now())
+	require.ErrorIs(t, err, storage.ErrCampaignMissing)
+	credit(t, st, userID, "2377225624", 1000)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 41000}, balance)
+
+	orders, err := st.GetOrders(ctx, userID)
+	require.NoError(t, err)
+	bonuses := make(map[string][2]models.Money)
+	for _, o := range orders {
+		bonuses[o.Number] = [2]models.Money{o.Accrual, o.Bonus}
+	}
+	assert.Equal(t, map[string][2]models.Money{
+		"79927398713": {10000, 20000},
+		"12345678903": {5000, 5000},
+		"2377225624":  {1000, 0},
+	}, bonuses)
+
+	entries, err := st.GetLedger(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	assert.Equal(t, models.LedgerBonus, entries[1].Kind)
+	assert.Equal(t, models.AccountCampaigns, entries[1].From)
+	assert.Equal(t, "Double, Welcome", entries[1].Comment)
+
+	stored, err := st.GetCampaigns(ctx)
+	require.NoError(t, err)
+	require.Len(t, stored, 3)
+	assert.False(t, stored[0].EndsAt.After(time.Now()))
+
+	// the first order bonus is granted even if the order earned nothing
+	otherID := addUser(t, st, "other")
+	credit(t, st, otherID, "49927398716", 0)
+	balance, err = st.GetBalance(ctx, otherID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 10000}, balance)
+	orders, err = st.GetOrders(ctx, otherID)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, models.Money(10000), orders[0].Bonus)
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func testReferrals(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+
+	referrerID := addUser(t, st, "referrer")
+	referrals, err := st.GetReferrals(ctx, referrerID)
+	require.NoError(t, err)
+	require.NotEmpty(t, referrals.Code)
+	assert.Empty(t, referrals.Referrals)
+
+	err = st.AddUser(ctx, &models.User{Login: "nobody", Hash: "abcdef", ReferredBy: "NOSUCHCODE"})
+	require.ErrorIs(t, err, storage.ErrReferralCodeMissing)
+
+	referees := make([]int, 0, 3)
+	for _, login := range []string{"low", "first", "capped"} {
+		user := &models.User{Login: login, Hash: "abcdef", ReferredBy: referrals.Code}
+		require.NoError(t, st.AddUser(ctx, user))
+		user, err = st.GetUser(ctx, user)
+		require.NoError(t, err)
+		assert.NotEqual(t, referrals.Code, user.ReferralCode)
+		referees = append(referees, user.ID)
+	}
+
+	// the first order brings too few points, the next ones do not count
+	credit(t, st, referees[0], "79927398713", 500)
+	credit(t, st, referees[0], "12345678903", 5000)
+	credit(t, st, referees[1], "2377225624", 10000)
+	// the referrer has been rewarded the maximum number of times
+	credit(t, st, referees[2], "4561261212345467", 10000)
+
+	for userID, want := range map[int]models.Money{
+		referrerID:  5000,
+		referees[0]: 5500,
+		referees[1]: 12000,
+		referees[2]: 12000,
+	} {
+		balance, err := st.GetBalance(ctx, userID)
+		require.NoError(t, err)
+		assert.Equal(t, want, balance.Current, "user %d", userID)
+	}
+
+	referrals, err = st.GetReferrals(ctx, referrerID)
+	require.NoError(t, err)
+	require.Len(t, referrals.Referrals, 3)
+	assert.Equal(t, "low", referrals.Referrals[0].Login)
+	assert.Equal(t, models.ReferralIneligible, referrals.Referrals[0].Status)
+	assert.Equal(t, models.ReferralRewarded, referrals.Referrals[1].Status)
+	assert.Equal(t, models.Money(5000), referrals.Referrals[1].Bonus)
+	assert.NotNil(t, referrals.Referrals[1].RewardedAt)
+	assert.Equal(t, models.ReferralIneligible, referrals.Referrals[2].Status)
+	assert.Equal(t, models.Money(0), referrals.Referrals[2].Bonus)
+
+	entries, err := st.GetLedger(ctx, referrerID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, models.LedgerReferral, entries[0].Kind)
+	assert.Equal(t, models.AccountReferrals, entries[0].From)
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func testHolds(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	credit(t, st, userID, "79927398713", 50000)
+	expiresAt := time.Now().Add(time.Hour)
+
+	err := st.CreateHold(ctx, &models.Hold{OrderNumber: "2377225624", Sum: 50001, ExpiresAt: expiresAt}, userID)
+	require.ErrorIs(t, err, storage.ErrInsufficientFunds)
+	err = st.CreateHold(ctx, &models.Hold{OrderNumber: "2377225624", Sum: -50000, ExpiresAt: expiresAt}, userID)
+	require.ErrorIs(t, err, storage.ErrZeroAmount)
+
+	hold := &models.Hold{OrderNumber: "2377225624", Sum: 20000, ExpiresAt: expiresAt}
+	err = st.CreateHold(ctx, hold, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.HoldStatusHeld, hold.Status)
+	assert.False(t, hold.CreatedAt.IsZero())
+	err = st.CreateHold(ctx, &models.Hold{OrderNumber: "12345678903", Sum: 10000, ExpiresAt: expiresAt}, userID)
+	require.NoError(t, err)
+	// the same order number can not be held twice
+	err = st.CreateHold(ctx, &models.Hold{OrderNumber: "2377225624", Sum: 100, ExpiresAt: expiresAt}, userID)
+	require.ErrorIs(t, err, storage.ErrHoldAlreadyExists)
+
+	// held points are not available to spend
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 20000, Held: 30000}, balance)
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "4561261212345467", Sum: 20001}, userID)
+	require.ErrorIs(t, err, storage.ErrInsufficientFunds)
+	// nor is the number of an active hold available to withdraw with
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 100}, userID)
+	require.ErrorIs(t, err, storage.ErrWithdrawalAlreadyExists)
+
+	// holds are settled by their owner only
+	err = st.CaptureHold(ctx, "2377225624", otherID)
+	require.ErrorIs(t, err, storage.ErrHoldMissing)
+
+	err = st.CaptureHold(ctx, "2377225624", userID)
+	require.NoError(t, err)
+	err = st.ReleaseHold(ctx, "12345678903", userID)
+	require.NoError(t, err)
+	err = st.ReleaseHold(ctx, "2377225624", userID)
+	require.ErrorIs(t, err, storage.ErrHoldSettled)
+	err = st.CaptureHold(ctx, "12345678903", userID)
+	require.ErrorIs(t, err, storage.ErrHoldSettled)
+
+	balance, err = st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 30000, Withdrawn: 20000}, balance)
+
+	// a captured hold becomes a withdrawal
+	withdrawals, err := st.GetWithdrawals(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, "2377225624", withdrawals[0].OrderNumber)
+	assert.Equal(t, models.Money(20000), withdrawals[0].Sum)
+
+	// the points released go back to the lot they were taken from and
+	// keep its lifetime
+	lots, err := st.GetPointLots(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, lots, 1)
+	assert.Equal(t, "79927398713", lots[0].OrderNumber)
+	assert.Equal(t, models.Money(30000), lots[0].Remaining)
+	assert.True(t, lots[0].CreditedAt.Before(hold.CreatedAt))
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func testExpireHolds(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 50000)
+	now := time.Now()
+
+	err := st.CreateHold(ctx, &models.Hold{OrderNumber: "2377225624", Sum: 20000, ExpiresAt: now.Add(-time.Second)}, userID)
+	require.NoError(t, err)
+	err = st.CreateHold(ctx, &models.Hold{OrderNumber: "12345678903", Sum: 10000, ExpiresAt: now.Add(time.Hour)}, userID)
+	require.NoError(t, err)
+
+	// an expired hold can not be captured even before it is released
+	err = st.CaptureHold(ctx, "2377225624", userID)
+	require.ErrorIs(t, err, storage.ErrHoldSettled)
+
+	expired, err := st.ExpireHolds(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, expired)
+	expired, err = st.ExpireHolds(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, expired)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 40000, Held: 10000}, balance)
+
+	err = st.ReleaseHold(ctx, "2377225624", userID)
+	require.ErrorIs(t, err, storage.ErrHoldSettled)
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func testSessions(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	now := time.Now().Truncate(time.Second)
+
+	for _, s := range []*models.Session{
+		{ID: "first", UserID: userID, UserAgent: "curl/7.68.0", IP: "192.0.2.1", CreatedAt: now.Add(-2 * time.Hour), LastSeenAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)},
+		{ID: "second", UserID: userID, UserAgent: "Mozilla/5.0", IP: "192.0.2.2", CreatedAt: now.Add(-time.Hour), LastSeenAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+		{ID: "expired", UserID: userID, CreatedAt: now.Add(-2 * time.Hour), LastSeenAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+		{ID: "other", UserID: otherID, CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)},
+	} {
+		require.NoError(t, st.AddSession(ctx, s))
+	}
+
+	session, err := st.GetSession(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, userID, session.UserID)
+	assert.Equal(t, "curl/7.68.0", session.UserAgent)
+	assert.Equal(t, "192.0.2.1", session.IP)
+	assert.WithinDuration(t, now.Add(time.Hour), session.ExpiresAt, 0)
+	assert.True(t, session.Active(now))
+
+	_, err = st.GetSession(ctx, "nosuchsession")
+	require.ErrorIs(t, err, storage.ErrSessionMissing)
+
+	// the most recently used sessions go first, the expired one is not listed
+	require.NoError(t, st.TouchSession(ctx, "first", now))
+	// the last seen time never goes back
+	require.NoError(t, st.TouchSession(ctx, "second", now.Add(-3*time.Hour)))
+	sessions, err := st.GetSessions(ctx, userID, now)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "first", sessions[0].ID)
+	assert.WithinDuration(t, now, sessions[0].LastSeenAt, 0)
+	assert.Equal(t, "second", sessions[1].ID)
+	assert.WithinDuration(t, now.Add(-time.Hour), sessions[1].LastSeenAt, 0)
+
+	// sessions are revoked by their owner only, and only once
+	require.ErrorIs(t, st.RevokeSession(ctx, otherID, "first", now), storage.ErrSessionMissing)
+	require.NoError(t, st.RevokeSession(ctx, userID, "first", now))
+	require.ErrorIs(t, st.RevokeSession(ctx, userID, "first", now), storage.ErrSessionMissing)
+
+	session, err = st.GetSession(ctx, "first")
+	require.NoError(t, err)
+	require.NotNil(t, session.RevokedAt)
+	assert.False(t, session.Active(now))
+
+	sessions, err = st.GetSessions(ctx, userID, now)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "second", sessions[0].ID)
+
+	// the expired session is revoked as well
+	revoked, err := st.RevokeSessions(ctx, userID, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, revoked)
+
+	sessions, err = st.GetSessions(ctx, userID, now)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	sessions, err = st.GetSessions(ctx, otherID, now)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+}
+
+func testRefreshTokens(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	now := time.Now().Truncate(time.Second)
+
+	for _, s := range []*models.Session{
+		{ID: "session", UserID: userID, Login: "user", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)},
+		{ID: "stale", UserID: userID, Login: "user", CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)},
+	} {
+		require.NoError(t, st.AddSession(ctx, s))
+	}
+	for _, rt := range []*models.RefreshToken{
+		{Hash: "first", SessionID: "session", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{Hash: "expired", SessionID: "stale", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+	} {
+		require.NoError(t, st.AddRefreshToken(ctx, rt))
+	}
+
+	_, err := st.RotateRefreshToken(ctx, "nosuchtoken", &models.RefreshToken{Hash: "none"}, now)
+	require.ErrorIs(t, err, storage.ErrRefreshTokenMissing)
+	_, err = st.RotateRefreshToken(ctx, "expired", &models.RefreshToken{Hash: "none"}, now)
+	require.ErrorIs(t, err, storage.ErrRefreshTokenMissing)
+
+	// the rotation extends the session
+	later := now.Add(30 * time.Minute)
+	second := &models.RefreshToken{Hash: "second", CreatedAt: later, ExpiresAt: later.Add(time.Hour)}
+	session, err := st.RotateRefreshToken(ctx, "first", second, later)
+	require.NoError(t, err)
+	assert.Equal(t, "session", session.ID)
+	assert.Equal(t, "session", second.SessionID)
+	assert.Equal(t, userID, session.UserID)
+	assert.Equal(t, "user", session.Login)
+	assert.WithinDuration(t, later.Add(time.Hour), session.ExpiresAt, 0)
+	assert.WithinDuration(t, later, session.LastSeenAt, 0)
+
+	session, err = st.GetSession(ctx, "session")
+	require.NoError(t, err)
+	assert.WithinDuration(t, later.Add(time.Hour), session.ExpiresAt, 0)
+
+	// the used token is presented again: the family is revoked
+	_, err = st.RotateRefreshToken(ctx, "first", &models.RefreshToken{Hash: "third", CreatedAt: later, ExpiresAt: later.Add(time.Hour)}, later)
+	require.ErrorIs(t, err, storage.ErrRefreshTokenReused)
+
+	session, err = st.GetSession(ctx, "session")
+	require.NoError(t, err)
+	assert.False(t, session.Active(later))
+
+	_, err = st.RotateRefreshToken(ctx, "second", &models.RefreshToken{Hash: "fourth", CreatedAt: later, ExpiresAt: later.Add(time.Hour)}, later)
+	require.ErrorIs(t, err, storage.ErrRefreshTokenMissing)
+
+	// the other session is not affected
+	session, err = st.GetSession(ctx, "stale")
+	require.NoError(t, err)
+	assert.True(t, session.Active(later))
+}
+
+func testPasswords(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	now := time.Now().Truncate(time.Second)
+
+	user, err := st.GetUserByID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "user", user.Login)
+	assert.Equal(t, "abcdef", user.Hash)
+
+	_, err = st.GetUserByID(ctx, userID+1)
+	require.ErrorIs(t, err, storage.ErrLoginMissing)
+
+	for _, id := range []string{"current", "other"} {
+		require.NoError(t, st.AddSession(ctx, &models.Session{ID: id, UserID: userID, CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}))
+	}
+
+	// the current session is kept
+	require.NoError(t, st.ChangePassword(ctx, userID, "changed", "current", now))
+	user, err = st.GetUserByID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "changed", user.Hash)
+	sessions, err := st.GetSessions(ctx, userID, now)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "current", sessions[0].ID)
+
+	// the token issued last is the only one valid
+	for _, hash := range []string{"replaced", "reset"} {
+		require.NoError(t, st.AddPasswordReset(ctx, &models.PasswordReset{Hash: hash, UserID: userID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}))
+	}
+	_, err = st.ResetPassword(ctx, "replaced", "reset", now)
+	require.ErrorIs(t, err, storage.ErrPasswordResetMissing)
+	_, err = st.ResetPassword(ctx, "reset", "reset", now.Add(time.Hour))
+	require.ErrorIs(t, err, storage.ErrPasswordResetMissing)
+
+	resetUserID, err := st.ResetPassword(ctx, "reset", "reset", now)
+	require.NoError(t, err)
+	assert.Equal(t, userID, resetUserID)
+	user, err = st.GetUserByID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "reset", user.Hash)
+
+	// every session is revoked and the token is used once
+	sessions, err = st.GetSessions(ctx, userID, now)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	_, err = st.ResetPassword(ctx, "reset", "again", now)
+	require.ErrorIs(t, err, storage.ErrPasswordResetMissing)
+}
+
+func testIdempotencyKeys(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	staleBefore := time.Now().Add(-time.Hour)
+	leaseBefore := time.Now().Add(-time.Minute)
+
+	rec := &models.IdempotencyRecord{UserID: userID, Key: "key", RequestHash: "hash"}
+	existing, err := st.ReserveIdempotencyKey(ctx, rec, staleBefore, leaseBefore)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	// the key is in progress until completed
+	existing, err = st.ReserveIdempotencyKey(ctx, &models.IdempotencyRecord{UserID: userID, Key: "key", RequestHash: "other"}, staleBefore, leaseBefore)
+	require.NoError(t, err)
+	require.NotNil(t, existing)
+	assert.Equal(t, "hash", existing.RequestHash)
+	assert.False(t, existing.Completed)
+
+	// the request which has outlived its lease is assumed to have never
+	// finished, the key is reserved anew
+	existing, err = st.ReserveIdempotencyKey(ctx, &models.IdempotencyRecord{UserID: userID, Key: "key", RequestHash: "hash"}, staleBefore, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	// keys are per user
+	existing, err = st.ReserveIdempotencyKey(ctx, &models.IdempotencyRecord{UserID: otherID, Key: "key", RequestHash: "hash"}, staleBefore, leaseBefore)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	rec.StatusCode = 202
+	rec.ContentType = "application/json"
+	rec.Body = []byte(`{"status":"ok"}`)
+	err = st.CompleteIdempotencyKey(ctx, rec)
+	require.NoError(t, err)
+
+	existing, err = st.ReserveIdempotencyKey(ctx, &models.IdempotencyRecord{UserID: userID, Key: "key", RequestHash: "hash"}, staleBefore, leaseBefore)
+	require.NoError(t, err)
+	require.NotNil(t, existing)
+	assert.True(t, existing.Completed)
+	assert.Equal(t, 202, existing.StatusCode)
+	assert.Equal(t, "application/json", existing.ContentType)
+	assert.Equal(t, []byte(`{"status":"ok"}`), existing.Body)
+
+	// the lease does not apply to the completed requests
+	existing, err = st.ReserveIdempotencyKey(ctx, &models.IdempotencyRecord{UserID: userID, Key: "key", RequestHash: "hash"}, staleBefore, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.NotNil(t, existing)
+	assert.True(t, existing.Completed)
+
+	// the record which has outlived the retention window is replaced
+	existing, err = st.ReserveIdempotencyKey(ctx, &models.IdempotencyRecord{UserID: userID, Key: "key", RequestHash: "new"}, time.Now().Add(time.Hour), leaseBefore)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	err = st.DeleteIdempotencyKey(ctx, userID, "key")
+	require.NoError(t, err)
+	existing, err = st.ReserveIdempotencyKey(ctx, &models.IdempotencyRecord{UserID: userID, Key: "key", RequestHash: "hash"}, staleBefore, leaseBefore)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	purged, err := st.PurgeIdempotencyKeys(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+}
+
+func testConcurrentWithdrawals(t *testing.T, st storage.Storage) {
+	const (
+		attempts = 20
+		sum      = models.Money(100)
+		credited = models.Money(1000)
+	)
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", credited)
+
+	var (
+		wg                  sync.WaitGroup
+		mu                  sync.Mutex
+		succeeded, rejected int
+		unexpected          []error
+	)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wr := &models.WithdrawRequest{OrderNumber: fmt.Sprintf("withdraw-%d", i), Sum: sum}
+			err := st.ProcessWithdraw(ctx, wr, userID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				succeeded++
+			case errors.Is(err, storage.ErrInsufficientFunds):
+				rejected++
+			default:
+				unexpected = append(unexpected, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Empty(t, unexpected)
+	assert.Equal(t, int(credited/sum), succeeded)
+	assert.Equal(t, attempts-int(credited/sum), rejected)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 0, Withdrawn: credited}, balance)
+
+	withdrawals, err := st.GetWithdrawals(ctx, userID)
+	require.NoError(t, err)
+	assert.Len(t, withdrawals, succeeded)
+}
+
+func testAccrualJobLease(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	order := newOrder("12345678903")
+
+	err := st.AddOrder(ctx, order, userID)
+	require.NoError(t, err)
+
+	jobs, err := st.AcquireAccrualJobs(ctx, "first", 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, order.Number, jobs[0].OrderNumber)
+	assert.Equal(t, models.OrderStatusNew, jobs[0].OrderStatus)
+
+	// the job is leased by the first worker
+	other, err := st.AcquireAccrualJobs(ctx, "second", 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, other)
+
+	err = st.ReleaseAccrualJob(ctx, jobs[0], "second")
+	require.ErrorIs(t, err, storage.ErrAccrualJobLeaseLost)
+
+	jobs[0].Attempts++
+	jobs[0].LastError = "not yet"
+	err = st.ReleaseAccrualJob(ctx, jobs[0], "first")
+	require.NoError(t, err)
+
+	other, err = st.AcquireAccrualJobs(ctx, "second", 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, other, 1)
+	assert.Equal(t, 1, other[0].Attempts)
+	assert.Equal(t, "not yet", other[0].LastError)
+
+	// a job given up is never leased again
+	other[0].GaveUp = true
+	err = st.ReleaseAccrualJob(ctx, other[0], "second")
+	require.NoError(t, err)
+	jobs, err = st.AcquireAccrualJobs(ctx, "first", 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	err = st.CompleteAccrualJob(ctx, order.Number)
+	require.NoError(t, err)
+
+	err = st.ReleaseAccrualJob(ctx, other[0], "second")
+	require.ErrorIs(t, err, storage.ErrAccrualJobLeaseLost)
+}
+
+func testLedger(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	credit(t, st, userID, "79927398713", 50000)
+	credit(t, st, otherID, "12345678903", 700)
+
+	err := st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 20000}, userID)
+	require.NoError(t, err)
+
+	entries, err := st.GetLedger(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, models.LedgerAccrual, entries[0].Kind)
+	assert.Equal(t, models.AccountAccruals, entries[0].From)
+	assert.Equal(t, models.UserAccount(userID), entries[0].To)
+	assert.Equal(t, models.Money(50000), entries[0].Amount)
+	assert.Equal(t, "79927398713", entries[0].OrderNumber)
+
+	assert.Equal(t, models.LedgerWithdrawal, entries[1].Kind)
+	assert.Equal(t, models.UserAccount(userID), entries[1].From)
+	assert.Equal(t, models.AccountWithdrawals, entries[1].To)
+	assert.Equal(t, models.Money(20000), entries[1].Amount)
+	assert.Equal(t, "2377225624", entries[1].OrderNumber)
+	assert.True(t, entries[0].ID < entries[1].ID)
+	assert.False(t, entries[1].CreatedAt.IsZero())
+
+	// the ledger agrees with the balances
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	err = st.RebuildBalances(ctx)
+	require.NoError(t, err)
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 30000, Withdrawn: 20000}, balance)
+	balance, err = st.GetBalance(ctx, otherID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 700}, balance)
+}
+
+func testAdjustment(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+
+	err := st.AddAdjustment(ctx, userID, 0, "nothing")
+	require.ErrorIs(t, err, storage.ErrZeroAmount)
+	err = st.AddAdjustment(ctx, userID, -1, "below zero")
+	require.ErrorIs(t, err, storage.ErrInsufficientFunds)
+
+	err = st.AddAdjustment(ctx, userID, 1500, "compensation")
+	require.NoError(t, err)
+	err = st.AddAdjustment(ctx, userID, -500, "correction")
+	require.NoError(t, err)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 1000}, balance)
+
+	entries, err := st.GetLedger(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, models.LedgerAdjustment, entries[0].Kind)
+	assert.Equal(t, models.AccountAdjustments, entries[0].From)
+	assert.Equal(t, models.Money(1500), entries[0].Amount)
+	assert.Equal(t, "compensation", entries[0].Comment)
+	assert.Equal(t, models.UserAccount(userID), entries[1].From)
+	assert.Equal(t, models.AccountAdjustments, entries[1].To)
+	assert.Equal(t, models.Money(500), entries[1].Amount)
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func testPointLots(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	credit(t, st, userID, "79927398713", 1000)
+	time.Sleep(10 * time.Millisecond)
+	credit(t, st, userID, "12345678903", 500)
+	time.Sleep(10 * time.Millisecond)
+	err := st.AddAdjustment(ctx, userID, 200, "compensation")
+	require.NoError(t, err)
+
+	// the oldest lot is spent first
+	err = st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 1200}, userID)
+	require.NoError(t, err)
+
+	lots, err := st.GetPointLots(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, lots, 2)
+	assert.Equal(t, "12345678903", lots[0].OrderNumber)
+	assert.Equal(t, models.Money(500), lots[0].Amount)
+	assert.Equal(t, models.Money(300), lots[0].Remaining)
+	assert.Equal(t, "", lots[1].OrderNumber)
+	assert.Equal(t, models.Money(200), lots[1].Remaining)
+	assert.True(t, lots[0].CreditedAt.Before(lots[1].CreditedAt))
+
+	// so are the negative adjustments
+	err = st.AddAdjustment(ctx, userID, -400, "correction")
+	require.NoError(t, err)
+
+	lots, err = st.GetPointLots(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, lots, 1)
+	assert.Equal(t, models.Money(100), lots[0].Remaining)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 100, Withdrawn: 1200}, balance)
+}
+
+func testExpirePoints(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	userID := addUser(t, st, "user")
+	otherID := addUser(t, st, "other")
+	credit(t, st, userID, "79927398713", 1000)
+	time.Sleep(10 * time.Millisecond)
+	credit(t, st, userID, "12345678903", 500)
+	time.Sleep(10 * time.Millisecond)
+	credit(t, st, otherID, "49927398716", 700)
+
+	err := st.ProcessWithdraw(ctx, &models.WithdrawRequest{OrderNumber: "2377225624", Sum: 1200}, userID)
+	require.NoError(t, err)
+
+	lots, err := st.GetPointLots(ctx, otherID)
+	require.NoError(t, err)
+	require.Len(t, lots, 1)
+	cutoff := lots[0].CreditedAt
+
+	// only the points credited before the moment expire
+	expired, err := st.ExpirePoints(ctx, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(300), expired)
+
+	balance, err := st.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 0, Withdrawn: 1200, Expired: 300}, balance)
+	balance, err = st.GetBalance(ctx, otherID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Balance{Current: 700}, balance)
+
+	lots, err = st.GetPointLots(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, lots)
+
+	entries, err := st.GetLedger(ctx, userID)
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	last := entries[len(entries)-1]
+	assert.Equal(t, models.LedgerExpiration, last.Kind)
+	assert.Equal(t, models.AccountExpirations, last.To)
+	assert.Equal(t, models.Money(300), last.Amount)
+
+	// nothing is left to expire twice
+	expired, err = st.ExpirePoints(ctx, cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(0), expired)
+
+	mismatches, err := st.ReconcileBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+// addUser stores a new user and returns the user's ID
+func addUser(t *testing.T, st storage.Storage, login string) int {
+	t.Helper()
+
+	user := &models.User{
+		Login: login,
+		Hash:  "abcdef",
+	}
+	err := st.AddUser(context.Background(), user)
+	require.NoError(t, err)
+
+	user, err = st.GetUser(context.Background(), user)
+	require.NoError(t, err)
+
+	return user.ID
+}
+
+// credit adds a processed order bringing sum to the user's balance
+func credit(t *testing.T, st storage.Storage, userID int, number string, sum models.Money) {
+	t.Helper()
+
+	err := st.AddOrder(context.Background(), newOrder(number), userID)
+	require.NoError(t, err)
+	err = st.ProcessOrder(context.Background(), processed(number, sum))
+	require.NoError(t, err)
+}
+
+// tierProgram parses the tiers of the test cases, which are known to be valid
+func tierProgram(spec, basis string, window time.Duration) *models.TierProgram {
+	program, err := models.ParseTierProgram(spec, basis, window)
+	if err != nil {
+		panic(err)
+	}
+	return program
+}
+
+func newOrder(number string) *models.Order {
+	return &models.Order{
+		Number: number,
+		Status: models.OrderStatusNew,
+	}
+}
+
+func processed(number string, accrual models.Money) *models.AccrualResponse {
+	return &models.AccrualResponse{
+		OrderNumber: number,
+		Status:      models.OrderStatusProcessed,
+		Accrual:     accrual,
+	}
+}